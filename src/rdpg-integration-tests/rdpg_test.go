@@ -47,9 +47,8 @@ func TestRDPGSystemIntegration(t *testing.T) {
 			organizationID := uuid.NewUUID().String()
 			spaceID := uuid.NewUUID().String()
 
-			req, err := http.NewRequest("GET", cfsbAPIURL(`/v2/catalog`), nil)
+			req, err := newBrokerRequest("GET", cfsbAPIURL(`/v2/catalog`), nil)
 			So(err, ShouldBeNil)
-			req.SetBasicAuth("cfadmin", "cfadmin")
 			httpClient := &http.Client{}
 			resp, err := httpClient.Do(req)
 			So(err, ShouldBeNil)
@@ -110,8 +109,7 @@ func TestRDPGSystemIntegration(t *testing.T) {
 					So(err, ShouldBeNil)
 
 					url := cfsbAPIURL("/v2/service_instances/" + instanceID)
-					req, err := http.NewRequest("PUT", url, bytes.NewBuffer(insbody))
-					req.SetBasicAuth("cfadmin", "cfadmin")
+					req, err := newBrokerRequest("PUT", url, bytes.NewBuffer(insbody))
 
 					fmt.Printf(`Assigning database # %d`, ps)
 					httpClient := &http.Client{}
@@ -122,8 +120,13 @@ func TestRDPGSystemIntegration(t *testing.T) {
 
 						Convey("Trying to asign one more database than total capacity", func() {
 							So(err, ShouldBeNil)
-							So(resp.StatusCode, ShouldEqual, http.StatusInternalServerError)
-							So(resp.Body, ShouldEqual, "status: 500,description: Provisioning failed, out of capacity. Need to increase capacity setting for service cluster through admin API or redeploy to scale out, please notify the operations team.")
+							So(resp.StatusCode, ShouldEqual, http.StatusInsufficientStorage)
+							var body struct {
+								Description string `json:"description"`
+							}
+							err = json.NewDecoder(resp.Body).Decode(&body)
+							So(err, ShouldBeNil)
+							So(body.Description, ShouldEqual, instances.ErrOutOfCapacity.Error())
 						})
 						Convey(`The number of instances should be equal with the instance capacity.`, func() {
 							sq := fmt.Sprintf(`SELECT count(id) FROM cfsb.instances`)
@@ -134,7 +137,7 @@ func TestRDPGSystemIntegration(t *testing.T) {
 
 					if ps < capacityAllowed*4 {
 						So(err, ShouldBeNil)
-						So(resp.StatusCode, ShouldEqual, http.StatusOK)
+						So(resp.StatusCode, ShouldEqual, http.StatusCreated)
 						fmt.Printf(`Assigning database!!!! # %d`, ps)
 
 						time.Sleep(500 * time.Millisecond) // Wait a second for the transaction commit...
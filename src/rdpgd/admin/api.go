@@ -1,6 +1,7 @@
 package admin
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
 	"net/http"
@@ -14,6 +15,7 @@ import (
 var (
 	adminPort, adminUser, adminPass string
 	pgPort, pbPort, pgPass          string
+	server                          *http.Server
 )
 
 type Admin struct {
@@ -64,24 +66,62 @@ func API() (err error) {
 	router.HandleFunc(`/stats/locks/{database}`, httpAuth(LocksHandler))
 	router.HandleFunc(`/databases/{action}`, httpAuth(DatabasesHandler))
 	router.HandleFunc(`/databases/{action}/{database}`, httpAuth(DatabasesHandler))
+	router.HandleFunc(`/catalog/services`, httpAuth(CatalogServicesHandler)).Methods("GET", "POST")
+	router.HandleFunc(`/catalog/services/{service_id}`, httpAuth(CatalogServicesHandler)).Methods("GET", "PUT", "DELETE")
+	router.HandleFunc(`/catalog/plans`, httpAuth(CatalogPlansHandler)).Methods("GET", "POST")
+	router.HandleFunc(`/catalog/plans/{plan_id}`, httpAuth(CatalogPlansHandler)).Methods("GET", "PUT", "DELETE")
 	router.HandleFunc(`/clusters/{clusterid}/capacity/instances/allowed/{value}`, httpAuth(CapacityHandler))
 	router.HandleFunc(`/clusters/{clusterid}/capacity/instances`, httpAuth(CapacityHandler))
 	router.HandleFunc(`/env/{key}`, httpAuth(EnvHandler))
-	router.HandleFunc(`/backup/{how:(now|enqueue)}`, httpAuth(BackupHandler)).Methods("POST")
+	router.HandleFunc(`/backup/{how:(now|enqueue|workflow)}`, httpAuth(BackupHandler)).Methods("POST")
 	router.HandleFunc(`/backup/list`, httpAuth(BackupListAllHandler)).Methods("GET")
 	router.HandleFunc(`/backup/list/{where:(local|remote)}`, httpAuth(BackupListHandler)).Methods("GET")
 	router.HandleFunc(`/backup/only/{where:(local|remote|diff|both)}`, httpAuth(BackupDiffHandler)).Methods("GET")
 	router.HandleFunc(`/backup/retention/custom`, httpAuth(CustomRetentionRulesHandler)).Methods("GET")
 	router.HandleFunc(`/backup/retention/policy/{where:(local|remote)}`, httpAuth(RetentionPolicyHandler)).Methods("GET", "PUT")
 	router.HandleFunc(`/backup/remote/copyto`, httpAuth(RemoteCopyHandler)).Methods("PUT")
+	router.HandleFunc(`/backup/settings/{dbname}`, httpAuth(BackupSettingsHandler)).Methods("GET", "PUT", "DELETE")
 	router.HandleFunc(`/restore/inplace`, httpAuth(RestoreInPlaceHandler)).Methods("POST")
+	router.HandleFunc(`/tasks/schedules`, httpAuth(SchedulesHandler)).Methods("GET", "POST")
+	router.HandleFunc(`/tasks/schedules/upcoming`, httpAuth(UpcomingSchedulesHandler)).Methods("GET")
+	router.HandleFunc(`/tasks/schedules/{id:[0-9]+}`, httpAuth(ScheduleHandler)).Methods("GET", "PUT", "DELETE")
+	router.HandleFunc(`/tasks/schedules/{id:[0-9]+}/{state:(enable|disable)}`, httpAuth(ScheduleStateHandler)).Methods("PUT")
+	router.HandleFunc(`/tasks/schedules/{id:[0-9]+}/run`, httpAuth(ScheduleRunHandler)).Methods("POST")
+	router.HandleFunc(`/tasks/maintenance_windows`, httpAuth(MaintenanceWindowsHandler)).Methods("GET")
+	router.HandleFunc(`/tasks/maintenance_windows/{name}`, httpAuth(MaintenanceWindowsHandler)).Methods("PUT", "DELETE")
+	router.HandleFunc(`/tasks/queue`, httpAuth(QueueHandler)).Methods("GET", "DELETE")
+	router.HandleFunc(`/tasks/queue/{id:[0-9]+}`, httpAuth(QueuedTaskHandler)).Methods("GET", "DELETE")
+	router.HandleFunc(`/tasks/queue/{id:[0-9]+}/requeue`, httpAuth(QueueRequeueHandler)).Methods("PUT")
+	router.HandleFunc(`/tasks/{kind:(queue|schedules)}/{id:[0-9]+}/priority`, httpAuth(PriorityHandler)).Methods("PUT")
+	router.HandleFunc(`/tasks/workflows`, httpAuth(WorkflowsHandler)).Methods("GET")
+	router.HandleFunc(`/tasks/workflows/{id:[0-9]+}`, httpAuth(WorkflowsHandler)).Methods("GET")
+	router.HandleFunc(`/tasks/history`, httpAuth(TaskHistoryHandler)).Methods("GET")
+	router.HandleFunc(`/tasks/dead_letters`, httpAuth(DeadLettersHandler)).Methods("GET")
+	router.HandleFunc(`/tasks/dead_letters/{id:[0-9]+}/replay`, httpAuth(DeadLetterReplayHandler)).Methods("PUT")
 
 	AdminMux.Handle("/", router)
-	err = http.ListenAndServe(":"+adminPort, AdminMux)
+	server = &http.Server{Addr: ":" + adminPort, Handler: AdminMux}
+	err = server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
 	log.Error(fmt.Sprintf(`admin.API() ! %s`, err))
 	return
 }
 
+// Shutdown stops the admin API accepting requests and waits for those in
+// progress until ctx is done.
+func Shutdown(ctx context.Context) (err error) {
+	if server == nil {
+		return
+	}
+	err = server.Shutdown(ctx)
+	if err != nil {
+		log.Error(fmt.Sprintf(`admin.Shutdown() ! %s`, err))
+	}
+	return
+}
+
 func httpAuth(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, request *http.Request) {
 		if len(request.Header[`Authorization`]) == 0 {
@@ -25,7 +25,8 @@ const twoYears float64 = 17520.0
 
 /* Should contain a form value dbname which equals the database name
    e.g. curl www.hostname.com/backup/now -X POST -d "dbname=nameofdatabase"
-   The {how} should be either "now" or "enqueue" */
+   The {how} should be either "now", "enqueue" or "workflow", an enqueued backup may be given
+   a form value priority, see tasks.PriorityNormal */
 func BackupHandler(w http.ResponseWriter, request *http.Request) {
 	vars := mux.Vars(request)
 	dbname := request.FormValue("dbname")
@@ -42,6 +43,16 @@ func BackupHandler(w http.ResponseWriter, request *http.Request) {
 	}
 
 	var err error
+	if p := request.FormValue("priority"); p != "" {
+		var priority int
+		priority, err = strconv.Atoi(p)
+		t.Priority = &priority
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid priority"))
+			return
+		}
+	}
 	if dbname != "rdpg" {
 		//Using FindByDatabase to determine if the database actually exists to be backed up.
 		inst, err := instances.FindByDatabase(dbname)
@@ -82,6 +93,18 @@ func BackupHandler(w http.ResponseWriter, request *http.Request) {
 			return
 		}
 		w.Write([]byte("Backup successfully queued."))
+	case "workflow":
+		// Queues the backup, verification, upload and retention as a workflow
+		// whose progress is available from /tasks/workflows/{id}.
+		wf := tasks.NewBackupWorkflow(dbname, *t)
+		err = wf.Start()
+		if err != nil {
+			log.Error(fmt.Sprintf(`api.BackupHandler() Workflow.Start() %+v ! %s`, wf, err))
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Error while trying to start backup workflow"))
+			return
+		}
+		w.Write([]byte(fmt.Sprintf("Backup workflow %d started.", wf.ID)))
 	default:
 		w.WriteHeader(http.StatusNotFound)
 	}
@@ -553,3 +576,73 @@ func RemoteCopyHandler(w http.ResponseWriter, request *http.Request) {
 	w.Write([]byte(fmt.Sprintf("%d files were written to S3", numFiles)))
 
 }
+
+/*
+BackupSettingsHandler shows or changes how a database is backed up, its plan's
+backup settings with the instance's overrides applied. Only the management
+cluster holds the instances, the service cluster is sent the new settings.
+
+	GET    /backup/settings/{dbname} - the settings and the overrides
+	PUT    /backup/settings/{dbname} - override the given frequency, window or mode
+	DELETE /backup/settings/{dbname} - drop the overrides, back to the plan's
+*/
+func BackupSettingsHandler(w http.ResponseWriter, request *http.Request) {
+	dbname := mux.Vars(request)[`dbname`]
+	if globals.ServiceRole != `manager` {
+		msg := fmt.Sprintf(`{"status": %d, "description": "backup settings are managed on the management cluster"}`+"\n", http.StatusBadRequest)
+		log.Error(fmt.Sprintf(`admin.BackupSettingsHandler(%s) %s`, dbname, msg))
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	i, err := instances.FindByDatabase(dbname)
+	if err != nil {
+		msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusInternalServerError, err)
+		log.Error(fmt.Sprintf(`admin.BackupSettingsHandler(%s) instances.FindByDatabase() ! %s`, dbname, err))
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	if i == nil {
+		msg := fmt.Sprintf(`{"status": %d, "description": "No such database: %s"}`+"\n", http.StatusNotFound, dbname)
+		http.Error(w, msg, http.StatusNotFound)
+		return
+	}
+	switch request.Method {
+	case `PUT`:
+		_, overrides, err := i.BackupSettings()
+		if err != nil {
+			msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusInternalServerError, err)
+			log.Error(fmt.Sprintf(`admin.BackupSettingsHandler(%s) Instance#BackupSettings() ! %s`, dbname, err))
+			http.Error(w, msg, http.StatusInternalServerError)
+			return
+		}
+		changes := instances.BackupSettings{}
+		err = json.NewDecoder(request.Body).Decode(&changes)
+		if err == nil {
+			overrides = overrides.Merge(changes)
+			err = overrides.Validate()
+		}
+		if err != nil {
+			msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusBadRequest, err)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		err = i.SetBackupSettings(overrides)
+	case `DELETE`:
+		err = i.SetBackupSettings(instances.BackupSettings{})
+	}
+	if err != nil {
+		msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusInternalServerError, err)
+		log.Error(fmt.Sprintf(`admin.BackupSettingsHandler(%s) %s ! %s`, dbname, request.Method, err))
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	settings, overrides, err := i.BackupSettings()
+	if err != nil {
+		msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusInternalServerError, err)
+		log.Error(fmt.Sprintf(`admin.BackupSettingsHandler(%s) Instance#BackupSettings() ! %s`, dbname, err))
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	overrides.DBName = ``
+	writeTasksJSON(w, `admin.BackupSettingsHandler()`, map[string]instances.BackupSettings{`settings`: settings, `overrides`: overrides})
+}
@@ -0,0 +1,183 @@
+package admin
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/starkandwayne/rdpgd/cfsb"
+	"github.com/starkandwayne/rdpgd/log"
+	"github.com/starkandwayne/rdpgd/tasks"
+)
+
+/*
+CatalogServicesHandler manages the services of the broker's catalog, used on
+the management cluster.
+GET /catalog/services lists them, POST creates one.
+GET, PUT and DELETE /catalog/services/{service_id} show, update and retire
+one. Retiring a service retires its plans.
+*/
+func CatalogServicesHandler(w http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	serviceID := vars[`service_id`]
+	switch request.Method {
+	case `GET`:
+		if serviceID == `` {
+			services, err := cfsb.Services()
+			if err != nil {
+				msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusInternalServerError, err)
+				log.Error(fmt.Sprintf(`admin.CatalogServicesHandler(): cfsb.Services() ! %s`, err))
+				http.Error(w, msg, http.StatusInternalServerError)
+				return
+			}
+			writeTasksJSON(w, `admin.CatalogServicesHandler()`, services)
+			return
+		}
+		s, err := cfsb.FindService(serviceID)
+		if err != nil {
+			writeCatalogError(w, `admin.CatalogServicesHandler()`, err)
+			return
+		}
+		writeTasksJSON(w, `admin.CatalogServicesHandler()`, s)
+	case `POST`, `PUT`:
+		s := &cfsb.Service{Bindable: true, Updateable: true, Tags: cfsb.TagList{`rdpg`, `postgresql`}}
+		if request.Method == `PUT` {
+			var err error
+			s, err = cfsb.FindService(serviceID)
+			if err != nil {
+				writeCatalogError(w, `admin.CatalogServicesHandler()`, err)
+				return
+			}
+		}
+		err := json.NewDecoder(request.Body).Decode(s)
+		if err != nil {
+			msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusBadRequest, err)
+			log.Error(fmt.Sprintf(`admin.CatalogServicesHandler(): decoder.Decode() ! %s`, err))
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		if request.Method == `PUT` {
+			s.ServiceID = serviceID
+			err = s.Update()
+		} else {
+			err = s.Create()
+		}
+		if err != nil {
+			msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusBadRequest, err)
+			log.Error(fmt.Sprintf(`admin.CatalogServicesHandler(): %s`, msg))
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		writeTasksJSON(w, `admin.CatalogServicesHandler()`, s)
+	case `DELETE`:
+		err := cfsb.RetireService(serviceID)
+		if err != nil {
+			writeCatalogError(w, `admin.CatalogServicesHandler()`, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{}`))
+	default:
+		msg := fmt.Sprintf(`{"status": %d, "description": "Method not allowed %s"}`+"\n", http.StatusMethodNotAllowed, request.Method)
+		log.Error(fmt.Sprintf(`admin.CatalogServicesHandler(): %s`, msg))
+		http.Error(w, msg, http.StatusMethodNotAllowed)
+	}
+}
+
+/*
+CatalogPlansHandler manages the plans of the broker's catalog with their
+backup settings, allowed parameters and quotas, used on the management
+cluster.
+GET /catalog/plans lists them, POST creates one.
+GET, PUT and DELETE /catalog/plans/{plan_id} show, update and retire one. An
+updated plan's backup settings and quotas are sent on to its instances.
+*/
+func CatalogPlansHandler(w http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	planID := vars[`plan_id`]
+	switch request.Method {
+	case `GET`:
+		if planID == `` {
+			plans, err := cfsb.Plans()
+			if err != nil {
+				msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusInternalServerError, err)
+				log.Error(fmt.Sprintf(`admin.CatalogPlansHandler(): cfsb.Plans() ! %s`, err))
+				http.Error(w, msg, http.StatusInternalServerError)
+				return
+			}
+			writeTasksJSON(w, `admin.CatalogPlansHandler()`, plans)
+			return
+		}
+		plan, err := cfsb.FindPlan(planID)
+		if err != nil {
+			writeCatalogError(w, `admin.CatalogPlansHandler()`, err)
+			return
+		}
+		writeTasksJSON(w, `admin.CatalogPlansHandler()`, plan)
+	case `POST`, `PUT`:
+		plan := &cfsb.PlanConfig{Plan: cfsb.Plan{Free: true}, AllowedPoolModes: `session transaction`}
+		if request.Method == `PUT` {
+			var err error
+			plan, err = cfsb.FindPlan(planID)
+			if err != nil {
+				writeCatalogError(w, `admin.CatalogPlansHandler()`, err)
+				return
+			}
+		}
+		err := json.NewDecoder(request.Body).Decode(plan)
+		if err != nil {
+			msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusBadRequest, err)
+			log.Error(fmt.Sprintf(`admin.CatalogPlansHandler(): decoder.Decode() ! %s`, err))
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		if request.Method == `PUT` {
+			plan.PlanID = planID
+			err = plan.Update()
+		} else {
+			err = plan.Create()
+		}
+		if err != nil {
+			msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusBadRequest, err)
+			log.Error(fmt.Sprintf(`admin.CatalogPlansHandler(): %s`, msg))
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		if request.Method == `PUT` {
+			err = tasks.EnqueueApplyPlan(plan.PlanID)
+			if err != nil {
+				msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusInternalServerError, err)
+				log.Error(fmt.Sprintf(`admin.CatalogPlansHandler(): tasks.EnqueueApplyPlan() ! %s`, err))
+				http.Error(w, msg, http.StatusInternalServerError)
+				return
+			}
+		}
+		writeTasksJSON(w, `admin.CatalogPlansHandler()`, plan)
+	case `DELETE`:
+		err := cfsb.RetirePlan(planID)
+		if err != nil {
+			writeCatalogError(w, `admin.CatalogPlansHandler()`, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{}`))
+	default:
+		msg := fmt.Sprintf(`{"status": %d, "description": "Method not allowed %s"}`+"\n", http.StatusMethodNotAllowed, request.Method)
+		log.Error(fmt.Sprintf(`admin.CatalogPlansHandler(): %s`, msg))
+		http.Error(w, msg, http.StatusMethodNotAllowed)
+	}
+}
+
+// writeCatalogError responds 404 when the service or plan is not in the
+// catalog, 500 otherwise.
+func writeCatalogError(w http.ResponseWriter, caller string, err error) {
+	status, description := http.StatusInternalServerError, err.Error()
+	if err == sql.ErrNoRows {
+		status, description = http.StatusNotFound, `Not found in the catalog`
+	}
+	msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", status, description)
+	log.Error(fmt.Sprintf(`%s ! %s`, caller, err))
+	http.Error(w, msg, status)
+}
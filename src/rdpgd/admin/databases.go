@@ -9,11 +9,23 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/starkandwayne/rdpgd/instances"
 	"github.com/starkandwayne/rdpgd/log"
+	"github.com/starkandwayne/rdpgd/tasks"
 )
 
 /*
+GET /databases
+GET /databases/available
+GET /databases/usage/{database}
 POST /databases/register
 PUT /databases/assign
+PUT /databases/backup
+PUT /databases/parameters
+PUT /databases/bind
+PUT /databases/unbind
+PUT /databases/migrate
+PUT /databases/migrated
+PUT /databases/migrating
+PUT /databases/retire
 */
 func DatabasesHandler(w http.ResponseWriter, request *http.Request) {
 	vars := mux.Vars(request)
@@ -57,6 +69,17 @@ func DatabasesHandler(w http.ResponseWriter, request *http.Request) {
 				w.WriteHeader(http.StatusOK)
 				w.Write(jsonInstances)
 			}
+		case "usage": // reports a database's size, connections, backups and restores.
+			// GET /databases/usage/{database}
+			// This is requested from master cluster to service cluster
+			usage, err := instances.FindUsage(vars["database"])
+			if err != nil {
+				msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusInternalServerError, err)
+				log.Error(fmt.Sprintf(`admin.DatabasesHandler(): instances.FindUsage() %s %+v ! %s`, msg, vars, err))
+				http.Error(w, msg, http.StatusInternalServerError)
+				return
+			}
+			writeTasksJSON(w, `admin.DatabasesHandler()`, usage)
 		default:
 			msg := fmt.Sprintf(`{"status": %d, "description": "Invalid Action %s"}`+"\n", http.StatusBadRequest, vars["action"])
 			log.Error(fmt.Sprintf(`admin.DatabasesHandler(): %s %s`, msg, vars))
@@ -104,7 +127,7 @@ func DatabasesHandler(w http.ResponseWriter, request *http.Request) {
 				http.Error(w, msg, http.StatusInternalServerError)
 				return
 			}
-			err = i.Assign()
+			err = tasks.AssignInstance(&i)
 			if err != nil {
 				msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusInternalServerError, err)
 				log.Error(fmt.Sprintf(`admin.DatabasesHandler(): instances.Assign() %s %s ! %s`, msg, vars, err))
@@ -116,6 +139,192 @@ func DatabasesHandler(w http.ResponseWriter, request *http.Request) {
 				w.Write([]byte(`{}`))
 				return
 			}
+		case `backup`: // records a database's backup settings and reschedules its backups.
+			// PUT /databases/backup
+			// This is requested from master cluster to service cluster
+			var settings instances.BackupSettings
+			decoder := json.NewDecoder(request.Body)
+			err := decoder.Decode(&settings)
+			if err != nil {
+				msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusBadRequest, err)
+				log.Error(fmt.Sprintf(`admin.DatabasesHandler(): decoder.Decode() backup %s %s ! %s`, msg, vars, err))
+				http.Error(w, msg, http.StatusBadRequest)
+				return
+			}
+			if settings.DBName == `` {
+				msg := fmt.Sprintf(`{"status": %d, "description": "dbname is required"}`+"\n", http.StatusBadRequest)
+				log.Error(fmt.Sprintf(`admin.DatabasesHandler(): backup %s %s`, msg, vars))
+				http.Error(w, msg, http.StatusBadRequest)
+				return
+			}
+			err = tasks.ApplyBackupSettings(settings)
+			if err != nil {
+				msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusInternalServerError, err)
+				log.Error(fmt.Sprintf(`admin.DatabasesHandler(): tasks.ApplyBackupSettings() %s %s ! %s`, msg, vars, err))
+				http.Error(w, msg, http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set(`Content-Type`, `application/json; charset=UTF-8`)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{}`))
+			return
+		case `parameters`: // records a database's parameters and applies them on each node.
+			// PUT /databases/parameters
+			// This is requested from master cluster to service cluster
+			var params instances.DatabaseParameters
+			decoder := json.NewDecoder(request.Body)
+			err := decoder.Decode(&params)
+			if err != nil {
+				msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusBadRequest, err)
+				log.Error(fmt.Sprintf(`admin.DatabasesHandler(): decoder.Decode() parameters %s %s ! %s`, msg, vars, err))
+				http.Error(w, msg, http.StatusBadRequest)
+				return
+			}
+			if params.DBName == `` {
+				msg := fmt.Sprintf(`{"status": %d, "description": "dbname is required"}`+"\n", http.StatusBadRequest)
+				log.Error(fmt.Sprintf(`admin.DatabasesHandler(): parameters %s %s`, msg, vars))
+				http.Error(w, msg, http.StatusBadRequest)
+				return
+			}
+			err = tasks.ApplyDatabaseParameters(params)
+			if err != nil {
+				msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusInternalServerError, err)
+				log.Error(fmt.Sprintf(`admin.DatabasesHandler(): tasks.ApplyDatabaseParameters() %s %s ! %s`, msg, vars, err))
+				http.Error(w, msg, http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set(`Content-Type`, `application/json; charset=UTF-8`)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{}`))
+			return
+		case `bind`, `unbind`: // creates or drops the role of a service binding.
+			// PUT /databases/bind
+			// This is requested from master cluster to service cluster
+			var r instances.BindingRole
+			decoder := json.NewDecoder(request.Body)
+			err := decoder.Decode(&r)
+			if err != nil {
+				msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusBadRequest, err)
+				log.Error(fmt.Sprintf(`admin.DatabasesHandler(): decoder.Decode() %s %s %s ! %s`, vars[`action`], msg, vars, err))
+				http.Error(w, msg, http.StatusBadRequest)
+				return
+			}
+			if r.Database == `` || r.User == `` {
+				msg := fmt.Sprintf(`{"status": %d, "description": "dbname and uname are required"}`+"\n", http.StatusBadRequest)
+				log.Error(fmt.Sprintf(`admin.DatabasesHandler(): %s %s %s`, vars[`action`], msg, vars))
+				http.Error(w, msg, http.StatusBadRequest)
+				return
+			}
+			if vars[`action`] == `bind` {
+				err = tasks.BindInstance(&r)
+			} else {
+				err = tasks.UnbindInstance(&r)
+			}
+			if err != nil {
+				msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusInternalServerError, err)
+				log.Error(fmt.Sprintf(`admin.DatabasesHandler(): %s %s %s ! %s`, vars[`action`], msg, vars, err))
+				http.Error(w, msg, http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set(`Content-Type`, `application/json; charset=UTF-8`)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{}`))
+			return
+		case `migrate`, `migrated`: // copies a migrated database, or finishes its migration.
+			// PUT /databases/migrate
+			// This is requested from master cluster to the target service cluster
+			// PUT /databases/migrated
+			// This is requested from the target service cluster to master cluster
+			var m instances.Migration
+			decoder := json.NewDecoder(request.Body)
+			err := decoder.Decode(&m)
+			if err != nil {
+				msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusBadRequest, err)
+				log.Error(fmt.Sprintf(`admin.DatabasesHandler(): decoder.Decode() %s %s %s ! %s`, vars[`action`], msg, vars, err))
+				http.Error(w, msg, http.StatusBadRequest)
+				return
+			}
+			if m.OperationID == `` || m.Instance.Database == `` {
+				msg := fmt.Sprintf(`{"status": %d, "description": "operation_id and instance dbname are required"}`+"\n", http.StatusBadRequest)
+				log.Error(fmt.Sprintf(`admin.DatabasesHandler(): %s %s %s`, vars[`action`], msg, vars))
+				http.Error(w, msg, http.StatusBadRequest)
+				return
+			}
+			if vars[`action`] == `migrate` {
+				err = tasks.EnqueueMigrateDatabase(&m)
+			} else {
+				err = tasks.CompleteMigration(&m)
+			}
+			if err != nil {
+				msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusInternalServerError, err)
+				log.Error(fmt.Sprintf(`admin.DatabasesHandler(): %s %s %s ! %s`, vars[`action`], msg, vars, err))
+				http.Error(w, msg, http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set(`Content-Type`, `application/json; charset=UTF-8`)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{}`))
+			return
+		case `migrating`: // keeps the tenant from a database while it is migrated away, or lets it back.
+			// PUT /databases/migrating
+			// This is requested from master cluster to service cluster
+			type migrating struct {
+				Database  string `json:"dbname"`
+				Migrating bool   `json:"migrating"`
+			}
+			mg := migrating{}
+			decoder := json.NewDecoder(request.Body)
+			err := decoder.Decode(&mg)
+			if err != nil || mg.Database == `` {
+				msg := fmt.Sprintf(`{"status": %d, "description": "dbname is required"}`+"\n", http.StatusBadRequest)
+				log.Error(fmt.Sprintf(`admin.DatabasesHandler(): migrating %s %s ! %v`, msg, vars, err))
+				http.Error(w, msg, http.StatusBadRequest)
+				return
+			}
+			sourceDSN, err := tasks.SetMigrating(mg.Database, mg.Migrating)
+			if err != nil {
+				msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusInternalServerError, err)
+				log.Error(fmt.Sprintf(`admin.DatabasesHandler(): tasks.SetMigrating(%s,%t) %s ! %s`, mg.Database, mg.Migrating, msg, err))
+				http.Error(w, msg, http.StatusInternalServerError)
+				return
+			}
+			body, err := json.Marshal(map[string]string{`source_dsn`: sourceDSN})
+			if err != nil {
+				msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusInternalServerError, err)
+				log.Error(fmt.Sprintf(`admin.DatabasesHandler(): migrating json.Marshal() %s ! %s`, msg, err))
+				http.Error(w, msg, http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set(`Content-Type`, `application/json; charset=UTF-8`)
+			w.WriteHeader(http.StatusOK)
+			w.Write(body)
+			return
+		case `retire`: // drops the copy of a database migrated to another service cluster.
+			// PUT /databases/retire
+			// This is requested from master cluster to service cluster
+			type retirement struct {
+				Database string `json:"dbname"`
+			}
+			rt := retirement{}
+			decoder := json.NewDecoder(request.Body)
+			err := decoder.Decode(&rt)
+			if err != nil || rt.Database == `` {
+				msg := fmt.Sprintf(`{"status": %d, "description": "dbname is required"}`+"\n", http.StatusBadRequest)
+				log.Error(fmt.Sprintf(`admin.DatabasesHandler(): retire %s %s ! %v`, msg, vars, err))
+				http.Error(w, msg, http.StatusBadRequest)
+				return
+			}
+			err = tasks.RetireDatabase(rt.Database)
+			if err != nil {
+				msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusInternalServerError, err)
+				log.Error(fmt.Sprintf(`admin.DatabasesHandler(): tasks.RetireDatabase(%s) %s ! %s`, rt.Database, msg, err))
+				http.Error(w, msg, http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set(`Content-Type`, `application/json; charset=UTF-8`)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{}`))
+			return
 		case `decommissioned`: // updates an existing record to show it was deprovisioned.
 			// PUT /databases/decommissioned
 			// This is requested from service cluster to master cluster
@@ -176,7 +385,7 @@ func DatabasesHandler(w http.ResponseWriter, request *http.Request) {
 				http.Error(w, msg, http.StatusInternalServerError)
 				return
 			} else {
-				err = i.Decommission()
+				err = tasks.DecommissionInstance(i)
 				if err != nil {
 					msg := fmt.Sprintf(`{"status": %d, "description": "There was an error decommissioning the database (%s)"}`+"\n", http.StatusInternalServerError, err)
 					log.Error(fmt.Sprintf(`admin.DatabasesHandler(): instance#Decommission() %s %s ! %s`, msg, vars, err))
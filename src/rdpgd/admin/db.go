@@ -50,6 +50,16 @@ func getQueueDepth() (rowCount int) {
 	return
 }
 
+func getQueueWaiting() (rowCount int) {
+	sq := `SELECT COUNT(*) FROM tasks.tasks WHERE locked_by IS NULL;`
+	rowCount, err := getRowCount(sq)
+	if err != nil {
+		log.Error(fmt.Sprintf("admin.getQueueWaiting() Could not get row count running query %s ! %s", sq, err))
+		return -1
+	}
+	return
+}
+
 func getNumberOfBoundDatabases() (rowCount int) {
 	sq := `SELECT COUNT(*) FROM cfsb.instances WHERE instance_id IS NOT NULL AND effective_at IS NOT NULL AND ineffective_at IS NULL AND decommissioned_at IS NULL;`
 	rowCount, err := getRowCount(sq)
@@ -7,6 +7,7 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/starkandwayne/rdpgd/log"
+	"github.com/starkandwayne/rdpgd/tasks"
 )
 
 // StatsHandler handle http request
@@ -21,13 +22,15 @@ type Stats interface {
 
 // AgentStats actual struct to get data
 type AgentStats struct {
-	QueueDepth        int `json:"task_queue_depth"`
-	NumBoundDB        int `json:"num_bound_db"`
-	NumFreeDB         int `json:"num_free_db"`
-	NumReplSlots      int `json:"num_replication_slots"`
-	NumDBBackupDisk   int `json:"num_db_backup_files_on_disk"`
-	NumUserDatabases  int `json:"num_user_databases"`
-	NumLimitDatabases int `json:"num_limit_databases"`
+	QueueDepth        int             `json:"task_queue_depth"`
+	QueueWaiting      int             `json:"task_queue_waiting"`
+	TaskWorkers       tasks.PoolStats `json:"task_workers"`
+	NumBoundDB        int             `json:"num_bound_db"`
+	NumFreeDB         int             `json:"num_free_db"`
+	NumReplSlots      int             `json:"num_replication_slots"`
+	NumDBBackupDisk   int             `json:"num_db_backup_files_on_disk"`
+	NumUserDatabases  int             `json:"num_user_databases"`
+	NumLimitDatabases int             `json:"num_limit_databases"`
 }
 
 // MockStats used for testing mock data
@@ -38,6 +41,8 @@ type MockStats struct {
 //GetStats return stats for agent
 func (a *AgentStats) GetStats() interface{} {
 	a.QueueDepth = getQueueDepth()
+	a.QueueWaiting = getQueueWaiting()
+	a.TaskWorkers = tasks.WorkerPoolStats()
 	a.NumBoundDB = getNumberOfBoundDatabases()
 	a.NumFreeDB = getNumberOfFreeDatabases()
 	a.NumReplSlots = getNumberOfReplicationSlots()
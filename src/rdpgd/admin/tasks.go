@@ -0,0 +1,670 @@
+/* Handlers for API calls to inspect and manage the task queue */
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/starkandwayne/rdpgd/history"
+	"github.com/starkandwayne/rdpgd/log"
+	"github.com/starkandwayne/rdpgd/tasks"
+)
+
+/*
+DeadLettersHandler lists the tasks which exhausted their retries and have not
+been replayed yet, optionally filtered by action.
+	curl www.hostname.com/tasks/dead_letters?action=BackupDatabase
+*/
+func DeadLettersHandler(w http.ResponseWriter, request *http.Request) {
+	deadLetters, err := tasks.DeadLetters(request.FormValue(`action`))
+	if err != nil {
+		msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusInternalServerError, err)
+		log.Error(fmt.Sprintf(`admin.DeadLettersHandler(): tasks.DeadLetters() ! %s`, err))
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	writeTasksJSON(w, `admin.DeadLettersHandler()`, deadLetters)
+}
+
+/*
+DeadLetterReplayHandler puts the task held in a dead letter back on the queue.
+	curl www.hostname.com/tasks/dead_letters/42/replay -X PUT
+*/
+func DeadLetterReplayHandler(w http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	id, err := strconv.ParseInt(vars[`id`], 10, 64)
+	if err != nil {
+		msg := fmt.Sprintf(`{"status": %d, "description": "Invalid dead letter id %s"}`+"\n", http.StatusBadRequest, vars[`id`])
+		log.Error(fmt.Sprintf(`admin.DeadLetterReplayHandler(): %s`, msg))
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	t, err := tasks.ReplayDeadLetter(id)
+	if err != nil {
+		msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusInternalServerError, err)
+		log.Error(fmt.Sprintf(`admin.DeadLetterReplayHandler(): tasks.ReplayDeadLetter(%d) ! %s`, id, err))
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	writeTasksJSON(w, `admin.DeadLetterReplayHandler()`, t)
+}
+
+/*
+PriorityHandler changes the priority of a queued task or of the tasks a
+schedule enqueues. Higher priorities are worked first, a schedule given the
+priority default goes back to its action's default.
+	curl www.hostname.com/tasks/queue/42/priority -X PUT -d 'priority=10'
+	curl www.hostname.com/tasks/schedules/7/priority -X PUT -d 'priority=-10'
+	curl www.hostname.com/tasks/schedules/7/priority -X PUT -d 'priority=default'
+*/
+func PriorityHandler(w http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	id, err := strconv.ParseInt(vars[`id`], 10, 64)
+	if err != nil {
+		msg := fmt.Sprintf(`{"status": %d, "description": "Invalid id %s"}`+"\n", http.StatusBadRequest, vars[`id`])
+		log.Error(fmt.Sprintf(`admin.PriorityHandler(): %s`, msg))
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	var priority *int
+	if request.FormValue(`priority`) != `default` || vars[`kind`] != `schedules` {
+		var p int
+		p, err = strconv.Atoi(request.FormValue(`priority`))
+		priority = &p
+	}
+	if err != nil {
+		msg := fmt.Sprintf(`{"status": %d, "description": "Invalid priority %s"}`+"\n", http.StatusBadRequest, request.FormValue(`priority`))
+		log.Error(fmt.Sprintf(`admin.PriorityHandler(): %s`, msg))
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	if vars[`kind`] == `schedules` {
+		err = tasks.SetSchedulePriority(id, priority)
+	} else {
+		err = tasks.SetTaskPriority(id, *priority)
+	}
+	if err != nil {
+		msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusNotFound, err)
+		log.Error(fmt.Sprintf(`admin.PriorityHandler(): %s %d ! %s`, vars[`kind`], id, err))
+		http.Error(w, msg, http.StatusNotFound)
+		return
+	}
+	writeTasksJSON(w, `admin.PriorityHandler()`, map[string]interface{}{`id`: id, `priority`: priority})
+}
+
+const (
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+)
+
+/*
+TaskHistoryHandler lists executed tasks from tasks.history, newest first.
+Optional filters are action, database, status (ok, error, timeout, cancelled
+or misfired) and since and until timestamps, paged with limit and offset.
+	curl www.hostname.com/tasks/history?action=BackupDatabase&status=error&since=2016-01-01&limit=50
+*/
+func TaskHistoryHandler(w http.ResponseWriter, request *http.Request) {
+	f := history.TaskHistoryFilter{
+		Action: request.FormValue(`action`),
+		DBName: request.FormValue(`database`),
+		Status: request.FormValue(`status`),
+		Since:  request.FormValue(`since`),
+		Until:  request.FormValue(`until`),
+		Limit:  defaultHistoryLimit,
+	}
+	var err error
+	if v := request.FormValue(`limit`); v != `` {
+		f.Limit, err = strconv.Atoi(v)
+		if err != nil || f.Limit < 1 || f.Limit > maxHistoryLimit {
+			msg := fmt.Sprintf(`{"status": %d, "description": "limit must be between 1 and %d"}`+"\n", http.StatusBadRequest, maxHistoryLimit)
+			log.Error(fmt.Sprintf(`admin.TaskHistoryHandler(): %s`, msg))
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+	}
+	if v := request.FormValue(`offset`); v != `` {
+		f.Offset, err = strconv.Atoi(v)
+		if err != nil || f.Offset < 0 {
+			msg := fmt.Sprintf(`{"status": %d, "description": "Invalid offset %s"}`+"\n", http.StatusBadRequest, v)
+			log.Error(fmt.Sprintf(`admin.TaskHistoryHandler(): %s`, msg))
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+	}
+	switch f.Status {
+	case ``, `ok`, `error`, `timeout`, `cancelled`, `misfired`:
+	default:
+		msg := fmt.Sprintf(`{"status": %d, "description": "Invalid status %s"}`+"\n", http.StatusBadRequest, f.Status)
+		log.Error(fmt.Sprintf(`admin.TaskHistoryHandler(): %s`, msg))
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	histories, err := history.TaskHistories(f)
+	if err != nil {
+		msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusInternalServerError, err)
+		log.Error(fmt.Sprintf(`admin.TaskHistoryHandler(): history.TaskHistories() ! %s`, err))
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	writeTasksJSON(w, `admin.TaskHistoryHandler()`, histories)
+}
+
+/*
+WorkflowsHandler lists workflows newest first, optionally filtered by status
+(running, succeeded or failed), or returns one workflow with its steps.
+	curl www.hostname.com/tasks/workflows?status=failed&limit=10
+	curl www.hostname.com/tasks/workflows/42
+*/
+func WorkflowsHandler(w http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	if vars[`id`] != `` {
+		id, err := strconv.ParseInt(vars[`id`], 10, 64)
+		if err != nil {
+			msg := fmt.Sprintf(`{"status": %d, "description": "Invalid workflow id %s"}`+"\n", http.StatusBadRequest, vars[`id`])
+			log.Error(fmt.Sprintf(`admin.WorkflowsHandler(): %s`, msg))
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		workflow, err := tasks.FindWorkflow(id)
+		if err != nil {
+			msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusInternalServerError, err)
+			log.Error(fmt.Sprintf(`admin.WorkflowsHandler(): tasks.FindWorkflow(%d) ! %s`, id, err))
+			http.Error(w, msg, http.StatusInternalServerError)
+			return
+		}
+		if workflow == nil {
+			msg := fmt.Sprintf(`{"status": %d, "description": "Workflow %d not found"}`+"\n", http.StatusNotFound, id)
+			http.Error(w, msg, http.StatusNotFound)
+			return
+		}
+		writeTasksJSON(w, `admin.WorkflowsHandler()`, workflow)
+		return
+	}
+
+	status := request.FormValue(`status`)
+	switch status {
+	case ``, tasks.WorkflowRunning, tasks.WorkflowSucceeded, tasks.WorkflowFailed:
+	default:
+		msg := fmt.Sprintf(`{"status": %d, "description": "Invalid status %s"}`+"\n", http.StatusBadRequest, status)
+		log.Error(fmt.Sprintf(`admin.WorkflowsHandler(): %s`, msg))
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	limit := defaultHistoryLimit
+	if v := request.FormValue(`limit`); v != `` {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxHistoryLimit {
+			msg := fmt.Sprintf(`{"status": %d, "description": "limit must be between 1 and %d"}`+"\n", http.StatusBadRequest, maxHistoryLimit)
+			log.Error(fmt.Sprintf(`admin.WorkflowsHandler(): %s`, msg))
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+	}
+	workflows, err := tasks.Workflows(status, limit)
+	if err != nil {
+		msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusInternalServerError, err)
+		log.Error(fmt.Sprintf(`admin.WorkflowsHandler(): tasks.Workflows() ! %s`, err))
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	writeTasksJSON(w, `admin.WorkflowsHandler()`, workflows)
+}
+
+/*
+UpcomingSchedulesHandler lists the enabled schedules in the order they will
+next run, with their next_run_at.
+	curl www.hostname.com/tasks/schedules/upcoming?limit=10
+*/
+func UpcomingSchedulesHandler(w http.ResponseWriter, request *http.Request) {
+	limit := defaultHistoryLimit
+	if v := request.FormValue(`limit`); v != `` {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxHistoryLimit {
+			msg := fmt.Sprintf(`{"status": %d, "description": "limit must be between 1 and %d"}`+"\n", http.StatusBadRequest, maxHistoryLimit)
+			log.Error(fmt.Sprintf(`admin.UpcomingSchedulesHandler(): %s`, msg))
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+	}
+	schedules, err := tasks.UpcomingSchedules(limit)
+	if err != nil {
+		msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusInternalServerError, err)
+		log.Error(fmt.Sprintf(`admin.UpcomingSchedulesHandler(): tasks.UpcomingSchedules() ! %s`, err))
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	writeTasksJSON(w, `admin.UpcomingSchedulesHandler()`, schedules)
+}
+
+/*
+MaintenanceWindowsHandler lists, creates or updates and deletes maintenance
+windows. A PUT body may list the actions whose schedules are restricted to the
+window, replacing those it had, an empty list leaves it none. Without the list
+they are left as they were.
+	curl www.hostname.com/tasks/maintenance_windows
+	curl www.hostname.com/tasks/maintenance_windows/nightly -X PUT -d '{"cron":"0 2 * * *","time_zone":"America/New_York","duration":"3 hours","actions":["Vacuum","BackupAllDatabases"]}'
+	curl www.hostname.com/tasks/maintenance_windows/nightly -X DELETE
+*/
+func MaintenanceWindowsHandler(w http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	switch request.Method {
+	case `GET`:
+		windows, err := tasks.MaintenanceWindows()
+		if err != nil {
+			msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusInternalServerError, err)
+			log.Error(fmt.Sprintf(`admin.MaintenanceWindowsHandler(): tasks.MaintenanceWindows() ! %s`, err))
+			http.Error(w, msg, http.StatusInternalServerError)
+			return
+		}
+		writeTasksJSON(w, `admin.MaintenanceWindowsHandler()`, windows)
+	case `PUT`:
+		body := struct {
+			tasks.MaintenanceWindow
+			Actions []string `json:"actions"`
+		}{}
+		err := json.NewDecoder(request.Body).Decode(&body)
+		if err != nil {
+			msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusBadRequest, err)
+			log.Error(fmt.Sprintf(`admin.MaintenanceWindowsHandler(): decoder.Decode() ! %s`, err))
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		window := body.MaintenanceWindow
+		window.Name = vars[`name`]
+		if err = window.Validate(); err != nil {
+			msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusBadRequest, err)
+			log.Error(fmt.Sprintf(`admin.MaintenanceWindowsHandler(): %s`, msg))
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		for _, action := range body.Actions {
+			if _, ok := tasks.Lookup(action); !ok {
+				msg := fmt.Sprintf(`{"status": %d, "description": "Unknown action %s"}`+"\n", http.StatusBadRequest, action)
+				log.Error(fmt.Sprintf(`admin.MaintenanceWindowsHandler(): %s`, msg))
+				http.Error(w, msg, http.StatusBadRequest)
+				return
+			}
+		}
+		if err = window.Save(); err != nil {
+			msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusInternalServerError, err)
+			log.Error(fmt.Sprintf(`admin.MaintenanceWindowsHandler(): window.Save() ! %s`, err))
+			http.Error(w, msg, http.StatusInternalServerError)
+			return
+		}
+		if body.Actions == nil {
+			writeTasksJSON(w, `admin.MaintenanceWindowsHandler()`, window)
+			return
+		}
+		if err = window.AssignActions(body.Actions); err != nil {
+			msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusInternalServerError, err)
+			log.Error(fmt.Sprintf(`admin.MaintenanceWindowsHandler(): window.AssignActions() ! %s`, err))
+			http.Error(w, msg, http.StatusInternalServerError)
+			return
+		}
+		writeTasksJSON(w, `admin.MaintenanceWindowsHandler()`, window)
+	case `DELETE`:
+		err := tasks.DeleteMaintenanceWindow(vars[`name`])
+		if err != nil {
+			msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusInternalServerError, err)
+			log.Error(fmt.Sprintf(`admin.MaintenanceWindowsHandler(): tasks.DeleteMaintenanceWindow() ! %s`, err))
+			http.Error(w, msg, http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{}`))
+	default:
+		msg := fmt.Sprintf(`{"status": %d, "description": "Method not allowed %s"}`+"\n", http.StatusMethodNotAllowed, request.Method)
+		log.Error(fmt.Sprintf(`admin.MaintenanceWindowsHandler(): %s`, msg))
+		http.Error(w, msg, http.StatusMethodNotAllowed)
+	}
+}
+
+// writeTasksJSON writes v as a JSON response, caller names the handler for
+// logging.
+func writeTasksJSON(w http.ResponseWriter, caller string, v interface{}) {
+	jsonBody, err := json.Marshal(v)
+	if err != nil {
+		msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusInternalServerError, err)
+		log.Error(fmt.Sprintf(`%s: json.Marshal() ! %s`, caller, err))
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBody)
+}
+
+/*
+SchedulesHandler lists the schedules, optionally of one action, or creates a
+schedule. Role, node type, ttl, frequency and time zone default to the action's
+handler, 1 hour and UTC.
+	curl www.hostname.com/tasks/schedules?action=BackupDatabase
+	curl www.hostname.com/tasks/schedules -X POST -d '{"action":"BackupDatabase","data":"d0","node_type":"write","frequency":"6 hours","enabled":true}'
+*/
+func SchedulesHandler(w http.ResponseWriter, request *http.Request) {
+	if request.Method == `GET` {
+		schedules, err := tasks.Schedules(request.FormValue(`action`))
+		if err != nil {
+			msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusInternalServerError, err)
+			log.Error(fmt.Sprintf(`admin.SchedulesHandler(): tasks.Schedules() ! %s`, err))
+			http.Error(w, msg, http.StatusInternalServerError)
+			return
+		}
+		writeTasksJSON(w, `admin.SchedulesHandler()`, schedules)
+		return
+	}
+
+	s := tasks.NewSchedule()
+	err := json.NewDecoder(request.Body).Decode(s)
+	if err != nil {
+		msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusBadRequest, err)
+		log.Error(fmt.Sprintf(`admin.SchedulesHandler(): decoder.Decode() ! %s`, err))
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	s.ID = 0
+	if err = s.Validate(); err != nil {
+		msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusBadRequest, err)
+		log.Error(fmt.Sprintf(`admin.SchedulesHandler(): %s`, msg))
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	err = s.Create()
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == tasks.ErrScheduleExists {
+			status = http.StatusConflict
+		}
+		msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", status, err)
+		log.Error(fmt.Sprintf(`admin.SchedulesHandler(): Schedule#Create() ! %s`, err))
+		http.Error(w, msg, status)
+		return
+	}
+	writeTasksJSON(w, `admin.SchedulesHandler()`, s)
+}
+
+/*
+ScheduleHandler returns, updates or deletes a schedule. A PUT body only needs
+the fields being changed, the schedule is next due by its new timing.
+	curl www.hostname.com/tasks/schedules/7
+	curl www.hostname.com/tasks/schedules/7 -X PUT -d '{"frequency":"1 day"}'
+	curl www.hostname.com/tasks/schedules/7 -X DELETE
+*/
+func ScheduleHandler(w http.ResponseWriter, request *http.Request) {
+	id, ok := scheduleID(w, request)
+	if !ok {
+		return
+	}
+	switch request.Method {
+	case `DELETE`:
+		err := tasks.DeleteSchedule(id)
+		if err != nil {
+			writeScheduleError(w, `tasks.DeleteSchedule()`, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{}`))
+		return
+	}
+
+	s, err := tasks.FindSchedule(id)
+	if err == nil && s == nil {
+		err = tasks.ErrScheduleNotFound
+	}
+	if err != nil {
+		writeScheduleError(w, `tasks.FindSchedule()`, err)
+		return
+	}
+	if request.Method == `PUT` {
+		err = json.NewDecoder(request.Body).Decode(s)
+		if err != nil {
+			msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusBadRequest, err)
+			log.Error(fmt.Sprintf(`admin.ScheduleHandler(): decoder.Decode() ! %s`, err))
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		s.ID = id
+		if err = s.Validate(); err != nil {
+			msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusBadRequest, err)
+			log.Error(fmt.Sprintf(`admin.ScheduleHandler(): %s`, msg))
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		if err = s.Update(); err != nil {
+			writeScheduleError(w, `Schedule#Update()`, err)
+			return
+		}
+		s.NextRunAt = ``
+	}
+	writeTasksJSON(w, `admin.ScheduleHandler()`, s)
+}
+
+/*
+ScheduleStateHandler enables or disables a schedule, eg. to pause retention
+during an incident.
+	curl www.hostname.com/tasks/schedules/7/disable -X PUT
+*/
+func ScheduleStateHandler(w http.ResponseWriter, request *http.Request) {
+	id, ok := scheduleID(w, request)
+	if !ok {
+		return
+	}
+	enabled := mux.Vars(request)[`state`] == `enable`
+	err := tasks.SetScheduleEnabled(id, enabled)
+	if err != nil {
+		writeScheduleError(w, `tasks.SetScheduleEnabled()`, err)
+		return
+	}
+	writeTasksJSON(w, `admin.ScheduleStateHandler()`, map[string]interface{}{`id`: id, `enabled`: enabled})
+}
+
+/*
+ScheduleRunHandler enqueues the schedule's task straight away.
+	curl www.hostname.com/tasks/schedules/7/run -X POST
+*/
+func ScheduleRunHandler(w http.ResponseWriter, request *http.Request) {
+	id, ok := scheduleID(w, request)
+	if !ok {
+		return
+	}
+	s, err := tasks.FindSchedule(id)
+	if err == nil && s == nil {
+		err = tasks.ErrScheduleNotFound
+	}
+	if err != nil {
+		writeScheduleError(w, `tasks.FindSchedule()`, err)
+		return
+	}
+	t, err := s.RunNow()
+	if err != nil {
+		writeScheduleError(w, `Schedule#RunNow()`, err)
+		return
+	}
+	writeTasksJSON(w, `admin.ScheduleRunHandler()`, t)
+}
+
+// scheduleID parses the {id} of a schedule route, writing a 400 if it is
+// invalid.
+func scheduleID(w http.ResponseWriter, request *http.Request) (id int64, ok bool) {
+	vars := mux.Vars(request)
+	id, err := strconv.ParseInt(vars[`id`], 10, 64)
+	if err != nil {
+		msg := fmt.Sprintf(`{"status": %d, "description": "Invalid schedule id %s"}`+"\n", http.StatusBadRequest, vars[`id`])
+		log.Error(fmt.Sprintf(`admin.scheduleID(): %s`, msg))
+		http.Error(w, msg, http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// writeScheduleError writes err as a 404 for a missing schedule and a 500
+// otherwise.
+func writeScheduleError(w http.ResponseWriter, caller string, err error) {
+	status := http.StatusInternalServerError
+	if err == tasks.ErrScheduleNotFound {
+		status = http.StatusNotFound
+	}
+	msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", status, err)
+	log.Error(fmt.Sprintf(`admin: %s ! %s`, caller, err))
+	http.Error(w, msg, status)
+}
+
+/*
+QueueHandler lists the tasks in the queue, those being worked first with the
+worker holding them, or purges the queued tasks of an action. Optional filters
+are action, state (queued or running) and node, paged with limit and offset.
+	curl www.hostname.com/tasks/queue?state=running
+	curl www.hostname.com/tasks/queue?action=CopyFileToS3 -X DELETE
+*/
+func QueueHandler(w http.ResponseWriter, request *http.Request) {
+	action := request.FormValue(`action`)
+	if request.Method == `DELETE` {
+		if action == `` {
+			msg := fmt.Sprintf(`{"status": %d, "description": "action is required to purge the queue"}`+"\n", http.StatusBadRequest)
+			log.Error(fmt.Sprintf(`admin.QueueHandler(): %s`, msg))
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		purged, err := tasks.PurgeTasks(action)
+		if err != nil {
+			msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusInternalServerError, err)
+			log.Error(fmt.Sprintf(`admin.QueueHandler(): tasks.PurgeTasks(%s) ! %s`, action, err))
+			http.Error(w, msg, http.StatusInternalServerError)
+			return
+		}
+		writeTasksJSON(w, `admin.QueueHandler()`, map[string]interface{}{`action`: action, `purged`: purged})
+		return
+	}
+
+	f := tasks.QueueFilter{
+		Action: action,
+		State:  request.FormValue(`state`),
+		Node:   request.FormValue(`node`),
+		Limit:  defaultHistoryLimit,
+	}
+	switch f.State {
+	case ``, `queued`, `running`:
+	default:
+		msg := fmt.Sprintf(`{"status": %d, "description": "Invalid state %s"}`+"\n", http.StatusBadRequest, f.State)
+		log.Error(fmt.Sprintf(`admin.QueueHandler(): %s`, msg))
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	var err error
+	if v := request.FormValue(`limit`); v != `` {
+		f.Limit, err = strconv.Atoi(v)
+		if err != nil || f.Limit < 1 || f.Limit > maxHistoryLimit {
+			msg := fmt.Sprintf(`{"status": %d, "description": "limit must be between 1 and %d"}`+"\n", http.StatusBadRequest, maxHistoryLimit)
+			log.Error(fmt.Sprintf(`admin.QueueHandler(): %s`, msg))
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+	}
+	if v := request.FormValue(`offset`); v != `` {
+		f.Offset, err = strconv.Atoi(v)
+		if err != nil || f.Offset < 0 {
+			msg := fmt.Sprintf(`{"status": %d, "description": "Invalid offset %s"}`+"\n", http.StatusBadRequest, v)
+			log.Error(fmt.Sprintf(`admin.QueueHandler(): %s`, msg))
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+	}
+	queued, err := tasks.QueuedTasks(f)
+	if err != nil {
+		msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", http.StatusInternalServerError, err)
+		log.Error(fmt.Sprintf(`admin.QueueHandler(): tasks.QueuedTasks() ! %s`, err))
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	writeTasksJSON(w, `admin.QueueHandler()`, queued)
+}
+
+/*
+QueuedTaskHandler returns a task in the queue or cancels it. A queued task is
+removed straight away, a task being worked is stopped by its worker at the next
+heartbeat.
+	curl www.hostname.com/tasks/queue/42
+	curl www.hostname.com/tasks/queue/42 -X DELETE
+*/
+func QueuedTaskHandler(w http.ResponseWriter, request *http.Request) {
+	id, ok := taskID(w, request)
+	if !ok {
+		return
+	}
+	if request.Method == `DELETE` {
+		removed, err := tasks.CancelTask(id)
+		if err != nil {
+			writeTaskError(w, `tasks.CancelTask()`, err)
+			return
+		}
+		status := `cancelling`
+		if removed {
+			status = `cancelled`
+		}
+		writeTasksJSON(w, `admin.QueuedTaskHandler()`, map[string]interface{}{`id`: id, `status`: status})
+		return
+	}
+	t, err := tasks.FindTask(id)
+	if err != nil {
+		writeTaskError(w, `tasks.FindTask()`, err)
+		return
+	}
+	writeTasksJSON(w, `admin.QueuedTaskHandler()`, t)
+}
+
+/*
+QueueRequeueHandler releases a task from a worker which stopped heartbeating,
+eg. on a node which is gone, so that it is worked again straight away.
+	curl www.hostname.com/tasks/queue/42/requeue -X PUT
+*/
+func QueueRequeueHandler(w http.ResponseWriter, request *http.Request) {
+	id, ok := taskID(w, request)
+	if !ok {
+		return
+	}
+	err := tasks.RequeueTask(id)
+	if err != nil {
+		writeTaskError(w, `tasks.RequeueTask()`, err)
+		return
+	}
+	t, err := tasks.FindTask(id)
+	if err != nil {
+		writeTaskError(w, `tasks.FindTask()`, err)
+		return
+	}
+	writeTasksJSON(w, `admin.QueueRequeueHandler()`, t)
+}
+
+// taskID parses the {id} of a queue route, writing a 400 if it is invalid.
+func taskID(w http.ResponseWriter, request *http.Request) (id int64, ok bool) {
+	vars := mux.Vars(request)
+	id, err := strconv.ParseInt(vars[`id`], 10, 64)
+	if err != nil {
+		msg := fmt.Sprintf(`{"status": %d, "description": "Invalid task id %s"}`+"\n", http.StatusBadRequest, vars[`id`])
+		log.Error(fmt.Sprintf(`admin.taskID(): %s`, msg))
+		http.Error(w, msg, http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// writeTaskError writes err as a 404 for a task no longer in the queue, a 409
+// for one which cannot be requeued and a 500 otherwise.
+func writeTaskError(w http.ResponseWriter, caller string, err error) {
+	status := http.StatusInternalServerError
+	switch err {
+	case tasks.ErrTaskNotFound:
+		status = http.StatusNotFound
+	case tasks.ErrTaskNotLocked, tasks.ErrTaskHeartbeating:
+		status = http.StatusConflict
+	}
+	msg := fmt.Sprintf(`{"status": %d, "description": "%s"}`+"\n", status, err)
+	log.Error(fmt.Sprintf(`admin: %s ! %s`, caller, err))
+	http.Error(w, msg, status)
+}
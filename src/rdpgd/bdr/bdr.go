@@ -185,6 +185,82 @@ func (b *BDR) DropUser(dbuser string) (err error) {
 	return nil
 }
 
+// Grant the given role to a user on each node, roles are not replicated.
+func (b *BDR) GrantRole(role, dbuser string) (err error) {
+	nodes, err := b.PGNodes()
+	if err != nil {
+		log.Error(fmt.Sprintf(`bdr.BDR#GrantRole(%s,%s) b.PGNodes() ! %s`, role, dbuser, err))
+		return err
+	}
+	for _, pg := range nodes {
+		err = pg.GrantRole(role, dbuser)
+		if err != nil {
+			log.Error(fmt.Sprintf(`bdr.BDR<%s>#GrantRole(%s,%s) pg.GrantRole() ! %s`, pg.IP, role, dbuser, err))
+			return err
+		}
+	}
+	return nil
+}
+
+// Terminate the sessions of the given user on each node, the nodes are all
+// tried and the first error returned.
+func (b *BDR) TerminateUserSessions(dbuser string) (err error) {
+	nodes, err := b.PGNodes()
+	if err != nil {
+		log.Error(fmt.Sprintf(`bdr.BDR#TerminateUserSessions(%s) b.PGNodes() ! %s`, dbuser, err))
+		return err
+	}
+	for _, pg := range nodes {
+		nodeErr := pg.TerminateUserSessions(dbuser)
+		if nodeErr != nil {
+			log.Error(fmt.Sprintf(`bdr.BDR<%s>#TerminateUserSessions(%s) pg.TerminateUserSessions() ! %s`, pg.IP, dbuser, nodeErr))
+			if err == nil {
+				err = nodeErr
+			}
+		}
+	}
+	return
+}
+
+// Limit the connections of the given user on each node, roles are not
+// replicated.
+func (b *BDR) SetUserConnectionLimit(dbuser string, limit int) (err error) {
+	nodes, err := b.PGNodes()
+	if err != nil {
+		log.Error(fmt.Sprintf(`bdr.BDR#SetUserConnectionLimit(%s) b.PGNodes() ! %s`, dbuser, err))
+		return err
+	}
+	for _, pg := range nodes {
+		err = pg.SetUserConnectionLimit(dbuser, limit)
+		if err != nil {
+			log.Error(fmt.Sprintf(`bdr.BDR<%s>#SetUserConnectionLimit(%s) pg.SetUserConnectionLimit() ! %s`, pg.IP, dbuser, err))
+			return err
+		}
+	}
+	return nil
+}
+
+// Hand the objects the given user owns in a database over to another role on
+// each node so that the user may be dropped, ownership is not replicated.
+func (b *BDR) ReassignOwned(dbname, dbuser, owner string) (err error) {
+	nodes, err := b.PGNodes()
+	if err != nil {
+		log.Error(fmt.Sprintf(`bdr.BDR#ReassignOwned(%s,%s,%s) b.PGNodes() ! %s`, dbname, dbuser, owner, err))
+		return err
+	}
+	for _, pg := range nodes {
+		if exists, _ := pg.DatabaseExists(dbname); !exists {
+			continue
+		}
+		err = pg.ReassignOwned(dbname, dbuser, owner)
+		if err != nil {
+			log.Error(fmt.Sprintf(`bdr.BDR<%s>#ReassignOwned(%s,%s,%s) pg.ReassignOwned() ! %s`, pg.IP, dbname, dbuser, owner, err))
+			return err
+		}
+	}
+	return nil
+}
+
 // Stop replication for given database (bdr replication group) and delete the grop on each node.
 func (b *BDR) DeleteReplicationGroup(dbname string) (err error) {
 	nodes, err := b.PGNodes()
@@ -1,6 +1,8 @@
 package cfsb
 
 import (
+	"context"
+	"database/sql"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -12,23 +14,34 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/starkandwayne/rdpgd/instances"
 	"github.com/starkandwayne/rdpgd/log"
+	"github.com/starkandwayne/rdpgd/tasks"
 )
 
 var (
 	sbPort, sbUser, sbPass string
 	pgPort, pbPort, pgPass string
+	server                 *http.Server
 )
 
 //CFSB used for service broker
 type CFSB struct {
 }
 
-//Response struct
+//Response struct is the body of the broker's error responses and of those
+//without anything else to return, as the Open Service Broker API has them.
 type Response struct {
-	Status      int
-	Description string
+	// Error is a code Cloud Controller acts on, eg. AsyncRequired.
+	Error       string `json:"error,omitempty"`
+	Description string `json:"description,omitempty"`
 }
 
+// The oldest version of the Open Service Broker API the broker serves, that
+// which introduced asynchronous operations.
+const (
+	minAPIMajor = 2
+	minAPIMinor = 7
+)
+
 func init() {
 	sbPort = os.Getenv("RDPGD_SB_PORT")
 	if sbPort == "" {
@@ -53,41 +66,79 @@ func init() {
 func API() (err error) {
 	CFSBMux := http.NewServeMux()
 	router := mux.NewRouter()
-	router.HandleFunc("/v2/catalog", httpAuth(CatalogHandler))
-	router.HandleFunc("/v2/service_instances/{instance_id}", httpAuth(InstanceHandler))
+	router.HandleFunc("/v2/catalog", httpAuth(apiVersion(CatalogHandler)))
+	router.HandleFunc("/v2/service_instances/{instance_id}", httpAuth(apiVersion(InstanceHandler)))
+	router.HandleFunc("/v2/service_instances/{instance_id}/last_operation", httpAuth(apiVersion(LastOperationHandler)))
 	CFSBMux.Handle("/", router)
-	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", httpAuth(BindingHandler))
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", httpAuth(apiVersion(BindingHandler)))
+	// Tenants sign in to the dashboard with UAA rather than the broker's
+	// credentials.
+	router.HandleFunc("/dashboard/instances/{instance_id}", DashboardHandler).Methods("GET")
+	router.HandleFunc("/dashboard/auth/callback", DashboardCallbackHandler).Methods("GET")
 
 	http.Handle("/", router)
-	err = http.ListenAndServe(":"+sbPort, CFSBMux)
+	server = &http.Server{Addr: ":" + sbPort, Handler: CFSBMux}
+	err = server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
 	log.Error(fmt.Sprintf(`cfsbapi.API() ! %s`, err))
 	return err
 }
 
+//Shutdown stops the broker API accepting requests and waits for those in
+//progress until ctx is done.
+func Shutdown(ctx context.Context) (err error) {
+	if server == nil {
+		return
+	}
+	err = server.Shutdown(ctx)
+	if err != nil {
+		log.Error(fmt.Sprintf(`cfsbapi.Shutdown() ! %s`, err))
+	}
+	return
+}
+
 func httpAuth(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, request *http.Request) {
 		if len(request.Header["Authorization"]) == 0 {
 			log.Trace(fmt.Sprintf("httpAuth(): 'Authorization' Header Required"))
-			http.Error(w, "Authorization Required", http.StatusUnauthorized)
+			writeJSONResponse(w, http.StatusUnauthorized, "Authorization Required")
 			return
 		}
 
 		auth := strings.SplitN(request.Header["Authorization"][0], " ", 2)
 		if len(auth) != 2 || auth[0] != "Basic" {
 			log.Error(fmt.Sprintf("httpAuth(): Unhandled Authorization Type, Expected Basic"))
-			http.Error(w, "Unhandled Authorization Type, Expected Basic\n", http.StatusBadRequest)
+			writeJSONResponse(w, http.StatusUnauthorized, "Unhandled Authorization Type, Expected Basic")
 			return
 		}
 		payload, err := base64.StdEncoding.DecodeString(auth[1])
 		if err != nil {
 			log.Error(fmt.Sprintf("httpAuth(): Authorization base64.StdEncoding.DecodeString() Failed"))
-			http.Error(w, "Authorization Failed\n", http.StatusUnauthorized)
+			writeJSONResponse(w, http.StatusUnauthorized, "Authorization Failed")
 			return
 		}
 		nv := strings.SplitN(string(payload), ":", 2)
 		if (len(nv) != 2) || !isAuthorized(nv[0], nv[1]) {
 			log.Error(fmt.Sprintf("httpAuth(): Authorization Failed: !isAuthorized() nv: %+v", nv))
-			http.Error(w, "Authorization Failed\n", http.StatusUnauthorized)
+			writeJSONResponse(w, http.StatusUnauthorized, "Authorization Failed")
+			return
+		}
+		h(w, request)
+	}
+}
+
+// apiVersion answers requests whose X-Broker-API-Version header is missing or
+// older than the broker serves with a 412.
+func apiVersion(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, request *http.Request) {
+		version := request.Header.Get("X-Broker-API-Version")
+		var major, minor int
+		_, err := fmt.Sscanf(version, "%d.%d", &major, &minor)
+		if err != nil || major != minAPIMajor || minor < minAPIMinor {
+			log.Error(fmt.Sprintf("apiVersion(): Unsupported X-Broker-API-Version '%s'", version))
+			writeJSONResponse(w, http.StatusPreconditionFailed, fmt.Sprintf("X-Broker-API-Version %d.%d or later %d.x is required, got '%s'", minAPIMajor, minAPIMinor, minAPIMajor, version))
 			return
 		}
 		h(w, request)
@@ -127,23 +178,26 @@ func CatalogHandler(w http.ResponseWriter, request *http.Request) {
 	return
 }
 
-// InstanceHandler handles put and delete
+// InstanceHandler handles get, put, patch and delete
+// (FI) GET /v2/service_instances/:id
 // (PI) PUT /v2/service_instances/:id
+// (UI) PATCH /v2/service_instances/:id
 // (RI) DELETE /v2/service_instances/:id
 func InstanceHandler(w http.ResponseWriter, request *http.Request) {
 	vars := mux.Vars(request)
 	log.Trace(fmt.Sprintf("%s /v2/service_instances/:instance_id :: %+v", request.Method, vars))
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
-	switch request.Method {
-	case "PUT":
-		type instanceRequest struct {
-			ServiceID      string `json:"service_id"`
-			Plan           string `json:"plan_id"`
-			OrganizationID string `json:"organization_guid"`
-			SpaceID        string `json:"space_guid"`
-		}
-		ir := instanceRequest{}
+	type instanceRequest struct {
+		ServiceID      string             `json:"service_id"`
+		Plan           string             `json:"plan_id"`
+		OrganizationID string             `json:"organization_guid"`
+		SpaceID        string             `json:"space_guid"`
+		Parameters     instanceParameters `json:"parameters"`
+	}
+	ir := instanceRequest{}
+	params := instances.DatabaseParameters{}
+	if request.Method == "PUT" || request.Method == "PATCH" {
 		body, err := ioutil.ReadAll(request.Body)
 		if err != nil {
 			log.Error(fmt.Sprintf("%s /v2/service_instances/:instance_id %s", request.Method, err))
@@ -151,11 +205,63 @@ func InstanceHandler(w http.ResponseWriter, request *http.Request) {
 			return
 		}
 		err = json.Unmarshal(body, &ir)
+		if err != nil {
+			log.Error(fmt.Sprintf("%s /v2/service_instances/:instance_id ! %s", request.Method, err))
+			writeJSONResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		err = ir.Parameters.backupSettings().Validate()
+		if err == nil {
+			params, err = ir.Parameters.databaseParameters()
+		}
+		if err != nil {
+			log.Error(fmt.Sprintf("%s /v2/service_instances/:instance_id ! %s", request.Method, err))
+			writeJSONResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	switch request.Method {
+	case "GET":
+		instance, err := instances.FindByInstanceID(vars["instance_id"])
+		if err == sql.ErrNoRows {
+			writeJSONResponse(w, http.StatusNotFound, fmt.Sprintf("Could not find instance %s", vars["instance_id"]))
+			return
+		}
 		if err != nil {
 			log.Error(fmt.Sprintf("%s /v2/service_instances/:instance_id ! %s", request.Method, err))
 			writeJSONResponse(w, http.StatusInternalServerError, err.Error())
 			return
 		}
+		o, err := instances.LastOperation(instance.InstanceID)
+		if err != nil {
+			writeJSONResponse(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if o != nil && o.State == instances.OperationInProgress {
+			switch o.Kind {
+			case instances.OperationProvision:
+				writeJSONResponse(w, http.StatusNotFound, fmt.Sprintf("Instance %s is being provisioned", instance.InstanceID))
+				return
+			case instances.OperationUpdate:
+				writeErrorResponse(w, http.StatusUnprocessableEntity, "ConcurrencyError", fmt.Sprintf("Instance %s is being updated", instance.InstanceID))
+				return
+			}
+		}
+		f, err := fetchInstance(instance)
+		if err != nil {
+			writeJSONResponse(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		j, err := json.Marshal(f)
+		if err != nil {
+			writeJSONResponse(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(j)
+		return
+	case "PUT":
 		instance, err := NewServiceInstance(
 			vars["instance_id"],
 			ir.ServiceID,
@@ -164,11 +270,71 @@ func InstanceHandler(w http.ResponseWriter, request *http.Request) {
 			ir.SpaceID,
 		)
 		if err != nil {
+			log.Error(fmt.Sprintf("%s /v2/service_instances/:instance_id ! %s", request.Method, err))
+			writeJSONResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		// Cloud Controller provisions again when unsure the first succeeded.
+		existing, err := instances.FindByInstanceID(instance.InstanceID)
+		switch err {
+		case nil:
+			if existing.ServiceID != instance.ServiceID || existing.PlanID != instance.PlanID || existing.OrganizationID != instance.OrganizationID || existing.SpaceID != instance.SpaceID {
+				writeJSONResponse(w, http.StatusConflict, fmt.Sprintf("Instance %s already exists with another service, plan, organization or space", instance.InstanceID))
+				return
+			}
+			o, err := instances.LastOperation(instance.InstanceID)
+			if err == nil && o != nil && o.Kind == instances.OperationProvision && o.State == instances.OperationInProgress {
+				writeProvisionResponse(w, http.StatusAccepted, instance, "", o)
+				return
+			}
+			writeProvisionResponse(w, http.StatusOK, instance, "", nil)
+			return
+		case sql.ErrNoRows:
+		default:
 			log.Error(fmt.Sprintf("%s /v2/service_instances/:instance_id ! %s", request.Method, err))
 			writeJSONResponse(w, http.StatusInternalServerError, err.Error())
 			return
 		}
+		// Retired plans are out of the catalog, only their instances keep them.
+		_, err = instances.PlanClusterService(instance.PlanID)
+		if err == instances.ErrPlanNotFound {
+			writeJSONResponse(w, http.StatusBadRequest, fmt.Sprintf("Could not find plan %s", instance.PlanID))
+			return
+		}
+		if err != nil {
+			writeJSONResponse(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		err = params.Validate(instance.PlanID)
+		if err != nil {
+			log.Error(fmt.Sprintf("%s /v2/service_instances/:instance_id ! %s", request.Method, err))
+			writeJSONResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if acceptsIncomplete(request) {
+			provisionAsync(w, instance, ir.Parameters.backupSettings(), params)
+			return
+		}
 		err = instance.Provision()
+		if err != nil {
+			log.Error(fmt.Sprintf("%s /v2/service_instances/:instance_id ! %s", request.Method, err))
+			switch err {
+			case instances.ErrNoDatabaseAvailable:
+				writeJSONResponse(w, http.StatusServiceUnavailable, err.Error())
+			case instances.ErrOutOfCapacity:
+				writeJSONResponse(w, http.StatusInsufficientStorage, err.Error())
+			default:
+				writeJSONResponse(w, http.StatusInternalServerError, err.Error())
+			}
+			return
+		}
+
+		// Always sent, so that the service cluster backs the database up as
+		// its plan says even without overrides.
+		err = instance.SetBackupSettings(ir.Parameters.backupSettings())
+		if err == nil {
+			err = instance.SetParameters(params)
+		}
 		if err != nil {
 			log.Error(fmt.Sprintf("%s /v2/service_instances/:instance_id ! %s", request.Method, err))
 			writeJSONResponse(w, http.StatusInternalServerError, err.Error())
@@ -176,29 +342,119 @@ func InstanceHandler(w http.ResponseWriter, request *http.Request) {
 		}
 
 		msg := fmt.Sprintf("Provisioned Instance %s", instance.InstanceID)
-		writeJSONResponse(w, http.StatusOK, msg)
+		writeProvisionResponse(w, http.StatusCreated, instance, msg, nil)
+		return
+	case "PATCH":
+		instance, err := instances.FindByInstanceID(vars["instance_id"])
+		if err != nil {
+			log.Error(fmt.Sprintf("%s /v2/service_instances/:instance_id ! %s", request.Method, err))
+			if err == sql.ErrNoRows {
+				writeJSONResponse(w, http.StatusNotFound, fmt.Sprintf("Could not find instance %s", vars["instance_id"]))
+				return
+			}
+			writeJSONResponse(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		planID := instance.PlanID
+		if ir.Plan != "" {
+			planID = strings.ToLower(ir.Plan)
+		}
+		// Checked against the plan the instance is updated to.
+		if !params.Empty() || planID != instance.PlanID {
+			err = instance.ValidateParameters(params, planID)
+		}
+		if err != nil {
+			log.Error(fmt.Sprintf("%s /v2/service_instances/:instance_id ! %s", request.Method, err))
+			writeJSONResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		_, overrides, err := instance.BackupSettings()
+		if err == nil {
+			err = instance.SetBackupSettings(overrides.Merge(ir.Parameters.backupSettings()))
+		}
+		if err != nil {
+			log.Error(fmt.Sprintf("%s /v2/service_instances/:instance_id ! %s", request.Method, err))
+			writeJSONResponse(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if planID == instance.PlanID {
+			if !params.Empty() {
+				err = instance.SetParameters(params)
+			}
+			if err != nil {
+				log.Error(fmt.Sprintf("%s /v2/service_instances/:instance_id ! %s", request.Method, err))
+				writeJSONResponse(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			writeJSONResponse(w, http.StatusOK, "Updated Instance "+instance.InstanceID)
+			return
+		}
+		clusterService, err := instances.PlanClusterService(ir.Plan)
+		if err != nil {
+			log.Error(fmt.Sprintf("%s /v2/service_instances/:instance_id ! %s", request.Method, err))
+			if err == instances.ErrPlanNotFound {
+				writeJSONResponse(w, http.StatusBadRequest, fmt.Sprintf("Could not find plan %s", ir.Plan))
+				return
+			}
+			writeJSONResponse(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		// Plans of the same cluster service differ in their settings only.
+		if clusterService == instance.ClusterService {
+			err = instance.ChangePlan(strings.ToLower(ir.Plan), instance.ClusterID, instance.ClusterService)
+			if err == nil {
+				err = instance.PushAssignment()
+			}
+			if err == nil {
+				err = instance.PushBackupSettings()
+			}
+			if err == nil {
+				err = instance.SetParameters(params)
+			}
+			if err != nil {
+				log.Error(fmt.Sprintf("%s /v2/service_instances/:instance_id ! %s", request.Method, err))
+				writeJSONResponse(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			writeJSONResponse(w, http.StatusOK, "Updated Instance "+instance.InstanceID)
+			return
+		}
+		if !acceptsIncomplete(request) {
+			writeErrorResponse(w, http.StatusUnprocessableEntity, "AsyncRequired", "Changing to this plan migrates the database and requires accepts_incomplete=true")
+			return
+		}
+		updateAsync(w, instance, ir.Plan, params)
 		return
 	case "DELETE":
 		instance, err := instances.FindByInstanceID(vars["instance_id"])
+		if err == sql.ErrNoRows {
+			// Gone already, eg. Cloud Controller retrying or mitigating an orphan.
+			writeJSONResponse(w, http.StatusGone, "")
+			return
+		}
 		if err != nil {
 			log.Error(fmt.Sprintf("%s /v2/service_instances/:instance_id ! %s", request.Method, err))
-			msg := fmt.Sprintf("Could not find instance %s, perhaps it was already deleted?", vars["instance_id"])
-			writeJSONResponse(w, http.StatusInternalServerError, msg)
+			writeJSONResponse(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		err = instance.Decommission()
+		if acceptsIncomplete(request) {
+			deprovisionAsync(w, instance)
+			return
+		}
+		err = tasks.DecommissionInstance(instance)
 		if err != nil {
 			log.Error(fmt.Sprintf("%s /v2/service_instances/:instance_id %s", request.Method, err))
 			writeJSONResponse(w, http.StatusInternalServerError, "There was an error decommissioning instance "+instance.InstanceID)
 			return
 		}
-		writeJSONResponse(w, http.StatusOK, "Successfully Deprovisioned Instance "+instance.InstanceID)
+		writeJSONResponse(w, http.StatusOK, "")
 	default:
-		writeJSONResponse(w, http.StatusMethodNotAllowed, "Allowed Methods: PUT, DELETE")
+		writeJSONResponse(w, http.StatusMethodNotAllowed, "Allowed Methods: GET, PUT, PATCH, DELETE")
 	}
 }
 
 // BindingHandler handles binding services
+// (FB) GET /v2/service_instances/:instance_id/service_bindings/:binding_id
 // (CB) PUT /v2/service_instances/:instance_id/service_bindings/:binding_id
 // (RB) DELETE /v2/service_instances/:instance_id/service_bindings/:binding_id
 
@@ -206,9 +462,13 @@ func BindingHandler(w http.ResponseWriter, request *http.Request) {
 	vars := mux.Vars(request)
 	log.Trace(fmt.Sprintf("%s /v2/service_instances/:instance_id/service_bindings/:binding_id :: %+v", request.Method, vars))
 	switch request.Method {
-	case "PUT":
+	case "GET":
 		binding := Binding{InstanceID: vars["instance_id"], BindingID: vars["binding_id"]}
-		err := binding.Create()
+		err := binding.Fetch()
+		if err == sql.ErrNoRows {
+			writeJSONResponse(w, http.StatusNotFound, fmt.Sprintf("Could not find binding %s of instance %s", vars["binding_id"], vars["instance_id"]))
+			return
+		}
 		if err != nil {
 			log.Error(fmt.Sprintf("%s /v2/service_instances/:instance_id/service_bindings/:binding_id %s", request.Method, err))
 			writeJSONResponse(w, http.StatusInternalServerError, err.Error())
@@ -216,39 +476,105 @@ func BindingHandler(w http.ResponseWriter, request *http.Request) {
 		}
 		j, err := json.Marshal(binding)
 		if err != nil {
-			log.Error(fmt.Sprintf("%s /v2/service_instances/:instance_id/service_bindings/:binding_id %s", request.Method, err))
 			writeJSONResponse(w, http.StatusInternalServerError, err.Error())
 			return
 		}
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, string(j))
+		w.Write(j)
+		return
+	case "PUT":
+		binding := Binding{InstanceID: vars["instance_id"], BindingID: vars["binding_id"]}
+		created, err := binding.Create()
+		if err != nil {
+			log.Error(fmt.Sprintf("%s /v2/service_instances/:instance_id/service_bindings/:binding_id %s", request.Method, err))
+			switch err {
+			case sql.ErrNoRows:
+				writeJSONResponse(w, http.StatusNotFound, fmt.Sprintf("Could not find instance %s", vars["instance_id"]))
+			case ErrBindingConflict:
+				writeJSONResponse(w, http.StatusConflict, err.Error())
+			case ErrUpdateInProgress:
+				writeErrorResponse(w, http.StatusUnprocessableEntity, "ConcurrencyError", err.Error())
+			default:
+				writeJSONResponse(w, http.StatusInternalServerError, err.Error())
+			}
+			return
+		}
+		j, err := json.Marshal(binding)
+		if err != nil {
+			log.Error(fmt.Sprintf("%s /v2/service_instances/:instance_id/service_bindings/:binding_id %s", request.Method, err))
+			writeJSONResponse(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		if created {
+			w.WriteHeader(http.StatusCreated)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+		w.Write(j)
 		return
 
 	case "DELETE":
 		binding := Binding{BindingID: vars["binding_id"]}
 		err := binding.Remove()
+		if err == sql.ErrNoRows {
+			// Does not exist or has already been deleted.
+			writeJSONResponse(w, http.StatusGone, "")
+			return
+		}
 		if err != nil {
 			log.Error(fmt.Sprintf("%s /v2/service_instances/:instance_id/service_bindings/:binding_id %s", request.Method, err))
-			msg := "Binding does not exist or has already been deleted."
-			writeJSONResponse(w, http.StatusInternalServerError, msg)
-			return
-		} else {
-			writeJSONResponse(w, http.StatusOK, "Binding Removed")
+			writeJSONResponse(w, http.StatusInternalServerError, err.Error())
 			return
 		}
+		writeJSONResponse(w, http.StatusOK, "")
+		return
 	default:
-		writeJSONResponse(w, http.StatusMethodNotAllowed, "Allowed Methods: PUT, DELETE")
+		writeJSONResponse(w, http.StatusMethodNotAllowed, "Allowed Methods: GET, PUT, DELETE")
 		return
 	}
 }
 
+// writeJSONResponse responds with the status and a body describing it, {} when
+// description is empty.
 func writeJSONResponse(writer http.ResponseWriter, status int, description string) {
-	resp := Response{Status: status, Description: description}
+	writeErrorResponse(writer, status, "", description)
+}
+
+// writeProvisionResponse responds to a provision with the instance's
+// dashboard URL, if it has a dashboard, and the operation when accepted.
+func writeProvisionResponse(w http.ResponseWriter, status int, instance *instances.Instance, description string, o *instances.Operation) {
+	body := map[string]string{}
+	if url := instanceDashboardURL(instance.ServiceID, instance.InstanceID); url != "" {
+		body["dashboard_url"] = url
+	}
+	if description != "" {
+		body["description"] = description
+	}
+	if o != nil {
+		body["operation"] = o.OperationID
+	}
+	msg, err := json.Marshal(body)
+	if err != nil {
+		writeJSONResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	w.Write(append(msg, '\n'))
+}
+
+// writeErrorResponse responds with the status and a body carrying the error
+// code Cloud Controller acts on along with the description.
+func writeErrorResponse(writer http.ResponseWriter, status int, code, description string) {
+	resp := Response{Error: code, Description: description}
 	msg, err := json.Marshal(resp)
 	if err != nil {
 		log.Error(err.Error())
 	}
 	log.Debug("Returning response: " + string(msg))
+	writer.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	writer.WriteHeader(status)
-	http.Error(writer, string(msg), status)
+	writer.Write(append(msg, '\n'))
 }
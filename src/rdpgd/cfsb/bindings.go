@@ -9,8 +9,17 @@ import (
 	"github.com/starkandwayne/rdpgd/instances"
 	"github.com/starkandwayne/rdpgd/log"
 	"github.com/starkandwayne/rdpgd/pg"
+	"github.com/starkandwayne/rdpgd/tasks"
 )
 
+// ErrUpdateInProgress is returned when binding an instance whose database is
+// being migrated, the binding's role would not be carried over.
+var ErrUpdateInProgress = errors.New(`the instance is being updated, try again once the update finished`)
+
+// ErrBindingConflict is returned when binding with the id of a binding of
+// another instance.
+var ErrBindingConflict = errors.New(`a binding with this id exists for another instance`)
+
 type Binding struct {
 	ID         int          `db:"id"`
 	BindingID  string       `db:"binding_id" json:"binding_id"`
@@ -18,8 +27,8 @@ type Binding struct {
 	Creds      *Credentials `json:"credentials"`
 }
 
-// Create Binding in the data store
-func (b *Binding) Create() (err error) {
+// Create Binding in the data store, created is false when it already was.
+func (b *Binding) Create() (created bool, err error) {
 	log.Trace(fmt.Sprintf(`cfsb.Binding#Create(%s,%s) ... `, b.InstanceID, b.BindingID))
 
 	instance, err := instances.FindByInstanceID(b.InstanceID)
@@ -28,42 +37,61 @@ func (b *Binding) Create() (err error) {
 		return
 	}
 
+	o, err := instances.LastOperation(instance.InstanceID)
+	if err != nil {
+		return
+	}
+	if o != nil && o.Kind == instances.OperationUpdate && o.State == instances.OperationInProgress {
+		return false, ErrUpdateInProgress
+	}
+
 	dns, err := instance.ExternalDNS()
 	if err != nil {
 		log.Error(fmt.Sprintf(`cfsb.Binding#Create(%s) instance.ExternalDNS(%s) ! %s`, b.BindingID, b.InstanceID, err))
 		return
 	}
-	// For now the crednetials are fixed, future feature is that we will be able to
-	// create new users/credentials for each binding later on. Currently only
-	// one set of credentials exists for each Instance.
-	s := strings.Split(dns, ":")
-	uri, err := instance.URI()
+
+	// Each binding gets its own role, a member of the instance's owner role, so
+	// that unbinding revokes its credentials alone. Concurrent requests for the
+	// binding wait for the first to record it, then return its credentials.
+	err = tasks.BindingLock(b.BindingID)
 	if err != nil {
-		log.Error(fmt.Sprintf(`cfsb.Binding#Create(%s) instance.URI(%s) ! %s`, b.BindingID, b.InstanceID, err))
+		log.Error(fmt.Sprintf(`cfsb.Binding#Create(%s) tasks.BindingLock() ! %s`, b.BindingID, err))
 		return
 	}
-	dsn, err := instance.DSN()
-	if err != nil {
-		log.Error(fmt.Sprintf(`cfsb.Binding#Create(%s) instance.DSN(%s) ! %s`, b.BindingID, b.InstanceID, err))
+	defer tasks.BindingUnlock(b.BindingID)
+	err = b.Find()
+	if err != nil && err != sql.ErrNoRows {
 		return
 	}
-	jdbc, err := instance.JDBCURI()
+	exists := err == nil
+	if exists && b.InstanceID != instance.InstanceID {
+		return false, ErrBindingConflict
+	}
+	user, pass := ``, ``
+	if exists { // Binding already exists, return its existing credentials.
+		c := &Credentials{BindingID: b.BindingID}
+		err = c.Find()
+		if err != nil {
+			log.Error(fmt.Sprintf(`cfsb.Binding#Create(%s) c.Find() ! %s`, b.BindingID, err))
+			return
+		}
+		user, pass = c.UserName, c.Password
+	} else {
+		r := instances.NewBindingRole(instance, b.BindingID)
+		err = instance.PushBind(r)
+		if err != nil {
+			log.Error(fmt.Sprintf(`cfsb.Binding#Create(%s) instance.PushBind(%s) ! %s`, b.BindingID, b.InstanceID, err))
+			return
+		}
+		user, pass = r.User, r.Pass
+	}
+	err = b.setCredentials(instance, dns, user, pass)
 	if err != nil {
-		log.Error(fmt.Sprintf(`cfsb.Binding#Create(%s) instance.JDBCURI(%s) ! %s`, b.BindingID, b.InstanceID, err))
 		return
 	}
-
-	b.Creds = &Credentials{
-		InstanceID: b.InstanceID,
-		BindingID:  b.BindingID,
-		URI:        uri,
-		DSN:        dsn,
-		JDBCURI:    jdbc,
-		Host:       s[0],
-		Port:       s[1],
-		UserName:   instance.User,
-		Password:   instance.Pass,
-		Database:   instance.Database,
+	if exists {
+		return false, nil
 	}
 
 	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
@@ -74,23 +102,88 @@ func (b *Binding) Create() (err error) {
 	}
 	defer db.Close()
 
+	sq := fmt.Sprintf(`INSERT INTO cfsb.bindings (instance_id,binding_id) VALUES (lower('%s'),lower('%s'));`, b.InstanceID, b.BindingID)
+	log.Trace(fmt.Sprintf(`cfsb.Binding#Create() > %s`, sq))
+	_, err = db.Exec(sq)
+	if err != nil {
+		log.Error(fmt.Sprintf(`cfsb.Binding#Create(%s) %s ! %s`, b.BindingID, sq, err))
+		return
+	}
+	err = b.Creds.Create()
+	if err != nil {
+		log.Error(fmt.Sprintf(`cfsb.Binding#Create(%s) b.Creds.Create() ! %s`, b.BindingID, err))
+		return
+	}
+	return true, nil
+}
+
+// Fetch the binding of the instance along with its credentials, sql.ErrNoRows
+// when the instance has no such binding.
+func (b *Binding) Fetch() (err error) {
+	log.Trace(fmt.Sprintf(`cfsb.Binding#Fetch(%s,%s) ... `, b.InstanceID, b.BindingID))
+
+	instanceID := strings.ToLower(b.InstanceID)
 	err = b.Find()
 	if err != nil {
-		if err == sql.ErrNoRows { // Does not yet exist, insert the binding and it's credentials.
-			sq := fmt.Sprintf(`INSERT INTO cfsb.bindings (instance_id,binding_id) VALUES (lower('%s'),lower('%s'));`, b.InstanceID, b.BindingID)
-			log.Trace(fmt.Sprintf(`cfsb.Binding#Create() > %s`, sq))
-			_, err = db.Exec(sq)
-			if err != nil {
-				log.Error(fmt.Sprintf(`cfsb.Binding#Create(%s) %s ! %s`, b.BindingID, sq, err))
-			}
-			err := b.Creds.Create()
-			if err != nil {
-				log.Error(fmt.Sprintf(`cfsb.Binding#Create(%s) b.Creds.Create() ! %s`, b.BindingID, err))
-			}
-		}
-	} else { // Binding already exists, return existing binding and credentials.
 		return
 	}
+	if b.InstanceID != instanceID {
+		return sql.ErrNoRows
+	}
+	instance, err := instances.FindByInstanceID(b.InstanceID)
+	if err != nil {
+		log.Error(fmt.Sprintf(`cfsb.Binding#Fetch(%s) instances.FindByInstanceID(%s) ! %s`, b.BindingID, b.InstanceID, err))
+		return
+	}
+	dns, err := instance.ExternalDNS()
+	if err != nil {
+		log.Error(fmt.Sprintf(`cfsb.Binding#Fetch(%s) instance.ExternalDNS(%s) ! %s`, b.BindingID, b.InstanceID, err))
+		return
+	}
+	c := &Credentials{BindingID: b.BindingID}
+	err = c.Find()
+	if err != nil {
+		log.Error(fmt.Sprintf(`cfsb.Binding#Fetch(%s) c.Find() ! %s`, b.BindingID, err))
+		return
+	}
+	return b.setCredentials(instance, dns, c.UserName, c.Password)
+}
+
+// setCredentials sets the credentials of the binding to connect as the given
+// role to the instance's database, reached at its external dns.
+func (b *Binding) setCredentials(instance *instances.Instance, dns, user, pass string) (err error) {
+	bound := *instance
+	bound.User, bound.Pass = user, pass
+
+	s := strings.Split(dns, ":")
+	uri, err := bound.URI()
+	if err != nil {
+		log.Error(fmt.Sprintf(`cfsb.Binding#setCredentials(%s) instance.URI(%s) ! %s`, b.BindingID, b.InstanceID, err))
+		return
+	}
+	dsn, err := bound.DSN()
+	if err != nil {
+		log.Error(fmt.Sprintf(`cfsb.Binding#setCredentials(%s) instance.DSN(%s) ! %s`, b.BindingID, b.InstanceID, err))
+		return
+	}
+	jdbc, err := bound.JDBCURI()
+	if err != nil {
+		log.Error(fmt.Sprintf(`cfsb.Binding#setCredentials(%s) instance.JDBCURI(%s) ! %s`, b.BindingID, b.InstanceID, err))
+		return
+	}
+
+	b.Creds = &Credentials{
+		InstanceID: b.InstanceID,
+		BindingID:  b.BindingID,
+		URI:        uri,
+		DSN:        dsn,
+		JDBCURI:    jdbc,
+		Host:       s[0],
+		Port:       s[1],
+		UserName:   bound.User,
+		Password:   bound.Pass,
+		Database:   bound.Database,
+	}
 	return
 }
 
@@ -108,7 +201,7 @@ func (b *Binding) Find() (err error) {
 	}
 	defer db.Close()
 
-	sq := fmt.Sprintf(`SELECT id,instance_id FROM cfsb.bindings WHERE binding_id=lower('%s') LIMIT 1`, b.BindingID)
+	sq := fmt.Sprintf(`SELECT id,instance_id FROM cfsb.bindings WHERE binding_id=lower('%s') AND ineffective_at IS NULL LIMIT 1`, b.BindingID)
 	log.Trace(fmt.Sprintf(`cfsb.Binding#Find(%s) > %s`, b.BindingID, sq))
 	err = db.Get(b, sq)
 	if err != nil {
@@ -117,8 +210,6 @@ func (b *Binding) Find() (err error) {
 		} else {
 			log.Error(fmt.Sprintf("cfsb.Binding#Find(%s) ! %s", b.BindingID, err))
 		}
-	} else {
-		// TODO: Load creds: b.Creds := Credentials{} ... b.Creds.Find()
 	}
 	return
 }
@@ -130,6 +221,37 @@ func (b *Binding) Remove() (err error) {
 		log.Error(fmt.Sprintf(`cfsb.Binding#Remove(%s) ! %s`, b.BindingID, err))
 		return
 	}
+	b.Creds = &Credentials{
+		InstanceID: b.InstanceID,
+		BindingID:  b.BindingID,
+	}
+	err = b.Creds.Find()
+	if err != nil {
+		log.Error(fmt.Sprintf(`cfsb.Binding#Remove(%s) b.Creds.Find() ! %s`, b.BindingID, err))
+		return
+	}
+	instance, err := instances.FindByInstanceID(b.InstanceID)
+	if err != nil {
+		log.Error(fmt.Sprintf(`cfsb.Binding#Remove(%s) instances.FindByInstanceID(%s) ! %s`, b.BindingID, b.InstanceID, err))
+		return
+	}
+	// Bindings made before each had its own role share the instance's owner
+	// role, which stays until the instance is deprovisioned.
+	if b.Creds.UserName != `` && b.Creds.UserName != instance.User {
+		r := &instances.BindingRole{
+			InstanceID: b.InstanceID,
+			BindingID:  b.BindingID,
+			Database:   instance.Database,
+			Owner:      instance.User,
+			User:       b.Creds.UserName,
+		}
+		err = instance.PushUnbind(r)
+		if err != nil {
+			log.Error(fmt.Sprintf(`cfsb.Binding#Remove(%s) instance.PushUnbind(%s) ! %s`, b.BindingID, b.InstanceID, err))
+			return
+		}
+	}
+
 	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
 	db, err := p.Connect()
 	if err != nil {
@@ -138,8 +260,6 @@ func (b *Binding) Remove() (err error) {
 	}
 	defer db.Close()
 
-	// TODO: Scheduled background task that does any cleanup necessary for an
-	// unbinding (remove credentials?)
 	sq := fmt.Sprintf(`UPDATE cfsb.bindings SET ineffective_at=CURRENT_TIMESTAMP WHERE binding_id=lower('%s')`, b.BindingID)
 	log.Trace(fmt.Sprintf(`cfsb.Binding#Remove(%s) SQL > %s`, b.BindingID, sq))
 	_, err = db.Exec(sq)
@@ -147,11 +267,6 @@ func (b *Binding) Remove() (err error) {
 		log.Error(fmt.Sprintf(`cfsb.Binding#Remove(%s) ! %s`, b.BindingID, err))
 	}
 
-	b.Creds = &Credentials{
-		InstanceID: b.InstanceID,
-		BindingID:  b.BindingID,
-	}
-
 	err = b.Creds.Remove()
 	if err != nil {
 		log.Error(fmt.Sprintf(`cfsb.Binding#Remove(%s) b.Creds.Remove() ! %s`, b.BindingID, err))
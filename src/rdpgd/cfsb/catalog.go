@@ -21,26 +21,33 @@ func (c *Catalog) Fetch() (err error) {
 	}
 	defer db.Close()
 
-	sq := `SELECT service_id,name,description,bindable FROM cfsb.services;`
+	services := []Service{}
+	sq := fmt.Sprintf(`SELECT %s FROM cfsb.services WHERE ineffective_at IS NULL ORDER BY name`, serviceColumns)
 	log.Trace(fmt.Sprintf(`cfsb.Catalog#Fetch() > %s`, sq))
-	err = db.Select(&c.Services, sq)
+	err = db.Select(&services, sq)
 	if err != nil {
 		log.Error(fmt.Sprintf("cfsb.Catalog#Fetch() db.Select() ! %s", err.Error()))
 		return
 	}
 
-	// TODO: Account for plans being associated with a service.
-	for i, _ := range c.Services {
-		service := &c.Services[i]
-		sq := fmt.Sprintf(`SELECT plan_id,name,description FROM cfsb.plans WHERE service_id = '%s' ORDER BY name;`, service.ServiceID)
+	// Retired plans are left out, their instances keep them.
+	c.Services = []Service{}
+	for _, service := range services {
+		sq := `SELECT plan_id, COALESCE(name,'') AS name, COALESCE(description,'') AS description, COALESCE(free,true) AS free, metadata FROM cfsb.plans WHERE service_id=$1 AND ineffective_at IS NULL ORDER BY name`
 		log.Trace(fmt.Sprintf(`cfsb.Catalog#Fetch() > %s`, sq))
-		err = db.Select(&service.Plans, sq)
+		err = db.Select(&service.Plans, sq, service.ServiceID)
 		if err != nil {
 			log.Error(fmt.Sprintf("cfsb.Catalog#Fetch() db.Select() ! %s", err.Error()))
 			return
 		}
-		c.Services[i].Tags = []string{"rdpg", "postgresql"}
-		// c.Services[i].Dashboard = DashboardClient{}
+		// Cloud Controller refuses services without plans.
+		if len(service.Plans) == 0 {
+			continue
+		}
+		service.DashboardClient = service.dashboardClient()
+		service.InstancesRetrievable = true
+		service.BindingsRetrievable = true
+		c.Services = append(c.Services, service)
 	}
 	return
 }
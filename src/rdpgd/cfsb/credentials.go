@@ -68,7 +68,7 @@ func (c *Credentials) Find() (err error) {
 	}
 	defer db.Close()
 
-	sq := fmt.Sprintf(`SELECT id,instance_id,binding_id FROM cfsb.credentials WHERE binding_id=lower('%s') LIMIT 1`, c.BindingID)
+	sq := fmt.Sprintf(`SELECT id,instance_id,binding_id,COALESCE(host,'') AS host,COALESCE(port,'') AS port,COALESCE(dbuser,'') AS dbuser,COALESCE(dbpass,'') AS dbpass,COALESCE(dbname,'') AS dbname FROM cfsb.credentials WHERE binding_id=lower('%s') AND ineffective_at IS NULL LIMIT 1`, c.BindingID)
 	log.Trace(fmt.Sprintf(`cfsb.Credentials#Find(%s) SQL > %s`, c.BindingID, sq))
 	err = db.Get(c, sq)
 	if err != nil {
@@ -0,0 +1,341 @@
+package cfsb
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/starkandwayne/rdpgd/instances"
+	"github.com/starkandwayne/rdpgd/log"
+)
+
+var (
+	// dashboardURL is the public URL the broker's dashboard is reached at,
+	// empty when it serves none.
+	dashboardURL string
+	cf           CF
+)
+
+// How long tenants have to sign in, and stay signed in to a dashboard.
+const (
+	dashboardStateTTL   = 10 * time.Minute
+	dashboardSessionTTL = time.Hour
+)
+
+const dashboardCookie = `rdpg_dashboard`
+
+var dashboardHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+func init() {
+	dashboardURL = strings.TrimRight(os.Getenv(`RDPGD_DASHBOARD_URL`), `/`)
+	cf = CF{
+		CCTarget:  strings.TrimRight(os.Getenv(`RDPGD_CC_URL`), `/`),
+		UAATarget: strings.TrimRight(os.Getenv(`RDPGD_UAA_URL`), `/`),
+	}
+}
+
+// dashboardClient returns the service's dashboard client, nil when it has
+// none or the broker serves no dashboard. Cloud Controller requires its
+// redirect URI, the dashboard's callback unless set otherwise.
+func (s *Service) dashboardClient() *DashboardClient {
+	if dashboardURL == `` || s.DashboardClient == nil || s.DashboardClient.ClientID == `` {
+		return nil
+	}
+	c := *s.DashboardClient
+	if c.RedirectURI == `` {
+		c.RedirectURI = dashboardCallbackURL()
+	}
+	return &c
+}
+
+func dashboardCallbackURL() string {
+	return dashboardURL + `/dashboard/auth/callback`
+}
+
+// instanceDashboardURL returns the URL of the instance's dashboard, empty
+// when its service has none.
+func instanceDashboardURL(serviceID, instanceID string) string {
+	if dashboardURL == `` {
+		return ``
+	}
+	s, err := FindService(serviceID)
+	if err != nil || s.dashboardClient() == nil {
+		return ``
+	}
+	return dashboardURL + `/dashboard/instances/` + instanceID
+}
+
+// findDashboard returns the instance and its service's dashboard client,
+// sql.ErrNoRows when either is missing.
+func findDashboard(instanceID string) (i *instances.Instance, c *DashboardClient, err error) {
+	i, err = instances.FindByInstanceID(instanceID)
+	if err != nil {
+		return
+	}
+	s, err := FindService(i.ServiceID)
+	if err != nil {
+		return
+	}
+	c = s.dashboardClient()
+	if c == nil {
+		err = sql.ErrNoRows
+	}
+	return
+}
+
+// DashboardHandler shows tenants the usage of their instance, sending them to
+// sign in with UAA first.
+// GET /dashboard/instances/:instance_id
+func DashboardHandler(w http.ResponseWriter, request *http.Request) {
+	instanceID := mux.Vars(request)["instance_id"]
+	log.Trace(fmt.Sprintf("%s /dashboard/instances/%s", request.Method, instanceID))
+	i, client, err := findDashboard(instanceID)
+	if err == sql.ErrNoRows {
+		http.Error(w, fmt.Sprintf("Could not find a dashboard for instance %s", instanceID), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error(fmt.Sprintf("%s /dashboard/instances/%s ! %s", request.Method, instanceID, err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	cookie, err := request.Cookie(dashboardCookie)
+	if err != nil || !client.verify(cookie.Value, `session`, instanceID) {
+		q := url.Values{}
+		q.Set(`response_type`, `code`)
+		q.Set(`client_id`, client.ClientID)
+		q.Set(`redirect_uri`, dashboardCallbackURL())
+		q.Set(`scope`, `openid cloud_controller_service_permissions.read`)
+		q.Set(`state`, client.sign(`state`, instanceID, dashboardStateTTL))
+		http.Redirect(w, request, cf.UAATarget+`/oauth/authorize?`+q.Encode(), http.StatusFound)
+		return
+	}
+
+	usage, err := i.Usage()
+	if err != nil {
+		log.Error(fmt.Sprintf("%s /dashboard/instances/%s ! %s", request.Method, instanceID, err))
+		http.Error(w, fmt.Sprintf("Could not get the usage of instance %s", instanceID), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	err = dashboardTemplate.Execute(w, struct {
+		InstanceID string
+		Usage      instances.Usage
+	}{instanceID, usage})
+	if err != nil {
+		log.Error(fmt.Sprintf("%s /dashboard/instances/%s ! %s", request.Method, instanceID, err))
+	}
+}
+
+// DashboardCallbackHandler signs in tenants UAA sends back, given they may
+// see the instance in Cloud Controller, and sends them on to its dashboard.
+// GET /dashboard/auth/callback
+func DashboardCallbackHandler(w http.ResponseWriter, request *http.Request) {
+	log.Trace(fmt.Sprintf("%s /dashboard/auth/callback", request.Method))
+	q := request.URL.Query()
+	if q.Get(`error`) != `` {
+		http.Error(w, fmt.Sprintf("Sign in failed: %s", q.Get(`error`)), http.StatusForbidden)
+		return
+	}
+	// The state is checked against the client of the instance it names.
+	state := q.Get(`state`)
+	fields := strings.SplitN(state, `|`, 3)
+	if len(fields) != 3 {
+		http.Error(w, "Invalid state", http.StatusBadRequest)
+		return
+	}
+	instanceID := fields[1]
+	_, client, err := findDashboard(instanceID)
+	if err == sql.ErrNoRows {
+		http.Error(w, fmt.Sprintf("Could not find a dashboard for instance %s", instanceID), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error(fmt.Sprintf("%s /dashboard/auth/callback ! %s", request.Method, err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !client.verify(state, `state`, instanceID) {
+		http.Error(w, "Invalid state", http.StatusBadRequest)
+		return
+	}
+
+	token, err := client.accessToken(q.Get(`code`))
+	if err != nil {
+		http.Error(w, "Sign in failed", http.StatusForbidden)
+		return
+	}
+	allowed, err := instancePermitted(token, instanceID)
+	if err != nil {
+		http.Error(w, "Could not check the permissions of the instance", http.StatusBadGateway)
+		return
+	}
+	if !allowed {
+		http.Error(w, fmt.Sprintf("Not permitted to see instance %s", instanceID), http.StatusForbidden)
+		return
+	}
+
+	path := `/dashboard/instances/` + instanceID
+	http.SetCookie(w, &http.Cookie{
+		Name:     dashboardCookie,
+		Value:    client.sign(`session`, instanceID, dashboardSessionTTL),
+		Path:     path,
+		MaxAge:   int(dashboardSessionTTL.Seconds()),
+		Secure:   strings.HasPrefix(dashboardURL, `https://`),
+		HttpOnly: true,
+	})
+	http.Redirect(w, request, dashboardURL+path, http.StatusFound)
+}
+
+// sign returns a token of the kind for the instance, valid for ttl and signed
+// with the client's secret. State and session tokens are not interchangeable.
+func (c *DashboardClient) sign(kind, instanceID string, ttl time.Duration) string {
+	payload := fmt.Sprintf(`%s|%s|%d`, kind, instanceID, time.Now().Add(ttl).Unix())
+	return payload + `|` + c.signature(payload)
+}
+
+// verify checks the token is an unexpired one of the kind for the instance,
+// signed with the client's secret.
+func (c *DashboardClient) verify(token, kind, instanceID string) bool {
+	i := strings.LastIndex(token, `|`)
+	if i < 0 || !hmac.Equal([]byte(token[i+1:]), []byte(c.signature(token[:i]))) {
+		return false
+	}
+	fields := strings.Split(token[:i], `|`)
+	if len(fields) != 3 || fields[0] != kind || fields[1] != instanceID {
+		return false
+	}
+	expires, err := strconv.ParseInt(fields[2], 10, 64)
+	return err == nil && time.Now().Unix() < expires
+}
+
+func (c *DashboardClient) signature(payload string) string {
+	mac := hmac.New(sha256.New, []byte(c.ClientSecret))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// accessToken exchanges the authorization code UAA gave the tenant for their
+// access token.
+func (c *DashboardClient) accessToken(code string) (token string, err error) {
+	form := url.Values{}
+	form.Set(`grant_type`, `authorization_code`)
+	form.Set(`code`, code)
+	form.Set(`redirect_uri`, dashboardCallbackURL())
+	req, err := http.NewRequest(`POST`, cf.UAATarget+`/oauth/token`, strings.NewReader(form.Encode()))
+	if err != nil {
+		return
+	}
+	req.SetBasicAuth(c.ClientID, c.ClientSecret)
+	req.Header.Set(`Content-Type`, `application/x-www-form-urlencoded`)
+	req.Header.Set(`Accept`, `application/json`)
+	resp, err := dashboardHTTPClient.Do(req)
+	if err != nil {
+		log.Error(fmt.Sprintf("cfsb.DashboardClient#accessToken() ! %s", err))
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf(`POST %s/oauth/token returned %s`, cf.UAATarget, resp.Status)
+		log.Error(fmt.Sprintf("cfsb.DashboardClient#accessToken() ! %s", err))
+		return
+	}
+	body := struct {
+		AccessToken string `json:"access_token"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		log.Error(fmt.Sprintf("cfsb.DashboardClient#accessToken() ! %s", err))
+		return
+	}
+	return body.AccessToken, nil
+}
+
+// instancePermitted asks Cloud Controller whether the owner of the access
+// token may manage or read the instance.
+func instancePermitted(token, instanceID string) (allowed bool, err error) {
+	req, err := http.NewRequest(`GET`, fmt.Sprintf(`%s/v2/service_instances/%s/permissions`, cf.CCTarget, url.PathEscape(instanceID)), nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set(`Authorization`, `bearer `+token)
+	resp, err := dashboardHTTPClient.Do(req)
+	if err != nil {
+		log.Error(fmt.Sprintf("cfsb.instancePermitted(%s) ! %s", instanceID, err))
+		return
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusForbidden, http.StatusNotFound:
+		return false, nil
+	default:
+		err = fmt.Errorf(`GET %s/v2/service_instances/%s/permissions returned %s`, cf.CCTarget, instanceID, resp.Status)
+		log.Error(fmt.Sprintf("cfsb.instancePermitted(%s) ! %s", instanceID, err))
+		return
+	}
+	permissions := struct {
+		Manage bool `json:"manage"`
+		Read   bool `json:"read"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&permissions)
+	if err != nil {
+		log.Error(fmt.Sprintf("cfsb.instancePermitted(%s) ! %s", instanceID, err))
+		return
+	}
+	return permissions.Manage || permissions.Read, nil
+}
+
+var dashboardTemplate = template.Must(template.New(`dashboard`).Funcs(template.FuncMap{
+	`mb`: func(bytes int64) string { return fmt.Sprintf(`%.1f MB`, float64(bytes)/(1024*1024)) },
+	`at`: func(t time.Time) string { return t.UTC().Format(`2006-01-02 15:04:05 UTC`) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>PostgreSQL {{.InstanceID}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: left; }
+.warning { color: #b00; }
+</style>
+</head>
+<body>
+<h1>PostgreSQL {{.InstanceID}}</h1>
+{{with .Usage}}
+<table>
+<tr><th>Size</th><td>{{mb .SizeBytes}}{{if gt .MaxStorageMB 0}} of {{.MaxStorageMB}} MB{{end}}</td></tr>
+<tr><th>Connections</th><td>{{.Connections}}{{if gt .MaxConnections 0}} of {{.MaxConnections}}{{end}}</td></tr>
+</table>
+{{if .OverQuota}}<p class="warning">The database is over its storage quota, new sessions default to read only.</p>{{end}}
+<h2>Backups</h2>
+{{if .Backups}}
+<table>
+<tr><th>File</th><th>Status</th><th>Taken</th><th>Duration (s)</th></tr>
+{{range .Backups}}<tr><td>{{.FileName}}</td><td>{{.Status}}</td><td>{{at .CreatedAt}}</td><td>{{.Duration}}</td></tr>
+{{end}}</table>
+{{else}}<p>No backups yet.</p>{{end}}
+<h2>Restores</h2>
+{{if .Restores}}
+<table>
+<tr><th>File</th><th>Status</th><th>At</th><th>Duration (s)</th></tr>
+{{range .Restores}}<tr><td>{{.FileName}}</td><td>{{.Status}}</td><td>{{at .CreatedAt}}</td><td>{{.Duration}}</td></tr>
+{{end}}</table>
+{{else}}<p>No restores.</p>{{end}}
+{{end}}
+</body>
+</html>
+`))
@@ -1,9 +1,11 @@
 package cfsb
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/starkandwayne/rdpgd/instances"
@@ -11,6 +13,117 @@ import (
 	"github.com/starkandwayne/rdpgd/pg"
 )
 
+// instanceParameters are the parameters tenants may give when creating or
+// updating a service instance, eg. cf create-service -c '{"backup_mode":"custom"}'.
+type instanceParameters struct {
+	BackupFrequency string                 `json:"backup_frequency"`
+	BackupWindow    string                 `json:"backup_window"`
+	BackupMode      string                 `json:"backup_mode"`
+	Extensions      []string               `json:"extensions"`
+	Settings        map[string]interface{} `json:"settings"`
+	PoolMode        string                 `json:"pool_mode"`
+	// unknown are the names of the parameters given that are not any of the
+	// above.
+	unknown []string
+}
+
+// UnmarshalJSON decodes the parameters, noting those it does not know so that
+// they are rejected rather than ignored.
+func (p *instanceParameters) UnmarshalJSON(data []byte) (err error) {
+	type parameters instanceParameters
+	if err = json.Unmarshal(data, (*parameters)(p)); err != nil {
+		return
+	}
+	given := map[string]json.RawMessage{}
+	if err = json.Unmarshal(data, &given); err != nil {
+		return
+	}
+	for name := range given {
+		switch name {
+		case `backup_frequency`, `backup_window`, `backup_mode`, `extensions`, `settings`, `pool_mode`:
+		default:
+			p.unknown = append(p.unknown, name)
+		}
+	}
+	sort.Strings(p.unknown)
+	return
+}
+
+// backupSettings returns the backup settings the parameters override.
+func (p instanceParameters) backupSettings() instances.BackupSettings {
+	return instances.BackupSettings{Frequency: p.BackupFrequency, Window: p.BackupWindow, Mode: p.BackupMode}
+}
+
+// databaseParameters returns the database parameters given, the values of
+// settings may be given as JSON strings, numbers or booleans.
+func (p instanceParameters) databaseParameters() (params instances.DatabaseParameters, err error) {
+	if len(p.unknown) > 0 {
+		return params, fmt.Errorf(`unknown parameters: %s`, strings.Join(p.unknown, `, `))
+	}
+	params.Extensions = p.Extensions
+	params.PoolMode = p.PoolMode
+	if len(p.Settings) > 0 {
+		params.Settings = map[string]string{}
+	}
+	for name, value := range p.Settings {
+		switch v := value.(type) {
+		case string:
+			params.Settings[strings.ToLower(name)] = v
+		case float64, bool:
+			params.Settings[strings.ToLower(name)] = fmt.Sprint(v)
+		case nil:
+			// Removes the setting, see instances.DatabaseParameters#Merge().
+			params.Settings[strings.ToLower(name)] = ``
+		default:
+			return params, fmt.Errorf(`setting '%s' must be a string, number or boolean`, name)
+		}
+	}
+	return
+}
+
+// fetchedInstance is the instance as GET /v2/service_instances/:instance_id
+// returns it, with the parameters it was created or last updated with.
+type fetchedInstance struct {
+	ServiceID    string                 `json:"service_id"`
+	PlanID       string                 `json:"plan_id"`
+	DashboardURL string                 `json:"dashboard_url,omitempty"`
+	Parameters   map[string]interface{} `json:"parameters"`
+}
+
+// fetchInstance returns the instance with its backup overrides and database
+// parameters, in the shape they are given to the broker.
+func fetchInstance(i *instances.Instance) (f fetchedInstance, err error) {
+	f = fetchedInstance{ServiceID: i.ServiceID, PlanID: i.PlanID, DashboardURL: instanceDashboardURL(i.ServiceID, i.InstanceID), Parameters: map[string]interface{}{}}
+	_, overrides, err := i.BackupSettings()
+	if err != nil {
+		log.Error(fmt.Sprintf("cfsb.fetchInstance(%s) i.BackupSettings() ! %s", i.InstanceID, err))
+		return
+	}
+	params, err := i.Parameters()
+	if err != nil {
+		log.Error(fmt.Sprintf("cfsb.fetchInstance(%s) i.Parameters() ! %s", i.InstanceID, err))
+		return
+	}
+	given := map[string]string{
+		`backup_frequency`: overrides.Frequency,
+		`backup_window`:    overrides.Window,
+		`backup_mode`:      overrides.Mode,
+		`pool_mode`:        params.PoolMode,
+	}
+	for name, value := range given {
+		if value != `` {
+			f.Parameters[name] = value
+		}
+	}
+	if len(params.Extensions) > 0 {
+		f.Parameters[`extensions`] = params.Extensions
+	}
+	if len(params.Settings) > 0 {
+		f.Parameters[`settings`] = params.Settings
+	}
+	return
+}
+
 func NewServiceInstance(instanceID, serviceID, planID, organizationID, spaceID string) (i *instances.Instance, err error) {
 	re := regexp.MustCompile("[^A-Za-z0-9_]")
 	id := instanceID
@@ -0,0 +1,152 @@
+package cfsb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/starkandwayne/rdpgd/instances"
+	"github.com/starkandwayne/rdpgd/log"
+	"github.com/starkandwayne/rdpgd/tasks"
+)
+
+// acceptsIncomplete reports whether Cloud Foundry accepts the request being
+// worked asynchronously, polling last_operation for its outcome.
+func acceptsIncomplete(request *http.Request) bool {
+	return request.URL.Query().Get("accepts_incomplete") == "true"
+}
+
+// provisionAsync records a provision operation for the instance and enqueues
+// its work, responding 202 with the operation. A provision already in progress
+// for the instance is responded with instead.
+func provisionAsync(w http.ResponseWriter, instance *instances.Instance, backup instances.BackupSettings, params instances.DatabaseParameters) {
+	o, err := instances.LastOperation(instance.InstanceID)
+	if err != nil {
+		writeJSONResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if o != nil && o.Kind == instances.OperationProvision && o.State == instances.OperationInProgress {
+		writeProvisionResponse(w, http.StatusAccepted, instance, "", o)
+		return
+	}
+	o, err = instances.NewOperation(instance.InstanceID, instances.OperationProvision, instances.ProvisionRequest{Instance: *instance, Backup: backup, Parameters: params})
+	if err != nil {
+		writeJSONResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = tasks.EnqueueProvision(o)
+	if err != nil {
+		o.Finish(instances.OperationFailed, err.Error())
+		writeJSONResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Trace(fmt.Sprintf("cfsb.provisionAsync(%s) Operation %s in progress", instance.InstanceID, o.OperationID))
+	writeProvisionResponse(w, http.StatusAccepted, instance, "", o)
+}
+
+// deprovisionAsync records a deprovision operation for the instance and
+// decommissions it, responding 202 with the operation. The operation succeeds
+// once the service cluster reports the database decommissioned. A deprovision
+// already in progress for the instance is responded with instead.
+func deprovisionAsync(w http.ResponseWriter, instance *instances.Instance) {
+	o, err := instances.LastOperation(instance.InstanceID)
+	if err != nil {
+		writeJSONResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if o != nil && o.Kind == instances.OperationDeprovision && o.State == instances.OperationInProgress {
+		writeOperationResponse(w, http.StatusAccepted, o)
+		return
+	}
+	o, err = instances.NewOperation(instance.InstanceID, instances.OperationDeprovision, struct{}{})
+	if err != nil {
+		writeJSONResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = tasks.DecommissionInstance(instance)
+	if err != nil {
+		log.Error(fmt.Sprintf("cfsb.deprovisionAsync(%s) ! %s", instance.InstanceID, err))
+		o.Finish(instances.OperationFailed, err.Error())
+		writeJSONResponse(w, http.StatusInternalServerError, "There was an error decommissioning instance "+instance.InstanceID)
+		return
+	}
+	writeOperationResponse(w, http.StatusAccepted, o)
+}
+
+// updateAsync records an update operation moving the instance to the plan with
+// the parameters and enqueues the migration of its database, responding 202 with the operation.
+// An update already in progress for the instance is responded with instead.
+func updateAsync(w http.ResponseWriter, instance *instances.Instance, planID string, params instances.DatabaseParameters) {
+	o, err := instances.LastOperation(instance.InstanceID)
+	if err != nil {
+		writeJSONResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if o != nil && o.Kind == instances.OperationUpdate && o.State == instances.OperationInProgress {
+		writeOperationResponse(w, http.StatusAccepted, o)
+		return
+	}
+	o, err = instances.NewOperation(instance.InstanceID, instances.OperationUpdate, instances.UpdateRequest{PlanID: strings.ToLower(planID), Parameters: params})
+	if err != nil {
+		writeJSONResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = tasks.EnqueueMigration(o)
+	if err != nil {
+		o.Finish(instances.OperationFailed, err.Error())
+		writeJSONResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Trace(fmt.Sprintf("cfsb.updateAsync(%s) Operation %s in progress", instance.InstanceID, o.OperationID))
+	writeOperationResponse(w, http.StatusAccepted, o)
+}
+
+// LastOperationHandler reports the state of an asynchronous operation, the one
+// given by the operation query parameter or else the instance's latest.
+// (LO) GET /v2/service_instances/:instance_id/last_operation
+func LastOperationHandler(w http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	log.Trace(fmt.Sprintf("%s /v2/service_instances/:instance_id/last_operation :: %+v", request.Method, vars))
+	if request.Method != "GET" {
+		writeJSONResponse(w, http.StatusMethodNotAllowed, "Allowed Methods: GET")
+		return
+	}
+	var o *instances.Operation
+	var err error
+	if id := request.URL.Query().Get("operation"); id != "" {
+		o, err = instances.FindOperation(id)
+	} else {
+		o, err = instances.LastOperation(vars["instance_id"])
+	}
+	if err != nil {
+		writeJSONResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if o == nil || o.InstanceID != strings.ToLower(vars["instance_id"]) {
+		// Cloud Foundry takes 410 Gone as a finished deprovision.
+		writeJSONResponse(w, http.StatusGone, fmt.Sprintf("No operation found for instance %s", vars["instance_id"]))
+		return
+	}
+	writeOperationResponse(w, http.StatusOK, o)
+}
+
+// writeOperationResponse writes the operation as the broker API expects, its
+// id when it is accepted and its state when it is polled.
+func writeOperationResponse(w http.ResponseWriter, status int, o *instances.Operation) {
+	var body interface{}
+	if status == http.StatusAccepted {
+		body = map[string]string{"operation": o.OperationID}
+	} else {
+		body = map[string]string{"state": o.State, "description": o.Description}
+	}
+	msg, err := json.Marshal(body)
+	if err != nil {
+		writeJSONResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	w.Write(msg)
+}
@@ -1,41 +1,279 @@
 package cfsb
 
 import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 
+	"github.com/jmoiron/sqlx"
+	"github.com/starkandwayne/rdpgd/instances"
 	"github.com/starkandwayne/rdpgd/log"
 	"github.com/starkandwayne/rdpgd/pg"
 )
 
+// ErrPlanNameTaken is returned when saving a plan under the name of another
+// plan of its service.
+var ErrPlanNameTaken = errors.New(`the service already has a plan with this name`)
+
+// clusterServices are those plans may provision databases on.
+var clusterServices = []string{`postgresql`, `pgbdr`}
+
 type PlanDetails struct {
 	Cost        string              `json:"cost"`
 	Bullets     []map[string]string `json:"bullets"`
 	DisplayName string              `json:"displayname"`
 }
 
+// Scan reads the details from their JSON column.
+func (d *PlanDetails) Scan(src interface{}) error {
+	return scanJSON(src, d)
+}
+
+// Value stores the details in their JSON column.
+func (d PlanDetails) Value() (driver.Value, error) {
+	return valueJSON(d)
+}
+
 type Plan struct {
 	PlanID      string      `db:"plan_id" json:"id"`
 	Name        string      `db:"name" json:"name"`
 	Description string      `db:"description" json:"description"`
-	Metadata    PlanDetails `json:"metadata"`
+	Free        bool        `db:"free" json:"free"`
+	Metadata    PlanDetails `db:"metadata" json:"metadata"`
 	MgmtDbUri   string      `json:""`
 }
 
-func FindPlan(planID string) (plan *Plan, err error) {
+/*
+PlanConfig struct is used to represent a plan as it is administered: its
+catalog entry along with the cluster service its databases are provisioned
+on, the backup settings and parameters it allows its instances and its quotas.
+A quota of 0 is unlimited, the storage quota is advisory, see
+tasks.EnforceQuotas. Retired plans are left out of the catalog, their existing
+instances are unaffected.
+*/
+type PlanConfig struct {
+	Plan
+	ServiceID         string `db:"service_id" json:"service_id"`
+	ClusterService    string `db:"cluster_service" json:"cluster_service"`
+	BackupFrequency   string `db:"backup_frequency" json:"backup_frequency"`
+	BackupWindow      string `db:"backup_window" json:"backup_window"`
+	BackupMode        string `db:"backup_mode" json:"backup_mode"`
+	AllowedExtensions string `db:"allowed_extensions" json:"allowed_extensions"`
+	AllowedSettings   string `db:"allowed_settings" json:"allowed_settings"`
+	AllowedPoolModes  string `db:"allowed_pool_modes" json:"allowed_pool_modes"`
+	MaxStorageMB      int64  `db:"max_storage_mb" json:"max_storage_mb"`
+	MaxConnections    int    `db:"max_connections" json:"max_connections"`
+	Retired           bool   `db:"retired" json:"retired"`
+}
+
+const planConfigColumns = `plan_id, service_id, cluster_service, COALESCE(name,'') AS name, COALESCE(description,'') AS description, COALESCE(free,true) AS free, metadata, backup_frequency::text AS backup_frequency, backup_window, backup_mode, allowed_extensions, allowed_settings, allowed_pool_modes, max_storage_mb, max_connections, ineffective_at IS NOT NULL AS retired`
+
+// FindPlan returns the plan, retired or not.
+func FindPlan(planID string) (plan *PlanConfig, err error) {
 	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
 	db, err := p.Connect()
 	if err != nil {
-		log.Error(fmt.Sprintf("cfsb#FindPlan(%s) ! %s", planID, err))
+		log.Error(fmt.Sprintf("cfsb.FindPlan(%s) ! %s", planID, err))
 		return
 	}
 	defer db.Close()
 
-	plan = &Plan{}
-	sq := fmt.Sprintf(`SELECT plan_id,name,description FROM cfsb.plans WHERE id='%s' LIMIT 1;`, planID)
+	plan = &PlanConfig{}
+	sq := fmt.Sprintf(`SELECT %s FROM cfsb.plans WHERE plan_id=lower($1) LIMIT 1`, planConfigColumns)
 	log.Trace(fmt.Sprintf("cfsb.FindPlan(%s) > %s", planID, sq))
-	err = db.Get(&plan, sq, planID)
+	err = db.Get(plan, sq, planID)
 	if err != nil {
-		log.Error(fmt.Sprintf("cfsb.FindPlan(%s) %s", planID, err))
+		log.Error(fmt.Sprintf("cfsb.FindPlan(%s) ! %s", planID, err))
 	}
 	return plan, err
 }
+
+// Plans returns every plan, retired ones last.
+func Plans() (plans []PlanConfig, err error) {
+	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("cfsb.Plans() ! %s", err))
+		return
+	}
+	defer db.Close()
+
+	plans = []PlanConfig{}
+	sq := fmt.Sprintf(`SELECT %s FROM cfsb.plans ORDER BY ineffective_at IS NOT NULL, service_id, name`, planConfigColumns)
+	log.Trace(fmt.Sprintf("cfsb.Plans() > %s", sq))
+	err = db.Select(&plans, sq)
+	if err != nil {
+		log.Error(fmt.Sprintf("cfsb.Plans() ! %s", err))
+	}
+	return
+}
+
+// Validate checks the plan belongs to a service in the catalog, provisions on
+// a known cluster service and has valid backup settings, pool modes and
+// quotas.
+func (plan *PlanConfig) Validate() (err error) {
+	if strings.TrimSpace(plan.Name) == `` {
+		return errors.New(`plan name is required`)
+	}
+	s, err := FindService(plan.ServiceID)
+	if err == sql.ErrNoRows || (err == nil && s.Retired) {
+		return fmt.Errorf(`service '%s' is not in the catalog`, plan.ServiceID)
+	}
+	if err != nil {
+		return
+	}
+	if !whitelisted(clusterServices, plan.ClusterService) {
+		return fmt.Errorf(`invalid cluster service '%s', expected one of %s`, plan.ClusterService, strings.Join(clusterServices, `, `))
+	}
+	err = instances.BackupSettings{Frequency: plan.BackupFrequency, Window: plan.BackupWindow, Mode: plan.BackupMode}.Validate()
+	if err != nil {
+		return
+	}
+	modes := []string{instances.PoolModeSession, instances.PoolModeTransaction, instances.PoolModeStatement}
+	for _, mode := range strings.Fields(plan.AllowedPoolModes) {
+		if !whitelisted(modes, mode) {
+			return fmt.Errorf(`invalid pool mode '%s', expected one of %s`, mode, strings.Join(modes, `, `))
+		}
+	}
+	if plan.MaxStorageMB < 0 || plan.MaxConnections < 0 {
+		return errors.New(`quotas must not be negative, 0 is unlimited`)
+	}
+	return nil
+}
+
+// Create adds the plan to the catalog, generating its id if it has none.
+func (plan *PlanConfig) Create() (err error) {
+	if plan.BackupFrequency == `` {
+		plan.BackupFrequency = instances.DefaultBackupSettings.Frequency
+	}
+	if plan.BackupMode == `` {
+		plan.BackupMode = instances.DefaultBackupSettings.Mode
+	}
+	if err = plan.Validate(); err != nil {
+		return
+	}
+	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("cfsb.PlanConfig#Create(%s) ! %s", plan.Name, err))
+		return
+	}
+	defer db.Close()
+
+	if err = plan.checkName(db); err != nil {
+		return
+	}
+	sq := `INSERT INTO cfsb.plans (plan_id,service_id,cluster_service,name,description,free,metadata,backup_frequency,backup_window,backup_mode,allowed_extensions,allowed_settings,allowed_pool_modes,max_storage_mb,max_connections) VALUES (lower(COALESCE(NULLIF($1,''),gen_random_uuid()::text)),lower($2),$3,$4,$5,$6,$7,$8::interval,$9,$10,$11,$12,$13,$14,$15) RETURNING plan_id`
+	log.Trace(fmt.Sprintf("cfsb.PlanConfig#Create(%s) > %s", plan.Name, sq))
+	err = db.Get(&plan.PlanID, sq, plan.PlanID, plan.ServiceID, plan.ClusterService, plan.Name, plan.Description, plan.Free, plan.Metadata, plan.BackupFrequency, plan.BackupWindow, plan.BackupMode, plan.AllowedExtensions, plan.AllowedSettings, plan.AllowedPoolModes, plan.MaxStorageMB, plan.MaxConnections)
+	if err != nil {
+		log.Error(fmt.Sprintf("cfsb.PlanConfig#Create(%s) ! %s", plan.Name, err))
+	}
+	return
+}
+
+// Update saves the plan. The service and cluster service of a plan are fixed
+// once created, its instances are on clusters of that cluster service. Its
+// instances are given its new backup settings and quotas by an ApplyPlan task.
+func (plan *PlanConfig) Update() (err error) {
+	existing, err := FindPlan(plan.PlanID)
+	if err != nil {
+		return
+	}
+	if existing.ServiceID != strings.ToLower(plan.ServiceID) || existing.ClusterService != plan.ClusterService {
+		return errors.New(`the service and cluster service of a plan can not be changed, create another plan and retire this one instead`)
+	}
+	if err = plan.Validate(); err != nil {
+		return
+	}
+	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("cfsb.PlanConfig#Update(%s) ! %s", plan.PlanID, err))
+		return
+	}
+	defer db.Close()
+
+	if err = plan.checkName(db); err != nil {
+		return
+	}
+	sq := `UPDATE cfsb.plans SET name=$2, description=$3, free=$4, metadata=$5, backup_frequency=$6::interval, backup_window=$7, backup_mode=$8, allowed_extensions=$9, allowed_settings=$10, allowed_pool_modes=$11, max_storage_mb=$12, max_connections=$13 WHERE plan_id=lower($1)`
+	log.Trace(fmt.Sprintf("cfsb.PlanConfig#Update(%s) > %s", plan.PlanID, sq))
+	_, err = db.Exec(sq, plan.PlanID, plan.Name, plan.Description, plan.Free, plan.Metadata, plan.BackupFrequency, plan.BackupWindow, plan.BackupMode, plan.AllowedExtensions, plan.AllowedSettings, plan.AllowedPoolModes, plan.MaxStorageMB, plan.MaxConnections)
+	if err != nil {
+		log.Error(fmt.Sprintf("cfsb.PlanConfig#Update(%s) ! %s", plan.PlanID, err))
+	}
+	return
+}
+
+// checkName returns ErrPlanNameTaken when another plan of the service in the
+// catalog has the plan's name, Cloud Controller requires them unique.
+func (plan *PlanConfig) checkName(db *sqlx.DB) (err error) {
+	var count int
+	sq := `SELECT count(*) FROM cfsb.plans WHERE service_id=lower($1) AND name=$2 AND plan_id<>lower($3) AND ineffective_at IS NULL`
+	err = db.Get(&count, sq, plan.ServiceID, plan.Name, plan.PlanID)
+	if err != nil {
+		log.Error(fmt.Sprintf("cfsb.PlanConfig#checkName(%s) ! %s", plan.Name, err))
+		return
+	}
+	if count > 0 {
+		return ErrPlanNameTaken
+	}
+	return nil
+}
+
+// RetirePlan removes the plan from the catalog, sql.ErrNoRows if it is not in
+// it. Its instances keep it and may still be updated to other plans.
+func RetirePlan(planID string) (err error) {
+	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("cfsb.RetirePlan(%s) ! %s", planID, err))
+		return
+	}
+	defer db.Close()
+
+	sq := `UPDATE cfsb.plans SET ineffective_at=CURRENT_TIMESTAMP WHERE plan_id=lower($1) AND ineffective_at IS NULL`
+	log.Trace(fmt.Sprintf("cfsb.RetirePlan(%s) > %s", planID, sq))
+	res, err := db.Exec(sq, planID)
+	if err != nil {
+		log.Error(fmt.Sprintf("cfsb.RetirePlan(%s) ! %s", planID, err))
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func whitelisted(list []string, name string) bool {
+	for _, allowed := range list {
+		if allowed == name {
+			return true
+		}
+	}
+	return false
+}
+
+func scanJSON(src interface{}, v interface{}) error {
+	switch b := src.(type) {
+	case nil:
+		return nil
+	case []byte:
+		return json.Unmarshal(b, v)
+	case string:
+		return json.Unmarshal([]byte(b), v)
+	}
+	return fmt.Errorf(`cannot scan %T as JSON`, src)
+}
+
+func valueJSON(v interface{}) (driver.Value, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
@@ -1,14 +1,57 @@
 package cfsb
 
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/starkandwayne/rdpgd/log"
+	"github.com/starkandwayne/rdpgd/pg"
+)
+
 type Service struct {
 	ServiceID   string         `db:"service_id" json:"id"`
 	Name        string         `db:"name" json:"name"`
 	Description string         `db:"description" json:"description"`
 	Bindable    bool           `db:"bindable" json:"bindable"`
-	Tags        []string       `json:"tags"`
-	Metadata    ServiceDetails `json:"metadata"`
+	Updateable  bool           `db:"plan_updateable" json:"plan_updateable"`
+	Tags        TagList        `db:"tags" json:"tags"`
+	Metadata    ServiceDetails `db:"metadata" json:"metadata"`
 	Plans       []*Plan        `json:"plans"`
-	//DashboardClient   DashboardClient `json:"dashboard_client,omitempty"`
+	// DashboardClient lets Cloud Controller register the instances' dashboard
+	// with UAA, services without its id are left without a dashboard.
+	DashboardClient *DashboardClient `db:"dashboard_client" json:"dashboard_client,omitempty"`
+	// InstancesRetrievable and BindingsRetrievable tell Cloud Controller it may
+	// GET instances and bindings.
+	InstancesRetrievable bool `json:"instances_retrievable"`
+	BindingsRetrievable  bool `json:"bindings_retrievable"`
+	// Retired services are left out of the catalog along with their plans.
+	Retired bool `db:"retired" json:"retired,omitempty"`
+}
+
+// TagList is stored space separated, as cfsb.plans' allowed_* columns.
+type TagList []string
+
+// Scan reads the tags from their column.
+func (l *TagList) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*l = TagList{}
+	case []byte:
+		*l = TagList(strings.Fields(string(v)))
+	case string:
+		*l = TagList(strings.Fields(v))
+	default:
+		return fmt.Errorf(`cannot scan %T as tags`, src)
+	}
+	return nil
+}
+
+// Value stores the tags in their column.
+func (l TagList) Value() (driver.Value, error) {
+	return strings.Join(l, ` `), nil
 }
 
 type ServiceDetails struct {
@@ -21,6 +64,16 @@ type ServiceDetails struct {
 	Metadata    TileDetails `json:"metadata"`
 }
 
+// Scan reads the details from their JSON column.
+func (d *ServiceDetails) Scan(src interface{}) error {
+	return scanJSON(src, d)
+}
+
+// Value stores the details in their JSON column.
+func (d ServiceDetails) Value() (driver.Value, error) {
+	return valueJSON(d)
+}
+
 type TileDetails struct {
 	DisplayName         string `db:"displayname" json:"displayname"`
 	ImageUrl            string `db:"imageurl" json:"imageurl"`
@@ -35,3 +88,144 @@ type DashboardClient struct {
 	ClientSecret string `json:"secret,omitempty"`
 	RedirectURI  string `json:"redirect_uri,omitempty"`
 }
+
+// Scan reads the client from its JSON column.
+func (c *DashboardClient) Scan(src interface{}) error {
+	return scanJSON(src, c)
+}
+
+// Value stores the client in its JSON column.
+func (c DashboardClient) Value() (driver.Value, error) {
+	return valueJSON(c)
+}
+
+const serviceColumns = `service_id, name, description, bindable, plan_updateable, tags, metadata, COALESCE(dashboard_client,'{}'::json) AS dashboard_client, ineffective_at IS NOT NULL AS retired`
+
+// FindService returns the service, retired or not.
+func FindService(serviceID string) (s *Service, err error) {
+	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("cfsb.FindService(%s) ! %s", serviceID, err))
+		return
+	}
+	defer db.Close()
+
+	s = &Service{}
+	sq := fmt.Sprintf(`SELECT %s FROM cfsb.services WHERE service_id=lower($1) LIMIT 1`, serviceColumns)
+	log.Trace(fmt.Sprintf("cfsb.FindService(%s) > %s", serviceID, sq))
+	err = db.Get(s, sq, serviceID)
+	if err != nil {
+		log.Error(fmt.Sprintf("cfsb.FindService(%s) ! %s", serviceID, err))
+	}
+	return
+}
+
+// Services returns every service, retired ones last, without their plans.
+func Services() (services []Service, err error) {
+	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("cfsb.Services() ! %s", err))
+		return
+	}
+	defer db.Close()
+
+	services = []Service{}
+	sq := fmt.Sprintf(`SELECT %s FROM cfsb.services ORDER BY ineffective_at IS NOT NULL, name`, serviceColumns)
+	log.Trace(fmt.Sprintf("cfsb.Services() > %s", sq))
+	err = db.Select(&services, sq)
+	if err != nil {
+		log.Error(fmt.Sprintf("cfsb.Services() ! %s", err))
+	}
+	return
+}
+
+// Validate checks the service has a name and description, Cloud Controller
+// requires both.
+func (s *Service) Validate() error {
+	if strings.TrimSpace(s.Name) == `` || strings.TrimSpace(s.Description) == `` {
+		return errors.New(`service name and description are required`)
+	}
+	return nil
+}
+
+// Create adds the service to the catalog, generating its id if it has none.
+func (s *Service) Create() (err error) {
+	if err = s.Validate(); err != nil {
+		return
+	}
+	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("cfsb.Service#Create(%s) ! %s", s.Name, err))
+		return
+	}
+	defer db.Close()
+
+	sq := `INSERT INTO cfsb.services (service_id,name,description,bindable,plan_updateable,tags,metadata,dashboard_client) VALUES (lower(COALESCE(NULLIF($1,''),gen_random_uuid()::text)),$2,$3,$4,$5,$6,$7,COALESCE($8,'{}')::json) RETURNING service_id`
+	log.Trace(fmt.Sprintf("cfsb.Service#Create(%s) > %s", s.Name, sq))
+	err = db.Get(&s.ServiceID, sq, s.ServiceID, s.Name, s.Description, s.Bindable, s.Updateable, s.Tags, s.Metadata, s.DashboardClient)
+	if err != nil {
+		log.Error(fmt.Sprintf("cfsb.Service#Create(%s) ! %s", s.Name, err))
+	}
+	return
+}
+
+// Update saves the service.
+func (s *Service) Update() (err error) {
+	if err = s.Validate(); err != nil {
+		return
+	}
+	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("cfsb.Service#Update(%s) ! %s", s.ServiceID, err))
+		return
+	}
+	defer db.Close()
+
+	sq := `UPDATE cfsb.services SET name=$2, description=$3, bindable=$4, plan_updateable=$5, tags=$6, metadata=$7, dashboard_client=COALESCE($8,'{}')::json WHERE service_id=lower($1)`
+	log.Trace(fmt.Sprintf("cfsb.Service#Update(%s) > %s", s.ServiceID, sq))
+	_, err = db.Exec(sq, s.ServiceID, s.Name, s.Description, s.Bindable, s.Updateable, s.Tags, s.Metadata, s.DashboardClient)
+	if err != nil {
+		log.Error(fmt.Sprintf("cfsb.Service#Update(%s) ! %s", s.ServiceID, err))
+	}
+	return
+}
+
+// RetireService removes the service and its plans from the catalog,
+// sql.ErrNoRows if it is not in it. Its instances are unaffected.
+func RetireService(serviceID string) (err error) {
+	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("cfsb.RetireService(%s) ! %s", serviceID, err))
+		return
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error(fmt.Sprintf("cfsb.RetireService(%s) Begin ! %s", serviceID, err))
+		return
+	}
+	sq := `UPDATE cfsb.services SET ineffective_at=CURRENT_TIMESTAMP WHERE service_id=lower($1) AND ineffective_at IS NULL`
+	log.Trace(fmt.Sprintf("cfsb.RetireService(%s) > %s", serviceID, sq))
+	res, err := tx.Exec(sq, serviceID)
+	if err == nil {
+		if n, _ := res.RowsAffected(); n == 0 {
+			tx.Rollback()
+			return sql.ErrNoRows
+		}
+		sq = `UPDATE cfsb.plans SET ineffective_at=CURRENT_TIMESTAMP WHERE service_id=lower($1) AND ineffective_at IS NULL`
+		log.Trace(fmt.Sprintf("cfsb.RetireService(%s) > %s", serviceID, sq))
+		_, err = tx.Exec(sq, serviceID)
+	}
+	if err != nil {
+		log.Error(fmt.Sprintf("cfsb.RetireService(%s) ! %s", serviceID, err))
+		tx.Rollback()
+		return
+	}
+	return tx.Commit()
+}
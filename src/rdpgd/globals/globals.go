@@ -6,6 +6,7 @@ package globals
    be extremely minimal. Basically, only log. */
 import (
 	"fmt"
+	"net"
 	"os"
 	"strconv"
 	"strings"
@@ -29,24 +30,38 @@ var (
 	PGPort              string
 	StuckDuration       string
 	UserExtensions      string
+	Coordination        string //Set from RDPGD_COORDINATION, consul or postgres
 )
 
 const TIME_FORMAT string = "20060102150405"
 const PSQL_PATH string = `/var/vcap/packages/postgresql-9.4/bin/psql`
+const PG_RESTORE_PATH string = `/var/vcap/packages/postgresql-9.4/bin/pg_restore`
+
+// Coordination backends for the scheduler and task workers' locks.
+const (
+	CoordinationConsul   string = `consul`
+	CoordinationPostgres string = `postgres`
+)
 
 func init() {
+	var err error
+	Coordination = os.Getenv("RDPGD_COORDINATION")
+	switch Coordination {
+	case CoordinationConsul, CoordinationPostgres:
+	case "":
+		Coordination = CoordinationConsul
+	default:
+		log.Error(fmt.Sprintf("globals.init() Invalid RDPGD_COORDINATION '%s', using %s", Coordination, CoordinationConsul))
+		Coordination = CoordinationConsul
+	}
+
 	// Set MyIP variable
-	client, err := consulapi.NewClient(consulapi.DefaultConfig())
-	if err != nil {
-		log.Error(fmt.Sprintf("config.init() consulapi.NewClient()! %s", err))
-	} else {
-		agent := client.Agent()
-		info, err := agent.Self()
-		if err != nil {
-			log.Error(fmt.Sprintf("config.init() agent.Self()! %s", err))
-		} else {
-			MyIP = info["Config"]["AdvertiseAddr"].(string)
-		}
+	MyIP = os.Getenv("RDPGD_MY_IP")
+	if MyIP == "" && Coordination == CoordinationConsul {
+		MyIP = consulIP()
+	}
+	if MyIP == "" {
+		MyIP = interfaceIP()
 	}
 
 	ClusterService = os.Getenv("RDPGD_CLUSTER_SERVICE")
@@ -98,3 +113,36 @@ func init() {
 	UserExtensions = os.Getenv("RDPGD_PG_EXTENSIONS")
 
 }
+
+// consulIP returns the address the local Consul agent advertises.
+func consulIP() (ip string) {
+	client, err := consulapi.NewClient(consulapi.DefaultConfig())
+	if err != nil {
+		log.Error(fmt.Sprintf("config.init() consulapi.NewClient()! %s", err))
+		return
+	}
+	agent := client.Agent()
+	info, err := agent.Self()
+	if err != nil {
+		log.Error(fmt.Sprintf("config.init() agent.Self()! %s", err))
+		return
+	}
+	return info["Config"]["AdvertiseAddr"].(string)
+}
+
+// interfaceIP returns the first non loopback IPv4 address of the host, for
+// deployments without Consul.
+func interfaceIP() (ip string) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Error(fmt.Sprintf("globals.interfaceIP() net.InterfaceAddrs()! %s", err))
+		return
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+			return ipnet.IP.String()
+		}
+	}
+	return
+}
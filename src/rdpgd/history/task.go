@@ -0,0 +1,128 @@
+package history
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/starkandwayne/rdpgd/config"
+	"github.com/starkandwayne/rdpgd/globals"
+	"github.com/starkandwayne/rdpgd/log"
+	"github.com/starkandwayne/rdpgd/pg"
+	"github.com/starkandwayne/rdpgd/utils/rdpgpg"
+)
+
+//TaskHistory - One executed task as recorded in tasks.history
+type TaskHistory struct {
+	ID             int64  `db:"id" json:"id"`
+	TaskID         int64  `db:"task_id" json:"task_id"`
+	ClusterID      string `db:"cluster_id" json:"cluster_id"`
+	ClusterService string `db:"cluster_service" json:"cluster_service"`
+	Node           string `db:"node" json:"node"`
+	Role           string `db:"role" json:"role"`
+	Action         string `db:"action" json:"action"`
+	Data           string `db:"data" json:"data"`
+	DBName         string `db:"dbname" json:"dbname"`
+	Attempt        int64  `db:"attempt" json:"attempt"`
+	Status         string `db:"status" json:"status"`
+	Error          string `db:"error" json:"error"`
+	StartedAt      string `db:"started_at" json:"started_at"`
+	FinishedAt     string `db:"finished_at" json:"finished_at"`
+	Duration       int    `db:"duration" json:"duration"`
+}
+
+//TaskHistoryFilter - Restricts which rows TaskHistories returns, empty fields
+//are not filtered on. Since and Until are timestamps compared to started_at.
+type TaskHistoryFilter struct {
+	Action string
+	DBName string
+	Status string
+	Since  string
+	Until  string
+	Limit  int
+	Offset int
+}
+
+//InsertTaskHistory - Record an executed task in tasks.history
+func InsertTaskHistory(h TaskHistory) (err error) {
+	p := pg.NewPG(`127.0.0.1`, globals.PBPort, `rdpg`, `rdpg`, globals.PGPass)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf(`history.InsertTaskHistory() p.Connect(%s) ! %s`, p.URI, err))
+		return
+	}
+	defer db.Close()
+
+	// Timestamps are taken from the database clock like the rest of the schema,
+	// the task is taken to have finished now and started Duration seconds ago.
+	sq := fmt.Sprintf(`INSERT INTO tasks.history (task_id,cluster_id,cluster_service,node,role,action,data,dbname,attempt,status,error,started_at,finished_at,duration) VALUES (%d,'%s','%s','%s','%s','%s',$1,'%s',%d,'%s',$2,CURRENT_TIMESTAMP - '%d seconds'::interval,CURRENT_TIMESTAMP,%d)`, h.TaskID, h.ClusterID, h.ClusterService, h.Node, h.Role, h.Action, h.DBName, h.Attempt, h.Status, h.Duration, h.Duration)
+	log.Trace(fmt.Sprintf(`history.InsertTaskHistory() > %s`, sq))
+	_, err = db.Exec(sq, h.Data, h.Error)
+	if err != nil {
+		log.Error(fmt.Sprintf(`history.InsertTaskHistory() Error inserting record into tasks.history, running query: %s ! %s`, sq, err))
+	}
+	return
+}
+
+//TaskHistories - Return rows from tasks.history matching the filter, newest first
+func TaskHistories(f TaskHistoryFilter) (histories []TaskHistory, err error) {
+	histories = []TaskHistory{}
+	p := pg.NewPG(`127.0.0.1`, globals.PBPort, `rdpg`, `rdpg`, globals.PGPass)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf(`history.TaskHistories() p.Connect(%s) ! %s`, p.URI, err))
+		return
+	}
+	defer db.Close()
+
+	where := []string{}
+	args := []interface{}{}
+	add := func(condition string, value string) {
+		if value != `` {
+			args = append(args, value)
+			where = append(where, fmt.Sprintf(condition, len(args)))
+		}
+	}
+	add(`action = $%d`, f.Action)
+	add(`dbname = $%d`, f.DBName)
+	add(`status = $%d`, f.Status)
+	add(`started_at >= $%d::timestamp`, f.Since)
+	add(`started_at < $%d::timestamp`, f.Until)
+
+	sq := `SELECT id,task_id,cluster_id,cluster_service,node,role,action,data,dbname,attempt,status,COALESCE(error,'') AS error,started_at::text AS started_at,finished_at::text AS finished_at,duration FROM tasks.history`
+	if len(where) > 0 {
+		sq += ` WHERE ` + strings.Join(where, ` AND `)
+	}
+	sq += fmt.Sprintf(` ORDER BY started_at DESC, id DESC LIMIT %d OFFSET %d`, f.Limit, f.Offset)
+	log.Trace(fmt.Sprintf(`history.TaskHistories() > %s %v`, sq, args))
+	err = db.Select(&histories, sq, args...)
+	if err != nil {
+		log.Error(fmt.Sprintf(`history.TaskHistories() Error running query %s ! %s`, sq, err))
+	}
+	return
+}
+
+//DeleteTaskHistory - Responsible for deleting records from tasks.history
+//older than the value in rdpg.config.key = defaultDaysToKeepTaskHistory
+func DeleteTaskHistory() (err error) {
+	daysToKeep, err := config.GetValue(`defaultDaysToKeepTaskHistory`)
+	if err != nil {
+		return
+	}
+	log.Trace(fmt.Sprintf("history.DeleteTaskHistory() Keeping %s days of task history in tasks.history and tasks.workflows", daysToKeep))
+
+	address := `127.0.0.1`
+	sq := fmt.Sprintf(`DELETE FROM tasks.history WHERE started_at < NOW() - '%s days'::interval; `, daysToKeep)
+
+	err = rdpgpg.ExecQuery(address, sq)
+	if err != nil {
+		log.Error(fmt.Sprintf(`history.DeleteTaskHistory() Error when running query %s ! %s`, sq, err))
+		return
+	}
+	// Steps and dependencies of finished workflows are removed by cascade.
+	sq = fmt.Sprintf(`DELETE FROM tasks.workflows WHERE finished_at < NOW() - '%s days'::interval; `, daysToKeep)
+	err = rdpgpg.ExecQuery(address, sq)
+	if err != nil {
+		log.Error(fmt.Sprintf(`history.DeleteTaskHistory() Error when running query %s ! %s`, sq, err))
+	}
+	return
+}
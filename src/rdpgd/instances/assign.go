@@ -8,7 +8,7 @@ import (
 )
 
 // Assign() is called when the master cluster tells the service cluster about
-// an assignment.
+// an assignment. tasks.AssignInstance() also reconfigures pgbouncer for it.
 func (i *Instance) Assign() (err error) {
 	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
 	db, err := p.Connect()
@@ -42,21 +42,5 @@ func (i *Instance) Assign() (err error) {
 			break
 		}
 	}
-
-	ips, err := i.ClusterIPs()
-	if err != nil {
-		log.Error(fmt.Sprintf(`instances.Instance#Assign(%s) i.ClusterIPs() ! %s`, i.InstanceID, err))
-		return
-	}
-	for _, ip := range ips {
-		// TODO: tasks.Task{ClusterID: ,Node: ,Role: ,Action:, Data: }.Enqueue()
-		// Question is how to do this without an import cycle? Smoe tasks require instances.
-		sq := fmt.Sprintf(`INSERT INTO tasks.tasks (cluster_id,node,role,action,data,node_type, cluster_service) VALUES ('%s','%s','service','Reconfigure','pgbouncer','any','%s')`, ClusterID, ip, i.ClusterService)
-		log.Trace(fmt.Sprintf(`instances.Instance#Assign(%s) Enqueue Reconfigure of pgbouncer > %s`, i.InstanceID, sq))
-		_, err = db.Exec(sq)
-		if err != nil {
-			log.Error(fmt.Sprintf(`instances.Instance#Assign(%s) Inserting into tasks: %s`, i.InstanceID, sq))
-		}
-	}
 	return
 }
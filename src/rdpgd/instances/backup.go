@@ -0,0 +1,289 @@
+package instances
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	consulapi "github.com/hashicorp/consul/api"
+
+	"github.com/starkandwayne/rdpgd/log"
+	"github.com/starkandwayne/rdpgd/pg"
+)
+
+// Backup dump modes, how BackupDatabase dumps a database.
+const (
+	// BackupModePlain dumps the database as a plain SQL file restored by psql.
+	BackupModePlain = `plain`
+	// BackupModeCustom dumps the database in pg_dump's compressed custom
+	// format, restored by pg_restore.
+	BackupModeCustom = `custom`
+)
+
+/*
+BackupSettings struct is used to represent how a database is backed up: how
+often, within which maintenance window and in which dump mode. Empty fields
+of an instance's overrides fall back to its plan's settings.
+*/
+type BackupSettings struct {
+	DBName    string `db:"dbname" json:"dbname,omitempty"`
+	Frequency string `db:"backup_frequency" json:"frequency"`
+	// Window names the maintenance window backups are started in, empty for
+	// any time.
+	Window string `db:"backup_window" json:"window"`
+	Mode   string `db:"backup_mode" json:"mode"`
+}
+
+// DefaultBackupSettings are the settings of databases without any, eg. those
+// not provisioned through the broker.
+var DefaultBackupSettings = BackupSettings{Frequency: `1 hour`, Mode: BackupModePlain}
+
+// Merge returns the settings with the non-empty fields of overrides replacing
+// their own.
+func (b BackupSettings) Merge(overrides BackupSettings) BackupSettings {
+	if overrides.Frequency != `` {
+		b.Frequency = overrides.Frequency
+	}
+	if overrides.Window != `` {
+		b.Window = overrides.Window
+	}
+	if overrides.Mode != `` {
+		b.Mode = overrides.Mode
+	}
+	return b
+}
+
+// Validate checks the dump mode and that the frequency, if given, is a
+// positive PostgreSQL interval.
+func (b BackupSettings) Validate() (err error) {
+	switch b.Mode {
+	case ``, BackupModePlain, BackupModeCustom:
+	default:
+		return fmt.Errorf(`invalid backup mode '%s', expected %s or %s`, b.Mode, BackupModePlain, BackupModeCustom)
+	}
+	if b.Frequency == `` {
+		return nil
+	}
+	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.BackupSettings#Validate() p.Connect(%s) ! %s", p.URI, err))
+		return
+	}
+	defer db.Close()
+	var positive bool
+	err = db.QueryRow(`SELECT $1::interval > '0'::interval`, b.Frequency).Scan(&positive)
+	if err != nil {
+		return fmt.Errorf(`invalid backup frequency '%s'`, b.Frequency)
+	}
+	if !positive {
+		return fmt.Errorf(`backup frequency '%s' must be positive`, b.Frequency)
+	}
+	return nil
+}
+
+// BackupSettings returns the instance's backup settings, its plan's with its
+// own overrides applied, along with the overrides. Used on the management
+// cluster.
+func (i *Instance) BackupSettings() (settings, overrides BackupSettings, err error) {
+	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.Instance<%s>#BackupSettings() p.Connect(%s) ! %s", i.Database, p.URI, err))
+		return
+	}
+	defer db.Close()
+
+	rows := []struct {
+		PlanFrequency     string `db:"plan_frequency"`
+		PlanWindow        string `db:"plan_window"`
+		PlanMode          string `db:"plan_mode"`
+		OverrideFrequency string `db:"backup_frequency"`
+		OverrideWindow    string `db:"backup_window"`
+		OverrideMode      string `db:"backup_mode"`
+	}{}
+	sq := fmt.Sprintf(`SELECT COALESCE(p.backup_frequency::text,'') AS plan_frequency, COALESCE(p.backup_window,'') AS plan_window, COALESCE(p.backup_mode,'') AS plan_mode, COALESCE(i.backup_frequency::text,'') AS backup_frequency, COALESCE(i.backup_window,'') AS backup_window, COALESCE(i.backup_mode,'') AS backup_mode FROM cfsb.instances i LEFT JOIN cfsb.plans p ON p.plan_id=i.plan_id WHERE i.dbname='%s' LIMIT 1`, i.Database)
+	log.Trace(fmt.Sprintf(`instances.Instance<%s>#BackupSettings() > %s`, i.Database, sq))
+	err = db.Select(&rows, sq)
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.Instance<%s>#BackupSettings() ! %s", i.Database, err))
+		return
+	}
+	if len(rows) == 0 {
+		return settings, overrides, sql.ErrNoRows
+	}
+	r := rows[0]
+	overrides = BackupSettings{Frequency: r.OverrideFrequency, Window: r.OverrideWindow, Mode: r.OverrideMode}
+	plan := BackupSettings{Frequency: r.PlanFrequency, Window: r.PlanWindow, Mode: r.PlanMode}
+	settings = DefaultBackupSettings.Merge(plan).Merge(overrides)
+	settings.DBName = i.Database
+	return
+}
+
+// SetBackupSettings replaces the instance's backup overrides, an empty field
+// falling back to the plan's setting, and sends the resulting settings to the
+// service cluster holding the database. Used on the management cluster.
+func (i *Instance) SetBackupSettings(overrides BackupSettings) (err error) {
+	if err = overrides.Validate(); err != nil {
+		return
+	}
+	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.Instance<%s>#SetBackupSettings() p.Connect(%s) ! %s", i.Database, p.URI, err))
+		return
+	}
+	defer db.Close()
+
+	sq := fmt.Sprintf(`UPDATE cfsb.instances SET backup_frequency=NULLIF($1,'')::interval, backup_window=NULLIF($2,''), backup_mode=NULLIF($3,'') WHERE dbname='%s'`, i.Database)
+	log.Trace(fmt.Sprintf(`instances.Instance<%s>#SetBackupSettings() > %s`, i.Database, sq))
+	_, err = db.Exec(sq, overrides.Frequency, overrides.Window, overrides.Mode)
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.Instance<%s>#SetBackupSettings() ! %s", i.Database, err))
+		return
+	}
+	return i.PushBackupSettings()
+}
+
+// PushBackupSettings sends the instance's backup settings to the service
+// cluster holding its database, which reschedules its backups to match.
+func (i *Instance) PushBackupSettings() (err error) {
+	settings, _, err := i.BackupSettings()
+	if err != nil {
+		return
+	}
+	body, err := json.Marshal(settings)
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.Instance<%s>#PushBackupSettings() json.Marshal() ! %s", i.Database, err))
+		return
+	}
+	return i.putServiceCluster(`databases/backup`, body)
+}
+
+// putServiceCluster sends body in a PUT to the given path of the admin API of
+// the service cluster holding the instance's database.
+func (i *Instance) putServiceCluster(path string, body []byte) (err error) {
+	_, err = i.requestServiceCluster(`PUT`, path, body)
+	return
+}
+
+// getServiceCluster decodes the response to a GET of the given path of the
+// admin API of the service cluster holding the instance's database into v.
+func (i *Instance) getServiceCluster(path string, v interface{}) (err error) {
+	body, err := i.requestServiceCluster(`GET`, path, nil)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(body, v)
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.Instance<%s>#getServiceCluster() json.Unmarshal() ! %s", i.Database, err))
+	}
+	return
+}
+
+// requestServiceCluster sends a request to the given path of the admin API of
+// the service cluster holding the instance's database, returning the body of
+// its response.
+func (i *Instance) requestServiceCluster(method, path string, body []byte) (respBody []byte, err error) {
+	client, err := consulapi.NewClient(consulapi.DefaultConfig())
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.Instance<%s>#requestServiceCluster() consulapi.NewClient() ! %s", i.Database, err))
+		return
+	}
+	catalog := client.Catalog()
+	svcs, _, err := catalog.Service(i.ClusterID, "", nil)
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.Instance<%s>#requestServiceCluster() consulapi.Client.Catalog() ! %s", i.Database, err))
+		return
+	}
+	if len(svcs) == 0 {
+		err = fmt.Errorf(`no nodes found for cluster %s`, i.ClusterID)
+		log.Error(fmt.Sprintf("instances.Instance<%s>#requestServiceCluster() ! %s", i.Database, err))
+		return
+	}
+	url := fmt.Sprintf("http://%s:%s/%s", svcs[0].Address, os.Getenv("RDPGD_ADMIN_PORT"), path)
+	req, err := http.NewRequest(method, url, bytes.NewBuffer(body))
+	if err != nil {
+		return
+	}
+	log.Trace(fmt.Sprintf(`instances.Instance<%s>#requestServiceCluster() %s %s`, i.Database, method, url))
+	req.SetBasicAuth(os.Getenv("RDPGD_ADMIN_USER"), os.Getenv("RDPGD_ADMIN_PASS"))
+	httpClient := &http.Client{}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		log.Error(fmt.Sprintf(`instances.Instance<%s>#requestServiceCluster() httpClient.Do() %s ! %s`, i.Database, url, err))
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf(`%s %s returned %s`, method, url, resp.Status)
+		log.Error(fmt.Sprintf(`instances.Instance<%s>#requestServiceCluster() ! %s`, i.Database, err))
+		return
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// FindBackupSettings returns the backup settings the management cluster sent
+// for the database, DefaultBackupSettings if it sent none. Used on service
+// clusters.
+func FindBackupSettings(dbname string) (settings BackupSettings, err error) {
+	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.FindBackupSettings(%s) p.Connect(%s) ! %s", dbname, p.URI, err))
+		return
+	}
+	defer db.Close()
+
+	settings = DefaultBackupSettings
+	settings.DBName = dbname
+	sq := `SELECT dbname, frequency::text AS backup_frequency, backup_window, mode AS backup_mode FROM backups.settings WHERE dbname=$1`
+	log.Trace(fmt.Sprintf(`instances.FindBackupSettings(%s) > %s`, dbname, sq))
+	err = db.Get(&settings, sq, dbname)
+	if err == sql.ErrNoRows {
+		return settings, nil
+	}
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.FindBackupSettings(%s) ! %s", dbname, err))
+	}
+	return
+}
+
+// SaveBackupSettings records the backup settings the management cluster sent
+// for a database. Used on service clusters.
+func SaveBackupSettings(settings BackupSettings) (err error) {
+	settings = DefaultBackupSettings.Merge(settings)
+	if err = settings.Validate(); err != nil {
+		return
+	}
+	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.SaveBackupSettings(%s) p.Connect(%s) ! %s", settings.DBName, p.URI, err))
+		return
+	}
+	defer db.Close()
+
+	// Delete and insert in one transaction as PostgreSQL 9.4 has no upsert.
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.SaveBackupSettings(%s) Begin ! %s", settings.DBName, err))
+		return
+	}
+	_, err = tx.Exec(`DELETE FROM backups.settings WHERE dbname=$1`, settings.DBName)
+	if err == nil {
+		sq := `INSERT INTO backups.settings (dbname,frequency,backup_window,mode) VALUES ($1,$2::interval,$3,$4)`
+		log.Trace(fmt.Sprintf(`instances.SaveBackupSettings(%s) > %s`, settings.DBName, sq))
+		_, err = tx.Exec(sq, settings.DBName, settings.Frequency, settings.Window, settings.Mode)
+	}
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.SaveBackupSettings(%s) ! %s", settings.DBName, err))
+		tx.Rollback()
+		return
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,136 @@
+package instances
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/starkandwayne/rdpgd/log"
+	"github.com/starkandwayne/rdpgd/pg"
+	"github.com/starkandwayne/rdpgd/uuid"
+)
+
+/*
+BindingRole struct is used to represent the PostgreSQL role created for a
+service binding, a member of its instance's owner role so that it has the
+owner's privileges while unbinding it drops the role alone.
+*/
+type BindingRole struct {
+	InstanceID string `db:"instance_id" json:"instance_id"`
+	BindingID  string `db:"binding_id" json:"binding_id"`
+	Database   string `db:"dbname" json:"dbname"`
+	Owner      string `db:"owner" json:"owner"`
+	User       string `db:"dbuser" json:"uname"`
+	Pass       string `db:"dbpass" json:"pass"`
+}
+
+// NewBindingRole returns a role with a new name and password for the binding
+// of the instance.
+func NewBindingRole(i *Instance, bindingID string) *BindingRole {
+	re := regexp.MustCompile("[^A-Za-z0-9_]")
+	u1 := uuid.NewUUID().String()
+	u2 := uuid.NewUUID().String()
+	identifier := strings.ToLower(string(re.ReplaceAll([]byte(u1), []byte(""))))
+	dbpass := strings.ToLower(string(re.ReplaceAll([]byte(u2), []byte(""))))
+	return &BindingRole{
+		InstanceID: i.InstanceID,
+		BindingID:  bindingID,
+		Database:   i.Database,
+		Owner:      i.User,
+		User:       "b" + identifier,
+		Pass:       dbpass,
+	}
+}
+
+// PushBind sends the binding's role to the service cluster holding the
+// instance's database, which creates it.
+func (i *Instance) PushBind(r *BindingRole) (err error) {
+	body, err := json.Marshal(r)
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.Instance<%s>#PushBind(%s) json.Marshal() ! %s", i.Database, r.BindingID, err))
+		return
+	}
+	return i.putServiceCluster(`databases/bind`, body)
+}
+
+// PushUnbind tells the service cluster holding the instance's database to drop
+// the binding's role.
+func (i *Instance) PushUnbind(r *BindingRole) (err error) {
+	body, err := json.Marshal(r)
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.Instance<%s>#PushUnbind(%s) json.Marshal() ! %s", i.Database, r.BindingID, err))
+		return
+	}
+	return i.putServiceCluster(`databases/unbind`, body)
+}
+
+// Record records the binding's role in cfsb.credentials so that pgbouncer is
+// configured with it. Used on service clusters.
+func (r *BindingRole) Record() (err error) {
+	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.BindingRole<%s>#Record() p.Connect(%s) ! %s", r.BindingID, p.URI, err))
+		return
+	}
+	defer db.Close()
+
+	sq := `INSERT INTO cfsb.credentials (instance_id,binding_id,dbuser,dbpass,dbname) SELECT lower($1),lower($2),$3,$4,$5 WHERE NOT EXISTS (SELECT 1 FROM cfsb.credentials WHERE dbuser=$3 AND ineffective_at IS NULL)`
+	log.Trace(fmt.Sprintf(`instances.BindingRole<%s>#Record() > %s`, r.BindingID, sq))
+	_, err = db.Exec(sq, r.InstanceID, r.BindingID, r.User, r.Pass, r.Database)
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.BindingRole<%s>#Record() ! %s", r.BindingID, err))
+	}
+	return
+}
+
+// Retire marks the binding's role ineffective in cfsb.credentials. Used on
+// service clusters.
+func (r *BindingRole) Retire() (err error) {
+	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.BindingRole<%s>#Retire() p.Connect(%s) ! %s", r.BindingID, p.URI, err))
+		return
+	}
+	defer db.Close()
+
+	sq := `UPDATE cfsb.credentials SET ineffective_at=CURRENT_TIMESTAMP WHERE dbuser=$1 AND ineffective_at IS NULL`
+	log.Trace(fmt.Sprintf(`instances.BindingRole<%s>#Retire() > %s`, r.BindingID, sq))
+	_, err = db.Exec(sq, r.User)
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.BindingRole<%s>#Retire() ! %s", r.BindingID, err))
+	}
+	return
+}
+
+// ActiveBindingRoles returns the roles of the bindings in effect on this
+// service cluster with their passwords md5 hashed for pgbouncer's userlist.
+func ActiveBindingRoles() (roles []BindingRole, err error) {
+	return bindingRoles(`'md5'||md5(dbpass||dbuser)`, ``)
+}
+
+// BindingRoles returns the roles of the bindings in effect on the database.
+func BindingRoles(dbname string) (roles []BindingRole, err error) {
+	return bindingRoles(`dbpass`, dbname)
+}
+
+func bindingRoles(pass, dbname string) (roles []BindingRole, err error) {
+	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.bindingRoles(%s) p.Connect(%s) ! %s", dbname, p.URI, err))
+		return
+	}
+	defer db.Close()
+
+	roles = []BindingRole{}
+	sq := fmt.Sprintf(`SELECT instance_id, binding_id, dbname, dbuser, %s AS dbpass FROM cfsb.credentials WHERE ineffective_at IS NULL AND ($1='' OR dbname=$1)`, pass)
+	log.Trace(fmt.Sprintf(`instances.bindingRoles(%s) > %s`, dbname, sq))
+	err = db.Select(&roles, sq, dbname)
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.bindingRoles(%s) ! %s", dbname, err))
+	}
+	return
+}
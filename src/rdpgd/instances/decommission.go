@@ -7,6 +7,8 @@ import (
 	"github.com/starkandwayne/rdpgd/pg"
 )
 
+// Decommission() marks the instance ineffective, tasks.DecommissionInstance()
+// also schedules the removal of its database.
 func (i *Instance) Decommission() (err error) {
 	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
 	db, err := p.Connect()
@@ -24,15 +26,6 @@ func (i *Instance) Decommission() (err error) {
 		log.Error(fmt.Sprintf("Instance#Decommission(%s) setting inefective_at ! %s", i.InstanceID, err))
 		return
 	}
-
-	// TODO: tasks.Task{ClusterID: ,Node: ,Role: ,Action:, Data: }.Enqueue()
-	// Question is how to do this without an import cycle? Some tasks require instances.
-	sq = fmt.Sprintf(`INSERT INTO tasks.tasks (cluster_id,role,action,data, cluster_service) VALUES ('%s','all','DecommissionDatabase','%s', '%s')`, i.ClusterID, i.Database, i.ClusterService)
-	log.Trace(fmt.Sprintf(`instances.Instance#Decommission(%s) Scheduling Instance Removal > %s`, i.InstanceID, sq))
-	_, err = db.Exec(sq)
-	if err != nil {
-		log.Error(fmt.Sprintf(`instances.Instance#Decommission(%s) ! %s`, i.InstanceID, err))
-	}
 	return
 }
 
@@ -52,7 +45,8 @@ func (i *Instance) DecommissionedAt(timestamp string) (err error) {
 	_, err = db.Exec(sq)
 	if err != nil {
 		log.Error(fmt.Sprintf("instances.Instance#DecommissionedAt(%s) decommissioned_at ! %s", i.Database, err))
+		return
 	}
 
-	return
+	return FinishOperations(i.Database, OperationDeprovision, OperationSucceeded, `Deprovisioned database `+i.Database)
 }
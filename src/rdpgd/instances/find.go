@@ -17,7 +17,7 @@ func FindByInstanceID(instanceID string) (i *Instance, err error) {
 	}
 	defer db.Close()
 	in := Instance{}
-	sq := fmt.Sprintf(`SELECT id, cluster_id,instance_id, service_id, plan_id, organization_id, space_id, dbname, dbuser, dbpass FROM cfsb.instances WHERE instance_id=lower('%s') LIMIT 1`, instanceID)
+	sq := fmt.Sprintf(`SELECT id, cluster_id, cluster_service,instance_id, service_id, plan_id, organization_id, space_id, dbname, dbuser, dbpass FROM cfsb.instances WHERE instance_id=lower('%s') AND ineffective_at IS NULL LIMIT 1`, instanceID)
 	log.Trace(fmt.Sprintf(`instances.FindByInstanceID(%s) > %s`, instanceID, sq))
 	err = db.Get(&in, sq)
 	if err != nil {
@@ -12,6 +12,7 @@ import (
 )
 
 var (
+	pgPort       string
 	pbPort       string
 	pgPass       string
 	ClusterID    string
@@ -52,6 +53,10 @@ func init() {
 	if ClusterID == "" {
 		log.Error(`instance.init() RDPGD_CLUSTER not found in environment!!!`)
 	}
+	pgPort = os.Getenv(`RDPGD_PG_PORT`)
+	if pgPort == `` {
+		pgPort = `5432`
+	}
 	pbPort = os.Getenv(`RDPGD_PB_PORT`)
 	if pbPort == `` {
 		pbPort = `6432`
@@ -0,0 +1,243 @@
+package instances
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	consulapi "github.com/hashicorp/consul/api"
+
+	"github.com/starkandwayne/rdpgd/log"
+	"github.com/starkandwayne/rdpgd/pg"
+)
+
+var (
+	// ErrPlanNotFound is returned for a plan id the catalog does not have.
+	ErrPlanNotFound = errors.New(`plan not found`)
+	// ErrNoMigrationTarget is returned when there is no service cluster of the
+	// plan's cluster service to migrate to.
+	ErrNoMigrationTarget = errors.New(`no service cluster found for the plan`)
+)
+
+// UpdateRequest is the plan an update operation moves its instance to and the
+// parameters applied once it is on that plan.
+type UpdateRequest struct {
+	PlanID     string             `json:"plan_id"`
+	Parameters DatabaseParameters `json:"parameters"`
+}
+
+/*
+Migration struct is used to represent the move of an instance's database to a
+service cluster of another cluster service, sent by the management cluster to
+the target cluster and reported back once the target holds a copy. The
+database keeps its name and credentials, those of its bindings included.
+*/
+type Migration struct {
+	OperationID string `json:"operation_id"`
+	// Instance is the instance as it is once migrated, on the target cluster.
+	Instance Instance `json:"instance"`
+	// SourceDSN connects to the database on the cluster it is migrated from
+	// as the role the copy is taken as.
+	SourceDSN string        `json:"source_dsn"`
+	Bindings  []BindingRole `json:"bindings"`
+	// Parameters are those of the database on the cluster it is migrated
+	// from, its extensions are created before the copy.
+	Parameters DatabaseParameters `json:"parameters"`
+	// Error is set when the target cluster reports the migration failed.
+	Error string `json:"error,omitempty"`
+}
+
+// PlanClusterService returns the cluster service databases of the plan are
+// held by, ErrPlanNotFound if there is no such plan.
+func PlanClusterService(planID string) (clusterService string, err error) {
+	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.PlanClusterService(%s) p.Connect(%s) ! %s", planID, p.URI, err))
+		return
+	}
+	defer db.Close()
+
+	sq := `SELECT cluster_service FROM cfsb.plans WHERE plan_id=lower($1) AND ineffective_at IS NULL LIMIT 1`
+	log.Trace(fmt.Sprintf(`instances.PlanClusterService(%s) > %s`, planID, sq))
+	err = db.Get(&clusterService, sq, planID)
+	if err == sql.ErrNoRows {
+		return ``, ErrPlanNotFound
+	}
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.PlanClusterService(%s) ! %s", planID, err))
+	}
+	return
+}
+
+// MigrationTarget returns the service cluster of the cluster service holding
+// the fewest instances.
+func MigrationTarget(clusterService string) (clusterID string, err error) {
+	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.MigrationTarget(%s) p.Connect(%s) ! %s", clusterService, p.URI, err))
+		return
+	}
+	defer db.Close()
+
+	sq := `SELECT cluster_id FROM cfsb.instances WHERE cluster_service=$1 AND ineffective_at IS NULL AND decommissioned_at IS NULL GROUP BY cluster_id ORDER BY count(instance_id), cluster_id LIMIT 1`
+	log.Trace(fmt.Sprintf(`instances.MigrationTarget(%s) > %s`, clusterService, sq))
+	err = db.Get(&clusterID, sq, clusterService)
+	if err == sql.ErrNoRows {
+		return ``, ErrNoMigrationTarget
+	}
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.MigrationTarget(%s) ! %s", clusterService, err))
+	}
+	return
+}
+
+// ChangePlan moves the instance to the plan and the service cluster holding
+// its database. Used on the management cluster.
+func (i *Instance) ChangePlan(planID, clusterID, clusterService string) (err error) {
+	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.Instance<%s>#ChangePlan(%s) p.Connect(%s) ! %s", i.Database, planID, p.URI, err))
+		return
+	}
+	defer db.Close()
+
+	sq := `UPDATE cfsb.instances SET plan_id=lower($1), cluster_id=$2, cluster_service=$3 WHERE dbname=$4`
+	log.Trace(fmt.Sprintf(`instances.Instance<%s>#ChangePlan(%s) > %s`, i.Database, planID, sq))
+	_, err = db.Exec(sq, planID, clusterID, clusterService, i.Database)
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.Instance<%s>#ChangePlan(%s) ! %s", i.Database, planID, err))
+		return
+	}
+	i.PlanID, i.ClusterID, i.ClusterService = planID, clusterID, clusterService
+	return
+}
+
+// NewMigration returns the migration of the instance to the plan on the target
+// service cluster, carrying the credentials of the instance's bindings. The
+// copy is taken from sourceDSN, see PushMigrating.
+func (i *Instance) NewMigration(operationID, planID, clusterID, clusterService, sourceDSN string) (m *Migration, err error) {
+	roles, err := BindingRoles(i.Database)
+	if err != nil {
+		return
+	}
+	params, err := i.Parameters()
+	if err != nil {
+		return
+	}
+	m = &Migration{OperationID: operationID, Instance: *i, SourceDSN: sourceDSN, Bindings: []BindingRole{}, Parameters: params}
+	m.Instance.PlanID, m.Instance.ClusterID, m.Instance.ClusterService = planID, clusterID, clusterService
+	for index := range roles {
+		r := roles[index]
+		// Bindings made before each had its own role use the owner's.
+		if r.User == i.User {
+			continue
+		}
+		r.Owner = i.User
+		m.Bindings = append(m.Bindings, r)
+	}
+	return
+}
+
+// Push sends the migration to the target service cluster, which copies the
+// database over.
+func (m *Migration) Push() (err error) {
+	body, err := json.Marshal(m)
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.Migration<%s>#Push() json.Marshal() ! %s", m.OperationID, err))
+		return
+	}
+	return m.Instance.putServiceCluster(`databases/migrate`, body)
+}
+
+// Report tells the management cluster the target service cluster holds a copy
+// of the database, or why it failed to when err is given.
+func (m *Migration) Report(cause error) (err error) {
+	if cause != nil {
+		m.Error = cause.Error()
+	}
+	body, err := json.Marshal(m)
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.Migration<%s>#Report() json.Marshal() ! %s", m.OperationID, err))
+		return
+	}
+	client, err := consulapi.NewClient(consulapi.DefaultConfig())
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.Migration<%s>#Report() consulapi.NewClient() ! %s", m.OperationID, err))
+		return
+	}
+	svcs, _, err := client.Catalog().Service(`rdpgmc`, "", nil)
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.Migration<%s>#Report() consulapi.Client.Catalog() ! %s", m.OperationID, err))
+		return
+	}
+	if len(svcs) == 0 {
+		err = fmt.Errorf(`no management cluster nodes found`)
+		log.Error(fmt.Sprintf("instances.Migration<%s>#Report() ! %s", m.OperationID, err))
+		return
+	}
+	url := fmt.Sprintf("http://%s:%s/%s", svcs[0].Address, os.Getenv("RDPGD_ADMIN_PORT"), `databases/migrated`)
+	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(body))
+	if err != nil {
+		return
+	}
+	log.Trace(fmt.Sprintf(`instances.Migration<%s>#Report() PUT %s`, m.OperationID, url))
+	req.SetBasicAuth(os.Getenv("RDPGD_ADMIN_USER"), os.Getenv("RDPGD_ADMIN_PASS"))
+	httpClient := &http.Client{}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		log.Error(fmt.Sprintf(`instances.Migration<%s>#Report() httpClient.Do() %s ! %s`, m.OperationID, url, err))
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf(`PUT %s returned %s`, url, resp.Status)
+		log.Error(fmt.Sprintf(`instances.Migration<%s>#Report() ! %s`, m.OperationID, err))
+	}
+	return
+}
+
+// PushRetire tells the service cluster the instance's database was migrated
+// from to drop its copy.
+func (i *Instance) PushRetire() (err error) {
+	body, err := json.Marshal(map[string]string{`dbname`: i.Database})
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.Instance<%s>#PushRetire() json.Marshal() ! %s", i.Database, err))
+		return
+	}
+	return i.putServiceCluster(`databases/retire`, body)
+}
+
+// PushMigrating tells the service cluster of the instance whether its database
+// is being migrated away, so that its tenant may not write to it while it is
+// copied. Once it is, the DSN of the role the copy is taken as is returned.
+func (i *Instance) PushMigrating(migrating bool) (sourceDSN string, err error) {
+	body, err := json.Marshal(map[string]interface{}{`dbname`: i.Database, `migrating`: migrating})
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.Instance<%s>#PushMigrating() json.Marshal() ! %s", i.Database, err))
+		return
+	}
+	respBody, err := i.requestServiceCluster(`PUT`, `databases/migrating`, body)
+	if err != nil || !migrating {
+		return
+	}
+	resp := struct {
+		SourceDSN string `json:"source_dsn"`
+	}{}
+	err = json.Unmarshal(respBody, &resp)
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.Instance<%s>#PushMigrating() json.Unmarshal() ! %s", i.Database, err))
+		return
+	}
+	if resp.SourceDSN == `` {
+		err = fmt.Errorf(`service cluster %s returned no source_dsn for %s`, i.ClusterID, i.Database)
+		log.Error(fmt.Sprintf("instances.Instance<%s>#PushMigrating() ! %s", i.Database, err))
+	}
+	return resp.SourceDSN, err
+}
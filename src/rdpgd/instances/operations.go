@@ -0,0 +1,165 @@
+package instances
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/starkandwayne/rdpgd/log"
+	"github.com/starkandwayne/rdpgd/pg"
+)
+
+// Kinds of asynchronous operations on service instances.
+const (
+	OperationProvision   = `provision`
+	OperationDeprovision = `deprovision`
+	// OperationUpdate changes the plan of an instance, migrating its database
+	// when the plan is of another cluster service.
+	OperationUpdate = `update`
+)
+
+// Operation states, as reported to Cloud Foundry by last_operation.
+const (
+	OperationInProgress = `in progress`
+	OperationSucceeded  = `succeeded`
+	OperationFailed     = `failed`
+)
+
+const operationColumns = `id,operation_id,instance_id,kind,state,description,request,created_at::text AS created_at,updated_at::text AS updated_at`
+
+/*
+Operation struct is used to represent an asynchronous provision or deprovision
+of a service instance requested by Cloud Foundry with accepts_incomplete=true,
+which polls its state through last_operation.
+*/
+type Operation struct {
+	ID          int64  `db:"id" json:"-"`
+	OperationID string `db:"operation_id" json:"operation"`
+	InstanceID  string `db:"instance_id" json:"instance_id"`
+	Kind        string `db:"kind" json:"kind"`
+	State       string `db:"state" json:"state"`
+	Description string `db:"description" json:"description"`
+	// Request is the JSON encoded request the operation works, see
+	// ProvisionRequest.
+	Request   string `db:"request" json:"-"`
+	CreatedAt string `db:"created_at" json:"created_at"`
+	UpdatedAt string `db:"updated_at" json:"updated_at"`
+}
+
+// ProvisionRequest is the instance a provision operation provisions along
+// with the backup overrides it was requested with.
+type ProvisionRequest struct {
+	Instance   Instance           `json:"instance"`
+	Backup     BackupSettings     `json:"backup"`
+	Parameters DatabaseParameters `json:"parameters"`
+}
+
+// NewOperation records a new operation of the kind on the instance, in
+// progress, with request JSON encoded.
+func NewOperation(instanceID, kind string, request interface{}) (o *Operation, err error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.NewOperation(%s) json.Marshal() ! %s", instanceID, err))
+		return
+	}
+	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.NewOperation(%s) p.Connect(%s) ! %s", instanceID, p.URI, err))
+		return
+	}
+	defer db.Close()
+
+	o = &Operation{}
+	sq := fmt.Sprintf(`INSERT INTO cfsb.operations (instance_id,kind,state,request) VALUES (lower($1),$2,'%s',$3) RETURNING %s`, OperationInProgress, operationColumns)
+	log.Trace(fmt.Sprintf(`instances.NewOperation(%s) > %s`, instanceID, sq))
+	err = db.Get(o, sq, instanceID, kind, string(body))
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.NewOperation(%s) ! %s", instanceID, err))
+		return nil, err
+	}
+	return
+}
+
+// FindOperation returns the operation with the given id, nil if there is none.
+func FindOperation(operationID string) (o *Operation, err error) {
+	return findOperation(`operation_id=$1`, operationID)
+}
+
+// LastOperation returns the instance's latest operation, nil if there is none.
+func LastOperation(instanceID string) (o *Operation, err error) {
+	return findOperation(`instance_id=lower($1)`, instanceID)
+}
+
+func findOperation(where, arg string) (o *Operation, err error) {
+	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.findOperation(%s) p.Connect(%s) ! %s", arg, p.URI, err))
+		return
+	}
+	defer db.Close()
+
+	op := Operation{}
+	sq := fmt.Sprintf(`SELECT %s FROM cfsb.operations WHERE %s ORDER BY id DESC LIMIT 1`, operationColumns, where)
+	log.Trace(fmt.Sprintf(`instances.findOperation(%s) > %s`, arg, sq))
+	err = db.Get(&op, sq, arg)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.findOperation(%s) ! %s", arg, err))
+		return nil, err
+	}
+	return &op, nil
+}
+
+// Decode decodes the operation's request into v.
+func (o *Operation) Decode(v interface{}) (err error) {
+	err = json.Unmarshal([]byte(o.Request), v)
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.Operation<%s>#Decode() ! %s", o.OperationID, err))
+	}
+	return
+}
+
+// Finish ends the operation in the given state, unless it already ended.
+func (o *Operation) Finish(state, description string) (err error) {
+	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.Operation<%s>#Finish() p.Connect(%s) ! %s", o.OperationID, p.URI, err))
+		return
+	}
+	defer db.Close()
+
+	sq := fmt.Sprintf(`UPDATE cfsb.operations SET state=$1, description=$2, updated_at=CURRENT_TIMESTAMP WHERE id=%d AND state='%s'`, o.ID, OperationInProgress)
+	log.Trace(fmt.Sprintf(`instances.Operation<%s>#Finish() > %s`, o.OperationID, sq))
+	_, err = db.Exec(sq, state, description)
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.Operation<%s>#Finish() ! %s", o.OperationID, err))
+		return
+	}
+	o.State, o.Description = state, description
+	return
+}
+
+// FinishOperations ends the operations of the kind in progress on the instance
+// holding the database in the given state.
+func FinishOperations(dbname, kind, state, description string) (err error) {
+	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.FinishOperations(%s) p.Connect(%s) ! %s", dbname, p.URI, err))
+		return
+	}
+	defer db.Close()
+
+	sq := fmt.Sprintf(`UPDATE cfsb.operations SET state=$1, description=$2, updated_at=CURRENT_TIMESTAMP WHERE kind=$3 AND state='%s' AND instance_id IN (SELECT instance_id FROM cfsb.instances WHERE dbname=$4)`, OperationInProgress)
+	log.Trace(fmt.Sprintf(`instances.FinishOperations(%s) > %s`, dbname, sq))
+	_, err = db.Exec(sq, state, description, kind, dbname)
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.FinishOperations(%s) ! %s", dbname, err))
+	}
+	return
+}
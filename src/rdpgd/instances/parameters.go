@@ -0,0 +1,325 @@
+package instances
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/starkandwayne/rdpgd/log"
+	"github.com/starkandwayne/rdpgd/pg"
+)
+
+// Pool modes pgbouncer may pool a database's connections in.
+const (
+	PoolModeSession     = `session`
+	PoolModeTransaction = `transaction`
+	PoolModeStatement   = `statement`
+)
+
+var (
+	extensionRE = regexp.MustCompile(`^[a-z0-9_-]+$`)
+	settingRE   = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+)
+
+/*
+DatabaseParameters struct is used to represent what tenants may tailor of their
+instance's database: extensions created in addition to the cluster service's
+own, settings the database defaults its sessions to and the mode pgbouncer
+pools its connections in. Each is checked against the instance plan's
+whitelist.
+*/
+type DatabaseParameters struct {
+	DBName     string            `json:"dbname,omitempty"`
+	Extensions []string          `json:"extensions,omitempty"`
+	Settings   map[string]string `json:"settings,omitempty"`
+	// PoolMode is pgbouncer's default pool mode when empty.
+	PoolMode string `json:"pool_mode,omitempty"`
+	// The quotas of the instance's plan, 0 for unlimited, sent along to the
+	// service cluster rather than recorded on the management cluster.
+	MaxStorageMB   int64 `json:"max_storage_mb,omitempty"`
+	MaxConnections int   `json:"max_connections,omitempty"`
+	// OverQuota is set on service clusters while the database is larger than
+	// MaxStorageMB, its sessions then default to read only.
+	OverQuota bool `json:"over_quota,omitempty"`
+	// Migrating is set on the service cluster a database is migrated from
+	// while it is copied, its owner and binding roles may then not connect.
+	Migrating bool `json:"migrating,omitempty"`
+}
+
+// PlanWhitelist is what a plan allows the parameters of its instances to set.
+type PlanWhitelist struct {
+	Extensions string `db:"allowed_extensions"`
+	Settings   string `db:"allowed_settings"`
+	PoolModes  string `db:"allowed_pool_modes"`
+}
+
+// Empty tells if the parameters set nothing.
+func (d DatabaseParameters) Empty() bool {
+	return len(d.Extensions) == 0 && len(d.Settings) == 0 && d.PoolMode == ``
+}
+
+// Merge returns the parameters with the extensions of overrides added, their
+// settings replacing its own, an empty value removing the setting, and their
+// pool mode replacing its own when given. Extensions are never removed, the
+// objects of the database may depend on them.
+func (d DatabaseParameters) Merge(overrides DatabaseParameters) DatabaseParameters {
+	merged := DatabaseParameters{DBName: d.DBName, PoolMode: d.PoolMode, Settings: map[string]string{}}
+	seen := map[string]bool{}
+	for _, ext := range append(append([]string{}, d.Extensions...), overrides.Extensions...) {
+		if !seen[ext] {
+			seen[ext] = true
+			merged.Extensions = append(merged.Extensions, ext)
+		}
+	}
+	for k, v := range d.Settings {
+		merged.Settings[k] = v
+	}
+	for k, v := range overrides.Settings {
+		if v == `` {
+			delete(merged.Settings, k)
+			continue
+		}
+		merged.Settings[k] = v
+	}
+	if overrides.PoolMode != `` {
+		merged.PoolMode = overrides.PoolMode
+	}
+	return merged
+}
+
+// Validate checks the parameters against the whitelist of the plan and the
+// values of the settings against PostgreSQL's own checks.
+func (d DatabaseParameters) Validate(planID string) (err error) {
+	if d.Empty() {
+		return nil
+	}
+	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.DatabaseParameters#Validate(%s) p.Connect(%s) ! %s", planID, p.URI, err))
+		return
+	}
+	defer db.Close()
+
+	w := PlanWhitelist{}
+	sq := `SELECT allowed_extensions, allowed_settings, allowed_pool_modes FROM cfsb.plans WHERE plan_id=lower($1) LIMIT 1`
+	log.Trace(fmt.Sprintf(`instances.DatabaseParameters#Validate(%s) > %s`, planID, sq))
+	err = db.Get(&w, sq, planID)
+	if err == sql.ErrNoRows {
+		return ErrPlanNotFound
+	}
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.DatabaseParameters#Validate(%s) ! %s", planID, err))
+		return
+	}
+
+	for _, ext := range d.Extensions {
+		if !extensionRE.MatchString(ext) || !whitelisted(w.Extensions, ext) {
+			return fmt.Errorf(`extension '%s' is not allowed by the plan, allowed: %s`, ext, allowedList(w.Extensions))
+		}
+	}
+	if d.PoolMode != `` && !whitelisted(w.PoolModes, d.PoolMode) {
+		return fmt.Errorf(`pool_mode '%s' is not allowed by the plan, allowed: %s`, d.PoolMode, allowedList(w.PoolModes))
+	}
+	names := []string{}
+	for name := range d.Settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !settingRE.MatchString(name) || !whitelisted(w.Settings, name) {
+			return fmt.Errorf(`setting '%s' is not allowed by the plan, allowed: %s`, name, allowedList(w.Settings))
+		}
+		// Setting it locally in a transaction rolled back checks the value.
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`SELECT set_config($1, $2, true)`, name, d.Settings[name])
+		tx.Rollback()
+		if err != nil {
+			return fmt.Errorf(`invalid value '%s' for setting '%s': %s`, d.Settings[name], name, strings.TrimPrefix(err.Error(), `pq: `))
+		}
+	}
+	return nil
+}
+
+func whitelisted(list, name string) bool {
+	for _, allowed := range strings.Fields(list) {
+		if allowed == name {
+			return true
+		}
+	}
+	return false
+}
+
+func allowedList(list string) string {
+	if len(strings.Fields(list)) == 0 {
+		return `none`
+	}
+	return strings.Join(strings.Fields(list), `, `)
+}
+
+// Parameters returns the parameters the instance's database was last given.
+func (i *Instance) Parameters() (params DatabaseParameters, err error) {
+	return FindParameters(i.Database)
+}
+
+// ValidateParameters checks the instance's parameters with overrides applied
+// against the whitelist of the plan.
+func (i *Instance) ValidateParameters(overrides DatabaseParameters, planID string) (err error) {
+	params, err := i.Parameters()
+	if err != nil {
+		return
+	}
+	return params.Merge(overrides).Validate(planID)
+}
+
+// SetParameters applies overrides to the instance's parameters, checked
+// against its plan's whitelist, and sends them to the service cluster holding
+// the database. Used on the management cluster.
+func (i *Instance) SetParameters(overrides DatabaseParameters) (err error) {
+	params, err := i.Parameters()
+	if err != nil {
+		return
+	}
+	// Sent even without parameters, for the quotas of the plan.
+	params = params.Merge(overrides)
+	if err = params.Validate(i.PlanID); err != nil {
+		return
+	}
+	params.DBName = i.Database
+	if err = SaveParameters(params); err != nil {
+		return
+	}
+	return i.PushParameters()
+}
+
+// PushParameters sends the instance's parameters to the service cluster
+// holding its database, which applies them on each of its nodes.
+func (i *Instance) PushParameters() (err error) {
+	params, err := i.Parameters()
+	if err != nil {
+		return
+	}
+	params.DBName = i.Database
+	params.MaxStorageMB, params.MaxConnections, err = PlanQuotas(i.PlanID)
+	if err != nil {
+		return
+	}
+	body, err := json.Marshal(params)
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.Instance<%s>#PushParameters() json.Marshal() ! %s", i.Database, err))
+		return
+	}
+	return i.putServiceCluster(`databases/parameters`, body)
+}
+
+// PlanQuotas returns the storage, in megabytes, and connections the databases
+// of the plan are limited to, 0 for unlimited.
+func PlanQuotas(planID string) (maxStorageMB int64, maxConnections int, err error) {
+	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.PlanQuotas(%s) p.Connect(%s) ! %s", planID, p.URI, err))
+		return
+	}
+	defer db.Close()
+
+	sq := `SELECT max_storage_mb, max_connections FROM cfsb.plans WHERE plan_id=lower($1) LIMIT 1`
+	log.Trace(fmt.Sprintf(`instances.PlanQuotas(%s) > %s`, planID, sq))
+	err = db.QueryRow(sq, planID).Scan(&maxStorageMB, &maxConnections)
+	if err == sql.ErrNoRows {
+		return 0, 0, ErrPlanNotFound
+	}
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.PlanQuotas(%s) ! %s", planID, err))
+	}
+	return
+}
+
+// FindParameters returns the parameters recorded for the database, none if it
+// was given none.
+func FindParameters(dbname string) (params DatabaseParameters, err error) {
+	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.FindParameters(%s) p.Connect(%s) ! %s", dbname, p.URI, err))
+		return
+	}
+	defer db.Close()
+
+	var body string
+	sq := `SELECT COALESCE(parameters::text,'') FROM cfsb.instances WHERE dbname=$1 LIMIT 1`
+	log.Trace(fmt.Sprintf(`instances.FindParameters(%s) > %s`, dbname, sq))
+	err = db.Get(&body, sq, dbname)
+	if err == sql.ErrNoRows || (err == nil && body == ``) {
+		return DatabaseParameters{DBName: dbname}, nil
+	}
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.FindParameters(%s) ! %s", dbname, err))
+		return
+	}
+	err = json.Unmarshal([]byte(body), &params)
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.FindParameters(%s) json.Unmarshal() ! %s", dbname, err))
+		return
+	}
+	params.DBName = dbname
+	return
+}
+
+// SaveParameters records the parameters of their database.
+func SaveParameters(params DatabaseParameters) (err error) {
+	body, err := json.Marshal(params)
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.SaveParameters(%s) json.Marshal() ! %s", params.DBName, err))
+		return
+	}
+	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.SaveParameters(%s) p.Connect(%s) ! %s", params.DBName, p.URI, err))
+		return
+	}
+	defer db.Close()
+
+	sq := `UPDATE cfsb.instances SET parameters=$1::json WHERE dbname=$2`
+	log.Trace(fmt.Sprintf(`instances.SaveParameters(%s) > %s`, params.DBName, sq))
+	_, err = db.Exec(sq, string(body), params.DBName)
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.SaveParameters(%s) ! %s", params.DBName, err))
+	}
+	return
+}
+
+// PoolModes returns the pool mode of each database in effect given one.
+func PoolModes() (modes map[string]string, err error) {
+	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.PoolModes() p.Connect(%s) ! %s", p.URI, err))
+		return
+	}
+	defer db.Close()
+
+	rows := []struct {
+		Database string `db:"dbname"`
+		PoolMode string `db:"pool_mode"`
+	}{}
+	sq := `SELECT dbname, parameters->>'pool_mode' AS pool_mode FROM cfsb.instances WHERE ineffective_at IS NULL AND COALESCE(parameters->>'pool_mode','') <> ''`
+	log.Trace(fmt.Sprintf(`instances.PoolModes() > %s`, sq))
+	err = db.Select(&rows, sq)
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.PoolModes() ! %s", err))
+		return
+	}
+	modes = map[string]string{}
+	for _, r := range rows {
+		modes[r.Database] = r.PoolMode
+	}
+	return
+}
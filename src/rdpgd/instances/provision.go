@@ -1,23 +1,42 @@
 package instances
 
 import (
-	"bytes"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"net/http"
-	"os"
 	"time"
 
-	consulapi "github.com/hashicorp/consul/api"
-
 	"github.com/starkandwayne/rdpgd/log"
 	"github.com/starkandwayne/rdpgd/pg"
 )
 
-// Provision is called by cfsb when a new service instance is requested.
+var (
+	// ErrOutOfCapacity is returned when the service clusters already hold as
+	// many databases as they are allowed.
+	ErrOutOfCapacity = errors.New(`Postgres service provisioning failed. The postgres cluster is out of capacity.  Please notify operations to adjust the database limits.`)
+	// ErrNoDatabaseAvailable is returned when no precreated database is
+	// available for the plan yet, PrecreateDatabases creates more.
+	ErrNoDatabaseAvailable = errors.New(`Provisioning failed, temporarily out of capacity. Please wait a few minutes and try again. If the problem persists beyond 10 minutes please notify the operations team.`)
+)
+
+// Provision is called by cfsb when a new service instance is requested, it
+// waits up to 30 seconds for a precreated database to become available.
 func (i *Instance) Provision() (err error) {
+	for attempts := 0; ; attempts++ {
+		err = i.TryProvision()
+		if err != ErrNoDatabaseAvailable || attempts >= 3 {
+			return
+		}
+		log.Error(fmt.Sprintf("instances.Instance#Provision() ! Out of Capacity, attempt %d, retrying in 10s.", attempts))
+		time.Sleep(10 * time.Second)
+	}
+}
+
+// TryProvision assigns the instance the oldest precreated database available
+// for its plan, returning ErrNoDatabaseAvailable straight away if there is
+// none. Used by the asynchronous provision operation which retries later.
+func (i *Instance) TryProvision() (err error) {
 	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
 	db, err := p.Connect()
 	if err != nil {
@@ -32,9 +51,8 @@ func (i *Instance) Provision() (err error) {
 	//log.Error(fmt.Sprintf("instances.Instance#Provision() Getting max instance capacity ! %s", err))
 	//}
 
-	attempts := 0
 	var dbname string
-	for { // In case we need to wait for a precreated database on the cluster...
+	for { // In case another request locks the database first...
 		// TODO: Compute which cluster the database will be assigned to based on
 		//      min(# assigned for each cluster), then targeting this cluster:
 		// TODO: Take into account plan with the above calculation, eg. dedicated vs shared
@@ -58,16 +76,9 @@ func (i *Instance) Provision() (err error) {
 					log.Error(fmt.Sprintf("instances.Instance#Provision(): Fail to get instance capacity ! %s", err))
 				}
 				if instanceNum >= instanceCapacity {
-					return errors.New(`Postgres service provisioning failed. The postgres cluster is out of capacity.  Please notify operations to adjust the database limits.`)
-				}
-				if attempts < 3 {
-					log.Error(fmt.Sprintf("instances.Instance#Provision() ! Out of Capacity, attempt %d, retrying in 10s.", attempts))
-					attempts += 1
-					time.Sleep(10 * time.Second)
-					continue
-				} else {
-					return errors.New(`Provisioning failed, temporarily out of capacity. Please wait a few minutes and try again. If the problem persists beyond 10 minutes please notify the operations team.`)
+					return ErrOutOfCapacity
 				}
+				return ErrNoDatabaseAvailable
 			} else {
 				log.Error(fmt.Sprintf("instances.Instance#Provision(%s) ! %s", i.InstanceID, err))
 				return err
@@ -100,44 +111,24 @@ func (i *Instance) Provision() (err error) {
 		if err != nil {
 			log.Error(fmt.Sprintf(`instances.Instance#Provision(%s) Unlocking ! %s`, i.InstanceID, err))
 		}
-		// Tell the service cluster about the assignment.
-		// TODO: This can be in a function.
-		client, err := consulapi.NewClient(consulapi.DefaultConfig())
-		if err != nil {
-			log.Error(fmt.Sprintf("instances.Instance#precreateDatabase() consulapi.NewClient() ! %s", err))
-			return err
-		}
-		catalog := client.Catalog()
-		svcs, _, err := catalog.Service(i.ClusterID, "", nil)
+		err = i.PushAssignment()
 		if err != nil {
-			log.Error(fmt.Sprintf("instances.Instance#precreateDatabase() consulapi.Client.Catalog() ! %s", err))
 			return err
 		}
-		if len(svcs) == 0 {
-			log.Error(fmt.Sprintf("instances.Instance#precreateDatabase() ! No services found, no known nodes?!"))
-			return err
-		}
-		body, err := json.Marshal(i)
-		if err != nil {
-			log.Error(fmt.Sprintf("instances.Instance#precreateDatabase() json.Marchal(i) ! %s", err))
-			return err
-		}
-		url := fmt.Sprintf("http://%s:%s/%s", svcs[0].Address, os.Getenv("RDPGD_ADMIN_PORT"), `databases/assign`)
-		req, err := http.NewRequest("PUT", url, bytes.NewBuffer([]byte(body)))
-		log.Trace(fmt.Sprintf(`instances.Instance#precreateDatabase(%s) PUT %s`, i.Database, url))
-		// req.Header.Set("Content-Type", "application/json")
-		// TODO: Retrieve from configuration in database.
-		req.SetBasicAuth(os.Getenv("RDPGD_ADMIN_USER"), os.Getenv("RDPGD_ADMIN_PASS"))
-		httpClient := &http.Client{}
-		resp, err := httpClient.Do(req)
-		if err != nil {
-			log.Error(fmt.Sprintf(`instances.Instance#precreateDatabase(%s) httpClient.Do() %s ! %s`, i.Database, url, err))
-			return err
-		}
-		resp.Body.Close()
 		// TODO: Trigger enqueueing of database creation on target cluster via AdminAPI.
 		// TODO: Also have scheduler which enqueues if number precreated databases < 10
 		break
 	}
 	return
 }
+
+// PushAssignment tells the service cluster holding the instance's database
+// that it is assigned to the instance, which may be done again.
+func (i *Instance) PushAssignment() (err error) {
+	body, err := json.Marshal(i)
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.Instance#PushAssignment() json.Marchal(i) ! %s", err))
+		return err
+	}
+	return i.putServiceCluster(`databases/assign`, body)
+}
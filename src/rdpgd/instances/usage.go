@@ -0,0 +1,125 @@
+package instances
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/starkandwayne/rdpgd/log"
+	"github.com/starkandwayne/rdpgd/pg"
+)
+
+// How many backups and restores of a database Usage lists, latest first.
+const usageHistoryLimit = 10
+
+/*
+Usage struct is what the service cluster holding a database reports of it for
+its tenant's dashboard: its size and connections on the node asked, its quotas
+and its latest backups and restores.
+*/
+type Usage struct {
+	DBName         string        `json:"dbname"`
+	SizeBytes      int64         `json:"size_bytes"`
+	Connections    int           `json:"connections"`
+	MaxStorageMB   int64         `json:"max_storage_mb"`
+	MaxConnections int           `json:"max_connections"`
+	OverQuota      bool          `json:"over_quota"`
+	Backups        []FileHistory `json:"backups"`
+	// Restores holds those queued or running, with the status queued or
+	// running, ahead of those finished.
+	Restores []FileHistory `json:"restores"`
+}
+
+// FileHistory struct is a backup or restore of a database, as recorded in
+// backups.file_history.
+type FileHistory struct {
+	FileName  string    `db:"file_name" json:"file_name"`
+	Status    string    `db:"status" json:"status"`
+	Duration  int       `db:"duration" json:"duration"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// Usage returns the usage of the instance's database as the service cluster
+// holding it reports.
+func (i *Instance) Usage() (u Usage, err error) {
+	err = i.getServiceCluster(`databases/usage/`+i.Database, &u)
+	return
+}
+
+// FindUsage returns the usage of the database. Used on service clusters.
+func FindUsage(dbname string) (u Usage, err error) {
+	params, err := FindParameters(dbname)
+	if err != nil {
+		return
+	}
+	u = Usage{DBName: dbname, MaxStorageMB: params.MaxStorageMB, MaxConnections: params.MaxConnections, OverQuota: params.OverQuota}
+
+	local := pg.NewPG(`127.0.0.1`, pgPort, `rdpg`, `rdpg`, pgPass)
+	u.SizeBytes, err = local.DatabaseSize(dbname)
+	if err != nil {
+		return
+	}
+	u.Connections, err = local.ConnectionCount(dbname)
+	if err != nil {
+		return
+	}
+
+	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.FindUsage(%s) p.Connect(%s) ! %s", dbname, p.URI, err))
+		return
+	}
+	defer db.Close()
+
+	u.Backups = []FileHistory{}
+	sq := fmt.Sprintf(`SELECT file_name, status, COALESCE(duration,0) AS duration, created_at FROM backups.file_history WHERE dbname=$1 AND action='CreateBackup' ORDER BY created_at DESC LIMIT %d`, usageHistoryLimit)
+	log.Trace(fmt.Sprintf(`instances.FindUsage(%s) > %s`, dbname, sq))
+	err = db.Select(&u.Backups, sq, dbname)
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.FindUsage(%s) ! %s", dbname, err))
+		return
+	}
+
+	// Restore requests are queued tasks until they run, restores run are in
+	// the file history.
+	type restoreTask struct {
+		Data       string    `db:"data"`
+		Processing bool      `db:"processing"`
+		CreatedAt  time.Time `db:"created_at"`
+	}
+	queued := []restoreTask{}
+	sq = `SELECT data, processing_at IS NOT NULL AS processing, created_at FROM tasks.tasks WHERE action='RestoreDatabaseFromFile' ORDER BY created_at DESC`
+	log.Trace(fmt.Sprintf(`instances.FindUsage(%s) > %s`, dbname, sq))
+	err = db.Select(&queued, sq)
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.FindUsage(%s) ! %s", dbname, err))
+		return
+	}
+	u.Restores = []FileHistory{}
+	for _, t := range queued {
+		var data struct {
+			DBName   string `json:"dbname"`
+			FileName string `json:"fileName"`
+		}
+		if json.Unmarshal([]byte(t.Data), &data) != nil || data.DBName != dbname {
+			continue
+		}
+		restore := FileHistory{FileName: filepath.Base(data.FileName), Status: `queued`, CreatedAt: t.CreatedAt}
+		if t.Processing {
+			restore.Status = `running`
+		}
+		u.Restores = append(u.Restores, restore)
+	}
+	restored := []FileHistory{}
+	sq = fmt.Sprintf(`SELECT file_name, status, COALESCE(duration,0) AS duration, created_at FROM backups.file_history WHERE dbname=$1 AND action='RestoreBackup' ORDER BY created_at DESC LIMIT %d`, usageHistoryLimit)
+	log.Trace(fmt.Sprintf(`instances.FindUsage(%s) > %s`, dbname, sq))
+	err = db.Select(&restored, sq, dbname)
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.FindUsage(%s) ! %s", dbname, err))
+		return
+	}
+	u.Restores = append(u.Restores, restored...)
+	return
+}
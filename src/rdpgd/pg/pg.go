@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"fmt"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -436,6 +437,186 @@ func (p *PG) DropUser(dbuser string) (err error) {
 	return
 }
 
+// Grant the given role to a user on a single target host. The user's sessions
+// act as the role so that the objects they create belong to the role.
+func (p *PG) GrantRole(role, dbuser string) (err error) {
+	log.Trace(fmt.Sprintf(`pg.PG<%s>#GrantRole(%s,%s) Granting postgres role...`, p.IP, role, dbuser))
+	p.Set(`database`, `postgres`)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("pg.PG<%s>#GrantRole(%s,%s) %s ! %s", p.IP, role, dbuser, p.URI, err))
+		return
+	}
+	defer db.Close()
+
+	for _, sq := range []string{
+		fmt.Sprintf(`GRANT %s TO %s`, role, dbuser),
+		fmt.Sprintf(`ALTER USER %s SET role TO %s`, dbuser, role),
+	} {
+		log.Trace(fmt.Sprintf(`pg.PG<%s>#GrantRole(%s,%s) > %s`, p.IP, role, dbuser, sq))
+		_, err = db.Exec(sq)
+		if err != nil {
+			log.Error(fmt.Sprintf("pg.PG<%s>#GrantRole(%s,%s) ! %s", p.IP, role, dbuser, err))
+			return
+		}
+	}
+	return
+}
+
+// Terminate the sessions of the given user on a single target host.
+func (p *PG) TerminateUserSessions(dbuser string) (err error) {
+	log.Trace(fmt.Sprintf(`pg.PG<%s>#TerminateUserSessions(%s) Terminating postgres user sessions...`, p.IP, dbuser))
+	p.Set(`database`, `postgres`)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("pg.PG<%s>#TerminateUserSessions(%s) %s ! %s", p.IP, dbuser, p.URI, err))
+		return
+	}
+	defer db.Close()
+
+	sq := `SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE usename=$1 AND pid <> pg_backend_pid()`
+	log.Trace(fmt.Sprintf(`pg.PG<%s>#TerminateUserSessions(%s) > %s`, p.IP, dbuser, sq))
+	_, err = db.Exec(sq, dbuser)
+	if err != nil {
+		log.Error(fmt.Sprintf("pg.PG<%s>#TerminateUserSessions(%s) ! %s", p.IP, dbuser, err))
+	}
+	return
+}
+
+// Hand the objects the given user owns in a database over to another role on a
+// single target host so that the user may be dropped.
+func (p *PG) ReassignOwned(dbname, dbuser, owner string) (err error) {
+	log.Trace(fmt.Sprintf(`pg.PG<%s>#ReassignOwned(%s,%s,%s) Reassigning owned objects...`, p.IP, dbname, dbuser, owner))
+	p.Set(`database`, dbname)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("pg.PG<%s>#ReassignOwned(%s,%s,%s) %s ! %s", p.IP, dbname, dbuser, owner, p.URI, err))
+		return
+	}
+	defer db.Close()
+
+	for _, sq := range []string{
+		fmt.Sprintf(`REASSIGN OWNED BY %s TO %s`, dbuser, owner),
+		fmt.Sprintf(`DROP OWNED BY %s`, dbuser),
+	} {
+		log.Trace(fmt.Sprintf(`pg.PG<%s>#ReassignOwned(%s,%s,%s) > %s`, p.IP, dbname, dbuser, owner, sq))
+		_, err = db.Exec(sq)
+		if err != nil {
+			log.Error(fmt.Sprintf("pg.PG<%s>#ReassignOwned(%s,%s,%s) ! %s", p.IP, dbname, dbuser, owner, err))
+			return
+		}
+	}
+	return
+}
+
+// Replace the settings the sessions of a database default to with the given
+// ones on a single target host. Names must be valid identifiers, values are
+// quoted.
+func (p *PG) SetDatabaseSettings(dbname string, settings map[string]string) (err error) {
+	log.Trace(fmt.Sprintf(`pg.PG<%s>#SetDatabaseSettings(%s) Setting database settings %+v...`, p.IP, dbname, settings))
+	p.Set(`database`, `postgres`)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("pg.PG<%s>#SetDatabaseSettings(%s) %s ! %s", p.IP, dbname, p.URI, err))
+		return
+	}
+	defer db.Close()
+
+	sqs := []string{fmt.Sprintf(`ALTER DATABASE "%s" RESET ALL`, dbname)}
+	for name, value := range settings {
+		sqs = append(sqs, fmt.Sprintf(`ALTER DATABASE "%s" SET %s TO '%s'`, dbname, name, strings.Replace(value, `'`, `''`, -1)))
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error(fmt.Sprintf("pg.PG<%s>#SetDatabaseSettings(%s) ! %s", p.IP, dbname, err))
+		return
+	}
+	for _, sq := range sqs {
+		log.Trace(fmt.Sprintf(`pg.PG<%s>#SetDatabaseSettings(%s) > %s`, p.IP, dbname, sq))
+		_, err = tx.Exec(sq)
+		if err != nil {
+			log.Error(fmt.Sprintf("pg.PG<%s>#SetDatabaseSettings(%s) ! %s", p.IP, dbname, err))
+			tx.Rollback()
+			return
+		}
+	}
+	return tx.Commit()
+}
+
+// Limit the connections to a database on a single target host, -1 for no
+// limit.
+func (p *PG) SetConnectionLimit(dbname string, limit int) (err error) {
+	p.Set(`database`, `postgres`)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("pg.PG<%s>#SetConnectionLimit(%s) %s ! %s", p.IP, dbname, p.URI, err))
+		return
+	}
+	defer db.Close()
+
+	sq := fmt.Sprintf(`ALTER DATABASE "%s" CONNECTION LIMIT %d`, dbname, limit)
+	log.Trace(fmt.Sprintf(`pg.PG<%s>#SetConnectionLimit(%s) > %s`, p.IP, dbname, sq))
+	_, err = db.Exec(sq)
+	if err != nil {
+		log.Error(fmt.Sprintf("pg.PG<%s>#SetConnectionLimit(%s) ! %s", p.IP, dbname, err))
+	}
+	return
+}
+
+// Limit the connections of a user on a single target host, 0 to keep it from
+// connecting and -1 for no limit.
+func (p *PG) SetUserConnectionLimit(dbuser string, limit int) (err error) {
+	p.Set(`database`, `postgres`)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("pg.PG<%s>#SetUserConnectionLimit(%s) %s ! %s", p.IP, dbuser, p.URI, err))
+		return
+	}
+	defer db.Close()
+
+	sq := fmt.Sprintf(`ALTER USER %s CONNECTION LIMIT %d`, dbuser, limit)
+	log.Trace(fmt.Sprintf(`pg.PG<%s>#SetUserConnectionLimit(%s) > %s`, p.IP, dbuser, sq))
+	_, err = db.Exec(sq)
+	if err != nil {
+		log.Error(fmt.Sprintf("pg.PG<%s>#SetUserConnectionLimit(%s) ! %s", p.IP, dbuser, err))
+	}
+	return
+}
+
+// Return the size of a database on a single target host, in bytes.
+func (p *PG) DatabaseSize(dbname string) (size int64, err error) {
+	p.Set(`database`, `postgres`)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("pg.PG<%s>#DatabaseSize(%s) %s ! %s", p.IP, dbname, p.URI, err))
+		return
+	}
+	defer db.Close()
+
+	err = db.Get(&size, `SELECT pg_database_size($1)`, dbname)
+	if err != nil {
+		log.Error(fmt.Sprintf("pg.PG<%s>#DatabaseSize(%s) ! %s", p.IP, dbname, err))
+	}
+	return
+}
+
+// Return the number of connections to a database on a single target host.
+func (p *PG) ConnectionCount(dbname string) (count int, err error) {
+	p.Set(`database`, `postgres`)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("pg.PG<%s>#ConnectionCount(%s) %s ! %s", p.IP, dbname, p.URI, err))
+		return
+	}
+	defer db.Close()
+
+	err = db.Get(&count, `SELECT count(*) FROM pg_stat_activity WHERE datname=$1`, dbname)
+	if err != nil {
+		log.Error(fmt.Sprintf("pg.PG<%s>#ConnectionCount(%s) ! %s", p.IP, dbname, err))
+	}
+	return
+}
+
 // Set host property to given value then regenerate the URI and DSN properties.
 func (p *PG) Set(key, value string) (err error) {
 	switch key {
@@ -60,13 +60,22 @@ func (r *RDPG) InitSchema() (err error) {
 		"create_table_cfsb_instances",
 		"create_table_cfsb_bindings",
 		"create_table_cfsb_credentials",
+		"create_table_cfsb_operations",
+		"create_table_cfsb_migrations",
 		"create_table_tasks_schedules",
+		"create_table_tasks_maintenance_windows",
 		"create_table_tasks_tasks",
+		"create_table_tasks_dead_letters",
+		"create_table_tasks_history",
+		"create_table_tasks_workflows",
+		"create_table_tasks_workflow_steps",
+		"create_table_tasks_workflow_dependencies",
 		"create_table_rdpg_consul_watch_notifications",
 		"create_table_rdpg_events",
 		"create_table_rdpg_config",
 		"create_table_backups_file_history",
 		"create_table_backups_retention_rules",
+		"create_table_backups_settings",
 	}
 	for _, key := range keys {
 		k := strings.Split(strings.Replace(strings.Replace(key, "create_table_", "", 1), "_", ".", 1), ".")
@@ -107,6 +116,10 @@ func (r *RDPG) InitSchema() (err error) {
 	}
 	newDefaultConfig = config.DefaultConfig{Key: `defaultDaysToKeepFileHistory`, ClusterID: ClusterID, Value: `180`}
 	newDefaultConfig.Add()
+	newDefaultConfig = config.DefaultConfig{Key: `defaultDaysToKeepTaskHistory`, ClusterID: ClusterID, Value: `30`}
+	newDefaultConfig.Add()
+	newDefaultConfig = config.DefaultConfig{Key: `defaultTaskMaxAttempts`, ClusterID: ClusterID, Value: `5`}
+	newDefaultConfig.Add()
 
 	// TODO: Move initial population of services out of rdpg to Admin API.
 	if err := db.QueryRow(`SELECT name FROM cfsb.services WHERE name IN ('postgres', 'rdpg') LIMIT 1;`).Scan(&name); err != nil {
@@ -209,6 +222,7 @@ func insertDefaultSchedules(db *sqlx.DB) (err error) {
 
 		schedules = append(schedules, tasks.Schedule{ClusterID: ClusterID, ClusterService: globals.ClusterService, Role: `all`, Action: `Vacuum`, Data: `tasks.tasks`, NodeType: `write`, Frequency: `5 minutes`, Enabled: true})
 		schedules = append(schedules, tasks.Schedule{ClusterID: ClusterID, ClusterService: globals.ClusterService, Role: `all`, Action: `DeleteBackupHistory`, Data: ``, NodeType: `read`, Frequency: `1 hour`, Enabled: true})
+		schedules = append(schedules, tasks.Schedule{ClusterID: ClusterID, ClusterService: globals.ClusterService, Role: `all`, Action: `DeleteTaskHistory`, Data: ``, NodeType: `read`, Frequency: `1 hour`, Enabled: true})
 		schedules = append(schedules, tasks.Schedule{ClusterID: ClusterID, ClusterService: globals.ClusterService, Role: `all`, Action: `BackupDatabase`, Data: `rdpg`, NodeType: `read`, Frequency: `1 hour`, Enabled: true})
 		schedules = append(schedules, tasks.Schedule{ClusterID: ClusterID, ClusterService: globals.ClusterService, Role: `all`, Action: `EnforceFileRetention`, Data: ``, NodeType: `read`, Frequency: `1 hour`, Enabled: true})
 		schedules = append(schedules, tasks.Schedule{ClusterID: ClusterID, ClusterService: globals.ClusterService, Role: `all`, Action: `EnforceFileRetention`, Data: ``, NodeType: `write`, Frequency: `1 hour`, Enabled: true})
@@ -234,12 +248,14 @@ func insertDefaultSchedules(db *sqlx.DB) (err error) {
 			schedules = append(schedules, tasks.Schedule{ClusterID: ClusterID, ClusterService: globals.ClusterService, Role: `service`, Action: `DecommissionDatabases`, Data: ``, NodeType: `write`, Frequency: `15 minutes`, Enabled: true})
 			schedules = append(schedules, tasks.Schedule{ClusterID: ClusterID, ClusterService: globals.ClusterService, Role: `service`, Action: `Reconfigure`, Data: `pgbouncer`, NodeType: `read`, Frequency: `1 hour`, Enabled: true})
 			schedules = append(schedules, tasks.Schedule{ClusterID: ClusterID, ClusterService: globals.ClusterService, Role: `service`, Action: `Reconfigure`, Data: `pgbouncer`, NodeType: `write`, Frequency: `1 hour`, Enabled: true})
+			schedules = append(schedules, tasks.Schedule{ClusterID: ClusterID, ClusterService: globals.ClusterService, Role: `service`, Action: `EnforceQuotas`, Data: ``, NodeType: `write`, Frequency: `15 minutes`, Enabled: true})
 
 		}
 
 	} else { // Currently else is specifically postgresql only... we'll have to move this to a switch statement later :)
 		schedules = append(schedules, tasks.Schedule{ClusterID: ClusterID, ClusterService: globals.ClusterService, Role: `all`, Action: `Vacuum`, Data: `tasks.tasks`, NodeType: `write`, Frequency: `5 minutes`, Enabled: true})
 		schedules = append(schedules, tasks.Schedule{ClusterID: ClusterID, ClusterService: globals.ClusterService, Role: `all`, Action: `DeleteBackupHistory`, Data: ``, NodeType: `write`, Frequency: `1 hour`, Enabled: true})
+		schedules = append(schedules, tasks.Schedule{ClusterID: ClusterID, ClusterService: globals.ClusterService, Role: `all`, Action: `DeleteTaskHistory`, Data: ``, NodeType: `write`, Frequency: `1 hour`, Enabled: true})
 		schedules = append(schedules, tasks.Schedule{ClusterID: ClusterID, ClusterService: globals.ClusterService, Role: `all`, Action: `BackupDatabase`, Data: `rdpg`, NodeType: `write`, Frequency: `1 hour`, Enabled: true})
 		schedules = append(schedules, tasks.Schedule{ClusterID: ClusterID, ClusterService: globals.ClusterService, Role: `all`, Action: `EnforceFileRetention`, Data: ``, NodeType: `write`, Frequency: `1 hour`, Enabled: true})
 		schedules = append(schedules, tasks.Schedule{ClusterID: ClusterID, ClusterService: globals.ClusterService, Role: `all`, Action: `BackupAllDatabases`, Data: ``, NodeType: `write`, Frequency: `1 hour`, Enabled: true})
@@ -262,6 +278,7 @@ func insertDefaultSchedules(db *sqlx.DB) (err error) {
 			schedules = append(schedules, tasks.Schedule{ClusterID: ClusterID, ClusterService: globals.ClusterService, Role: `service`, Action: `PrecreateDatabases`, Data: ``, NodeType: `write`, Frequency: `1 minute`, Enabled: true})
 			schedules = append(schedules, tasks.Schedule{ClusterID: ClusterID, ClusterService: globals.ClusterService, Role: `service`, Action: `DecommissionDatabases`, Data: ``, NodeType: `write`, Frequency: `15 minutes`, Enabled: true})
 			schedules = append(schedules, tasks.Schedule{ClusterID: ClusterID, ClusterService: globals.ClusterService, Role: `service`, Action: `Reconfigure`, Data: `pgbouncer`, NodeType: `write`, Frequency: `1 hour`, Enabled: true})
+			schedules = append(schedules, tasks.Schedule{ClusterID: ClusterID, ClusterService: globals.ClusterService, Role: `service`, Action: `EnforceQuotas`, Data: ``, NodeType: `write`, Frequency: `15 minutes`, Enabled: true})
 		}
 	}
 
@@ -307,5 +324,160 @@ func columnMigrations() (err error) {
 			return
 		}
 	}
+
+	planColumns := [][]string{
+		{`backup_frequency`, `INTERVAL NOT NULL DEFAULT '1 hour'::interval`},
+		{`backup_window`, `TEXT NOT NULL DEFAULT ''`},
+		{`backup_mode`, `TEXT NOT NULL DEFAULT 'plain'`},
+		{`allowed_extensions`, `TEXT NOT NULL DEFAULT 'citext hstore ltree pg_trgm pgcrypto tablefunc unaccent uuid-ossp fuzzystrmatch'`},
+		{`allowed_settings`, `TEXT NOT NULL DEFAULT 'timezone statement_timeout lock_timeout search_path client_encoding datestyle intervalstyle work_mem'`},
+		{`allowed_pool_modes`, `TEXT NOT NULL DEFAULT 'session transaction'`},
+		{`max_storage_mb`, `BIGINT NOT NULL DEFAULT 0`},
+		{`max_connections`, `INTEGER NOT NULL DEFAULT 0`},
+		{`metadata`, `json NOT NULL DEFAULT '{}'::json`},
+	}
+	for _, c := range planColumns {
+		if err = addColumn(db, `cfsb`, `plans`, c[0], c[1]); err != nil {
+			return
+		}
+	}
+	serviceColumns := [][]string{
+		{`plan_updateable`, `BOOLEAN NOT NULL DEFAULT true`},
+		{`tags`, `TEXT NOT NULL DEFAULT 'rdpg postgresql'`},
+		{`metadata`, `json NOT NULL DEFAULT '{}'::json`},
+	}
+	for _, c := range serviceColumns {
+		if err = addColumn(db, `cfsb`, `services`, c[0], c[1]); err != nil {
+			return
+		}
+	}
+	// An instance's backup overrides, NULL for its plan's setting, and the
+	// parameters it was given.
+	instanceColumns := [][]string{
+		{`backup_frequency`, `INTERVAL`},
+		{`backup_window`, `TEXT`},
+		{`backup_mode`, `TEXT`},
+		{`parameters`, `JSON`},
+	}
+	for _, c := range instanceColumns {
+		if err = addColumn(db, `cfsb`, `instances`, c[0], c[1]); err != nil {
+			return
+		}
+	}
+
+	taskColumns := [][]string{
+		{`attempts`, `INTEGER NOT NULL DEFAULT 0`},
+		{`last_error`, `TEXT`},
+		{`run_after`, `TIMESTAMP NOT NULL DEFAULT NOW()`},
+		{`heartbeat_at`, `TIMESTAMP`},
+		{`priority`, `INTEGER NOT NULL DEFAULT 0`},
+		{`workflow_step_id`, `BIGINT`},
+		{`cancel_requested_at`, `TIMESTAMP`},
+		{`dedup_key`, `TEXT`},
+		{`progress_phase`, `TEXT`},
+		{`progress_percent`, `REAL`},
+		{`progress_bytes`, `BIGINT`},
+		{`progress_total_bytes`, `BIGINT`},
+		{`progress_at`, `TIMESTAMP`},
+	}
+	for _, c := range taskColumns {
+		if err = addColumn(db, `tasks`, `tasks`, c[0], c[1]); err != nil {
+			return
+		}
+	}
+	// Only one task with a given dedup key may be queued and not yet running,
+	// the index used to cover running tasks too.
+	if _, err = db.Exec(`DROP INDEX IF EXISTS tasks.tasks_dedup_key_idx`); err != nil {
+		log.Error(fmt.Sprintf("rdpg.columnMigrations() ! %s", err))
+		return
+	}
+	if err = addIndex(db, `tasks`, `tasks_pending_dedup_key_idx`, `CREATE UNIQUE INDEX tasks_pending_dedup_key_idx ON tasks.tasks (dedup_key) WHERE dedup_key IS NOT NULL AND locked_by IS NULL`); err != nil {
+		return
+	}
+	deadLetterColumns := [][]string{
+		{`priority`, `INTEGER NOT NULL DEFAULT 0`},
+		{`dedup_key`, `TEXT`},
+	}
+	for _, c := range deadLetterColumns {
+		if err = addColumn(db, `tasks`, `dead_letters`, c[0], c[1]); err != nil {
+			return
+		}
+	}
+
+	scheduleColumns := [][]string{
+		{`cron`, `TEXT NOT NULL DEFAULT ''`},
+		{`time_zone`, `TEXT NOT NULL DEFAULT 'UTC'`},
+		{`maintenance_window`, `TEXT NOT NULL DEFAULT ''`},
+		{`next_run_at`, `TIMESTAMP WITH TIME ZONE`},
+		{`priority`, `INTEGER`},
+		{`misfire_policy`, `TEXT NOT NULL DEFAULT 'run_once'`},
+		{`jitter`, `INTERVAL NOT NULL DEFAULT '0'::interval`},
+		{`scheduled_at`, `TIMESTAMP WITH TIME ZONE`},
+	}
+	for _, c := range scheduleColumns {
+		if err = addColumn(db, `tasks`, `schedules`, c[0], c[1]); err != nil {
+			return
+		}
+	}
+	// A schedule's priority is NULL for its action's default, it used to be 0.
+	sq = `SELECT is_nullable FROM information_schema.columns WHERE table_schema='tasks' AND table_name='schedules' AND column_name='priority';`
+	log.Trace(fmt.Sprintf("rdpg.columnMigrations() %s", sq))
+	var nullable string
+	if err = db.QueryRow(sq).Scan(&nullable); err != nil {
+		log.Error(fmt.Sprintf("rdpg.columnMigrations() ! %s", err))
+		return
+	}
+	if nullable == `NO` {
+		sq = `ALTER TABLE tasks.schedules ALTER COLUMN priority DROP NOT NULL, ALTER COLUMN priority DROP DEFAULT; UPDATE tasks.schedules SET priority=NULL WHERE priority=0;`
+		log.Trace(fmt.Sprintf("rdpg.columnMigrations() %s", sq))
+		if _, err = db.Exec(sq); err != nil {
+			log.Error(fmt.Sprintf("rdpg.columnMigrations() %s ! %s", sq, err))
+			return
+		}
+	}
+	// last_operation looks up an instance's latest operation.
+	if err = addIndex(db, `cfsb`, `operations_instance_id_idx`, `CREATE INDEX operations_instance_id_idx ON cfsb.operations (instance_id, id)`); err != nil {
+		return
+	}
+	return
+}
+
+// addIndex creates the index in schema with the given statement unless it is
+// already present.
+func addIndex(db *sqlx.DB, schema, index, create string) (err error) {
+	sq := fmt.Sprintf(`SELECT indexname FROM pg_indexes WHERE schemaname='%s' AND indexname='%s';`, schema, index)
+	log.Trace(fmt.Sprintf("rdpg.addIndex() %s", sq))
+	var name string
+	if err = db.QueryRow(sq).Scan(&name); err != nil {
+		if err != sql.ErrNoRows {
+			log.Error(fmt.Sprintf("rdpg.addIndex() ! %s", err))
+			return
+		}
+		log.Trace(fmt.Sprintf("rdpg.addIndex() %s", create))
+		if _, err = db.Exec(create); err != nil {
+			log.Error(fmt.Sprintf("rdpg.addIndex() %s ! %s", create, err))
+			return
+		}
+	}
+	return
+}
+
+// addColumn adds the column to schema.table unless it is already present.
+func addColumn(db *sqlx.DB, schema, table, column, definition string) (err error) {
+	sq := fmt.Sprintf(`SELECT column_name FROM information_schema.columns WHERE table_schema='%s' AND table_name='%s' AND column_name='%s';`, schema, table, column)
+	log.Trace(fmt.Sprintf("rdpg.addColumn() %s", sq))
+	var name string
+	if err = db.QueryRow(sq).Scan(&name); err != nil {
+		if err != sql.ErrNoRows {
+			log.Error(fmt.Sprintf("rdpg.addColumn() ! %s", err))
+			return
+		}
+		sq = fmt.Sprintf(`ALTER TABLE %s.%s ADD COLUMN %s %s`, schema, table, column, definition)
+		log.Trace(fmt.Sprintf("rdpg.addColumn() %s", sq))
+		if _, err = db.Exec(sq); err != nil {
+			log.Error(fmt.Sprintf("rdpg.addColumn() %s ! %s", sq, err))
+			return
+		}
+	}
 	return
 }
@@ -37,6 +37,15 @@ CREATE TABLE IF NOT EXISTS backups.retention_rules (
 	is_remote_rule	 BOOLEAN,
 	PRIMARY KEY(dbname, is_remote_rule)
 );
+`,
+	"create_table_backups_settings": `
+CREATE TABLE IF NOT EXISTS backups.settings (
+  dbname        TEXT PRIMARY KEY NOT NULL,
+  frequency     INTERVAL NOT NULL DEFAULT '1 hour'::interval,
+  backup_window TEXT NOT NULL DEFAULT '',
+  mode          TEXT NOT NULL DEFAULT 'plain',
+  updated_at    TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
 `,
 	"create_table_cfsb_services": `
 CREATE TABLE IF NOT EXISTS cfsb.services (
@@ -45,6 +54,9 @@ CREATE TABLE IF NOT EXISTS cfsb.services (
   name             TEXT NOT NULL,
   description      TEXT NOT NULL,
   bindable         BOOLEAN NOT NULL DEFAULT true,
+  plan_updateable  BOOLEAN NOT NULL DEFAULT true,
+  tags             TEXT NOT NULL DEFAULT 'rdpg postgresql',
+  metadata         json NOT NULL DEFAULT '{}'::json,
   dashboard_client json DEFAULT '{}'::json,
   created_at       TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
   effective_at     TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
@@ -60,6 +72,15 @@ CREATE TABLE IF NOT EXISTS cfsb.plans (
   name            TEXT,
   description     TEXT,
   free            BOOLEAN   DEFAULT true,
+  backup_frequency INTERVAL NOT NULL DEFAULT '1 hour'::interval,
+  backup_window   TEXT NOT NULL DEFAULT '',
+  backup_mode     TEXT NOT NULL DEFAULT 'plain',
+  allowed_extensions TEXT NOT NULL DEFAULT 'citext hstore ltree pg_trgm pgcrypto tablefunc unaccent uuid-ossp fuzzystrmatch',
+  allowed_settings   TEXT NOT NULL DEFAULT 'timezone statement_timeout lock_timeout search_path client_encoding datestyle intervalstyle work_mem',
+  allowed_pool_modes TEXT NOT NULL DEFAULT 'session transaction',
+  max_storage_mb  BIGINT NOT NULL DEFAULT 0,
+  max_connections INTEGER NOT NULL DEFAULT 0,
+  metadata        json NOT NULL DEFAULT '{}'::json,
   created_at      TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
   effective_at    TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
   ineffective_at  TIMESTAMP
@@ -78,6 +99,10 @@ CREATE TABLE IF NOT EXISTS cfsb.instances (
   dbname            TEXT NOT NULL UNIQUE,
   dbuser            TEXT NOT NULL,
   dbpass            TEXT NOT NULL,
+  backup_frequency  INTERVAL,
+  backup_window     TEXT,
+  backup_mode       TEXT,
+  parameters        JSON,
   created_at        TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
   effective_at      TIMESTAMP,
   ineffective_at    TIMESTAMP,
@@ -105,6 +130,24 @@ CREATE TABLE IF NOT EXISTS cfsb.credentials (
   created_at     TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
   effective_at   TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
   ineffective_at TIMESTAMP
+);`,
+	"create_table_cfsb_operations": `
+CREATE TABLE IF NOT EXISTS cfsb.operations (
+  id             BIGSERIAL PRIMARY KEY NOT NULL,
+  operation_id   TEXT UNIQUE NOT NULL DEFAULT gen_random_uuid(),
+  instance_id    TEXT      NOT NULL,
+  kind           TEXT      NOT NULL,
+  state          TEXT      NOT NULL DEFAULT 'in progress',
+  description    TEXT      NOT NULL DEFAULT '',
+  request        TEXT      NOT NULL DEFAULT '{}',
+  created_at     TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  updated_at     TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);`,
+	"create_table_cfsb_migrations": `
+CREATE TABLE IF NOT EXISTS cfsb.migrations (
+  operation_id   TEXT      PRIMARY KEY NOT NULL,
+  migration      TEXT      NOT NULL,
+  created_at     TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
 );`,
 	"create_table_rdpg_consul_watch_notifications": `
 CREATE TABLE IF NOT EXISTS rdpg.consul_watch_notifications (
@@ -133,9 +176,97 @@ CREATE TABLE IF NOT EXISTS tasks.tasks (
   data TEXT NOT NULL,
   ttl INTEGER NOT NULL DEFAULT 3600,
   node_type TEXT NOT NULL DEFAULT 'any',
+  priority INTEGER NOT NULL DEFAULT 0,
   locked_by TEXT,
+  attempts INTEGER NOT NULL DEFAULT 0,
+  last_error TEXT,
+  run_after TIMESTAMP NOT NULL DEFAULT NOW(),
   created_at TIMESTAMP NOT NULL DEFAULT NOW(),
-  processing_at TIMESTAMP
+  processing_at TIMESTAMP,
+  heartbeat_at TIMESTAMP,
+  cancel_requested_at TIMESTAMP,
+  workflow_step_id BIGINT,
+  dedup_key TEXT,
+  progress_phase TEXT,
+  progress_percent REAL,
+  progress_bytes BIGINT,
+  progress_total_bytes BIGINT,
+  progress_at TIMESTAMP
+);`,
+	"create_table_tasks_dead_letters": `
+CREATE TABLE IF NOT EXISTS tasks.dead_letters (
+  id BIGSERIAL NOT NULL PRIMARY KEY,
+  task_id BIGINT NOT NULL,
+  cluster_id TEXT NOT NULL,
+  cluster_service TEXT NOT NULL,
+  node TEXT NOT NULL,
+  role TEXT NOT NULL,
+  action TEXT NOT NULL,
+  data TEXT NOT NULL,
+  ttl INTEGER NOT NULL,
+  node_type TEXT NOT NULL,
+  priority INTEGER NOT NULL DEFAULT 0,
+  dedup_key TEXT,
+  attempts INTEGER NOT NULL,
+  last_error TEXT,
+  created_at TIMESTAMP NOT NULL,
+  failed_at TIMESTAMP NOT NULL DEFAULT NOW(),
+  replayed_at TIMESTAMP
+);`,
+	"create_table_tasks_workflows": `
+CREATE TABLE IF NOT EXISTS tasks.workflows (
+  id BIGSERIAL NOT NULL PRIMARY KEY,
+  name TEXT NOT NULL,
+  status TEXT NOT NULL DEFAULT 'running',
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  finished_at TIMESTAMP
+);`,
+	"create_table_tasks_workflow_steps": `
+CREATE TABLE IF NOT EXISTS tasks.workflow_steps (
+  id BIGSERIAL NOT NULL PRIMARY KEY,
+  workflow_id BIGINT NOT NULL REFERENCES tasks.workflows(id) ON DELETE CASCADE,
+  name TEXT NOT NULL,
+  cluster_id TEXT NOT NULL,
+  cluster_service TEXT NOT NULL,
+  node TEXT NOT NULL DEFAULT '*',
+  role TEXT NOT NULL,
+  action TEXT NOT NULL,
+  data TEXT NOT NULL DEFAULT '',
+  ttl INTEGER NOT NULL DEFAULT 3600,
+  node_type TEXT NOT NULL DEFAULT 'any',
+  priority INTEGER NOT NULL DEFAULT 0,
+  status TEXT NOT NULL DEFAULT 'pending',
+  task_id BIGINT,
+  worked_by TEXT NOT NULL DEFAULT '',
+  output TEXT NOT NULL DEFAULT '',
+  error TEXT NOT NULL DEFAULT '',
+  finished_at TIMESTAMP,
+  UNIQUE (workflow_id, name)
+);`,
+	"create_table_tasks_workflow_dependencies": `
+CREATE TABLE IF NOT EXISTS tasks.workflow_dependencies (
+  workflow_id BIGINT NOT NULL REFERENCES tasks.workflows(id) ON DELETE CASCADE,
+  step TEXT NOT NULL,
+  depends_on TEXT NOT NULL,
+  PRIMARY KEY (workflow_id, step, depends_on)
+);`,
+	"create_table_tasks_history": `
+CREATE TABLE IF NOT EXISTS tasks.history (
+  id BIGSERIAL NOT NULL PRIMARY KEY,
+  task_id BIGINT NOT NULL,
+  cluster_id TEXT NOT NULL,
+  cluster_service TEXT NOT NULL,
+  node TEXT NOT NULL,
+  role TEXT NOT NULL,
+  action TEXT NOT NULL,
+  data TEXT NOT NULL,
+  dbname TEXT NOT NULL DEFAULT '',
+  attempt INTEGER NOT NULL,
+  status TEXT NOT NULL,
+  error TEXT,
+  started_at TIMESTAMP NOT NULL,
+  finished_at TIMESTAMP NOT NULL,
+  duration INT
 );`,
 	"create_table_tasks_schedules": `
 CREATE TABLE IF NOT EXISTS tasks.schedules (
@@ -149,7 +280,23 @@ CREATE TABLE IF NOT EXISTS tasks.schedules (
   ttl INT NOT NULL DEFAULT 3600,
   node_type TEXT NOT NULL DEFAULT 'any',
   enabled BOOLEAN NOT NULL DEFAULT true,
+  priority INTEGER,
+  cron TEXT NOT NULL DEFAULT '',
+  time_zone TEXT NOT NULL DEFAULT 'UTC',
+  maintenance_window TEXT NOT NULL DEFAULT '',
+  misfire_policy TEXT NOT NULL DEFAULT 'run_once',
+  jitter INTERVAL NOT NULL DEFAULT '0'::interval,
   last_scheduled_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  scheduled_at TIMESTAMP WITH TIME ZONE,
+  next_run_at TIMESTAMP WITH TIME ZONE,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);`,
+	"create_table_tasks_maintenance_windows": `
+CREATE TABLE IF NOT EXISTS tasks.maintenance_windows (
+  name TEXT NOT NULL PRIMARY KEY,
+  cron TEXT NOT NULL,
+  time_zone TEXT NOT NULL DEFAULT 'UTC',
+  duration INTERVAL NOT NULL,
   created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
 );`,
 	"create_table_rdpg_config": `
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/signal"
 	"strconv"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/starkandwayne/rdpgd/admin"
 	"github.com/starkandwayne/rdpgd/cfsb"
@@ -17,14 +20,28 @@ import (
 	"github.com/starkandwayne/rdpgd/tasks"
 )
 
+// defaultShutdownGracePeriod is how long running tasks and requests are given
+// to finish on shutdown unless RDPGD_SHUTDOWN_GRACE_PERIOD is set.
+const defaultShutdownGracePeriod = 60 * time.Second
+
 //var - entry point for configuring a cluster
 var (
-	VERSION string
-	pidFile string
+	VERSION             string
+	pidFile             string
+	shutdownGracePeriod time.Duration
 )
 
 func init() {
 	pidFile = os.Getenv("RDPGD_PIDFILE")
+	shutdownGracePeriod = defaultShutdownGracePeriod
+	if v := os.Getenv("RDPGD_SHUTDOWN_GRACE_PERIOD"); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds < 0 {
+			log.Error(fmt.Sprintf(`main.init() Invalid RDPGD_SHUTDOWN_GRACE_PERIOD '%s', using %s`, v, defaultShutdownGracePeriod))
+		} else {
+			shutdownGracePeriod = time.Duration(seconds) * time.Second
+		}
+	}
 }
 
 func main() {
@@ -166,6 +183,7 @@ func signalHandler() (err error) {
 	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
 	for sig := range ch {
 		log.Info(fmt.Sprintf("main.signalHandler() Received signal %v, shutting down gracefully...", sig))
+		shutdown()
 		if _, err := os.Stat(pidFile); err == nil {
 			if err := os.Remove(pidFile); err != nil {
 				log.Error(err.Error())
@@ -176,3 +194,32 @@ func signalHandler() (err error) {
 	}
 	return
 }
+
+// shutdown stops the APIs accepting requests and the workers claiming tasks,
+// waiting up to the grace period for requests and tasks in progress. Tasks
+// still running after it are released to be retried.
+func shutdown() {
+	switch globals.ServiceRole {
+	case "manager", "service":
+	default:
+		return
+	}
+	log.Info(fmt.Sprintf(`main.shutdown() Waiting up to %s for running tasks and requests...`, shutdownGracePeriod))
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownGracePeriod)
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		admin.Shutdown(ctx)
+	}()
+	if globals.ServiceRole == "manager" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cfsb.Shutdown(ctx)
+		}()
+	}
+	tasks.Shutdown(shutdownGracePeriod)
+	wg.Wait()
+}
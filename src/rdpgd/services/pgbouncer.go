@@ -24,6 +24,16 @@ func (s *Service) ConfigurePGBouncer() (err error) {
 	}
 	// TODO: Adjust for cluster role...
 	// TODO: This only happens on service clusters... simply return for management
+	roles, err := instances.ActiveBindingRoles()
+	if err != nil {
+		log.Error(fmt.Sprintf("services#Service.ConfigurePGBouncer() ! %s", err))
+		return err
+	}
+	poolModes, err := instances.PoolModes()
+	if err != nil {
+		log.Error(fmt.Sprintf("services#Service.ConfigurePGBouncer() ! %s", err))
+		return err
+	}
 	instances, err := instances.Active()
 	if err != nil {
 		log.Error(fmt.Sprintf("services#Service.ConfigurePGBouncer() ! %s", err))
@@ -47,9 +57,19 @@ func (s *Service) ConfigurePGBouncer() (err error) {
 	//pu = append(pu, fmt.Sprintf(`"health" md5("checkhealth")`))
 	for index := range instances {
 		i := instances[index]
-		pi = append(pi, fmt.Sprintf(`%s = host=%s port=%s dbname=%s`, i.Database, "127.0.0.1", pgPort, i.Database))
+		db := fmt.Sprintf(`%s = host=%s port=%s dbname=%s`, i.Database, "127.0.0.1", pgPort, i.Database)
+		// A pool mode given as a parameter, see tasks.ApplyDatabaseParameters().
+		if mode, ok := poolModes[i.Database]; ok {
+			db += ` pool_mode=` + mode
+		}
+		pi = append(pi, db)
 		pu = append(pu, fmt.Sprintf(`"%s" "%s"`, i.User, i.Pass))
 	}
+	// Each binding connects as its own role, see tasks.BindInstance().
+	for index := range roles {
+		r := roles[index]
+		pu = append(pu, fmt.Sprintf(`"%s" "%s"`, r.User, r.Pass))
+	}
 	pi = append(pi, "")
 	pu = append(pu, "")
 
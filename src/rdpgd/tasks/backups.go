@@ -1,22 +1,35 @@
 package tasks
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"time"
 
-	consulapi "github.com/hashicorp/consul/api"
-
 	"github.com/starkandwayne/rdpgd/config"
 	"github.com/starkandwayne/rdpgd/globals"
 	"github.com/starkandwayne/rdpgd/history"
+	"github.com/starkandwayne/rdpgd/instances"
 	"github.com/starkandwayne/rdpgd/log"
-	"github.com/starkandwayne/rdpgd/utils/rdpgconsul"
+	"github.com/starkandwayne/rdpgd/utils/backup"
 	"github.com/starkandwayne/rdpgd/utils/rdpgpg"
 )
 
+func init() {
+	Register(`ScheduleNewDatabaseBackups`, Handler{Run: (*Task).ScheduleNewDatabaseBackups, Role: `service`})
+	// Both run pg_dump, at most 2 at once on a node.
+	Register(`BackupDatabase`, Handler{Run: (*Task).BackupDatabase, Decode: decodeNonEmpty, Concurrency: 2, LimitGroup: `pg_dump`})
+	Register(`BackupAllDatabases`, Handler{Run: (*Task).BackupAllDatabases, Concurrency: 1, LimitGroup: `pg_dump`})
+	Register(`VerifyBackup`, Handler{Run: (*Task).VerifyBackup, Decode: decodeS3FileMetadata})
+	Register(`BackupWorkflow`, Handler{Run: (*Task).BackupWorkflow, Decode: decodeNonEmpty})
+}
+
 type backupParams struct {
 	pgDumpPath   string `json:"pg_dump_path"`
 	pgPort       string `json:"pg_port"`
@@ -24,10 +37,13 @@ type backupParams struct {
 	databaseName string `json:"database_name"`
 	baseFileName string `json:"base_file_name"`
 	node         string `json:"node"`
+	mode         string
+	ctx          context.Context
 }
 
-//ScheduleNewDatabaseBackups - Responsible for adding any databases which are in
-//cfsb.instances and aren't already scheduled in tasks.schedules
+// ScheduleNewDatabaseBackups - Responsible for adding any databases which are in
+// cfsb.instances and aren't already scheduled in tasks.schedules, and for
+// rescheduling backups whose settings in backups.settings changed
 func (t *Task) ScheduleNewDatabaseBackups() (err error) {
 
 	//SELECT active databases in cfsb.instances which aren't in tasks.schedules
@@ -45,16 +61,43 @@ func (t *Task) ScheduleNewDatabaseBackups() (err error) {
 		if t.ClusterService == "pgbdr" {
 			nodeType = `read`
 		}
-		newScheduledTask := Schedule{ClusterID: ClusterID, ClusterService: t.ClusterService, Role: `service`, Action: `BackupDatabase`, Data: databaseName, NodeType: nodeType, Frequency: `1 hour`, Enabled: true}
+		// Spread the backups of databases created together over the hour.
+		newScheduledTask := Schedule{ClusterID: ClusterID, ClusterService: t.ClusterService, Role: `service`, Action: `BackupDatabase`, Data: databaseName, NodeType: nodeType, Frequency: `1 hour`, Jitter: `30 minutes`, Enabled: true}
 		err = newScheduledTask.Add()
 
 	}
+
+	// Bring the backup schedules in line with the settings the management
+	// cluster sent, those rescheduled have their next run worked out again.
+	sq = `UPDATE tasks.schedules s SET frequency=b.frequency, maintenance_window=b.backup_window, jitter=LEAST(s.jitter, b.frequency/2), next_run_at=NULL FROM backups.settings b WHERE s.action='BackupDatabase' AND s.data=b.dbname AND (s.frequency<>b.frequency OR s.maintenance_window<>b.backup_window OR s.jitter>b.frequency/2)`
+	log.Trace(fmt.Sprintf(`tasks.Task<%d>#ScheduleNewDatabaseBackups() > %s`, t.ID, sq))
+	OpenWorkDB()
+	_, err = workDB.Exec(sq)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.Task<%d>#ScheduleNewDatabaseBackups() Failed to apply backup settings ! %s`, t.ID, err))
+	}
 	return
 }
 
-//BackupDatabase - Perform a schema and database backup of a given database to local disk
+// ApplyBackupSettings - Record the backup settings the management cluster sent
+// for a database and reschedule its backups to match straight away.
+func ApplyBackupSettings(settings instances.BackupSettings) (err error) {
+	err = instances.SaveBackupSettings(settings)
+	if err != nil {
+		return
+	}
+	t := Task{ClusterID: ClusterID, ClusterService: globals.ClusterService, Node: `*`, Role: `service`, Action: `ScheduleNewDatabaseBackups`, NodeType: `write`}
+	t.DedupKey = DedupKey(t.Action)
+	err = t.Enqueue()
+	if err == ErrDuplicate {
+		return nil
+	}
+	return
+}
+
+// BackupDatabase - Perform a schema and database backup of a given database to local disk
 func (t *Task) BackupDatabase() (err error) {
-	b := backupParams{}
+	b := backupParams{ctx: t.context()}
 
 	//Make sure database actually exists first.
 	b.databaseName = t.Data
@@ -71,12 +114,13 @@ func (t *Task) BackupDatabase() (err error) {
 			return errors.New("Database doesn't exist.")
 		}
 	}
-	lockAcquired, sessID := acquireBackupLock(b.databaseName)
-	if !lockAcquired {
+	lock := backupLockName(b.databaseName)
+	lockAcquired, err := coordination().TryLock(lock)
+	if err != nil || !lockAcquired {
 		log.Warn("Aborting Backup: Unable to acquire database lock. Is another backup already in progress?")
 		return errors.New("Unable to acquire database lock")
 	}
-	defer releaseBackupLock(b.databaseName, sessID)
+	defer coordination().Unlock(lock)
 
 	b.pgDumpPath, err = config.GetValue(`pgDumpBinaryLocation`)
 	if err != nil {
@@ -90,11 +134,13 @@ func (t *Task) BackupDatabase() (err error) {
 	if err != nil {
 		return err
 	}
-	b.node, err = rdpgconsul.GetNode()
+	b.node = globals.MyIP
+	b.baseFileName = getBaseFileName() //Use this to keep schema and data file names the same
+	settings, err := instances.FindBackupSettings(b.databaseName)
 	if err != nil {
 		return err
 	}
-	b.baseFileName = getBaseFileName() //Use this to keep schema and data file names the same
+	b.mode = settings.Mode
 
 	err = createTargetFolder(b.basePath + `/` + b.databaseName)
 	if err != nil {
@@ -102,26 +148,105 @@ func (t *Task) BackupDatabase() (err error) {
 		return err
 	}
 
-	schemaDataFileHistory, err := createSchemaAndDataFile(b)
-	if err != nil {
-		log.Error(fmt.Sprintf("tasks.BackupDatabase() Could not create schema and data file for database %s ! %s", b.databaseName, err))
+	stopProgress := t.watchFileProgress(`pg_dump `+b.databaseName, b.basePath+"/"+b.databaseName+"/"+b.baseFileName+b.fileSuffix())
+	schemaDataFileHistory, backupErr := createSchemaAndDataFile(b)
+	stopProgress()
+	if backupErr != nil {
+		log.Error(fmt.Sprintf("tasks.BackupDatabase() Could not create schema and data file for database %s ! %s", b.databaseName, backupErr))
 		schemaDataFileHistory.Status = `error`
 	}
 	err = history.InsertBackupHistory(schemaDataFileHistory)
 
 	if b.databaseName == `rdpg` {
-		globalsFileHistory, err := createGlobalsFile(b)
-		if err != nil {
-			log.Error(fmt.Sprintf("tasks.BackupDatabase() Could not create globals file for database %s ! %s", b.databaseName, err))
+		globalsFileHistory, globalsErr := createGlobalsFile(b)
+		if globalsErr != nil {
+			log.Error(fmt.Sprintf("tasks.BackupDatabase() Could not create globals file for database %s ! %s", b.databaseName, globalsErr))
 			globalsFileHistory.Status = `error`
+			if backupErr == nil {
+				backupErr = globalsErr
+			}
 		}
 
 		err = history.InsertBackupHistory(globalsFileHistory)
 
 	}
+	// A failed dump must be reported to the worker so the task is retried,
+	// even when its history row was written successfully.
+	if backupErr != nil {
+		return backupErr
+	}
+	// Hand the dump to the next step when run in a workflow.
+	output, _ := json.Marshal(S3FileMetadata{Location: schemaDataFileHistory.BackupPathAndFile, DBName: b.databaseName, Node: globals.MyIP, ClusterID: globals.ClusterID})
+	t.SetOutput(string(output))
+	return
+}
+
+// VerifyBackup - Check a backup file is readable and not empty, recording its
+// SHA-256 checksum for CopyFileToS3 to verify the upload against
+func (t *Task) VerifyBackup() (err error) {
+	fm, ok := t.Payload().(S3FileMetadata)
+	if !ok {
+		decoded, err := decodeS3FileMetadata(t.Data)
+		if err != nil {
+			log.Error(fmt.Sprintf("tasks.VerifyBackup() Invalid data %s ! %s", t.Data, err))
+			return err
+		}
+		fm = decoded.(S3FileMetadata)
+	}
+	file, err := os.Open(fm.Location)
+	if err != nil {
+		log.Error(fmt.Sprintf("tasks.VerifyBackup() Could not open backup file %s ! %s", fm.Location, err))
+		return err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, file)
+	if err != nil {
+		log.Error(fmt.Sprintf("tasks.VerifyBackup() Could not read backup file %s ! %s", fm.Location, err))
+		return err
+	}
+	if size == 0 {
+		return fmt.Errorf(`backup file %s is empty`, fm.Location)
+	}
+	fm.Checksum = hex.EncodeToString(h.Sum(nil))
+	log.Trace(fmt.Sprintf("tasks.VerifyBackup() %s %d bytes sha256 %s", fm.Location, size, fm.Checksum))
+	output, _ := json.Marshal(fm)
+	t.SetOutput(string(output))
+	return
+}
+
+// BackupWorkflow - Start the workflow which backs up the database named in the
+// task's data, verifies the dump, copies it to S3 when enabled and only then
+// enforces local file retention
+func (t *Task) BackupWorkflow() (err error) {
+	w := NewBackupWorkflow(t.Data, *t)
+	err = w.Start()
+	if err != nil {
+		log.Error(fmt.Sprintf("tasks.BackupWorkflow() Starting workflow for %s ! %s", t.Data, err))
+	}
 	return
 }
 
+// NewBackupWorkflow returns the backup -> verify -> upload -> retention
+// workflow for a database, its steps run with the template's cluster, role and
+// node type.
+func NewBackupWorkflow(dbname string, template Task) *Workflow {
+	step := func(action, data string) Task {
+		return Task{ClusterID: template.ClusterID, ClusterService: template.ClusterService, Node: template.Node, Role: template.Role, NodeType: template.NodeType, Action: action, Data: data}
+	}
+	w := NewWorkflow(fmt.Sprintf(`backup %s`, dbname))
+	w.Step(`backup`, step(`BackupDatabase`, dbname))
+	w.Step(`verify`, step(`VerifyBackup`, ``), `backup`)
+	last := `verify`
+	if isS3FileCopyEnabled() {
+		w.Step(`upload`, step(`CopyFileToS3`, ``), `verify`)
+		last = `upload`
+	}
+	w.Step(`retention`, step(`EnforceFileRetention`, ``), last)
+	return w
+}
+
 // createTargetFolder - On the os, create the backup folder if it doesn't exist
 func createTargetFolder(fullPath string) (err error) {
 	err = os.MkdirAll(fullPath, 0777)
@@ -140,7 +265,7 @@ func createSchemaFile(b backupParams) (f history.BackupFileHistory, err error) {
 	f.DBName = b.databaseName
 	f.Node = b.node
 
-	_, err = exec.Command(b.pgDumpPath, "-p", b.pgPort, "-U", "vcap", "-f", f.BackupPathAndFile, "-c", "-s", "-N", `"bdr"`, b.databaseName).CombinedOutput()
+	_, err = exec.CommandContext(b.ctx, b.pgDumpPath, "-p", b.pgPort, "-U", "vcap", "-f", f.BackupPathAndFile, "-c", "-s", "-N", `"bdr"`, b.databaseName).CombinedOutput()
 	if err != nil {
 		log.Error(fmt.Sprintf(`tasks.createSchemaFile() Error running pg_dump command for: %s file: %s ! %s`, b.databaseName, f.BackupPathAndFile, err))
 		return
@@ -157,12 +282,16 @@ func createSchemaAndDataFile(b backupParams) (f history.BackupFileHistory, err e
 	start := time.Now()
 	f.Duration = 0
 	f.Status = `ok`
-	f.BackupFile = b.baseFileName + ".sql"
+	f.BackupFile = b.baseFileName + b.fileSuffix()
 	f.BackupPathAndFile = b.basePath + "/" + b.databaseName + "/" + f.BackupFile
 	f.DBName = b.databaseName
 	f.Node = b.node
 
-	_, err = exec.Command(b.pgDumpPath, "-p", b.pgPort, "-U", "vcap", "-f", f.BackupPathAndFile, "-b", "-N", `"bdr"`, b.databaseName).CombinedOutput()
+	args := []string{"-p", b.pgPort, "-U", "vcap", "-f", f.BackupPathAndFile, "-b", "-N", `"bdr"`}
+	if b.mode == instances.BackupModeCustom {
+		args = append(args, "-Fc")
+	}
+	_, err = exec.CommandContext(b.ctx, b.pgDumpPath, append(args, b.databaseName)...).CombinedOutput()
 	if err != nil {
 		log.Error(fmt.Sprintf(`tasks.createSchemaAndDataFile() Error running pg_dump command for: %s file: %s ! %s`, b.databaseName, f.BackupPathAndFile, err))
 		return
@@ -173,6 +302,15 @@ func createSchemaAndDataFile(b backupParams) (f history.BackupFileHistory, err e
 
 }
 
+// fileSuffix - The suffix of the schema and data file for the backup's dump
+// mode, custom format dumps are restored by pg_restore
+func (b backupParams) fileSuffix() string {
+	if b.mode == instances.BackupModeCustom {
+		return backup.DumpFileSuffix
+	}
+	return ".sql"
+}
+
 // createDataFile - Create a pg backup file which contains only data which can be
 // copied back to an existing schema
 func createDataFile(b backupParams) (f history.BackupFileHistory, err error) {
@@ -185,7 +323,7 @@ func createDataFile(b backupParams) (f history.BackupFileHistory, err error) {
 	f.DBName = b.databaseName
 	f.Node = b.node
 
-	_, err = exec.Command(b.pgDumpPath, "-p", b.pgPort, "-U", "vcap", "-f", f.BackupPathAndFile, "-a", "-b", "-N", `"bdr"`, b.databaseName).CombinedOutput()
+	_, err = exec.CommandContext(b.ctx, b.pgDumpPath, "-p", b.pgPort, "-U", "vcap", "-f", f.BackupPathAndFile, "-a", "-b", "-N", `"bdr"`, b.databaseName).CombinedOutput()
 	if err != nil {
 		log.Error(fmt.Sprintf(`tasks.createDataFile() Error running pg_dump command for: %s file: %s ! %s`, b.databaseName, f.BackupPathAndFile, err))
 		return
@@ -209,7 +347,7 @@ func createGlobalsFile(b backupParams) (f history.BackupFileHistory, err error)
 
 	pgDumpallPath := b.pgDumpPath + `all`
 
-	_, err = exec.Command(pgDumpallPath, "-p", b.pgPort, "-U", "vcap", "-f", f.BackupPathAndFile, "--globals-only").CombinedOutput()
+	_, err = exec.CommandContext(b.ctx, pgDumpallPath, "-p", b.pgPort, "-U", "vcap", "-f", f.BackupPathAndFile, "--globals-only").CombinedOutput()
 	if err != nil {
 		log.Error(fmt.Sprintf(`tasks.createGlobalsFile() Error running pg_dumpall command for: %s file: %s ! %s`, b.databaseName, f.BackupPathAndFile, err))
 		return
@@ -233,7 +371,7 @@ func createDumpAllFile(b backupParams) (f history.BackupFileHistory, err error)
 
 	pgDumpallPath := b.pgDumpPath + `all`
 
-	_, err = exec.Command(pgDumpallPath, "-p", b.pgPort, "-b", "-U", "vcap", "-f", f.BackupPathAndFile).CombinedOutput()
+	_, err = exec.CommandContext(b.ctx, pgDumpallPath, "-p", b.pgPort, "-b", "-U", "vcap", "-f", f.BackupPathAndFile).CombinedOutput()
 	if err != nil {
 		log.Error(fmt.Sprintf(`tasks.createDumpAllFile() Error running pg_dumpall command for: %s file: %s ! %s`, b.databaseName, f.BackupPathAndFile, err))
 		return
@@ -248,47 +386,14 @@ func getBaseFileName() (baseFileName string) {
 	return
 }
 
-func acquireBackupLock(dbname string) (locked bool, sessID string) {
-	key := fmt.Sprintf("rdpg/%s/tasks/backups/%s/lock", globals.ClusterID, dbname)
-	client, _ := consulapi.NewClient(consulapi.DefaultConfig())
-	sessID, _, err := client.Session().Create(nil, nil)
-	if err != nil {
-		log.Error(fmt.Sprintf("tasks.backups.acquireBackupLock() Error Creating Session %s ! %s", key, err))
-		locked = false
-	}
-	locked, _, err = client.KV().Acquire(&consulapi.KVPair{Key: key, Value: []byte("locked"), Session: sessID}, nil)
-	if err != nil {
-		log.Error(fmt.Sprintf("tasks.backups.acquireBackupLock() Error Locking Backup Key %s ! %s", key, err))
-		locked = false
-	}
-	return
-}
-
-func releaseBackupLock(dbname, sessID string) {
-	key := fmt.Sprintf("rdpg/%s/tasks/backups/%s/lock", globals.ClusterID, dbname)
-	client, _ := consulapi.NewClient(consulapi.DefaultConfig())
-	//This Get part is for the purpose of making the check that only the holder of the lock is releasing it.
-	// This part could be pruned if this test becomes obsolete.
-	result, _, err := client.KV().Get(key, nil)
-	if err != nil {
-		log.Error(fmt.Sprintf("tasks.backups.releaseBackupLock() Error retrieving lock Key %s ! %s", key, err))
-		return
-	}
-	if result.Session != sessID {
-		log.Error(fmt.Sprintf("tasks.backups.releaseBackupLock() Can't release another session's lock (%s ~= %s) ! %s", result.Session, sessID, err))
-		return
-	}
-	//At this point, we're cleared to release the lock
-	_, _, err = client.KV().Release(&consulapi.KVPair{Key: key, Value: []byte("unlocked"), Session: sessID}, nil)
-	if err != nil {
-		log.Error(fmt.Sprintf("tasks.backups.releaseBackupLock() Error Releasing Backup Key %s ! %s", key, err))
-	}
-	return
+// backupLockName returns the name of the lock held while backing up dbname.
+func backupLockName(dbname string) string {
+	return fmt.Sprintf("rdpg/%s/tasks/backups/%s/lock", globals.ClusterID, dbname)
 }
 
-//BackupAllDatabases - Use pg_dumpall on a SOLO cluster to perform a full backup of everything postgres related
+// BackupAllDatabases - Use pg_dumpall on a SOLO cluster to perform a full backup of everything postgres related
 func (t *Task) BackupAllDatabases() (err error) {
-	b := backupParams{}
+	b := backupParams{ctx: t.context()}
 
 	b.databaseName = "postgres"
 	b.pgDumpPath, err = config.GetValue(`pgDumpBinaryLocation`)
@@ -303,10 +408,7 @@ func (t *Task) BackupAllDatabases() (err error) {
 	if err != nil {
 		return err
 	}
-	b.node, err = rdpgconsul.GetNode()
-	if err != nil {
-		return err
-	}
+	b.node = globals.MyIP
 	b.baseFileName = getBaseFileName() //Use this to keep schema and data file names the same
 
 	err = createTargetFolder(b.basePath + `/` + b.databaseName)
@@ -315,12 +417,16 @@ func (t *Task) BackupAllDatabases() (err error) {
 		return err
 	}
 
-	createDumpAllFileHistory, err := createDumpAllFile(b)
-	if err != nil {
-		log.Error(fmt.Sprintf("tasks.BackupAllDatabases() Could not create pg_dumpall file for database %s ! %s", b.databaseName, err))
+	stopProgress := t.watchFileProgress(`pg_dumpall`, b.basePath+"/"+b.databaseName+"/"+b.baseFileName+".sql")
+	createDumpAllFileHistory, backupErr := createDumpAllFile(b)
+	stopProgress()
+	if backupErr != nil {
+		log.Error(fmt.Sprintf("tasks.BackupAllDatabases() Could not create pg_dumpall file for database %s ! %s", b.databaseName, backupErr))
 		createDumpAllFileHistory.Status = `error`
 	}
 	err = history.InsertBackupHistoryDumpAll(createDumpAllFileHistory)
-
+	if backupErr != nil {
+		return backupErr
+	}
 	return
 }
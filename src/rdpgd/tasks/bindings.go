@@ -0,0 +1,122 @@
+package tasks
+
+import (
+	"fmt"
+
+	consulapi "github.com/hashicorp/consul/api"
+
+	"github.com/starkandwayne/rdpgd/bdr"
+	"github.com/starkandwayne/rdpgd/instances"
+	"github.com/starkandwayne/rdpgd/log"
+	"github.com/starkandwayne/rdpgd/pg"
+)
+
+// BindInstance - Create the binding's role on this service cluster as a member
+// of the instance owner role, record it and reconfigure pgbouncer on each node
+// so that the role may connect.
+func BindInstance(r *instances.BindingRole) (err error) {
+	i, err := instances.FindByDatabase(r.Database)
+	if err != nil {
+		return
+	}
+	if i == nil {
+		return fmt.Errorf(`database %s not found`, r.Database)
+	}
+	r.Owner = i.User
+	switch i.ClusterService {
+	case `pgbdr`:
+		client, err := consulapi.NewClient(consulapi.DefaultConfig())
+		if err != nil {
+			log.Error(fmt.Sprintf("tasks.BindInstance(%s) consulapi.NewClient() ! %s", r.BindingID, err))
+			return err
+		}
+		b := bdr.NewBDR(ClusterID, client)
+		if err = b.CreateUser(r.User, r.Pass); err != nil {
+			return err
+		}
+		if err = b.GrantRole(r.Owner, r.User); err != nil {
+			return err
+		}
+	default:
+		p := pg.NewPG(`127.0.0.1`, pgPort, `rdpg`, `rdpg`, pgPass)
+		if err = p.CreateUser(r.User, r.Pass); err != nil {
+			return
+		}
+		if err = p.GrantRole(r.Owner, r.User); err != nil {
+			return
+		}
+	}
+	if err = r.Record(); err != nil {
+		return
+	}
+	reconfigurePGBouncer(i, fmt.Sprintf(`tasks.BindInstance(%s)`, r.BindingID))
+	return
+}
+
+// UnbindInstance - Drop the binding's role from this service cluster after
+// terminating its sessions and reconfigure pgbouncer on each node without it.
+func UnbindInstance(r *instances.BindingRole) (err error) {
+	i, err := instances.FindByDatabase(r.Database)
+	if err != nil {
+		return
+	}
+	if i == nil {
+		return fmt.Errorf(`database %s not found`, r.Database)
+	}
+	if r.User == i.User {
+		return fmt.Errorf(`refusing to drop %s, the owner of %s`, r.User, r.Database)
+	}
+	if err = r.Retire(); err != nil {
+		return
+	}
+	reconfigurePGBouncer(i, fmt.Sprintf(`tasks.UnbindInstance(%s)`, r.BindingID))
+	return dropBindingRole(i, r.User)
+}
+
+// dropBindingRole terminates the sessions of a binding's role and drops it.
+// Its sessions act as the owner role, anything it still owns in the instance's
+// database is handed to the owner first, on each node of a pgbdr cluster.
+func dropBindingRole(i *instances.Instance, dbuser string) (err error) {
+	switch i.ClusterService {
+	case `pgbdr`:
+		client, err := consulapi.NewClient(consulapi.DefaultConfig())
+		if err != nil {
+			log.Error(fmt.Sprintf("tasks.dropBindingRole(%s) consulapi.NewClient() ! %s", dbuser, err))
+			return err
+		}
+		b := bdr.NewBDR(ClusterID, client)
+		if err = b.TerminateUserSessions(dbuser); err != nil {
+			return err
+		}
+		if err = b.ReassignOwned(i.Database, dbuser, i.User); err != nil {
+			return err
+		}
+		return b.DropUser(dbuser)
+	default:
+		p := pg.NewPG(`127.0.0.1`, pgPort, `rdpg`, `rdpg`, pgPass)
+		p.TerminateUserSessions(dbuser)
+		if exists, _ := p.DatabaseExists(i.Database); exists {
+			if err = p.ReassignOwned(i.Database, dbuser, i.User); err != nil {
+				return
+			}
+		}
+		return p.DropUser(dbuser)
+	}
+}
+
+// reconfigurePGBouncer enqueues a pgbouncer Reconfigure on each node of the
+// instance's service cluster.
+func reconfigurePGBouncer(i *instances.Instance, caller string) {
+	ips, err := i.ClusterIPs()
+	if err != nil {
+		log.Error(fmt.Sprintf(`%s i.ClusterIPs() ! %s`, caller, err))
+		return
+	}
+	for _, ip := range ips {
+		newTask := Task{ClusterID: ClusterID, ClusterService: i.ClusterService, Node: ip, Role: `service`, Action: `Reconfigure`, Data: `pgbouncer`}
+		err = newTask.Enqueue()
+		if err != nil {
+			log.Error(fmt.Sprintf(`%s Enqueue Reconfigure of pgbouncer on %s ! %s`, caller, ip, err))
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package tasks
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+
+	"github.com/starkandwayne/rdpgd/globals"
+	"github.com/starkandwayne/rdpgd/log"
+	"github.com/starkandwayne/rdpgd/pg"
+)
+
+const (
+	// claimRowLock claims tasks by locking their row, PostgreSQL's row locks
+	// keep two workers from claiming the same task.
+	claimRowLock = `row_lock`
+	// claimConsul claims tasks while holding the cluster's work lock, taken
+	// from the configured coordinator, for BDR clusters where row locks are not
+	// replicated between nodes.
+	claimConsul = `consul`
+	// tasksChannel is the channel Enqueue() notifies workers on.
+	tasksChannel = `rdpg_tasks`
+	// pollInterval is how long an idle worker waits for a notification before
+	// looking for tasks anyway, eg. tasks whose run_after has passed.
+	pollInterval = 5 * time.Second
+	// claimConflictRetries is how many times a worker tries again straight
+	// away when the task it selected is being claimed by another.
+	claimConflictRetries = 5
+)
+
+// claimMode returns how this node's workers claim tasks, RDPGD_TASK_CLAIM_MODE
+// or, when it is unset or auto, claimConsul on BDR clusters and claimRowLock
+// otherwise.
+func claimMode() string {
+	mode := os.Getenv(`RDPGD_TASK_CLAIM_MODE`)
+	switch mode {
+	case claimConsul, claimRowLock:
+		return mode
+	case ``, `auto`:
+	default:
+		log.Error(fmt.Sprintf(`tasks.claimMode() Invalid RDPGD_TASK_CLAIM_MODE '%s', using auto`, mode))
+	}
+	if globals.ClusterService == `pgbdr` {
+		return claimConsul
+	}
+	return claimRowLock
+}
+
+// rowLockClause returns how claimWithRowLock locks the task it selects:
+// skipping the tasks other workers are claiming on PostgreSQL 9.5 and later,
+// failing straight away instead of waiting for them on older versions such as
+// the bundled 9.4, which have no SKIP LOCKED.
+func rowLockClause() string {
+	var version int
+	err := workDB.Get(&version, `SELECT current_setting('server_version_num')::int`)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.rowLockClause() Selecting server_version_num, using NOWAIT ! %s`, err))
+		return `FOR UPDATE NOWAIT`
+	}
+	if version < 90500 {
+		return `FOR UPDATE NOWAIT`
+	}
+	return `FOR UPDATE SKIP LOCKED`
+}
+
+// claimQuery selects the next task this node may work, leaving out actions
+// at their concurrency limit.
+func claimQuery() string {
+	nodeType := `read`
+	if coordination().IsWriteNode() {
+		nodeType = `write`
+	}
+	return fmt.Sprintf(`SELECT id,cluster_id,node,role,action,data,ttl,node_type,cluster_service,attempts,priority,COALESCE(workflow_step_id,0) AS workflow_step_id FROM tasks.tasks WHERE locked_by IS NULL AND run_after <= CURRENT_TIMESTAMP AND role IN ('all','%s') AND node IN ('*','%s') AND node_type IN ('any','%s')%s ORDER BY %s LIMIT 1`, globals.ServiceRole, globals.MyIP, nodeType, excludeActions(pool.saturated()), dequeueOrder)
+}
+
+// claimWithRowLock returns a claim locking the next task in a transaction with
+// the given lock clause and marking it locked by this node. A task another
+// worker is claiming, which NOWAIT fails on, is looked for again after a
+// moment, the other worker has marked it by then. The claim returns nil when
+// there is no task to claim.
+func claimWithRowLock(lockClause string) func() (*Task, error) {
+	return func() (task *Task, err error) {
+		for retry := 0; ; retry++ {
+			task, err = claimRow(lockClause)
+			if !isLockNotAvailable(err) || retry >= claimConflictRetries {
+				return
+			}
+			log.Trace(fmt.Sprintf(`tasks.claimWithRowLock() Task being claimed by another worker, retrying ! %s`, err))
+			sleep(time.Duration(10*(retry+1)) * time.Millisecond)
+		}
+	}
+}
+
+// claimRow is a single attempt of claimWithRowLock.
+func claimRow(lockClause string) (task *Task, err error) {
+	tx, err := workDB.Beginx()
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.claimRow() Begin ! %s`, err))
+		return
+	}
+	tasks := []Task{}
+	sq := claimQuery() + ` ` + lockClause
+	log.Trace(fmt.Sprintf(`tasks.claimRow() > %s`, sq))
+	err = tx.Select(&tasks, sq)
+	if err != nil {
+		if !isLockNotAvailable(err) {
+			log.Error(fmt.Sprintf(`tasks.claimRow() Selecting Task ! %s`, err))
+		}
+		tx.Rollback()
+		return
+	}
+	if len(tasks) == 0 || !pool.acquire(tasks[0].Action) {
+		tx.Rollback()
+		return
+	}
+	task = &tasks[0]
+	sq = fmt.Sprintf(`UPDATE tasks.tasks SET locked_by='%s', processing_at=CURRENT_TIMESTAMP, heartbeat_at=CURRENT_TIMESTAMP WHERE id=%d`, myIP, task.ID)
+	log.Trace(fmt.Sprintf(`tasks.claimRow() > %s`, sq))
+	_, err = tx.Exec(sq)
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.claimRow() Task<%d> Locking ! %s`, task.ID, err))
+		pool.release(task.Action)
+		return nil, err
+	}
+	return
+}
+
+// isLockNotAvailable tells if err is PostgreSQL's lock_not_available, which
+// FOR UPDATE NOWAIT fails with on a row locked by another transaction.
+func isLockNotAvailable(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == `55P03`
+}
+
+// claimWithWorkLock selects and marks the next task while holding the work
+// lock. It returns nil when there is no task to claim.
+func claimWithWorkLock() (task *Task, err error) {
+	err = WorkLock()
+	if err != nil {
+		return
+	}
+	defer WorkUnlock()
+
+	tasks := []Task{}
+	sq := claimQuery()
+	log.Trace(fmt.Sprintf(`tasks.claimWithWorkLock() > %s`, sq))
+	err = workDB.Select(&tasks, sq)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.claimWithWorkLock() Selecting Task ! %s`, err))
+		return
+	}
+	if len(tasks) == 0 || !pool.acquire(tasks[0].Action) {
+		return
+	}
+	task = &tasks[0]
+	err = task.Dequeue()
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.claimWithWorkLock() Task<%d>#Dequeue() ! %s`, task.ID, err))
+		pool.release(task.Action)
+		return nil, err
+	}
+	return
+}
+
+// listenForTasks returns a listener notified whenever a task is enqueued. It
+// connects to PostgreSQL directly as LISTEN does not survive pgbouncer's
+// transaction pooling. It returns nil if it could not listen, workers then
+// only poll.
+func listenForTasks() *pq.Listener {
+	p := pg.NewPG(`127.0.0.1`, pgPort, `rdpg`, `rdpg`, pgPass)
+	listener := pq.NewListener(p.URI, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Error(fmt.Sprintf(`tasks.listenForTasks() Listener event %d ! %s`, event, err))
+		}
+	})
+	err := listener.Listen(tasksChannel)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.listenForTasks() LISTEN %s, polling every %s ! %s`, tasksChannel, pollInterval, err))
+		listener.Close()
+		return nil
+	}
+	return listener
+}
+
+// waitForTasks returns once a task is enqueued or pollInterval has passed.
+func waitForTasks(listener *pq.Listener) {
+	if listener == nil {
+		sleep(pollInterval)
+		return
+	}
+	select {
+	case <-listener.Notify:
+	case <-stopping:
+	case <-time.After(pollInterval):
+	}
+}
+
+// notifyWorkers wakes the workers waiting for tasks, inside the transaction
+// enqueueing the task if there is one so they are woken once it commits.
+func notifyWorkers(db sqlx.Execer, action string) {
+	sq := fmt.Sprintf(`NOTIFY %s, '%s'`, tasksChannel, action)
+	log.Trace(fmt.Sprintf(`tasks.notifyWorkers() > %s`, sq))
+	_, err := db.Exec(sq)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.notifyWorkers() ! %s`, err))
+	}
+}
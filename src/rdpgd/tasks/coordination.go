@@ -0,0 +1,311 @@
+package tasks
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/jmoiron/sqlx"
+
+	"github.com/starkandwayne/rdpgd/globals"
+	"github.com/starkandwayne/rdpgd/log"
+	"github.com/starkandwayne/rdpgd/pg"
+	"github.com/starkandwayne/rdpgd/utils/rdpgconsul"
+)
+
+// advisoryLockRetry is how often the postgres coordinator tries to take a lock
+// held elsewhere.
+const advisoryLockRetry = time.Second
+
+/*
+Coordinator is the backend holding the cluster wide locks the scheduler,
+workers and handlers take, selected by RDPGD_COORDINATION.
+*/
+type Coordinator interface {
+	// Lock blocks until the named lock is held, giving up when stop is closed.
+	Lock(name string, stop <-chan struct{}) error
+	// TryLock takes the named lock if it is free, without waiting for it.
+	TryLock(name string) (bool, error)
+	// Unlock releases the named lock.
+	Unlock(name string) error
+	// IsWriteNode reports whether this node takes writes.
+	IsWriteNode() bool
+}
+
+var (
+	coordinator     Coordinator
+	coordinatorOnce sync.Once
+)
+
+// coordination returns the coordinator selected by RDPGD_COORDINATION.
+func coordination() Coordinator {
+	coordinatorOnce.Do(func() {
+		switch globals.Coordination {
+		case globals.CoordinationPostgres:
+			coordinator = newPGCoordinator()
+		default:
+			coordinator = &consulCoordinator{locks: map[string]*consulapi.Lock{}, sessions: map[string]string{}}
+		}
+		log.Info(fmt.Sprintf(`tasks.coordination() Coordinating through %s`, globals.Coordination))
+	})
+	return coordinator
+}
+
+// lockName returns the name of the cluster's lock of the given kind, eg. the
+// work lock rdpg/<cluster>/tasks/work/lock.
+func lockName(kind string) string {
+	return fmt.Sprintf(`rdpg/%s/tasks/%s/lock`, ClusterID, kind)
+}
+
+// existenceLockName returns the name of the lock held while creating or
+// dropping databases on the cluster.
+func existenceLockName(clusterID string) string {
+	return fmt.Sprintf(`rdpg/%s/database/existence/lock`, clusterID)
+}
+
+// bindingLockTimeout is how long binding waits for another request binding
+// with the same id.
+const bindingLockTimeout = 30 * time.Second
+
+//BindingLock - Acquire the lock held while creating the binding with the
+// given id, so that two requests for it do not both create its role. It gives
+// up after bindingLockTimeout.
+func BindingLock(bindingID string) (err error) {
+	stop := make(chan struct{})
+	timer := time.AfterFunc(bindingLockTimeout, func() { close(stop) })
+	defer timer.Stop()
+	return coordination().Lock(bindingLockName(bindingID), stop)
+}
+
+//BindingUnlock - Release the lock of the binding with the given id.
+func BindingUnlock(bindingID string) (err error) {
+	return coordination().Unlock(bindingLockName(bindingID))
+}
+
+func bindingLockName(bindingID string) string {
+	return fmt.Sprintf(`rdpg/%s/cfsb/bindings/%s/lock`, ClusterID, strings.ToLower(bindingID))
+}
+
+// consulCoordinator holds locks as Consul K/V locks, the sessions behind them
+// are destroyed when they are unlocked.
+type consulCoordinator struct {
+	mu    sync.Mutex
+	locks map[string]*consulapi.Lock
+	// sessions holds the sessions of the locks taken with TryLock.
+	sessions map[string]string
+}
+
+func (c *consulCoordinator) Lock(name string, stop <-chan struct{}) (err error) {
+	client, _ := consulapi.NewClient(consulapi.DefaultConfig())
+	lock, err := client.LockKey(name)
+	if err != nil {
+		log.Error(fmt.Sprintf("tasks.consulCoordinator#Lock() Error Locking Key %s ! %s", name, err))
+		return
+	}
+	lockCh, err := lock.Lock(stop) // Acquire Consul K/V Lock, giving up on stop
+	if err != nil {
+		log.Error(fmt.Sprintf("tasks.consulCoordinator#Lock() Error Acquiring Key lock %s ! %s", name, err))
+		return
+	}
+	if lockCh == nil {
+		return fmt.Errorf(`tasks.consulCoordinator#Lock() Lock %s not acquired`, name)
+	}
+	c.mu.Lock()
+	c.locks[name] = lock
+	c.mu.Unlock()
+	return
+}
+
+func (c *consulCoordinator) TryLock(name string) (locked bool, err error) {
+	client, _ := consulapi.NewClient(consulapi.DefaultConfig())
+	sessID, _, err := client.Session().Create(&consulapi.SessionEntry{Name: name}, nil)
+	if err != nil {
+		log.Error(fmt.Sprintf("tasks.consulCoordinator#TryLock() Error Creating Session %s ! %s", name, err))
+		return
+	}
+	locked, _, err = client.KV().Acquire(&consulapi.KVPair{Key: name, Value: []byte(globals.MyIP), Flags: consulapi.LockFlagValue, Session: sessID}, nil)
+	if err != nil || !locked {
+		if err != nil {
+			log.Error(fmt.Sprintf("tasks.consulCoordinator#TryLock() Error Acquiring Key lock %s ! %s", name, err))
+		}
+		client.Session().Destroy(sessID, nil)
+		return
+	}
+	c.mu.Lock()
+	c.sessions[name] = sessID
+	c.mu.Unlock()
+	return
+}
+
+func (c *consulCoordinator) Unlock(name string) (err error) {
+	c.mu.Lock()
+	lock := c.locks[name]
+	delete(c.locks, name)
+	sessID := c.sessions[name]
+	delete(c.sessions, name)
+	c.mu.Unlock()
+	if sessID != `` {
+		client, _ := consulapi.NewClient(consulapi.DefaultConfig())
+		_, _, err = client.KV().Release(&consulapi.KVPair{Key: name, Flags: consulapi.LockFlagValue, Session: sessID}, nil)
+		if err != nil {
+			log.Error(fmt.Sprintf("tasks.consulCoordinator#Unlock() Error Releasing %s ! %s", name, err))
+		}
+		client.Session().Destroy(sessID, nil)
+	}
+	if lock == nil {
+		return
+	}
+	err = lock.Unlock()
+	if err != nil {
+		log.Error(fmt.Sprintf("tasks.consulCoordinator#Unlock() Error Unlocking %s ! %s", name, err))
+	}
+	return
+}
+
+func (c *consulCoordinator) IsWriteNode() bool {
+	return rdpgconsul.IsWriteNode(globals.MyIP)
+}
+
+// pgCoordinator holds locks as PostgreSQL session advisory locks on a single
+// connection made straight to PostgreSQL, pgbouncer's transaction pooling
+// would lose them. The locks go away with the connection if rdpgd dies.
+type pgCoordinator struct {
+	mu sync.Mutex
+	db *sqlx.DB
+	// held names the locks this process holds, advisory locks are reentrant
+	// within the session so they do not keep two of its goroutines apart.
+	held map[string]bool
+	// pid is the backend of the session the held locks were taken on. A
+	// dropped connection is replaced by a new session, PostgreSQL having
+	// released every lock of the old one.
+	pid int
+}
+
+func newPGCoordinator() *pgCoordinator {
+	return &pgCoordinator{held: map[string]bool{}}
+}
+
+// conn returns the coordinator's connection, connecting if need be.
+func (c *pgCoordinator) conn() (db *sqlx.DB, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.db == nil {
+		p := pg.NewPG(`127.0.0.1`, pgPort, `rdpg`, `rdpg`, pgPass)
+		c.db, err = p.Connect()
+		if err != nil {
+			log.Error(fmt.Sprintf(`tasks.pgCoordinator#conn() Failed connecting to %s ! %s`, p.URI, err))
+			return
+		}
+		// Advisory locks belong to the session, every lock must be taken and
+		// released on the same connection.
+		c.db.SetMaxOpenConns(1)
+		c.db.SetMaxIdleConns(1)
+	}
+	return c.db, nil
+}
+
+func (c *pgCoordinator) Lock(name string, stop <-chan struct{}) (err error) {
+	for {
+		var locked bool
+		locked, err = c.TryLock(name)
+		if err != nil {
+			return
+		}
+		if locked {
+			return
+		}
+		select {
+		case <-stop:
+			return fmt.Errorf(`tasks.pgCoordinator#Lock() Lock %s not acquired`, name)
+		case <-time.After(advisoryLockRetry):
+		}
+	}
+}
+
+func (c *pgCoordinator) TryLock(name string) (locked bool, err error) {
+	db, err := c.conn()
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var pid int
+	err = db.Get(&pid, `SELECT pg_backend_pid()`)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.pgCoordinator#TryLock() Error Checking session for %s ! %s`, name, err))
+		c.sessionLost(0)
+		return
+	}
+	c.sessionLost(pid)
+	if c.held[name] {
+		return false, nil
+	}
+	row := struct {
+		Locked bool `db:"locked"`
+		PID    int  `db:"pid"`
+	}{}
+	err = db.Get(&row, `SELECT pg_try_advisory_lock(hashtext($1)) AS locked, pg_backend_pid() AS pid`, name)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.pgCoordinator#TryLock() Error Acquiring %s ! %s`, name, err))
+		return
+	}
+	c.sessionLost(row.PID)
+	c.held[name] = row.Locked
+	return row.Locked, nil
+}
+
+func (c *pgCoordinator) Unlock(name string) (err error) {
+	db, err := c.conn()
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.held[name] {
+		return
+	}
+	delete(c.held, name)
+	row := struct {
+		Unlocked bool `db:"unlocked"`
+		PID      int  `db:"pid"`
+	}{}
+	err = db.Get(&row, `SELECT pg_advisory_unlock(hashtext($1)) AS unlocked, pg_backend_pid() AS pid`, name)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.pgCoordinator#Unlock() Error Unlocking %s ! %s`, name, err))
+		c.sessionLost(0)
+		return
+	}
+	c.sessionLost(row.PID)
+	return
+}
+
+// sessionLost forgets the held locks when the coordinator's session is no
+// longer backend pid, 0 when it is unknown, as PostgreSQL released them along
+// with the session they were taken on. They are then taken anew.
+func (c *pgCoordinator) sessionLost(pid int) {
+	if pid == c.pid {
+		return
+	}
+	if len(c.held) > 0 {
+		log.Warn(fmt.Sprintf(`tasks.pgCoordinator#sessionLost() Session %d lost, its locks were released: %v`, c.pid, c.held))
+		c.held = map[string]bool{}
+	}
+	c.pid = pid
+}
+
+// IsWriteNode reports whether the local PostgreSQL is not a standby.
+func (c *pgCoordinator) IsWriteNode() bool {
+	db, err := c.conn()
+	if err != nil {
+		return false
+	}
+	var standby bool
+	err = db.Get(&standby, `SELECT pg_is_in_recovery()`)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.pgCoordinator#IsWriteNode() ! %s`, err))
+		return false
+	}
+	return !standby
+}
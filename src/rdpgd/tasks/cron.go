@@ -0,0 +1,201 @@
+package tasks
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+cronSpec is a parsed five field cron expression,
+
+	minute hour day-of-month month day-of-week
+
+each field being `*`, a value, a range `a-b` or a comma separated list of
+those, optionally stepped with `/n`. Months and days of the week may be given
+by their three letter English names, Sunday is 0 or 7. The usual @hourly,
+@daily, @weekly, @monthly and @yearly shorthands are accepted.
+*/
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	// As with cron(8), when both day fields are restricted a day matching
+	// either of them matches.
+	domStar, dowStar bool
+}
+
+type cronField struct {
+	min, max int
+	names    map[string]int
+}
+
+var (
+	cronMinute = cronField{0, 59, nil}
+	cronHour   = cronField{0, 23, nil}
+	cronDom    = cronField{1, 31, nil}
+	cronMonth  = cronField{1, 12, map[string]int{`jan`: 1, `feb`: 2, `mar`: 3, `apr`: 4, `may`: 5, `jun`: 6, `jul`: 7, `aug`: 8, `sep`: 9, `oct`: 10, `nov`: 11, `dec`: 12}}
+	cronDow    = cronField{0, 7, map[string]int{`sun`: 0, `mon`: 1, `tue`: 2, `wed`: 3, `thu`: 4, `fri`: 5, `sat`: 6}}
+
+	cronShorthands = map[string]string{
+		`@yearly`:   `0 0 1 1 *`,
+		`@annually`: `0 0 1 1 *`,
+		`@monthly`:  `0 0 1 * *`,
+		`@weekly`:   `0 0 * * 0`,
+		`@daily`:    `0 0 * * *`,
+		`@midnight`: `0 0 * * *`,
+		`@hourly`:   `0 * * * *`,
+	}
+)
+
+// parseCron parses a cron expression, see cronSpec.
+func parseCron(expr string) (c *cronSpec, err error) {
+	expr = strings.TrimSpace(expr)
+	if full, ok := cronShorthands[strings.ToLower(expr)]; ok {
+		expr = full
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf(`cron expression '%s' must have 5 fields`, expr)
+	}
+	c = &cronSpec{}
+	if c.minute, err = cronMinute.parse(fields[0]); err != nil {
+		return nil, err
+	}
+	if c.hour, err = cronHour.parse(fields[1]); err != nil {
+		return nil, err
+	}
+	if c.dom, err = cronDom.parse(fields[2]); err != nil {
+		return nil, err
+	}
+	if c.month, err = cronMonth.parse(fields[3]); err != nil {
+		return nil, err
+	}
+	if c.dow, err = cronDow.parse(fields[4]); err != nil {
+		return nil, err
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1 << 0
+	}
+	c.domStar = strings.HasPrefix(fields[2], `*`)
+	c.dowStar = strings.HasPrefix(fields[4], `*`)
+	return c, nil
+}
+
+func (f cronField) parse(field string) (bits uint64, err error) {
+	for _, item := range strings.Split(field, `,`) {
+		step := 1
+		if i := strings.Index(item, `/`); i >= 0 {
+			step, err = strconv.Atoi(item[i+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf(`invalid step in cron field '%s'`, field)
+			}
+			item = item[:i]
+		}
+		lo, hi := f.min, f.max
+		switch {
+		case item == `*`:
+		case strings.Contains(item, `-`):
+			bounds := strings.SplitN(item, `-`, 2)
+			if lo, err = f.value(bounds[0]); err != nil {
+				return 0, err
+			}
+			if hi, err = f.value(bounds[1]); err != nil {
+				return 0, err
+			}
+		default:
+			if lo, err = f.value(item); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if step > 1 {
+				hi = f.max
+			}
+		}
+		if lo > hi {
+			return 0, fmt.Errorf(`invalid range in cron field '%s'`, field)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (f cronField) value(s string) (int, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf(`invalid cron value '%s', expected %d-%d`, s, f.min, f.max)
+	}
+	return v, nil
+}
+
+func (c *cronSpec) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first time strictly after t matching the expression in the
+// given location, or the zero time if there is none in the next five years
+// (eg. `0 0 30 2 *`).
+func (c *cronSpec) next(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, loc).Add(time.Minute)
+	limit := t.Year() + 5
+
+	for t.Year() <= limit {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// nextCronTime returns the first time after t matching the cron expression in
+// the named time zone, UTC if empty.
+func nextCronTime(expr, timeZone string, t time.Time) (next time.Time, err error) {
+	c, err := parseCron(expr)
+	if err != nil {
+		return
+	}
+	loc, err := loadLocation(timeZone)
+	if err != nil {
+		return
+	}
+	next = c.next(t, loc)
+	if next.IsZero() {
+		err = fmt.Errorf(`cron expression '%s' never fires`, expr)
+	}
+	return
+}
+
+func loadLocation(timeZone string) (*time.Location, error) {
+	if timeZone == `` {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(timeZone)
+	if err != nil {
+		return nil, fmt.Errorf(`invalid time zone '%s': %s`, timeZone, err)
+	}
+	return loc, nil
+}
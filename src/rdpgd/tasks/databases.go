@@ -21,6 +21,17 @@ import (
 	"github.com/starkandwayne/rdpgd/uuid"
 )
 
+// Extensions created in every database of the cluster service, those listed in
+// the manifest's rdpgd_service properties are created after them.
+var (
+	postgresqlExtensions = []string{`btree_gist`, `pg_stat_statements`, `uuid-ossp`, `hstore`, `pg_trgm`, `pgcrypto`}
+	bdrExtensions        = []string{`btree_gist`, `bdr`, `pg_stat_statements`, `uuid-ossp`, `hstore`, `pg_trgm`, `pgcrypto`}
+)
+
+func init() {
+	Register(`PrecreateDatabases`, Handler{Run: (*Task).PrecreateDatabases, Role: `service`, Priority: PriorityHigh})
+}
+
 /*
 PrecreateDatabases is called as a scheduled task for precreating databaes.
 */
@@ -45,30 +56,17 @@ func (t *Task) PrecreateDatabases() (err error) {
 		log.Error(fmt.Sprintf("tasks.Task#PrecreateDatabases() ! %s", err))
 		return
 	}
-	// Lock Database Creation (and Deletion) via Consul Lock
-	key := fmt.Sprintf(`rdpg/%s/database/existance/lock`, t.ClusterID)
-	lo := &consulapi.LockOptions{
-		Key:         key,
-		SessionName: fmt.Sprintf(`rdpg/%s/databases/existance`, t.ClusterID),
-	}
-	log.Trace(fmt.Sprintf(`tasks.Task<%s>#PrecreateDatabases() Attempting to acquire database existance lock %s...`, t.ClusterID, key))
-	databaseCreateLock, err := client.LockOpts(lo)
-	if err != nil {
-		log.Error(fmt.Sprintf(`tasks.Task<%s>#PrecreateDatabases() LockKey() Error locking database existance Key %s ! %s`, t.ClusterID, key, err))
-		return
-	}
-	databaseCreateLockCh, err := databaseCreateLock.Lock(nil)
+	// Lock Database Creation (and Deletion) through the coordinator
+	key := existenceLockName(t.ClusterID)
+	log.Trace(fmt.Sprintf(`tasks.Task<%s>#PrecreateDatabases() Attempting to acquire database existence lock %s...`, t.ClusterID, key))
+	err = coordination().Lock(key, t.context().Done())
 	if err != nil {
-		log.Error(fmt.Sprintf(`tasks.Task<%s>#PrecreateDatabases() Lock() database/existance lock %s ! %s`, t.ClusterID, key, err))
-		return
-	}
-	defer databaseCreateLock.Unlock()
-	if databaseCreateLockCh == nil {
-		log.Error(fmt.Sprintf(`tasks.Task<%s>#PrecreateDatabases() database/existance Lock not aquired, halting Creation!!!`, t.ClusterID))
+		log.Error(fmt.Sprintf(`tasks.Task<%s>#PrecreateDatabases() database/existence Lock not aquired, halting Creation ! %s`, t.ClusterID, err))
 		return
 	}
+	defer coordination().Unlock(key)
 
-	// We have the database existance lock...
+	// We have the database existence lock...
 	key = fmt.Sprintf(`rdpg/%s/capacity/instances/limit`, t.ClusterID)
 	kv := client.KV()
 	kvp, _, err := kv.Get(key, nil)
@@ -207,7 +205,7 @@ func (t *Task) postgresqlPrecreateDatabase(client *consulapi.Client) (err error)
 		return err
 	}
 
-	err = p.CreateExtensions(i.Database, []string{`btree_gist`, `pg_stat_statements`, `uuid-ossp`, `hstore`, `pg_trgm`, `pgcrypto`})
+	err = p.CreateExtensions(i.Database, postgresqlExtensions)
 	if err != nil {
 		log.Error(fmt.Sprintf("tasks.Task#postgresqlPrecreateDatabases(%s) CreateExtensions(%s,%s) ! %s", i.Database, i.Database, i.User, err))
 		return err
@@ -326,7 +324,7 @@ func (t *Task) bdrPrecreateDatabase(client *consulapi.Client) (err error) {
 		return err
 	}
 
-	err = b.CreateExtensions(i.Database, []string{`btree_gist`, `bdr`, `pg_stat_statements`, `uuid-ossp`, `hstore`, `pg_trgm`, `pgcrypto`})
+	err = b.CreateExtensions(i.Database, bdrExtensions)
 	if err != nil {
 		log.Error(fmt.Sprintf("tasks.Task#bdrPrecreateDatabases(%s) CreateExtensions(%s,%s) ! %s", i.Database, i.Database, i.User, err))
 		return err
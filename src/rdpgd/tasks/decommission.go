@@ -15,10 +15,16 @@ import (
 	"github.com/starkandwayne/rdpgd/pg"
 )
 
+func init() {
+	Register(`DecommissionDatabase`, Handler{Run: (*Task).DecommissionDatabase, Decode: decodeNonEmpty, Priority: PriorityHigh})
+	Register(`DecommissionDatabases`, Handler{Run: (*Task).DecommissionDatabases, Role: `service`, Priority: PriorityHigh})
+}
+
 //DecommissionDatabase - Remove targeted database specified in Data
 func (t *Task) DecommissionDatabase() (err error) {
 	log.Trace(fmt.Sprintf(`tasks.DecommissionDatabase(%s)...`, t.Data))
-
+	// On the management cluster the asynchronous deprovision waiting on the
+	// service cluster is failed along with the task, see operationFailed.
 	i, err := instances.FindByDatabase(t.Data)
 	if err != nil {
 		log.Error(fmt.Sprintf("tasks.DecommissionDatabase(%s) instances.FindByDatabase() ! %s", i.Database, err))
@@ -53,17 +59,23 @@ func (t *Task) DecommissionDatabase() (err error) {
 		// TODO: Retrieve from configuration in database.
 		req.SetBasicAuth(os.Getenv("RDPGD_ADMIN_USER"), os.Getenv("RDPGD_ADMIN_PASS"))
 		httpClient := &http.Client{}
-		_, err = httpClient.Do(req)
+		resp, err := httpClient.Do(req)
 		if err != nil {
 			log.Error(fmt.Sprintf(`tasks.Task#DecommissionDatabase(%s) httpClient.Do() %s ! %s`, i.Database, url, err))
 			return err
 		}
-		// TODO: Is there anything we want to do on successful request?
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf(`DELETE %s returned %s`, url, resp.Status)
+			log.Error(fmt.Sprintf(`tasks.Task#DecommissionDatabase(%s) ! %s`, i.Database, err))
+			return err
+		}
 	case "service":
 		// In here we must do everything necessary to physically delete and clean up
 		// the database from all service cluster nodes.
 		if err = t.BackupDatabase(); err != nil {
 			log.Error(fmt.Sprintf(`tasks.Task#DecommissionDatabase(%s) t.BackupDatabase(%s) ! %s`, i.Database, err))
+			return err
 		} else {
 			for _, ip := range ips { // Schedule pgbouncer reconfigure on each cluster node.
 				newTask := Task{ClusterID: ClusterID, Node: ip, Role: "all", Action: "Reconfigure", Data: "pgbouncer", NodeType: "any"}
@@ -80,92 +92,9 @@ func (t *Task) DecommissionDatabase() (err error) {
 				return err
 			}
 
-			// Lock Database Deletion via Consul Lock
-			key := fmt.Sprintf(`rdpg/%s/database/existance/lock`, t.ClusterID)
-			lo := &consulapi.LockOptions{
-				Key:         key,
-				SessionName: fmt.Sprintf(`rdpg/%s/databases/existance`, t.ClusterID),
-			}
-			log.Trace(fmt.Sprintf(`tasks.Task<%s>#DecommissionDatabase() Attempting to acquire database existance lock %s...`, t.ClusterID, key))
-			databaseCreateLock, err := client.LockOpts(lo)
-			if err != nil {
-				log.Error(fmt.Sprintf(`tasks.Task<%s>#DecommissionDatabase() LockKey() database/existance Lock Key %s ! %s`, t.ClusterID, key, err))
-				return err
-			}
-			databaseCreateLockCh, err := databaseCreateLock.Lock(nil)
-			if err != nil {
-				log.Error(fmt.Sprintf(`tasks.Task<%s>#DecommissionDatabase() Lock() database/existance lock %s ! %s`, t.ClusterID, key, err))
-				return err
-			}
-			if databaseCreateLockCh == nil {
-				err := fmt.Errorf(`tasks.Task<%s>#DecommissionDatabase() database/existance Lock not aquired, halting Decommission!!!`, t.ClusterID)
-				log.Error(err.Error())
-				return err
-			}
-			defer databaseCreateLock.Unlock()
-
-			p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
-			db, err := p.Connect()
-			if err != nil {
-				log.Error(fmt.Sprintf("instances.Decommission() p.Connect(%s) ! %s", p.URI, err))
+			if err = t.dropDatabase(i, client); err != nil {
 				return err
 			}
-			defer db.Close()
-
-			sq := fmt.Sprintf(`DELETE FROM tasks.tasks WHERE action='BackupDatabase' AND data='%s'`, i.Database)
-			log.Trace(fmt.Sprintf(`tasks.Task#DecommissionDatabase(%s) SQL > %s`, i.Database, sq))
-			_, err = db.Exec(sq)
-			if err != nil {
-				log.Error(fmt.Sprintf("tasks.Task#DecommissionDatabase(%s) ! %s", i.Database, err))
-			}
-			sq = fmt.Sprintf(`UPDATE tasks.schedules SET enabled = false WHERE action='BackupDatabase' AND data='%s'`, i.Database)
-			log.Trace(fmt.Sprintf(`tasks.Task#DecommissionDatabase(%s) SQL > %s`, i.Database, sq))
-			_, err = db.Exec(sq)
-			if err != nil {
-				log.Error(fmt.Sprintf("tasks.Task#DecommissionDatabase(%s) ! %s", i.Database, err))
-			}
-
-			if t.ClusterService == "pgbdr" {
-				b := bdr.NewBDR(ClusterID, client)
-				b.DropDatabase(i.Database)
-
-				dbuser := ""
-				sq = fmt.Sprintf(`SELECT dbuser FROM cfsb.instances WHERE dbname='%s' LIMIT 1`, i.Database)
-				log.Trace(fmt.Sprintf(`tasks.Task#DecommissionDatabase(%s) SQL > %s`, i.Database, sq))
-				err = db.Get(&dbuser, sq)
-				if err != nil {
-					log.Error(fmt.Sprintf("tasks.Task#DecommissionDatabase(%s) ! %s", i.Database, err))
-				}
-				b.DropUser(dbuser)
-
-				sq = fmt.Sprintf(`UPDATE cfsb.instances SET decommissioned_at=CURRENT_TIMESTAMP WHERE dbname='%s'`, i.Database)
-				log.Trace(fmt.Sprintf(`tasks.Task#DecommissionDatabase(%s) SQL > %s`, i.Database, sq))
-				_, err = db.Exec(sq)
-				if err != nil {
-					log.Error(fmt.Sprintf("tasks.Task#DecommissionDatabase(%s) ! %s", i.Database, err))
-				}
-
-			} else {
-				p.DisableDatabase(i.Database)
-				p.DropDatabase(i.Database)
-
-				dbuser := ""
-				sq = fmt.Sprintf(`SELECT dbuser FROM cfsb.instances WHERE dbname='%s' LIMIT 1`, i.Database)
-				log.Trace(fmt.Sprintf(`tasks.Task#DecommissionDatabase(%s) SQL > %s`, i.Database, sq))
-				err = db.Get(&dbuser, sq)
-				if err != nil {
-					log.Error(fmt.Sprintf("tasks.Task#DecommissionDatabase(%s) ! %s", i.Database, err))
-				}
-				p.DropUser(dbuser)
-
-				sq = fmt.Sprintf(`UPDATE cfsb.instances SET decommissioned_at=CURRENT_TIMESTAMP WHERE dbname='%s'`, i.Database)
-				log.Trace(fmt.Sprintf(`tasks.Task#DecommissionDatabase(%s) SQL > %s`, i.Database, sq))
-				_, err = db.Exec(sq)
-				if err != nil {
-					log.Error(fmt.Sprintf("tasks.Task#DecommissionDatabase(%s) ! %s", i.Database, err))
-				}
-
-			}
 
 			// Notify management cluster that the instance has been decommissioned
 			// Find management cluster API address
@@ -183,7 +112,7 @@ func (t *Task) DecommissionDatabase() (err error) {
 
 			// Query the database for the decommissioned_at timestamp set
 			timestamp := ""
-			sq = fmt.Sprintf(`SELECT decommissioned_at::text FROM cfsb.instances WHERE dbname='%s' LIMIT 1;`, i.Database)
+			sq := fmt.Sprintf(`SELECT decommissioned_at::text FROM cfsb.instances WHERE dbname='%s' LIMIT 1;`, i.Database)
 			db.Get(&timestamp, sq)
 
 			type decomm struct {
@@ -217,6 +146,114 @@ func (t *Task) DecommissionDatabase() (err error) {
 	return
 }
 
+// dropDatabase drops the instance's database, its owner and the roles of its
+// bindings from this service cluster and marks it decommissioned, holding the
+// cluster's database existence lock.
+func (t *Task) dropDatabase(i *instances.Instance, client *consulapi.Client) (err error) {
+	// Lock Database Deletion through the coordinator
+	key := existenceLockName(t.ClusterID)
+	log.Trace(fmt.Sprintf(`tasks.Task<%s>#DecommissionDatabase() Attempting to acquire database existence lock %s...`, t.ClusterID, key))
+	err = coordination().Lock(key, t.context().Done())
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.Task<%s>#DecommissionDatabase() database/existence Lock not aquired, halting Decommission ! %s`, t.ClusterID, err))
+		return err
+	}
+	defer coordination().Unlock(key)
+
+	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("instances.Decommission() p.Connect(%s) ! %s", p.URI, err))
+		return err
+	}
+	defer db.Close()
+
+	sq := fmt.Sprintf(`DELETE FROM tasks.tasks WHERE action='BackupDatabase' AND data='%s'`, i.Database)
+	log.Trace(fmt.Sprintf(`tasks.Task#DecommissionDatabase(%s) SQL > %s`, i.Database, sq))
+	_, err = db.Exec(sq)
+	if err != nil {
+		log.Error(fmt.Sprintf("tasks.Task#DecommissionDatabase(%s) ! %s", i.Database, err))
+	}
+	sq = fmt.Sprintf(`UPDATE tasks.schedules SET enabled = false WHERE action='BackupDatabase' AND data='%s'`, i.Database)
+	log.Trace(fmt.Sprintf(`tasks.Task#DecommissionDatabase(%s) SQL > %s`, i.Database, sq))
+	_, err = db.Exec(sq)
+	if err != nil {
+		log.Error(fmt.Sprintf("tasks.Task#DecommissionDatabase(%s) ! %s", i.Database, err))
+	}
+
+	// Drop the roles of any bindings left on the database.
+	roles, err := instances.BindingRoles(i.Database)
+	if err != nil {
+		log.Error(fmt.Sprintf("tasks.Task#DecommissionDatabase(%s) instances.BindingRoles() ! %s", i.Database, err))
+	}
+	for index := range roles {
+		r := roles[index]
+		if err = dropBindingRole(i, r.User); err != nil {
+			log.Error(fmt.Sprintf("tasks.Task#DecommissionDatabase(%s) dropBindingRole(%s) ! %s", i.Database, r.User, err))
+			continue
+		}
+		r.Retire()
+	}
+
+	if t.ClusterService == "pgbdr" {
+		b := bdr.NewBDR(ClusterID, client)
+		b.DropDatabase(i.Database)
+
+		dbuser := ""
+		sq = fmt.Sprintf(`SELECT dbuser FROM cfsb.instances WHERE dbname='%s' LIMIT 1`, i.Database)
+		log.Trace(fmt.Sprintf(`tasks.Task#DecommissionDatabase(%s) SQL > %s`, i.Database, sq))
+		err = db.Get(&dbuser, sq)
+		if err != nil {
+			log.Error(fmt.Sprintf("tasks.Task#DecommissionDatabase(%s) ! %s", i.Database, err))
+		}
+		b.DropUser(dbuser)
+
+		sq = fmt.Sprintf(`UPDATE cfsb.instances SET decommissioned_at=CURRENT_TIMESTAMP WHERE dbname='%s'`, i.Database)
+		log.Trace(fmt.Sprintf(`tasks.Task#DecommissionDatabase(%s) SQL > %s`, i.Database, sq))
+		_, err = db.Exec(sq)
+		if err != nil {
+			log.Error(fmt.Sprintf("tasks.Task#DecommissionDatabase(%s) ! %s", i.Database, err))
+		}
+
+	} else {
+		p.DisableDatabase(i.Database)
+		p.DropDatabase(i.Database)
+
+		dbuser := ""
+		sq = fmt.Sprintf(`SELECT dbuser FROM cfsb.instances WHERE dbname='%s' LIMIT 1`, i.Database)
+		log.Trace(fmt.Sprintf(`tasks.Task#DecommissionDatabase(%s) SQL > %s`, i.Database, sq))
+		err = db.Get(&dbuser, sq)
+		if err != nil {
+			log.Error(fmt.Sprintf("tasks.Task#DecommissionDatabase(%s) ! %s", i.Database, err))
+		}
+		p.DropUser(dbuser)
+
+		sq = fmt.Sprintf(`UPDATE cfsb.instances SET decommissioned_at=CURRENT_TIMESTAMP WHERE dbname='%s'`, i.Database)
+		log.Trace(fmt.Sprintf(`tasks.Task#DecommissionDatabase(%s) SQL > %s`, i.Database, sq))
+		_, err = db.Exec(sq)
+		if err != nil {
+			log.Error(fmt.Sprintf("tasks.Task#DecommissionDatabase(%s) ! %s", i.Database, err))
+		}
+
+	}
+	return
+}
+
+// DecommissionInstance - Mark the instance ineffective and schedule the removal
+// of its database.
+func DecommissionInstance(i *instances.Instance) (err error) {
+	err = i.Decommission()
+	if err != nil {
+		return
+	}
+	newTask := Task{ClusterID: i.ClusterID, ClusterService: i.ClusterService, Action: `DecommissionDatabase`, Data: i.Database}
+	err = newTask.Enqueue()
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.DecommissionInstance(%s) Scheduling Instance Removal ! %s`, i.InstanceID, err))
+	}
+	return
+}
+
 // DecommissionDatabases - Scheduled task to find and decommission databases that
 // require decommissioning eg. Clean up databases which users have declared they
 // no longer need/love
@@ -20,6 +20,12 @@ import (
 	"github.com/starkandwayne/rdpgd/log"
 )
 
+func init() {
+	Register(`EnforceFileRetention`, Handler{Run: (*Task).EnforceFileRetention})
+	Register(`EnforceRemoteFileRetention`, Handler{Run: (*Task).EnforceRemoteFileRetention})
+	Register(`DeleteFile`, Handler{Run: (*Task).DeleteFile, Decode: decodeS3FileMetadata})
+}
+
 /*EnforceFileRetention - Responsible for adding removing files which are no longer
 needed on the local file system.  For example, backup files which have been created
 successfully locally and copied to S3 successfully can be deleted to preserve
@@ -81,8 +87,11 @@ func (t *Task) EnforceFileRetention() (err error) {
 			fileToDeleteParams := string(byteParams)
 			log.Trace(fmt.Sprintf("tasks.EnforceFileRetention() > Attempting to add %s", fileToDeleteParams))
 			newTask := Task{ClusterID: t.ClusterID, Node: t.Node, Role: t.Role, Action: "DeleteFile", Data: fileToDeleteParams, TTL: t.TTL, NodeType: t.NodeType}
+			newTask.DedupKey = DedupKey(`DeleteFile`, fm.Location)
 			err = newTask.Enqueue()
-			if err != nil {
+			if err == ErrDuplicate {
+				err = nil
+			} else if err != nil {
 				log.Error(fmt.Sprintf(`tasks.EnforceFileRetention() service task schedules ! %s`, err))
 			}
 		}
@@ -1,12 +1,20 @@
 package tasks
 
 import (
+	"encoding/json"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/starkandwayne/rdpgd/history"
 	"github.com/starkandwayne/rdpgd/log"
 )
 
+func init() {
+	Register(`DeleteBackupHistory`, Handler{Run: (*Task).DeleteBackupHistory})
+	Register(`DeleteTaskHistory`, Handler{Run: (*Task).DeleteTaskHistory})
+}
+
 //DeleteBackupHistory - Responsible for deleting records from backups.file_history
 //older than the value in rdpg.config.key = defaultDaysToKeepFileHistory
 func (t *Task) DeleteBackupHistory() (err error) {
@@ -17,3 +25,64 @@ func (t *Task) DeleteBackupHistory() (err error) {
 	}
 	return
 }
+
+//DeleteTaskHistory - Responsible for deleting records from tasks.history
+//older than the value in rdpg.config.key = defaultDaysToKeepTaskHistory
+func (t *Task) DeleteTaskHistory() (err error) {
+	log.Trace("tasks.DeleteTaskHistory Starting...")
+	err = history.DeleteTaskHistory()
+	if err != nil {
+		log.Error(fmt.Sprintf("tasks.DeleteTaskHistory ! history.DeleteTaskHistory erred : %s", err.Error()))
+	}
+	return
+}
+
+// recordHistory writes the outcome of a worked task to tasks.history.
+func (t *Task) recordHistory(start time.Time, outcome error) {
+	h := history.TaskHistory{
+		TaskID:         t.ID,
+		ClusterID:      t.ClusterID,
+		ClusterService: t.ClusterService,
+		Node:           myIP,
+		Role:           t.Role,
+		Action:         t.Action,
+		Data:           t.Data,
+		DBName:         t.database(),
+		Attempt:        t.Attempts + 1,
+		Status:         `ok`,
+		Duration:       int(time.Since(start).Seconds()),
+	}
+	if outcome != nil {
+		h.Status = `error`
+		switch outcome.(type) {
+		case timeoutError:
+			h.Status = `timeout`
+		case cancelledError:
+			h.Status = `cancelled`
+		}
+		h.Error = outcome.Error()
+	}
+	err := history.InsertTaskHistory(h)
+	if err != nil {
+		log.Error(fmt.Sprintf("tasks.Task<%d>#recordHistory() ! %s", t.ID, err))
+	}
+}
+
+// database returns the name of the database the task acts on, if any, so that
+// history can be filtered by database.
+func (t *Task) database() string {
+	if strings.HasPrefix(t.Data, `{`) {
+		params := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(t.Data), &params); err == nil {
+			if dbname, ok := params[`dbname`].(string); ok {
+				return dbname
+			}
+		}
+		return ``
+	}
+	switch t.Action {
+	case `BackupDatabase`, `DecommissionDatabase`:
+		return t.Data
+	}
+	return ``
+}
@@ -0,0 +1,188 @@
+package tasks
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/starkandwayne/rdpgd/log"
+)
+
+/*
+MaintenanceWindow struct is used to represent a named window, from tasks.maintenance_windows,
+in which schedules assigned to it may start tasks. A window opens each time
+its cron expression fires and stays open for its duration.
+*/
+type MaintenanceWindow struct {
+	Name     string `db:"name" json:"name"`
+	Cron     string `db:"cron" json:"cron"`
+	TimeZone string `db:"time_zone" json:"time_zone"`
+	// Duration is a PostgreSQL interval, eg. `2 hours`.
+	Duration        string `db:"duration" json:"duration"`
+	DurationSeconds int64  `db:"duration_seconds" json:"-"`
+}
+
+// Contains reports whether the window is open at t.
+func (w *MaintenanceWindow) Contains(t time.Time) (bool, error) {
+	// The window is open if it opened within the last Duration, ie. the first
+	// opening after t - Duration is not after t.
+	opens, err := nextCronTime(w.Cron, w.TimeZone, t.Add(-time.Duration(w.DurationSeconds)*time.Second))
+	if err != nil {
+		return false, err
+	}
+	return !opens.After(t), nil
+}
+
+// NextStart returns the first time after t at which the window opens.
+func (w *MaintenanceWindow) NextStart(t time.Time) (time.Time, error) {
+	return nextCronTime(w.Cron, w.TimeZone, t)
+}
+
+// Validate checks the window's cron expression and time zone, and that its
+// duration is a positive interval.
+func (w *MaintenanceWindow) Validate() (err error) {
+	if w.Name == `` {
+		return fmt.Errorf(`maintenance window name is required`)
+	}
+	if w.Duration == `` {
+		return fmt.Errorf(`maintenance window duration is required`)
+	}
+	_, err = nextCronTime(w.Cron, w.TimeZone, time.Now())
+	if err != nil {
+		return
+	}
+	return positiveInterval(w.Duration)
+}
+
+// positiveInterval checks the interval is one PostgreSQL parses, longer than
+// zero.
+func positiveInterval(interval string) (err error) {
+	if err = OpenWorkDB(); err != nil {
+		return
+	}
+	var seconds float64
+	err = workDB.Get(&seconds, `SELECT EXTRACT(EPOCH FROM $1::interval)`, interval)
+	if err != nil {
+		return fmt.Errorf(`invalid maintenance window duration '%s'`, interval)
+	}
+	if seconds <= 0 {
+		return fmt.Errorf(`maintenance window duration '%s' must be positive`, interval)
+	}
+	return
+}
+
+//MaintenanceWindows - Return all maintenance windows
+func MaintenanceWindows() (windows []MaintenanceWindow, err error) {
+	windows = []MaintenanceWindow{}
+	sq := `SELECT name,cron,time_zone,duration::text AS duration,EXTRACT(EPOCH FROM duration)::bigint AS duration_seconds FROM tasks.maintenance_windows ORDER BY name`
+	log.Trace(fmt.Sprintf(`tasks.MaintenanceWindows() > %s`, sq))
+	OpenWorkDB()
+	err = workDB.Select(&windows, sq)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.MaintenanceWindows() ! %s`, err))
+	}
+	return
+}
+
+//FindMaintenanceWindow - Return the named maintenance window, nil if there is none
+func FindMaintenanceWindow(name string) (w *MaintenanceWindow, err error) {
+	windows := []MaintenanceWindow{}
+	sq := `SELECT name,cron,time_zone,duration::text AS duration,EXTRACT(EPOCH FROM duration)::bigint AS duration_seconds FROM tasks.maintenance_windows WHERE name=$1`
+	log.Trace(fmt.Sprintf(`tasks.FindMaintenanceWindow(%s) > %s`, name, sq))
+	OpenWorkDB()
+	err = workDB.Select(&windows, sq, name)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.FindMaintenanceWindow(%s) ! %s`, name, err))
+		return
+	}
+	if len(windows) > 0 {
+		w = &windows[0]
+	}
+	return
+}
+
+//Save - Insert or update the maintenance window
+func (w *MaintenanceWindow) Save() (err error) {
+	if err = w.Validate(); err != nil {
+		return
+	}
+	OpenWorkDB()
+	sq := `UPDATE tasks.maintenance_windows SET cron=$2, time_zone=$3, duration=$4::interval WHERE name=$1`
+	log.Trace(fmt.Sprintf(`tasks.MaintenanceWindow<%s>#Save() > %s`, w.Name, sq))
+	result, err := workDB.Exec(sq, w.Name, w.Cron, w.TimeZone, w.Duration)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.MaintenanceWindow<%s>#Save() ! %s`, w.Name, err))
+		return
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		sq = `INSERT INTO tasks.maintenance_windows (name,cron,time_zone,duration) VALUES ($1,$2,$3,$4::interval)`
+		log.Trace(fmt.Sprintf(`tasks.MaintenanceWindow<%s>#Save() > %s`, w.Name, sq))
+		_, err = workDB.Exec(sq, w.Name, w.Cron, w.TimeZone, w.Duration)
+		if err != nil {
+			log.Error(fmt.Sprintf(`tasks.MaintenanceWindow<%s>#Save() ! %s`, w.Name, err))
+			return
+		}
+	}
+	// Schedules in the window are due again as soon as it opens.
+	sq = `UPDATE tasks.schedules SET next_run_at=NULL WHERE maintenance_window=$1`
+	_, err = workDB.Exec(sq, w.Name)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.MaintenanceWindow<%s>#Save() ! %s`, w.Name, err))
+	}
+	return
+}
+
+//AssignActions - Restrict the schedules of the given actions, and only those,
+//to the window. Schedules of other actions which were restricted to it may start
+//at any time again.
+func (w *MaintenanceWindow) AssignActions(actions []string) (err error) {
+	OpenWorkDB()
+	tx, err := workDB.Beginx()
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.MaintenanceWindow<%s>#AssignActions() Begin ! %s`, w.Name, err))
+		return
+	}
+	sq := `UPDATE tasks.schedules SET maintenance_window='', next_run_at=NULL WHERE maintenance_window=$1 AND NOT action = ANY(string_to_array($2,','))`
+	log.Trace(fmt.Sprintf(`tasks.MaintenanceWindow<%s>#AssignActions() > %s`, w.Name, sq))
+	_, err = tx.Exec(sq, w.Name, strings.Join(actions, `,`))
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.MaintenanceWindow<%s>#AssignActions() ! %s`, w.Name, err))
+		tx.Rollback()
+		return
+	}
+	for _, action := range actions {
+		sq = `UPDATE tasks.schedules SET maintenance_window=$1, next_run_at=NULL WHERE action=$2 AND maintenance_window IS DISTINCT FROM $1`
+		log.Trace(fmt.Sprintf(`tasks.MaintenanceWindow<%s>#AssignActions() > %s`, w.Name, sq))
+		_, err = tx.Exec(sq, w.Name, action)
+		if err != nil {
+			log.Error(fmt.Sprintf(`tasks.MaintenanceWindow<%s>#AssignActions(%s) ! %s`, w.Name, action, err))
+			tx.Rollback()
+			return
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.MaintenanceWindow<%s>#AssignActions() Commit ! %s`, w.Name, err))
+	}
+	return
+}
+
+//DeleteMaintenanceWindow - Remove the named window, schedules which were
+//restricted to it may start at any time again.
+func DeleteMaintenanceWindow(name string) (err error) {
+	OpenWorkDB()
+	sq := `UPDATE tasks.schedules SET maintenance_window='', next_run_at=NULL WHERE maintenance_window=$1`
+	log.Trace(fmt.Sprintf(`tasks.DeleteMaintenanceWindow(%s) > %s`, name, sq))
+	_, err = workDB.Exec(sq, name)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.DeleteMaintenanceWindow(%s) ! %s`, name, err))
+		return
+	}
+	sq = `DELETE FROM tasks.maintenance_windows WHERE name=$1`
+	log.Trace(fmt.Sprintf(`tasks.DeleteMaintenanceWindow(%s) > %s`, name, sq))
+	_, err = workDB.Exec(sq, name)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.DeleteMaintenanceWindow(%s) ! %s`, name, err))
+	}
+	return
+}
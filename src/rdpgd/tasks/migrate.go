@@ -0,0 +1,624 @@
+package tasks
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	consulapi "github.com/hashicorp/consul/api"
+
+	"github.com/starkandwayne/rdpgd/bdr"
+	"github.com/starkandwayne/rdpgd/globals"
+	"github.com/starkandwayne/rdpgd/instances"
+	"github.com/starkandwayne/rdpgd/log"
+	"github.com/starkandwayne/rdpgd/pg"
+	"github.com/starkandwayne/rdpgd/utils/backup"
+)
+
+func init() {
+	Register(`MigrateInstance`, Handler{Run: (*Task).MigrateInstance, Decode: decodeNonEmpty, Role: `manager`, NodeType: `any`, Priority: PriorityHigh})
+	Register(`MigrateDatabase`, Handler{Run: (*Task).MigrateDatabase, Decode: decodeNonEmpty, Role: `service`, NodeType: `write`})
+	Register(`RetireMigratedDatabase`, Handler{Run: (*Task).RetireMigratedDatabase, Decode: decodeNonEmpty, Role: `service`, NodeType: `write`, Priority: PriorityHigh})
+}
+
+// decodeMigration accepts a migration naming its database and owner.
+func decodeMigration(data string) (interface{}, error) {
+	m := instances.Migration{}
+	if err := json.Unmarshal([]byte(data), &m); err != nil {
+		return nil, err
+	}
+	if m.Instance.Database == `` || m.Instance.User == `` || m.SourceDSN == `` {
+		return nil, fmt.Errorf(`dbname, uname and source_dsn are required`)
+	}
+	return m, nil
+}
+
+//MigrateInstance - Work the asynchronous update operation whose id is in Data
+// by sending its instance's database to a service cluster of the new plan's
+// cluster service. The operation is finished by CompleteMigration once that
+// cluster reports back.
+func (t *Task) MigrateInstance() (err error) {
+	o, err := instances.FindOperation(t.Data)
+	if err != nil {
+		return
+	}
+	if o == nil || o.State != instances.OperationInProgress {
+		log.Warn(fmt.Sprintf(`tasks.Task<%d>#MigrateInstance(%s) Operation not in progress, nothing to do`, t.ID, t.Data))
+		return nil
+	}
+	done, err := t.migrate(o)
+	if err != nil {
+		return
+	}
+	if done {
+		return o.Finish(instances.OperationSucceeded, `Updated Instance `+o.InstanceID)
+	}
+	return
+}
+
+func (t *Task) migrate(o *instances.Operation) (done bool, err error) {
+	r := instances.UpdateRequest{}
+	if err = o.Decode(&r); err != nil {
+		return false, permanentError{err}
+	}
+	i, err := instances.FindByInstanceID(o.InstanceID)
+	if err != nil {
+		return
+	}
+	if i.PlanID == strings.ToLower(r.PlanID) {
+		return true, i.SetParameters(r.Parameters)
+	}
+	clusterService, err := instances.PlanClusterService(r.PlanID)
+	if err == instances.ErrPlanNotFound {
+		return false, permanentError{err}
+	}
+	if err != nil {
+		return
+	}
+	clusterID, err := instances.MigrationTarget(clusterService)
+	if err == instances.ErrNoMigrationTarget {
+		return false, permanentError{err}
+	}
+	if err != nil {
+		return
+	}
+	sourceDSN, err := i.PushMigrating(true)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.Task<%d>#MigrateInstance(%s) i.PushMigrating() ! %s`, t.ID, i.InstanceID, err))
+		restoreMigrationSource(i)
+		return
+	}
+	m, err := i.NewMigration(o.OperationID, strings.ToLower(r.PlanID), clusterID, clusterService, sourceDSN)
+	if err != nil {
+		restoreMigrationSource(i)
+		return
+	}
+	err = m.Push()
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.Task<%d>#MigrateInstance(%s) m.Push() ! %s`, t.ID, i.InstanceID, err))
+		restoreMigrationSource(i)
+	}
+	return
+}
+
+// restoreMigrationSource lets the tenant of an instance which is not migrated
+// after all connect to its database again on its service cluster.
+func restoreMigrationSource(i *instances.Instance) {
+	_, err := i.PushMigrating(false)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.restoreMigrationSource(%s) i.PushMigrating() ! %s`, i.InstanceID, err))
+	}
+}
+
+//EnqueueMigration - Enqueue the work of an asynchronous update operation.
+func EnqueueMigration(o *instances.Operation) (err error) {
+	t := Task{ClusterID: ClusterID, Action: `MigrateInstance`, Data: o.OperationID}
+	t.DedupKey = DedupKey(t.Action, o.OperationID)
+	err = t.Enqueue()
+	if err == ErrDuplicate {
+		return nil
+	}
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.EnqueueMigration(%s) ! %s`, o.InstanceID, err))
+	}
+	return
+}
+
+//EnqueueMigrateDatabase - Enqueue the copy of a migrated database onto this
+// service cluster. The migration, which holds the credentials to copy from, is
+// kept in cfsb.migrations and the task only names its operation.
+func EnqueueMigrateDatabase(m *instances.Migration) (err error) {
+	err = saveMigration(m)
+	if err != nil {
+		return
+	}
+	t := Task{ClusterID: ClusterID, ClusterService: globals.ClusterService, Node: `*`, Role: `service`, Action: `MigrateDatabase`, Data: m.OperationID, NodeType: `write`}
+	t.DedupKey = DedupKey(t.Action, m.OperationID)
+	err = t.Enqueue()
+	if err == ErrDuplicate {
+		return nil
+	}
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.EnqueueMigrateDatabase(%s) ! %s`, m.Instance.Database, err))
+	}
+	return
+}
+
+// saveMigration keeps the migration pushed by the management cluster until
+// the MigrateDatabase task working it is done, a repeated push replaces it.
+func saveMigration(m *instances.Migration) (err error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.saveMigration(%s) json.Marshal() ! %s`, m.OperationID, err))
+		return
+	}
+	OpenWorkDB()
+	sq := `UPDATE cfsb.migrations SET migration=$2 WHERE operation_id=$1`
+	log.Trace(fmt.Sprintf(`tasks.saveMigration(%s) > %s`, m.OperationID, sq))
+	result, err := workDB.Exec(sq, m.OperationID, string(data))
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.saveMigration(%s) ! %s`, m.OperationID, err))
+		return
+	}
+	if updated, _ := result.RowsAffected(); updated > 0 {
+		return
+	}
+	sq = `INSERT INTO cfsb.migrations (operation_id,migration) VALUES ($1,$2)`
+	log.Trace(fmt.Sprintf(`tasks.saveMigration(%s) > %s`, m.OperationID, sq))
+	_, err = workDB.Exec(sq, m.OperationID, string(data))
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.saveMigration(%s) ! %s`, m.OperationID, err))
+	}
+	return
+}
+
+// findMigration returns the migration kept for the operation, nil if there is
+// none, eg. as it was reported already.
+func findMigration(operationID string) (m *instances.Migration, err error) {
+	var data string
+	OpenWorkDB()
+	sq := `SELECT migration FROM cfsb.migrations WHERE operation_id=$1`
+	log.Trace(fmt.Sprintf(`tasks.findMigration(%s) > %s`, operationID, sq))
+	err = workDB.Get(&data, sq, operationID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.findMigration(%s) ! %s`, operationID, err))
+		return
+	}
+	v, err := decodeMigration(data)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.findMigration(%s) ! %s`, operationID, err))
+		return
+	}
+	migration := v.(instances.Migration)
+	return &migration, nil
+}
+
+// deleteMigration drops the migration kept for the operation once it is
+// reported to the management cluster.
+func deleteMigration(operationID string) (err error) {
+	OpenWorkDB()
+	sq := `DELETE FROM cfsb.migrations WHERE operation_id=$1`
+	log.Trace(fmt.Sprintf(`tasks.deleteMigration(%s) > %s`, operationID, sq))
+	_, err = workDB.Exec(sq, operationID)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.deleteMigration(%s) ! %s`, operationID, err))
+	}
+	return
+}
+
+//MigrateDatabase - Create the migrated database with its owner on this service
+// cluster, copy it from the cluster it is migrated from, register and assign
+// it, recreate the roles of its bindings and report to the management cluster.
+// A retry picks up after the copy once the database is registered, the copy is
+// dropped when the last attempt fails.
+func (t *Task) MigrateDatabase() (err error) {
+	m, err := findMigration(t.Data)
+	if err != nil {
+		return
+	}
+	if m == nil {
+		log.Warn(fmt.Sprintf(`tasks.Task<%d>#MigrateDatabase(%s) Migration not found, nothing to do`, t.ID, t.Data))
+		return
+	}
+	i := &m.Instance
+	i.ClusterID = ClusterID
+	// The failure is reported to the management cluster once the task is
+	// given up on, see reportMigrationFailed.
+	defer func() {
+		if err != nil && t.lastAttempt(err) {
+			t.dropMigrationCopy(i)
+		}
+	}()
+
+	registered, err := migrationRegistered(i.Database)
+	if err != nil {
+		return
+	}
+	if !registered {
+		t.dropMigrationCopy(i)
+		err = t.createMigrationDatabase(i, m.Parameters.Extensions)
+		if err != nil {
+			return
+		}
+		err = backup.CopyDatabase(t.context(), i.Database, i.User, m.SourceDSN)
+		if err != nil {
+			return
+		}
+		err = registerMigration(i)
+		if err != nil {
+			return
+		}
+	}
+	err = AssignInstance(i)
+	if err != nil {
+		return
+	}
+	for index := range m.Bindings {
+		r := m.Bindings[index]
+		err = BindInstance(&r)
+		if err != nil {
+			log.Error(fmt.Sprintf(`tasks.Task<%d>#MigrateDatabase(%s) BindInstance(%s) ! %s`, t.ID, i.Database, r.BindingID, err))
+			return
+		}
+	}
+	err = m.Report(nil)
+	if err != nil {
+		return
+	}
+	deleteMigration(m.OperationID)
+	return
+}
+
+// migrationRegistered tells if the database is registered on this service
+// cluster and in effect, that is an earlier attempt to migrate it got as far.
+func migrationRegistered(dbname string) (registered bool, err error) {
+	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("tasks.migrationRegistered(%s) p.Connect(%s) ! %s", dbname, p.URI, err))
+		return
+	}
+	defer db.Close()
+
+	sq := `SELECT EXISTS (SELECT 1 FROM cfsb.instances WHERE dbname=$1 AND ineffective_at IS NULL AND decommissioned_at IS NULL)`
+	log.Trace(fmt.Sprintf(`tasks.migrationRegistered(%s) > %s`, dbname, sq))
+	err = db.Get(&registered, sq, dbname)
+	if err != nil {
+		log.Error(fmt.Sprintf("tasks.migrationRegistered(%s) ! %s", dbname, err))
+	}
+	return
+}
+
+// registerMigration registers the migrated database on this service cluster,
+// taking over the row left by a copy retired from it earlier as dbname is
+// unique.
+func registerMigration(i *instances.Instance) (err error) {
+	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf("tasks.registerMigration(%s) p.Connect(%s) ! %s", i.Database, p.URI, err))
+		return
+	}
+	defer db.Close()
+
+	sq := `UPDATE cfsb.instances SET cluster_id=$1, cluster_service=$2, dbuser=$3, dbpass=$4, effective_at=CURRENT_TIMESTAMP, ineffective_at=NULL, decommissioned_at=NULL WHERE dbname=$5 AND decommissioned_at IS NOT NULL`
+	log.Trace(fmt.Sprintf(`tasks.registerMigration(%s) > %s`, i.Database, sq))
+	result, err := db.Exec(sq, i.ClusterID, i.ClusterService, i.User, i.Pass, i.Database)
+	if err != nil {
+		log.Error(fmt.Sprintf("tasks.registerMigration(%s) ! %s", i.Database, err))
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows > 0 {
+		return
+	}
+	return i.Register()
+}
+
+// createMigrationDatabase creates the database and its owner the way the
+// databases of the cluster service are precreated, along with the extensions
+// the tenant asked for.
+func (t *Task) createMigrationDatabase(i *instances.Instance, tenantExtensions []string) (err error) {
+	exts := []string{}
+	if len(globals.UserExtensions) > 1 {
+		exts = strings.Split(globals.UserExtensions, " ")
+	}
+	exts = append(exts, tenantExtensions...)
+	switch t.ClusterService {
+	case `pgbdr`:
+		client, err := consulapi.NewClient(consulapi.DefaultConfig())
+		if err != nil {
+			log.Error(fmt.Sprintf("tasks.Task#createMigrationDatabase(%s) consulapi.NewClient() ! %s", i.Database, err))
+			return err
+		}
+		b := bdr.NewBDR(ClusterID, client)
+		if err = b.CreateUser(i.User, i.Pass); err != nil {
+			return err
+		}
+		if err = b.CreateDatabase(i.Database, i.User); err != nil {
+			return err
+		}
+		if err = b.CreateExtensions(i.Database, append(bdrExtensions, exts...)); err != nil {
+			return err
+		}
+		if err = b.CreateReplicationGroup(i.Database); err != nil {
+			log.Error(fmt.Sprintf("tasks.Task#createMigrationDatabase(%s) CreateReplicationGroup() ! %s", i.Database, err))
+			return err
+		}
+	default:
+		p := pg.NewPG(`127.0.0.1`, pgPort, `rdpg`, `rdpg`, pgPass)
+		if err = p.CreateUser(i.User, i.Pass); err != nil {
+			return
+		}
+		if err = p.CreateDatabase(i.Database, i.User); err != nil {
+			return
+		}
+		if err = p.CreateExtensions(i.Database, append(postgresqlExtensions, exts...)); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// dropMigrationCopy drops what attempts to migrate the database left on this
+// service cluster, its registration included.
+func (t *Task) dropMigrationCopy(i *instances.Instance) {
+	client, err := consulapi.NewClient(consulapi.DefaultConfig())
+	if err != nil {
+		log.Error(fmt.Sprintf("tasks.Task<%d>#dropMigrationCopy(%s) consulapi.NewClient() ! %s", t.ID, i.Database, err))
+		return
+	}
+	registered, err := migrationRegistered(i.Database)
+	if err != nil {
+		return
+	}
+	if registered {
+		log.Warn(fmt.Sprintf(`tasks.Task<%d>#dropMigrationCopy(%s) Dropping a registered copy`, t.ID, i.Database))
+		if err = i.Decommission(); err != nil {
+			return
+		}
+		reconfigurePGBouncer(i, fmt.Sprintf(`tasks.Task<%d>#dropMigrationCopy(%s)`, t.ID, i.Database))
+		t.dropDatabase(i, client)
+		return
+	}
+	p := pg.NewPG(`127.0.0.1`, pgPort, `rdpg`, `rdpg`, pgPass)
+	if exists, _ := p.DatabaseExists(i.Database); !exists {
+		return
+	}
+	log.Warn(fmt.Sprintf(`tasks.Task<%d>#dropMigrationCopy(%s) Dropping an incomplete copy`, t.ID, i.Database))
+	switch t.ClusterService {
+	case `pgbdr`:
+		b := bdr.NewBDR(ClusterID, client)
+		b.DropDatabase(i.Database)
+		b.DropUser(i.User)
+	default:
+		p.DisableDatabase(i.Database)
+		p.DropDatabase(i.Database)
+		p.DropUser(i.User)
+	}
+}
+
+// CompleteMigration - Finish the update operation of a migration reported by
+// the target service cluster. On success the instance is moved to the new plan
+// and cluster and the service cluster it was migrated from drops its copy,
+// otherwise the tenant may connect to the database there again.
+func CompleteMigration(m *instances.Migration) (err error) {
+	o, err := instances.FindOperation(m.OperationID)
+	if err != nil {
+		return
+	}
+	if o == nil || (o.State != instances.OperationInProgress && o.State != instances.OperationFailed) {
+		log.Warn(fmt.Sprintf(`tasks.CompleteMigration(%s) Operation not in progress, nothing to do`, m.OperationID))
+		return nil
+	}
+	i, err := instances.FindByInstanceID(o.InstanceID)
+	if err != nil {
+		return
+	}
+	// The operation was given up on while the database was being copied.
+	if o.State == instances.OperationFailed {
+		restoreMigrationSource(i)
+		return nil
+	}
+	if m.Error != `` {
+		restoreMigrationSource(i)
+		return o.Finish(instances.OperationFailed, m.Error)
+	}
+	r := instances.UpdateRequest{}
+	if err = o.Decode(&r); err != nil {
+		return
+	}
+	source := *i
+	err = i.ChangePlan(m.Instance.PlanID, m.Instance.ClusterID, m.Instance.ClusterService)
+	if err != nil {
+		return
+	}
+	err = i.PushBackupSettings()
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.CompleteMigration(%s) i.PushBackupSettings() ! %s`, i.InstanceID, err))
+	}
+	// Settings and the pool mode are per cluster, they are applied anew.
+	err = i.SetParameters(r.Parameters)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.CompleteMigration(%s) i.SetParameters() ! %s`, i.InstanceID, err))
+	}
+	err = source.PushRetire()
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.CompleteMigration(%s) source.PushRetire() ! %s`, i.InstanceID, err))
+	}
+	return o.Finish(instances.OperationSucceeded, fmt.Sprintf(`Migrated Instance %s to cluster %s`, i.InstanceID, i.ClusterID))
+}
+
+// migrationBindingID is the binding id the role a migrated database is copied
+// as is recorded under in cfsb.credentials, so that pgbouncer lets it connect.
+const migrationBindingID = `migration`
+
+//SetMigrating - Record whether a database of this service cluster is being
+// migrated to another. Once it is, the owner and binding roles of the database
+// are kept from connecting on each node and their sessions terminated, so that
+// nothing is written to it behind the copy, and a role which is a member of the
+// owner is created for the copy to be taken as; its DSN is returned. Once it no
+// longer is, that role is dropped and the tenant's roles may connect again.
+func SetMigrating(dbname string, migrating bool) (sourceDSN string, err error) {
+	i, err := instances.FindByDatabase(dbname)
+	if err != nil {
+		return
+	}
+	if i == nil {
+		return ``, fmt.Errorf(`database %s not found`, dbname)
+	}
+	params, err := instances.FindParameters(dbname)
+	if err != nil {
+		return
+	}
+	r, err := migrationRole(i)
+	if err != nil {
+		return
+	}
+	// Terminating the sessions again would abort a copy already under way.
+	if params.Migrating && migrating && r != nil {
+		return migrationDSN(i, r)
+	}
+	params.Migrating = migrating
+	err = instances.SaveParameters(params)
+	if err != nil {
+		return
+	}
+	if !migrating {
+		err = setTenantConnectionLimit(i, -1)
+		if err != nil || r == nil {
+			return
+		}
+		return ``, UnbindInstance(r)
+	}
+	err = setTenantConnectionLimit(i, 0)
+	if err == nil {
+		r = instances.NewBindingRole(i, migrationBindingID)
+		err = BindInstance(r)
+	}
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.SetMigrating(%s) ! %s`, dbname, err))
+		SetMigrating(dbname, false)
+		return
+	}
+	return migrationDSN(i, r)
+}
+
+// migrationRole returns the role the database of the instance is copied as
+// while it is migrated, nil if there is none.
+func migrationRole(i *instances.Instance) (r *instances.BindingRole, err error) {
+	roles, err := instances.BindingRoles(i.Database)
+	if err != nil {
+		return
+	}
+	for index := range roles {
+		if roles[index].BindingID == migrationBindingID {
+			return &roles[index], nil
+		}
+	}
+	return
+}
+
+// migrationDSN returns the DSN connecting to the database of the instance as
+// its migration role.
+func migrationDSN(i *instances.Instance, r *instances.BindingRole) (string, error) {
+	source := *i
+	source.User, source.Pass = r.User, r.Pass
+	return source.DSN()
+}
+
+// setTenantConnectionLimit limits the connections of the owner and binding
+// roles of the instance's database on each node, terminating their sessions
+// when they may not connect at all. The role of a migration is left alone.
+func setTenantConnectionLimit(i *instances.Instance, limit int) (err error) {
+	users := []string{i.User}
+	roles, err := instances.BindingRoles(i.Database)
+	if err != nil {
+		return
+	}
+	for index := range roles {
+		if roles[index].BindingID != migrationBindingID && roles[index].User != i.User {
+			users = append(users, roles[index].User)
+		}
+	}
+	switch i.ClusterService {
+	case `pgbdr`:
+		client, err := consulapi.NewClient(consulapi.DefaultConfig())
+		if err != nil {
+			log.Error(fmt.Sprintf("tasks.setTenantConnectionLimit(%s) consulapi.NewClient() ! %s", i.Database, err))
+			return err
+		}
+		b := bdr.NewBDR(ClusterID, client)
+		for _, dbuser := range users {
+			if err = b.SetUserConnectionLimit(dbuser, limit); err != nil {
+				return err
+			}
+			if limit == 0 {
+				if err = b.TerminateUserSessions(dbuser); err != nil {
+					return err
+				}
+			}
+		}
+	default:
+		p := pg.NewPG(`127.0.0.1`, pgPort, `rdpg`, `rdpg`, pgPass)
+		for _, dbuser := range users {
+			if err = p.SetUserConnectionLimit(dbuser, limit); err != nil {
+				return
+			}
+			if limit == 0 {
+				if err = p.TerminateUserSessions(dbuser); err != nil {
+					return
+				}
+			}
+		}
+	}
+	return
+}
+
+//RetireDatabase - Enqueue dropping this service cluster's copy of a database
+// that was migrated to another.
+func RetireDatabase(dbname string) (err error) {
+	t := Task{ClusterID: ClusterID, ClusterService: globals.ClusterService, Node: `*`, Role: `service`, Action: `RetireMigratedDatabase`, Data: dbname, NodeType: `write`}
+	t.DedupKey = DedupKey(t.Action, dbname)
+	err = t.Enqueue()
+	if err == ErrDuplicate {
+		return nil
+	}
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.RetireDatabase(%s) ! %s`, dbname, err))
+	}
+	return
+}
+
+//RetireMigratedDatabase - Take a last backup of a database migrated to another
+// service cluster, then drop it along with its owner and binding roles. Unlike
+// DecommissionDatabase the management cluster is not told, the instance lives
+// on elsewhere.
+func (t *Task) RetireMigratedDatabase() (err error) {
+	i, err := instances.FindByDatabase(t.Data)
+	if err != nil {
+		return
+	}
+	if i == nil {
+		return permanentError{fmt.Errorf(`database %s not found`, t.Data)}
+	}
+	err = t.BackupDatabase()
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.Task<%d>#RetireMigratedDatabase(%s) Final backup ! %s`, t.ID, t.Data, err))
+		return
+	}
+	err = i.Decommission()
+	if err != nil {
+		return
+	}
+	reconfigurePGBouncer(i, fmt.Sprintf(`tasks.Task<%d>#RetireMigratedDatabase(%s)`, t.ID, t.Data))
+	client, err := consulapi.NewClient(consulapi.DefaultConfig())
+	if err != nil {
+		log.Error(fmt.Sprintf("tasks.Task<%d>#RetireMigratedDatabase(%s) consulapi.NewClient() ! %s", t.ID, t.Data, err))
+		return
+	}
+	return t.dropDatabase(i, client)
+}
@@ -0,0 +1,137 @@
+package tasks
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/starkandwayne/rdpgd/history"
+	"github.com/starkandwayne/rdpgd/log"
+)
+
+// Misfire policies, what the scheduler does about the runs of a schedule
+// missed while it was not scheduling, eg. the manager being down.
+const (
+	// MisfireSkip drops the missed runs, the schedule next runs on time.
+	MisfireSkip = `skip`
+	// MisfireRunOnce enqueues a single task for all of the missed runs.
+	MisfireRunOnce = `run_once`
+	// MisfireRunAll enqueues a task for every missed run, up to maxCatchUpRuns.
+	MisfireRunAll = `run_all`
+)
+
+const (
+	// misfireThreshold is how late a run may be started before it counts as
+	// missed, the scheduler looks for due schedules every 10 seconds.
+	misfireThreshold = time.Minute
+	// maxCatchUpRuns is the most tasks MisfireRunAll enqueues at once.
+	maxCatchUpRuns = 100
+)
+
+// validateMisfire checks the misfire policy and that the jitter is a
+// non-negative PostgreSQL interval shorter than an interval schedule's
+// frequency, filling in the defaults.
+func (s *Schedule) validateMisfire() (err error) {
+	if s.MisfirePolicy == `` {
+		s.MisfirePolicy = MisfireRunOnce
+	}
+	switch s.MisfirePolicy {
+	case MisfireSkip, MisfireRunOnce, MisfireRunAll:
+	default:
+		return fmt.Errorf(`invalid misfire policy '%s', expected %s, %s or %s`, s.MisfirePolicy, MisfireSkip, MisfireRunOnce, MisfireRunAll)
+	}
+	if s.Jitter == `` {
+		s.Jitter = `0`
+	}
+	var positive, shorter bool
+	OpenWorkDB()
+	err = workDB.QueryRow(`SELECT $1::interval >= '0'::interval, $1::interval < $2::interval`, s.Jitter, s.Frequency).Scan(&positive, &shorter)
+	if err != nil {
+		return fmt.Errorf(`invalid jitter '%s'`, s.Jitter)
+	}
+	if !positive {
+		return fmt.Errorf(`jitter '%s' must not be negative`, s.Jitter)
+	}
+	if s.Cron == `` && !shorter {
+		return fmt.Errorf(`jitter '%s' must be shorter than the frequency '%s'`, s.Jitter, s.Frequency)
+	}
+	return nil
+}
+
+// dueRuns returns how many of the schedule's runs are due, the time its next
+// run is due and whether it misfired, ie. more than one run is due or the due
+// run is over misfireThreshold late. Runs are due at the schedule's own times,
+// scheduled_at, and jitter only delays when the scheduler starts them.
+func (s *Schedule) dueRuns(db *sqlx.DB, now time.Time) (runs int, next time.Time, misfired bool, err error) {
+	var scheduledAt time.Time
+	var late bool
+	sq := fmt.Sprintf(`SELECT COALESCE(scheduled_at, next_run_at), CURRENT_TIMESTAMP - next_run_at > '%d seconds'::interval FROM tasks.schedules WHERE id=%d`, int(misfireThreshold.Seconds()), s.ID)
+	log.Trace(fmt.Sprintf(`tasks.Schedule<%d>#dueRuns() > %s`, s.ID, sq))
+	err = db.QueryRow(sq).Scan(&scheduledAt, &late)
+	if err != nil {
+		return
+	}
+	if s.Cron != `` {
+		runs, next, err = cronRuns(s.Cron, s.TimeZone, scheduledAt, now)
+	} else {
+		sq = fmt.Sprintf(`SELECT COUNT(*), MAX(f) + frequency FROM tasks.schedules, generate_series($1::timestamptz, CURRENT_TIMESTAMP, frequency) AS f WHERE id=%d GROUP BY frequency`, s.ID)
+		log.Trace(fmt.Sprintf(`tasks.Schedule<%d>#dueRuns() > %s`, s.ID, sq))
+		err = db.QueryRow(sq, scheduledAt).Scan(&runs, &next)
+	}
+	if err != nil {
+		return
+	}
+	return runs, next, runs > 1 || late, nil
+}
+
+// cronRuns returns the number of times the cron expression fires from
+// scheduledAt, inclusive, up to now and the first time it fires after now.
+func cronRuns(expr, timeZone string, scheduledAt, now time.Time) (runs int, next time.Time, err error) {
+	next = scheduledAt
+	for !next.After(now) {
+		runs++
+		if next, err = nextCronTime(expr, timeZone, next); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// catchUp returns how many tasks the schedule's misfire policy enqueues for
+// the due runs.
+func (s *Schedule) catchUp(runs int) int {
+	switch s.MisfirePolicy {
+	case MisfireSkip:
+		return 0
+	case MisfireRunAll:
+		if runs > maxCatchUpRuns {
+			return maxCatchUpRuns
+		}
+		return runs
+	default:
+		return 1
+	}
+}
+
+// recordMisfire records in tasks.history that the schedule missed runs and
+// how many tasks were enqueued for them.
+func (s *Schedule) recordMisfire(runs, enqueued int) {
+	t := s.task()
+	h := history.TaskHistory{
+		ClusterID:      t.ClusterID,
+		ClusterService: t.ClusterService,
+		Node:           myIP,
+		Role:           t.Role,
+		Action:         t.Action,
+		Data:           t.Data,
+		DBName:         t.database(),
+		Status:         `misfired`,
+		Error:          fmt.Sprintf(`schedule %d missed %d run(s), misfire policy %s enqueued %d task(s)`, s.ID, runs, s.MisfirePolicy, enqueued),
+	}
+	log.Warn(fmt.Sprintf(`tasks.Schedule<%d>#recordMisfire() %s %s`, s.ID, s.Action, h.Error))
+	err := history.InsertTaskHistory(h)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.Schedule<%d>#recordMisfire() ! %s`, s.ID, err))
+	}
+}
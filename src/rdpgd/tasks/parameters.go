@@ -0,0 +1,116 @@
+package tasks
+
+import (
+	"fmt"
+
+	"github.com/starkandwayne/rdpgd/instances"
+	"github.com/starkandwayne/rdpgd/log"
+	"github.com/starkandwayne/rdpgd/pg"
+	"github.com/starkandwayne/rdpgd/services"
+)
+
+func init() {
+	Register(`ApplyDatabaseParameters`, Handler{Run: (*Task).ApplyDatabaseParameters, Decode: decodeNonEmpty, Role: `service`, Priority: PriorityHigh})
+}
+
+// ApplyDatabaseParameters - Record a database's parameters on this service
+// cluster and enqueue applying them on each of its nodes. Whether the database
+// is over its storage quota is this cluster's to tell, see EnforceQuotas, as is
+// whether it is being migrated away, see SetMigrating.
+func ApplyDatabaseParameters(params instances.DatabaseParameters) (err error) {
+	i, err := instances.FindByDatabase(params.DBName)
+	if err != nil {
+		return
+	}
+	if i == nil {
+		return fmt.Errorf(`database %s not found`, params.DBName)
+	}
+	existing, err := instances.FindParameters(params.DBName)
+	if err != nil {
+		return
+	}
+	params.OverQuota = existing.OverQuota
+	params.Migrating = existing.Migrating
+	err = instances.SaveParameters(params)
+	if err != nil {
+		return
+	}
+	return enqueueApplyDatabaseParameters(i)
+}
+
+// enqueueApplyDatabaseParameters enqueues applying the recorded parameters of
+// the instance's database on each node of this service cluster. A node with
+// such a task still pending is skipped, it applies the parameters recorded
+// when it runs; one already running gets another task after it.
+func enqueueApplyDatabaseParameters(i *instances.Instance) (err error) {
+	ips, err := i.ClusterIPs()
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.enqueueApplyDatabaseParameters(%s) i.ClusterIPs() ! %s`, i.Database, err))
+		return
+	}
+	for _, ip := range ips {
+		t := Task{ClusterID: ClusterID, ClusterService: i.ClusterService, Node: ip, Role: `service`, Action: `ApplyDatabaseParameters`, Data: i.Database}
+		t.DedupKey = DedupKey(t.Action, i.Database, ip)
+		err = t.Enqueue()
+		if err == ErrDuplicate {
+			err = nil
+			continue
+		}
+		if err != nil {
+			log.Error(fmt.Sprintf(`tasks.enqueueApplyDatabaseParameters(%s) Enqueue on %s ! %s`, i.Database, ip, err))
+			return
+		}
+	}
+	return
+}
+
+// ApplyDatabaseParameters - Create the extensions, set the settings and
+// connection limit of the database named in Data on this node, then
+// reconfigure pgbouncer for its pool mode. The parameters are read when the task runs, so that a later change is
+// never overwritten by an earlier one.
+func (t *Task) ApplyDatabaseParameters() (err error) {
+	params, err := instances.FindParameters(t.Data)
+	if err != nil {
+		return
+	}
+	p := pg.NewPG(`127.0.0.1`, pgPort, `rdpg`, `rdpg`, pgPass)
+	exists, err := p.DatabaseExists(t.Data)
+	if err != nil {
+		return
+	}
+	if !exists {
+		return permanentError{fmt.Errorf(`database %s does not exist`, t.Data)}
+	}
+	if len(params.Extensions) > 0 {
+		err = p.CreateExtensions(t.Data, params.Extensions)
+		if err != nil {
+			log.Error(fmt.Sprintf(`tasks.Task<%d>#ApplyDatabaseParameters(%s) CreateExtensions() ! %s`, t.ID, t.Data, err))
+			return
+		}
+	}
+	settings := map[string]string{}
+	for name, value := range params.Settings {
+		settings[name] = value
+	}
+	if params.OverQuota {
+		settings[`default_transaction_read_only`] = `on`
+	}
+	err = p.SetDatabaseSettings(t.Data, settings)
+	if err != nil {
+		return
+	}
+	limit := -1
+	if params.MaxConnections > 0 {
+		limit = params.MaxConnections
+	}
+	err = p.SetConnectionLimit(t.Data, limit)
+	if err != nil {
+		return
+	}
+	service, err := services.NewService(`pgbouncer`)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.Task<%d>#ApplyDatabaseParameters(%s) services.NewService(pgbouncer) ! %s`, t.ID, t.Data, err))
+		return
+	}
+	return service.Configure()
+}
@@ -0,0 +1,66 @@
+package tasks
+
+import (
+	"fmt"
+
+	"github.com/starkandwayne/rdpgd/instances"
+	"github.com/starkandwayne/rdpgd/log"
+	"github.com/starkandwayne/rdpgd/pg"
+)
+
+func init() {
+	Register(`ApplyPlan`, Handler{Run: (*Task).ApplyPlan, Decode: decodeNonEmpty, Role: `manager`, NodeType: `any`})
+}
+
+//EnqueueApplyPlan - Enqueue sending the backup settings and quotas of a plan
+// to the service clusters holding its instances, eg. once it was updated.
+func EnqueueApplyPlan(planID string) (err error) {
+	t := Task{ClusterID: ClusterID, Action: `ApplyPlan`, Data: planID}
+	t.DedupKey = DedupKey(t.Action, planID)
+	err = t.Enqueue()
+	if err == ErrDuplicate {
+		return nil
+	}
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.EnqueueApplyPlan(%s) ! %s`, planID, err))
+	}
+	return
+}
+
+// ApplyPlan - Send the backup settings and parameters, along with the quotas
+// of the plan named in Data, of each of its instances to the service cluster
+// holding it. An instance failing is retried with the others, sending them is
+// idempotent.
+func (t *Task) ApplyPlan() (err error) {
+	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.Task<%d>#ApplyPlan(%s) p.Connect(%s) ! %s`, t.ID, t.Data, p.URI, err))
+		return
+	}
+	defer db.Close()
+
+	instanceIDs := []string{}
+	sq := `SELECT instance_id FROM cfsb.instances WHERE plan_id=lower($1) AND instance_id IS NOT NULL AND ineffective_at IS NULL AND decommissioned_at IS NULL`
+	log.Trace(fmt.Sprintf(`tasks.Task<%d>#ApplyPlan(%s) > %s`, t.ID, t.Data, sq))
+	err = db.Select(&instanceIDs, sq, t.Data)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.Task<%d>#ApplyPlan(%s) ! %s`, t.ID, t.Data, err))
+		return
+	}
+	var failed error
+	for _, instanceID := range instanceIDs {
+		i, err := instances.FindByInstanceID(instanceID)
+		if err == nil {
+			err = i.PushBackupSettings()
+		}
+		if err == nil {
+			err = i.PushParameters()
+		}
+		if err != nil {
+			log.Error(fmt.Sprintf(`tasks.Task<%d>#ApplyPlan(%s) instance %s ! %s`, t.ID, t.Data, instanceID, err))
+			failed = err
+		}
+	}
+	return failed
+}
@@ -0,0 +1,210 @@
+package tasks
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/starkandwayne/rdpgd/log"
+)
+
+const defaultTaskWorkers = 4
+
+/*
+PoolStats struct is used to represent the worker pool of this node, how many
+tasks it is working and how many of each action against their limit.
+*/
+type PoolStats struct {
+	Workers int              `json:"workers"`
+	Active  int              `json:"active"`
+	Actions map[string]Slots `json:"actions"`
+}
+
+// Slots is the number of tasks of an action being worked and the most which
+// may be, 0 is unlimited.
+type Slots struct {
+	Active int `json:"active"`
+	Limit  int `json:"limit"`
+}
+
+// workerPool tracks the tasks this node is working so Work() only claims a
+// task when there is a free slot for it.
+type workerPool struct {
+	mu       sync.Mutex
+	workers  int
+	limits   map[string]int
+	active   int
+	byAction map[string]int
+	// byGroup counts the tasks of each action's limit group, the action itself
+	// when it has none.
+	byGroup map[string]int
+}
+
+var pool = newWorkerPool(defaultTaskWorkers, nil)
+
+func newWorkerPool(workers int, limits map[string]int) *workerPool {
+	if limits == nil {
+		limits = map[string]int{}
+	}
+	return &workerPool{workers: workers, limits: limits, byAction: map[string]int{}, byGroup: map[string]int{}}
+}
+
+// configurePool sizes the pool from RDPGD_TASK_WORKERS and
+// RDPGD_TASK_CONCURRENCY.
+func configurePool() {
+	workers := defaultTaskWorkers
+	if v := os.Getenv(`RDPGD_TASK_WORKERS`); v != `` {
+		w, err := strconv.Atoi(v)
+		if err != nil || w < 1 {
+			log.Error(fmt.Sprintf(`tasks.configurePool() Invalid RDPGD_TASK_WORKERS '%s', using %d`, v, defaultTaskWorkers))
+		} else {
+			workers = w
+		}
+	}
+	limits, err := parseConcurrency(os.Getenv(`RDPGD_TASK_CONCURRENCY`))
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.configurePool() Invalid RDPGD_TASK_CONCURRENCY, using handler defaults ! %s`, err))
+	}
+	pool = newWorkerPool(workers, limits)
+}
+
+// parseConcurrency parses per action, or limit group, limits given as
+// `Action=N,Group=N`.
+func parseConcurrency(s string) (limits map[string]int, err error) {
+	limits = map[string]int{}
+	for _, item := range strings.Split(s, `,`) {
+		item = strings.TrimSpace(item)
+		if item == `` {
+			continue
+		}
+		kv := strings.SplitN(item, `=`, 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf(`expected Action=N, got '%s'`, item)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf(`invalid limit in '%s'`, item)
+		}
+		limits[strings.TrimSpace(kv[0])] = n
+	}
+	return limits, nil
+}
+
+// limit returns the most tasks of the action's limit group worked at once for
+// the action to be claimed. Limits configured for the action, then for its
+// group, override the handler's Concurrency, 0 is unlimited.
+func (p *workerPool) limit(action string) int {
+	if n, ok := p.limits[action]; ok {
+		return n
+	}
+	h, _ := Lookup(action)
+	if n, ok := p.limits[h.LimitGroup]; ok && h.LimitGroup != `` {
+		return n
+	}
+	return h.Concurrency
+}
+
+// group returns the name the action's tasks are counted under against its
+// limit.
+func group(action string) string {
+	if h, _ := Lookup(action); h.LimitGroup != `` {
+		return h.LimitGroup
+	}
+	return action
+}
+
+// full reports whether every worker is busy.
+func (p *workerPool) full() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.active >= p.workers
+}
+
+// saturated returns the actions which are at their limit and must not be
+// claimed.
+func (p *workerPool) saturated() (actions []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, action := range Actions() {
+		if limit := p.limit(action); limit > 0 && p.byGroup[group(action)] >= limit {
+			actions = append(actions, action)
+		}
+	}
+	return
+}
+
+// acquire takes a slot for a task of the action, reporting false if there is
+// none free.
+func (p *workerPool) acquire(action string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.active >= p.workers {
+		return false
+	}
+	g := group(action)
+	if limit := p.limit(action); limit > 0 && p.byGroup[g] >= limit {
+		return false
+	}
+	p.active++
+	p.byAction[action]++
+	p.byGroup[g]++
+	return true
+}
+
+// release frees the slot taken by acquire.
+func (p *workerPool) release(action string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active--
+	p.byAction[action]--
+	if p.byAction[action] <= 0 {
+		delete(p.byAction, action)
+	}
+	g := group(action)
+	p.byGroup[g]--
+	if p.byGroup[g] <= 0 {
+		delete(p.byGroup, g)
+	}
+}
+
+// drain waits until no task is being worked, reporting false if ctx is done
+// first.
+func (p *workerPool) drain(ctx context.Context) bool {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		p.mu.Lock()
+		active := p.active
+		p.mu.Unlock()
+		if active == 0 {
+			return true
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (p *workerPool) stats() (s PoolStats) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s = PoolStats{Workers: p.workers, Active: p.active, Actions: map[string]Slots{}}
+	for _, action := range Actions() {
+		limit := p.limit(action)
+		if limit > 0 || p.byAction[action] > 0 {
+			s.Actions[action] = Slots{Active: p.byAction[action], Limit: limit}
+		}
+	}
+	return
+}
+
+//WorkerPoolStats - Return the worker pool's active slot counts for this node
+func WorkerPoolStats() PoolStats {
+	return pool.stats()
+}
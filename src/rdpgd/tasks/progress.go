@@ -0,0 +1,129 @@
+package tasks
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/starkandwayne/rdpgd/log"
+)
+
+// progressInterval is the least time between two writes of a task's progress
+// within the same phase.
+const progressInterval = 5 * time.Second
+
+// clearProgress resets the progress of a task which is run again.
+const clearProgress = `progress_phase=NULL, progress_percent=NULL, progress_bytes=NULL, progress_total_bytes=NULL, progress_at=NULL`
+
+/*
+Progress struct is used to represent how far a running task has got, as
+reported by its handler.
+*/
+type Progress struct {
+	Phase string `db:"progress_phase" json:"phase"`
+	// Percent is -1 while the amount of work left is unknown.
+	Percent    float64 `db:"progress_percent" json:"percent"`
+	Bytes      int64   `db:"progress_bytes" json:"bytes"`
+	TotalBytes int64   `db:"progress_total_bytes" json:"total_bytes"`
+	UpdatedAt  string  `db:"progress_at" json:"updated_at"`
+	// Status describes the progress for operators, see String().
+	Status string `db:"-" json:"status"`
+}
+
+// String describes the progress, eg. `restore d42: 63% (1.2 GB/1.9 GB)`.
+func (p Progress) String() string {
+	if p.Phase == `` {
+		return ``
+	}
+	switch {
+	case p.TotalBytes > 0:
+		return fmt.Sprintf(`%s: %.0f%% (%s/%s)`, p.Phase, p.Percent, formatBytes(p.Bytes), formatBytes(p.TotalBytes))
+	case p.Percent < 0 && p.Bytes > 0:
+		return fmt.Sprintf(`%s: %s`, p.Phase, formatBytes(p.Bytes))
+	case p.Percent < 0:
+		return p.Phase
+	default:
+		return fmt.Sprintf(`%s: %.0f%%`, p.Phase, p.Percent)
+	}
+}
+
+// formatBytes formats n bytes in the largest unit it is at least one of.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf(`%d B`, n)
+	}
+	value := float64(n) / unit
+	for _, suffix := range []string{`KB`, `MB`, `GB`, `TB`} {
+		if value < unit || suffix == `TB` {
+			return fmt.Sprintf(`%.1f %s`, value, suffix)
+		}
+		value /= unit
+	}
+	return ``
+}
+
+//ReportProgress - Record the phase the task is in and how far through it, as a
+// percentage, the task has got. percent -1 reports a phase whose length is
+// unknown. Progress within a phase is written at most every 5 seconds.
+func (t *Task) ReportProgress(phase string, percent float64) {
+	t.reportProgress(Progress{Phase: phase, Percent: percent})
+}
+
+//ReportBytes - Record the phase the task is in and how many of the phase's
+// total bytes have been processed, total 0 if it is unknown.
+func (t *Task) ReportBytes(phase string, bytes, total int64) {
+	p := Progress{Phase: phase, Percent: -1, Bytes: bytes, TotalBytes: total}
+	if total > 0 {
+		p.Percent = 100 * float64(bytes) / float64(total)
+	}
+	t.reportProgress(p)
+}
+
+func (t *Task) reportProgress(p Progress) {
+	// Tasks worked outside of a worker, eg. from the admin API, are not queued.
+	if t.ID == 0 {
+		return
+	}
+	finished := p.Percent >= 100
+	if p.Phase == t.progress.Phase && !finished && time.Since(t.progressAt) < progressInterval {
+		return
+	}
+	t.progress = p
+	t.progressAt = time.Now()
+	sq := fmt.Sprintf(`UPDATE tasks.tasks SET progress_phase=$1, progress_percent=$2, progress_bytes=$3, progress_total_bytes=$4, progress_at=CURRENT_TIMESTAMP WHERE id=%d AND locked_by='%s'`, t.ID, myIP)
+	log.Trace(fmt.Sprintf(`tasks.Task<%d>#reportProgress() %s > %s`, t.ID, p, sq))
+	OpenWorkDB()
+	_, err := workDB.Exec(sq, p.Phase, p.Percent, p.Bytes, p.TotalBytes)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.Task<%d>#reportProgress() ! %s`, t.ID, err))
+	}
+}
+
+// watchFileProgress reports the size of the file at path as the phase's
+// progress until the returned func is called, eg. while pg_dumpall writes it.
+func (t *Task) watchFileProgress(phase, path string) (stop func()) {
+	ctx, cancel := context.WithCancel(t.context())
+	done := make(chan struct{})
+	t.ReportProgress(phase, -1)
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if info, err := os.Stat(path); err == nil {
+					t.ReportBytes(phase, info.Size(), 0)
+				}
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
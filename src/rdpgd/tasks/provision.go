@@ -0,0 +1,77 @@
+package tasks
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/starkandwayne/rdpgd/instances"
+	"github.com/starkandwayne/rdpgd/log"
+)
+
+func init() {
+	Register(`ProvisionInstance`, Handler{Run: (*Task).ProvisionInstance, Decode: decodeNonEmpty, Role: `manager`, NodeType: `any`, Priority: PriorityHigh})
+}
+
+//ProvisionInstance - Work the asynchronous provision operation whose id is in
+// Data. The task is retried with backoff while no precreated database is
+// available, the operation fails once it runs out of attempts.
+func (t *Task) ProvisionInstance() (err error) {
+	o, err := instances.FindOperation(t.Data)
+	if err != nil {
+		return
+	}
+	if o == nil || o.State != instances.OperationInProgress {
+		log.Warn(fmt.Sprintf(`tasks.Task<%d>#ProvisionInstance(%s) Operation not in progress, nothing to do`, t.ID, t.Data))
+		return nil
+	}
+	// The operation is failed along with the task's last attempt, see
+	// operationFailed.
+	err = t.provision(o)
+	if err != nil {
+		return
+	}
+	return o.Finish(instances.OperationSucceeded, `Provisioned Instance `+o.InstanceID)
+}
+
+func (t *Task) provision(o *instances.Operation) (err error) {
+	r := instances.ProvisionRequest{}
+	if err = o.Decode(&r); err != nil {
+		return permanentError{err}
+	}
+	i := &r.Instance
+	// An earlier attempt may have assigned a database before failing.
+	existing, err := instances.FindByInstanceID(i.InstanceID)
+	switch err {
+	case sql.ErrNoRows:
+		err = i.TryProvision()
+		if err == instances.ErrOutOfCapacity {
+			return permanentError{err}
+		}
+	case nil:
+		i = existing
+		err = i.PushAssignment()
+	}
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.Task<%d>#ProvisionInstance(%s) ! %s`, t.ID, i.InstanceID, err))
+		return
+	}
+	err = i.SetBackupSettings(r.Backup)
+	if err != nil {
+		return
+	}
+	return i.SetParameters(r.Parameters)
+}
+
+//EnqueueProvision - Enqueue the work of an asynchronous provision operation.
+func EnqueueProvision(o *instances.Operation) (err error) {
+	t := Task{ClusterID: ClusterID, Action: `ProvisionInstance`, Data: o.OperationID}
+	t.DedupKey = DedupKey(t.Action, o.OperationID)
+	err = t.Enqueue()
+	if err == ErrDuplicate {
+		return nil
+	}
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.EnqueueProvision(%s) ! %s`, o.InstanceID, err))
+	}
+	return
+}
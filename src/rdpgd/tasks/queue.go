@@ -0,0 +1,201 @@
+package tasks
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/starkandwayne/rdpgd/log"
+)
+
+var (
+	// ErrTaskNotFound is returned when acting on a task which is not in the
+	// queue, eg. because it has completed.
+	ErrTaskNotFound = errors.New(`task not found`)
+	// ErrTaskNotLocked is returned by RequeueTask() for a task no worker holds.
+	ErrTaskNotLocked = errors.New(`task is not locked by a worker`)
+	// ErrTaskHeartbeating is returned by RequeueTask() for a task whose worker
+	// is still heartbeating, it has to be cancelled instead.
+	ErrTaskHeartbeating = errors.New(`task's worker is still heartbeating, cancel the task instead`)
+)
+
+// requeueAfter is how long a locked task must have gone without a heartbeat
+// for RequeueTask() to release it, a live worker heartbeats well within it.
+const requeueAfter = 2 * heartbeatInterval
+
+const queuedTaskColumns = `id,cluster_id,cluster_service,node,role,action,data,ttl,node_type,attempts,priority,COALESCE(workflow_step_id,0) AS workflow_step_id,COALESCE(dedup_key,'') AS dedup_key,CASE WHEN locked_by IS NULL THEN 'queued' ELSE 'running' END AS state,COALESCE(locked_by,'') AS locked_by,COALESCE(processing_at::text,'') AS processing_at,COALESCE(heartbeat_at::text,'') AS heartbeat_at,COALESCE(cancel_requested_at::text,'') AS cancel_requested_at,COALESCE(last_error,'') AS last_error,run_after::text AS run_after,created_at::text AS created_at,COALESCE(progress_phase,'') AS progress_phase,COALESCE(progress_percent,0) AS progress_percent,COALESCE(progress_bytes,0) AS progress_bytes,COALESCE(progress_total_bytes,0) AS progress_total_bytes,COALESCE(progress_at::text,'') AS progress_at`
+
+/*
+QueuedTask struct is used to represent a task in tasks.tasks along with the
+worker holding it, if any.
+*/
+type QueuedTask struct {
+	Task
+	// State is queued until a worker locks the task, then running.
+	State             string `db:"state" json:"state"`
+	LockedBy          string `db:"locked_by" json:"locked_by"`
+	ProcessingAt      string `db:"processing_at" json:"processing_at"`
+	HeartbeatAt       string `db:"heartbeat_at" json:"heartbeat_at"`
+	CancelRequestedAt string `db:"cancel_requested_at" json:"cancel_requested_at"`
+	LastError         string `db:"last_error" json:"last_error"`
+	RunAfter          string `db:"run_after" json:"run_after"`
+	CreatedAt         string `db:"created_at" json:"created_at"`
+	// Progress is the last progress reported by the task's handler.
+	Progress `json:"progress"`
+}
+
+/*
+QueueFilter struct is used to narrow down the tasks returned by QueuedTasks(),
+empty fields match every task.
+*/
+type QueueFilter struct {
+	Action string
+	// State is queued or running.
+	State  string
+	Node   string
+	Limit  int
+	Offset int
+}
+
+//QueuedTasks - Return the tasks in the queue in the order they will be worked,
+// those being worked first.
+func QueuedTasks(filter QueueFilter) (queued []QueuedTask, err error) {
+	queued = []QueuedTask{}
+	args := []interface{}{}
+	sq := fmt.Sprintf(`SELECT %s FROM tasks.tasks WHERE true`, queuedTaskColumns)
+	if filter.Action != `` {
+		args = append(args, filter.Action)
+		sq += fmt.Sprintf(` AND action=$%d`, len(args))
+	}
+	switch filter.State {
+	case ``:
+	case `queued`:
+		sq += ` AND locked_by IS NULL`
+	case `running`:
+		sq += ` AND locked_by IS NOT NULL`
+	default:
+		return nil, fmt.Errorf(`invalid state '%s', expected queued or running`, filter.State)
+	}
+	if filter.Node != `` {
+		args = append(args, filter.Node)
+		sq += fmt.Sprintf(` AND (node=$%d OR locked_by=$%d)`, len(args), len(args))
+	}
+	sq += fmt.Sprintf(` ORDER BY locked_by IS NULL, %s`, dequeueOrder)
+	if filter.Limit > 0 {
+		sq += fmt.Sprintf(` LIMIT %d`, filter.Limit)
+	}
+	if filter.Offset > 0 {
+		sq += fmt.Sprintf(` OFFSET %d`, filter.Offset)
+	}
+	log.Trace(fmt.Sprintf(`tasks.QueuedTasks() > %s`, sq))
+	OpenWorkDB()
+	err = workDB.Select(&queued, sq, args...)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.QueuedTasks() Selecting tasks ! %s`, err))
+		return
+	}
+	for i := range queued {
+		queued[i].Progress.Status = queued[i].Progress.String()
+	}
+	return
+}
+
+//FindTask - Return the task in the queue with the given id
+func FindTask(id int64) (q QueuedTask, err error) {
+	queued := []QueuedTask{}
+	sq := fmt.Sprintf(`SELECT %s FROM tasks.tasks WHERE id=%d LIMIT 1`, queuedTaskColumns, id)
+	log.Trace(fmt.Sprintf(`tasks.FindTask(%d) > %s`, id, sq))
+	OpenWorkDB()
+	err = workDB.Select(&queued, sq)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.FindTask(%d) ! %s`, id, err))
+		return
+	}
+	if len(queued) == 0 {
+		return q, ErrTaskNotFound
+	}
+	q = queued[0]
+	q.Progress.Status = q.Progress.String()
+	return q, nil
+}
+
+//CancelTask - Remove a queued task, failing its workflow step, or ask the
+// worker running it to stop, which it does at its next heartbeat. Returns
+// whether the task was removed straight away.
+func CancelTask(id int64) (removed bool, err error) {
+	q, err := FindTask(id)
+	if err != nil {
+		return
+	}
+	if q.LockedBy == `` {
+		err = q.Task.remove(cancelledError{}, ``)
+		if err == nil {
+			q.Task.recordHistory(time.Now(), cancelledError{})
+			log.Info(fmt.Sprintf(`tasks.CancelTask(%d) Cancelled queued %s task`, id, q.Action))
+			return true, nil
+		}
+		if err != errLockLost {
+			return
+		}
+		// A worker locked the task in the meantime, ask it to stop instead.
+	}
+	sq := fmt.Sprintf(`UPDATE tasks.tasks SET cancel_requested_at=CURRENT_TIMESTAMP WHERE id=%d AND cancel_requested_at IS NULL`, id)
+	log.Trace(fmt.Sprintf(`tasks.CancelTask(%d) > %s`, id, sq))
+	_, err = workDB.Exec(sq)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.CancelTask(%d) Requesting cancellation ! %s`, id, err))
+		return
+	}
+	log.Info(fmt.Sprintf(`tasks.CancelTask(%d) Requested cancellation of running %s task`, id, q.Action))
+	return false, nil
+}
+
+//RequeueTask - Release a task from a worker which stopped heartbeating, eg.
+// because its node is gone, so that it is worked again straight away rather
+// than once ClearStuckTasks gives up on the worker. A task whose worker is
+// still heartbeating is left alone, it may still be running its handler.
+func RequeueTask(id int64) (err error) {
+	sq := fmt.Sprintf(`UPDATE tasks.tasks SET locked_by=NULL, processing_at=NULL, heartbeat_at=NULL, cancel_requested_at=NULL, run_after=CURRENT_TIMESTAMP, %s, %s WHERE id=%d AND locked_by IS NOT NULL AND COALESCE(heartbeat_at,processing_at) < (CURRENT_TIMESTAMP - '%d seconds'::interval)`, clearProgress, releaseDedupKey, id, int64(requeueAfter.Seconds()))
+	log.Trace(fmt.Sprintf(`tasks.RequeueTask(%d) > %s`, id, sq))
+	OpenWorkDB()
+	result, err := workDB.Exec(sq)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.RequeueTask(%d) ! %s`, id, err))
+		return
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		var q QueuedTask
+		if q, err = FindTask(id); err != nil {
+			return
+		}
+		if q.LockedBy != `` {
+			return ErrTaskHeartbeating
+		}
+		return ErrTaskNotLocked
+	}
+	notifyWorkers(workDB, ``)
+	log.Info(fmt.Sprintf(`tasks.RequeueTask(%d) Task requeued`, id))
+	return
+}
+
+//PurgeTasks - Cancel every queued task of the given action, tasks being worked
+// are left alone. Returns the number of tasks removed.
+func PurgeTasks(action string) (purged int, err error) {
+	queued, err := QueuedTasks(QueueFilter{Action: action, State: `queued`})
+	if err != nil {
+		return
+	}
+	for _, q := range queued {
+		err = q.Task.remove(cancelledError{}, ``)
+		if err == errLockLost {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		q.Task.recordHistory(time.Now(), cancelledError{})
+		purged++
+	}
+	log.Info(fmt.Sprintf(`tasks.PurgeTasks(%s) Purged %d queued task(s)`, action, purged))
+	return purged, nil
+}
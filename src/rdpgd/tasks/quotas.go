@@ -0,0 +1,76 @@
+package tasks
+
+import (
+	"fmt"
+
+	"github.com/starkandwayne/rdpgd/instances"
+	"github.com/starkandwayne/rdpgd/log"
+	"github.com/starkandwayne/rdpgd/pg"
+)
+
+func init() {
+	Register(`EnforceQuotas`, Handler{Run: (*Task).EnforceQuotas, Role: `service`})
+}
+
+// EnforceQuotas - Flag the databases of this service cluster larger than the
+// storage quota of their plan over quota, so that their sessions default to
+// read only, and lift the flag from those back under it, eg. once data was
+// deleted and the database vacuumed. The storage quota is advisory, a session
+// may set itself read write again. The connection quota is applied along with
+// the database's parameters.
+func (t *Task) EnforceQuotas() (err error) {
+	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
+	db, err := p.Connect()
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.EnforceQuotas() p.Connect(%s) ! %s`, p.URI, err))
+		return
+	}
+	defer db.Close()
+
+	dbnames := []string{}
+	sq := `SELECT dbname FROM cfsb.instances WHERE ineffective_at IS NULL AND decommissioned_at IS NULL AND (COALESCE((parameters->>'max_storage_mb')::bigint,0) > 0 OR parameters->>'over_quota' = 'true')`
+	log.Trace(fmt.Sprintf(`tasks.EnforceQuotas() > %s`, sq))
+	err = db.Select(&dbnames, sq)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.EnforceQuotas() ! %s`, err))
+		return
+	}
+
+	local := pg.NewPG(`127.0.0.1`, pgPort, `rdpg`, `rdpg`, pgPass)
+	for _, dbname := range dbnames {
+		params, err := instances.FindParameters(dbname)
+		if err != nil {
+			return err
+		}
+		size, err := local.DatabaseSize(dbname)
+		if err != nil {
+			return err
+		}
+		over := params.MaxStorageMB > 0 && size > params.MaxStorageMB*1024*1024
+		if over == params.OverQuota {
+			continue
+		}
+		if over {
+			log.Warn(fmt.Sprintf(`tasks.EnforceQuotas() %s is %d bytes, over its quota of %d MB, defaulting its sessions to read only`, dbname, size, params.MaxStorageMB))
+		} else {
+			log.Info(fmt.Sprintf(`tasks.EnforceQuotas() %s is back under its quota of %d MB`, dbname, params.MaxStorageMB))
+		}
+		params.OverQuota = over
+		err = instances.SaveParameters(params)
+		if err != nil {
+			return err
+		}
+		i, err := instances.FindByDatabase(dbname)
+		if err != nil {
+			return err
+		}
+		if i == nil {
+			continue
+		}
+		err = enqueueApplyDatabaseParameters(i)
+		if err != nil {
+			return err
+		}
+	}
+	return
+}
@@ -15,6 +15,11 @@ import (
 	"github.com/starkandwayne/rdpgd/pg"
 )
 
+func init() {
+	Register(`ReconcileAvailableDatabases`, Handler{Run: (*Task).ReconcileAvailableDatabases, Role: `manager`})
+	Register(`ReconcileAllDatabases`, Handler{Run: (*Task).ReconcileAllDatabases, Role: `manager`})
+}
+
 func (t *Task) ReconcileAvailableDatabases() (err error) {
 	log.Trace(fmt.Sprintf(`tasks.ReconcileAvailableDatabases(%s)...`, t.Data))
 	client, err := consulapi.NewClient(consulapi.DefaultConfig())
@@ -3,14 +3,28 @@ package tasks
 import (
 	"fmt"
 
+	"github.com/starkandwayne/rdpgd/instances"
 	"github.com/starkandwayne/rdpgd/log"
 	"github.com/starkandwayne/rdpgd/services"
 )
 
+func init() {
+	Register(`Reconfigure`, Handler{Run: (*Task).Reconfigure, Decode: decodeReconfigure, Priority: PriorityHigh})
+}
+
+// decodeReconfigure accepts the services Reconfigure knows how to configure.
+func decodeReconfigure(data string) (interface{}, error) {
+	if data != `pgbouncer` {
+		return nil, fmt.Errorf(`unknown service to reconfigure '%s'`, data)
+	}
+	return data, nil
+}
+
 func (t *Task) Reconfigure() (err error) {
 	service, err := services.NewService("pgbouncer")
 	if err != nil {
 		log.Error(fmt.Sprintf(`tasks.Task#Reconfigure(%s) services.NewService(pgbouncer) ! %s`, t.ClusterID, err))
+		return
 	}
 	err = service.Configure()
 	if err != nil {
@@ -18,3 +32,14 @@ func (t *Task) Reconfigure() (err error) {
 	}
 	return
 }
+
+// AssignInstance - Record the assignment of the instance on this service
+// cluster and reconfigure pgbouncer on each of its nodes.
+func AssignInstance(i *instances.Instance) (err error) {
+	err = i.Assign()
+	if err != nil {
+		return
+	}
+	reconfigurePGBouncer(i, fmt.Sprintf(`tasks.AssignInstance(%s)`, i.InstanceID))
+	return
+}
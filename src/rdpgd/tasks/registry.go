@@ -0,0 +1,115 @@
+package tasks
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+/*
+Handler describes how workers run the tasks of one action.
+*/
+type Handler struct {
+	// Run works the task and reports its outcome.
+	Run func(t *Task) error
+	// Decode parses a task's data into the action's payload. It is used by
+	// Enqueue to reject malformed tasks and by workers before calling Run, which
+	// can read the result from Task#Payload(). nil accepts any data.
+	Decode func(data string) (interface{}, error)
+	// Role and NodeType are used for tasks enqueued without one.
+	Role     string
+	NodeType string
+	// TTL is used for tasks enqueued without one, in seconds.
+	TTL int64
+	// Concurrency is the most tasks of this action a node works at once, 0 is
+	// unlimited. Tasks of the actions of its LimitGroup count against it too.
+	Concurrency int
+	// LimitGroup names the actions sharing a concurrency limit, eg. those
+	// running pg_dump, empty for a limit of the action's own.
+	LimitGroup string
+	// Priority is used for tasks enqueued without one, see PriorityNormal.
+	Priority int
+}
+
+// Task priorities, workers claim the task with the highest priority first. A
+// task's priority rises by one for every priorityAgingInterval it waits so
+// low priority work is not starved.
+const (
+	PriorityLow    = -10
+	PriorityNormal = 0
+	PriorityHigh   = 10
+)
+
+var (
+	handlersMu sync.RWMutex
+	handlers   = map[string]Handler{}
+)
+
+/*
+Register makes a handler available for the given action. Packages register
+their actions in init(), registering an action twice or without a Run func
+panics.
+*/
+func Register(action string, h Handler) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	if h.Run == nil {
+		panic(fmt.Sprintf(`tasks.Register(%s) handler has no Run func`, action))
+	}
+	if _, dup := handlers[action]; dup {
+		panic(fmt.Sprintf(`tasks.Register(%s) action registered twice`, action))
+	}
+	if h.Role == `` {
+		h.Role = `all`
+	}
+	if h.NodeType == `` {
+		h.NodeType = `any`
+	}
+	handlers[action] = h
+}
+
+// Lookup returns the handler registered for the action.
+func Lookup(action string) (h Handler, ok bool) {
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+	h, ok = handlers[action]
+	return
+}
+
+// Actions returns the names of all registered actions, sorted.
+func Actions() (actions []string) {
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+	for action := range handlers {
+		actions = append(actions, action)
+	}
+	sort.Strings(actions)
+	return
+}
+
+// Payload returns the task's data as decoded by its handler's Decode func, nil
+// if the action has none or the task has not been worked.
+func (t *Task) Payload() interface{} {
+	return t.payload
+}
+
+// decodeNonEmpty is a Decode func for actions whose data names a database or
+// other object that must be given.
+func decodeNonEmpty(data string) (interface{}, error) {
+	if data == `` {
+		return nil, fmt.Errorf(`data is required`)
+	}
+	return data, nil
+}
+
+var relationRE = regexp.MustCompile(`^[a-z_][a-z0-9_]*(\.[a-z_][a-z0-9_]*)?$`)
+
+// decodeRelation is a Decode func for actions whose data is a (schema
+// qualified) table name which is interpolated into SQL.
+func decodeRelation(data string) (interface{}, error) {
+	if !relationRE.MatchString(data) {
+		return nil, fmt.Errorf(`invalid table name '%s'`, data)
+	}
+	return data, nil
+}
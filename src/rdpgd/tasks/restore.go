@@ -11,6 +11,11 @@ import (
 	"github.com/starkandwayne/rdpgd/pg"
 )
 
+func init() {
+	Register(`RestoreDatabaseFromFile`, Handler{Run: (*Task).RestoreDatabaseFromFile, Decode: decodeRestoreTaskParams, Concurrency: 1})
+	Register(`CreateTestDB`, Handler{Run: (*Task).CreateTestDB})
+}
+
 type restoreParams struct {
 	pgPsqlPath string `json:"psql_path"`
 	pgPort     string `json:"pg_port"`
@@ -19,24 +24,42 @@ type restoreParams struct {
 	node       string `json:"node"`
 }
 
-//Assumes task params are {"dbname":"test","fileName":"absolute path to the file"}
+//restoreTaskParams - The data of a RestoreDatabaseFromFile task, eg.
+//{"dbname":"test","fileName":"absolute path to the file"}
+type restoreTaskParams struct {
+	DBName   string `json:"dbname"`
+	FileName string `json:"fileName"`
+}
+
+func decodeRestoreTaskParams(data string) (interface{}, error) {
+	params := restoreTaskParams{}
+	if err := json.Unmarshal([]byte(data), &params); err != nil {
+		return nil, err
+	}
+	if params.DBName == `` || params.FileName == `` {
+		return nil, fmt.Errorf(`dbname and fileName are required`)
+	}
+	return params, nil
+}
 
 //RestoreDatabaseFromFile - Perform the restore of a backup file to a new clean database - ONLY SUPPORTING SOLO DBS FOR NOW...
 func (t *Task) RestoreDatabaseFromFile() (err error) {
-
-	taskParams := []byte(t.Data)
-	b := restoreParams{}
-
-	var dat map[string]interface{}
-	if err := json.Unmarshal(taskParams, &dat); err != nil {
-		log.Error(fmt.Sprintf("tasks.restoreDatabase() Could not JSON parse task.task.data value %s ! %s", t.Data, err))
+	params, ok := t.Payload().(restoreTaskParams)
+	if !ok {
+		decoded, err := decodeRestoreTaskParams(t.Data)
+		if err != nil {
+			log.Error(fmt.Sprintf("tasks.restoreDatabase() Could not JSON parse task.task.data value %s ! %s", t.Data, err))
+			return err
+		}
+		params = decoded.(restoreTaskParams)
 	}
-	b.dbname = dat["dbname"].(string)
-	b.fileName = dat["fileName"].(string)
+	b := restoreParams{dbname: params.DBName, fileName: params.FileName}
 
 	log.Trace(fmt.Sprintf("tasks.restoreDatabase() Restoring database: %s on node: %s with file: %s", b.dbname, globals.MyIP, b.fileName))
 
-	err = backup.ImportSqlFile(b.dbname, b.fileName)
+	err = backup.ImportSqlFileProgress(t.context(), b.dbname, b.fileName, func(done, total int64) {
+		t.ReportBytes(`restore `+b.dbname, done, total)
+	})
 	if err != nil {
 		log.Error(fmt.Sprintf("tasks.restoreDatabase() Could not import file '%s' for database %s ! %s", b.fileName, b.dbname, err))
 	}
@@ -0,0 +1,379 @@
+package tasks
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/starkandwayne/rdpgd/config"
+	"github.com/starkandwayne/rdpgd/globals"
+	"github.com/starkandwayne/rdpgd/instances"
+	"github.com/starkandwayne/rdpgd/log"
+)
+
+const (
+	retryBaseDelay     = 30 * time.Second
+	retryMaxDelay      = time.Hour
+	defaultMaxAttempts = 5
+)
+
+/*
+DeadLetter struct is used to represent a task which failed too many times
+and was moved out of the queue into tasks.dead_letters.
+*/
+type DeadLetter struct {
+	ID             int64  `db:"id" json:"id"`
+	TaskID         int64  `db:"task_id" json:"task_id"`
+	ClusterID      string `db:"cluster_id" json:"cluster_id"`
+	ClusterService string `db:"cluster_service" json:"cluster_service"`
+	Node           string `db:"node" json:"node"`
+	Role           string `db:"role" json:"role"`
+	Action         string `db:"action" json:"action"`
+	Data           string `db:"data" json:"data"`
+	TTL            int64  `db:"ttl" json:"ttl"`
+	NodeType       string `db:"node_type" json:"node_type"`
+	Priority       int    `db:"priority" json:"priority"`
+	DedupKey       string `db:"dedup_key" json:"dedup_key"`
+	Attempts       int64  `db:"attempts" json:"attempts"`
+	LastError      string `db:"last_error" json:"last_error"`
+	CreatedAt      string `db:"created_at" json:"created_at"`
+	FailedAt       string `db:"failed_at" json:"failed_at"`
+	ReplayedAt     string `db:"replayed_at" json:"replayed_at"`
+}
+
+// permanentError is the outcome of a task which cannot succeed by being
+// retried, eg. an unregistered action, it is moved to tasks.dead_letters
+// straight away.
+type permanentError struct {
+	error
+}
+
+// retryBackoff returns how long a task which has failed the given number of
+// times waits before it is run again, doubling from retryBaseDelay up to
+// retryMaxDelay.
+func retryBackoff(attempts int64) time.Duration {
+	if attempts < 1 {
+		return 0
+	}
+	delay := retryBaseDelay
+	for i := int64(1); i < attempts; i++ {
+		delay *= 2
+		if delay >= retryMaxDelay {
+			return retryMaxDelay
+		}
+	}
+	return delay
+}
+
+// maxAttempts returns the number of times a task is attempted before it is
+// moved to tasks.dead_letters, read from rdpg.config.
+func maxAttempts() int64 {
+	value, err := config.GetValue(`defaultTaskMaxAttempts`)
+	if err != nil {
+		return defaultMaxAttempts
+	}
+	max, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || max < 1 {
+		log.Error(fmt.Sprintf(`tasks.maxAttempts() Invalid defaultTaskMaxAttempts '%s', using %d`, value, defaultMaxAttempts))
+		return defaultMaxAttempts
+	}
+	return max
+}
+
+//Complete - Remove a successfully worked task from the queue, starting the
+// steps of its workflow which were waiting on it.
+func (t *Task) Complete() (err error) {
+	OpenWorkDB()
+	tx, err := workDB.Beginx()
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.Task<%d>#Complete() Begin ! %s`, t.ID, err))
+		return
+	}
+	sq := fmt.Sprintf(`DELETE FROM tasks.tasks WHERE id=%d AND locked_by='%s'`, t.ID, myIP)
+	log.Trace(fmt.Sprintf(`tasks.Task<%d>#Complete() > %s`, t.ID, sq))
+	result, err := tx.Exec(sq)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.Task<%d>#Complete() Deleting Task ! %s`, t.ID, err))
+		tx.Rollback()
+		return
+	}
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		log.Warn(fmt.Sprintf(`tasks.Task<%d>#Complete() ! %s`, t.ID, errLockLost))
+		tx.Rollback()
+		return errLockLost
+	}
+	if t.WorkflowStepID != 0 {
+		err = t.stepSucceeded(tx)
+		if err != nil {
+			log.Error(fmt.Sprintf(`tasks.Task<%d>#Complete() Workflow step %d ! %s`, t.ID, t.WorkflowStepID, err))
+			tx.Rollback()
+			return
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.Task<%d>#Complete() Commit ! %s`, t.ID, err))
+		return
+	}
+	log.Trace(fmt.Sprintf(`tasks.Task<%d>#Complete() Task Completed! > %+v`, t.ID, t))
+	return
+}
+
+// lastAttempt reports whether the task failing with cause moves it to
+// tasks.dead_letters rather than retrying it.
+func (t *Task) lastAttempt(cause error) bool {
+	_, permanent := cause.(permanentError)
+	return permanent || t.Attempts+1 >= maxAttempts()
+}
+
+//Fail - Record a failed attempt of the task, unlocking it to be retried after
+// a backoff or moving it to tasks.dead_letters once out of attempts.
+func (t *Task) Fail(cause error) (err error) {
+	attempts := t.Attempts + 1
+	max := maxAttempts()
+	if t.lastAttempt(cause) {
+		log.Error(fmt.Sprintf(`tasks.Task<%d>#Fail() %s failed %d of %d attempts, moving to dead letters ! %s`, t.ID, t.Action, attempts, max, cause))
+		return t.deadLetter(attempts, cause)
+	}
+
+	delay := retryBackoff(attempts)
+	sq := fmt.Sprintf(`UPDATE tasks.tasks SET locked_by=NULL, processing_at=NULL, attempts=%d, last_error=$1, run_after=CURRENT_TIMESTAMP + '%d seconds'::interval, %s, %s WHERE id=%d AND locked_by='%s'`, attempts, int64(delay.Seconds()), clearProgress, releaseDedupKey, t.ID, myIP)
+	log.Trace(fmt.Sprintf(`tasks.Task<%d>#Fail() > %s`, t.ID, sq))
+	OpenWorkDB()
+	result, err := workDB.Exec(sq, cause.Error())
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.Task<%d>#Fail() Updating Task for retry ! %s`, t.ID, err))
+		return
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		log.Warn(fmt.Sprintf(`tasks.Task<%d>#Fail() ! %s`, t.ID, errLockLost))
+		return errLockLost
+	}
+	log.Warn(fmt.Sprintf(`tasks.Task<%d>#Fail() %s failed %d of %d attempts, retrying in %s ! %s`, t.ID, t.Action, attempts, max, delay, cause))
+	return
+}
+
+// deadLetter moves the task from tasks.tasks to tasks.dead_letters, failing
+// its workflow step and the service broker operation it works, if any.
+func (t *Task) deadLetter(attempts int64, cause error) (err error) {
+	OpenWorkDB()
+	tx, err := workDB.Beginx()
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.Task<%d>#deadLetter() Begin ! %s`, t.ID, err))
+		return
+	}
+	sq := fmt.Sprintf(`INSERT INTO tasks.dead_letters (task_id,cluster_id,cluster_service,node,role,action,data,ttl,node_type,priority,dedup_key,attempts,last_error,created_at) SELECT id,cluster_id,cluster_service,node,role,action,data,ttl,node_type,priority,dedup_key,%d,$1,created_at FROM tasks.tasks WHERE id=%d AND locked_by='%s'`, attempts, t.ID, myIP)
+	log.Trace(fmt.Sprintf(`tasks.Task<%d>#deadLetter() > %s`, t.ID, sq))
+	result, err := tx.Exec(sq, cause.Error())
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.Task<%d>#deadLetter() Inserting dead letter ! %s`, t.ID, err))
+		tx.Rollback()
+		return
+	}
+	if inserted, _ := result.RowsAffected(); inserted == 0 {
+		log.Warn(fmt.Sprintf(`tasks.Task<%d>#deadLetter() ! %s`, t.ID, errLockLost))
+		tx.Rollback()
+		return errLockLost
+	}
+	sq = fmt.Sprintf(`DELETE FROM tasks.tasks WHERE id=%d`, t.ID)
+	log.Trace(fmt.Sprintf(`tasks.Task<%d>#deadLetter() > %s`, t.ID, sq))
+	_, err = tx.Exec(sq)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.Task<%d>#deadLetter() Deleting Task ! %s`, t.ID, err))
+		tx.Rollback()
+		return
+	}
+	if t.WorkflowStepID != 0 {
+		err = t.stepFailed(tx, cause)
+		if err != nil {
+			log.Error(fmt.Sprintf(`tasks.Task<%d>#deadLetter() Workflow step %d ! %s`, t.ID, t.WorkflowStepID, err))
+			tx.Rollback()
+			return
+		}
+	}
+	err = t.operationFailed(tx, cause)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.Task<%d>#deadLetter() Operation ! %s`, t.ID, err))
+		tx.Rollback()
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.Task<%d>#deadLetter() Commit ! %s`, t.ID, err))
+		return
+	}
+	t.reportMigrationFailed(cause)
+	return
+}
+
+// release unlocks the task for it to be worked again straight away, without
+// counting the attempt, eg. when rdpgd shuts down while working it.
+func (t *Task) release(cause error) (err error) {
+	sq := fmt.Sprintf(`UPDATE tasks.tasks SET locked_by=NULL, processing_at=NULL, heartbeat_at=NULL, last_error=$1, run_after=CURRENT_TIMESTAMP, %s, %s WHERE id=%d AND locked_by='%s'`, clearProgress, releaseDedupKey, t.ID, myIP)
+	log.Trace(fmt.Sprintf(`tasks.Task<%d>#release() > %s`, t.ID, sq))
+	OpenWorkDB()
+	_, err = workDB.Exec(sq, cause.Error())
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.Task<%d>#release() ! %s`, t.ID, err))
+	}
+	return
+}
+
+// remove deletes the task from the queue without retrying it, failing its
+// workflow step with the cause. lockedBy is the worker which must hold the
+// task, empty if it must still be queued.
+func (t *Task) remove(cause error, lockedBy string) (err error) {
+	OpenWorkDB()
+	tx, err := workDB.Beginx()
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.Task<%d>#remove() Begin ! %s`, t.ID, err))
+		return
+	}
+	sq := fmt.Sprintf(`DELETE FROM tasks.tasks WHERE id=%d AND %s`, t.ID, lockedByCondition(lockedBy))
+	log.Trace(fmt.Sprintf(`tasks.Task<%d>#remove() > %s`, t.ID, sq))
+	result, err := tx.Exec(sq)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.Task<%d>#remove() Deleting Task ! %s`, t.ID, err))
+		tx.Rollback()
+		return
+	}
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		tx.Rollback()
+		return errLockLost
+	}
+	if t.WorkflowStepID != 0 {
+		err = t.stepFailed(tx, cause)
+		if err != nil {
+			log.Error(fmt.Sprintf(`tasks.Task<%d>#remove() Workflow step %d ! %s`, t.ID, t.WorkflowStepID, err))
+			tx.Rollback()
+			return
+		}
+	}
+	err = t.operationFailed(tx, cause)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.Task<%d>#remove() Operation ! %s`, t.ID, err))
+		tx.Rollback()
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.Task<%d>#remove() Commit ! %s`, t.ID, err))
+		return
+	}
+	t.reportMigrationFailed(cause)
+	return
+}
+
+// operationFailed fails the in progress service broker operation the task
+// works, if any, so that it is not reported in progress forever once the task
+// is given up on, eg. after timing out on its last attempt.
+func (t *Task) operationFailed(tx *sqlx.Tx, cause error) (err error) {
+	var sq string
+	args := []interface{}{instances.OperationFailed, cause.Error(), instances.OperationInProgress}
+	switch {
+	case t.Action == `ProvisionInstance` || t.Action == `MigrateInstance`:
+		sq = `UPDATE cfsb.operations SET state=$1, description=$2, updated_at=CURRENT_TIMESTAMP WHERE state=$3 AND operation_id=$4`
+		args = append(args, t.Data)
+	case t.Action == `DecommissionDatabase` && globals.ServiceRole == `manager`:
+		sq = `UPDATE cfsb.operations SET state=$1, description=$2, updated_at=CURRENT_TIMESTAMP WHERE state=$3 AND kind=$4 AND instance_id IN (SELECT instance_id FROM cfsb.instances WHERE dbname=$5)`
+		args = append(args, instances.OperationDeprovision, t.Data)
+	default:
+		return
+	}
+	log.Trace(fmt.Sprintf(`tasks.Task<%d>#operationFailed() > %s`, t.ID, sq))
+	_, err = tx.Exec(sq, args...)
+	return
+}
+
+// reportMigrationFailed tells the management cluster, where its update
+// operation lives, that a MigrateDatabase task was given up on. For a
+// MigrateInstance task the tenant may connect to the database again on the
+// service cluster it was to be migrated from.
+func (t *Task) reportMigrationFailed(cause error) {
+	if t.Action == `MigrateInstance` {
+		o, err := instances.FindOperation(t.Data)
+		if err != nil || o == nil {
+			return
+		}
+		i, err := instances.FindByInstanceID(o.InstanceID)
+		if err != nil {
+			return
+		}
+		restoreMigrationSource(i)
+		return
+	}
+	if t.Action != `MigrateDatabase` {
+		return
+	}
+	m, err := findMigration(t.Data)
+	if err != nil || m == nil {
+		return
+	}
+	if err = m.Report(cause); err != nil {
+		return
+	}
+	deleteMigration(m.OperationID)
+}
+
+// lockedByCondition matches tasks locked by the given worker, or unlocked ones
+// if it is empty.
+func lockedByCondition(lockedBy string) string {
+	if lockedBy == `` {
+		return `locked_by IS NULL`
+	}
+	return fmt.Sprintf(`locked_by='%s'`, lockedBy)
+}
+
+//DeadLetters - Return the dead letters which have not been replayed, optionally
+// only those for the given action.
+func DeadLetters(action string) (deadLetters []DeadLetter, err error) {
+	deadLetters = []DeadLetter{}
+	sq := `SELECT id,task_id,cluster_id,cluster_service,node,role,action,data,ttl,node_type,priority,COALESCE(dedup_key,'') AS dedup_key,attempts,COALESCE(last_error,'') AS last_error,created_at::text AS created_at,failed_at::text AS failed_at,'' AS replayed_at FROM tasks.dead_letters WHERE replayed_at IS NULL`
+	args := []interface{}{}
+	if action != `` {
+		sq += ` AND action=$1`
+		args = append(args, action)
+	}
+	sq += ` ORDER BY failed_at DESC`
+	log.Trace(fmt.Sprintf(`tasks.DeadLetters() > %s`, sq))
+	OpenWorkDB()
+	err = workDB.Select(&deadLetters, sq, args...)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.DeadLetters() Selecting dead letters ! %s`, err))
+	}
+	return
+}
+
+//ReplayDeadLetter - Enqueue the task held in the given dead letter again with
+// a fresh attempt count and mark the dead letter as replayed.
+func ReplayDeadLetter(id int64) (t Task, err error) {
+	deadLetters := []DeadLetter{}
+	sq := fmt.Sprintf(`SELECT id,task_id,cluster_id,cluster_service,node,role,action,data,ttl,node_type,priority,COALESCE(dedup_key,'') AS dedup_key,attempts,COALESCE(last_error,'') AS last_error,created_at::text AS created_at,failed_at::text AS failed_at,'' AS replayed_at FROM tasks.dead_letters WHERE id=%d AND replayed_at IS NULL LIMIT 1`, id)
+	log.Trace(fmt.Sprintf(`tasks.ReplayDeadLetter(%d) > %s`, id, sq))
+	OpenWorkDB()
+	err = workDB.Select(&deadLetters, sq)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.ReplayDeadLetter(%d) Selecting dead letter ! %s`, id, err))
+		return
+	}
+	if len(deadLetters) == 0 {
+		err = fmt.Errorf(`dead letter %d not found or already replayed`, id)
+		return
+	}
+	dl := deadLetters[0]
+	t = Task{ClusterID: dl.ClusterID, ClusterService: dl.ClusterService, Node: dl.Node, Role: dl.Role, Action: dl.Action, Data: dl.Data, TTL: dl.TTL, NodeType: dl.NodeType, Priority: &dl.Priority, DedupKey: dl.DedupKey}
+	err = t.Enqueue()
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.ReplayDeadLetter(%d) Enqueue ! %s`, id, err))
+		return
+	}
+	sq = fmt.Sprintf(`UPDATE tasks.dead_letters SET replayed_at=CURRENT_TIMESTAMP WHERE id=%d`, id)
+	log.Trace(fmt.Sprintf(`tasks.ReplayDeadLetter(%d) > %s`, id, sq))
+	_, err = workDB.Exec(sq)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.ReplayDeadLetter(%d) Updating replayed_at ! %s`, id, err))
+	}
+	return
+}
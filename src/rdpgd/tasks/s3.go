@@ -2,6 +2,8 @@ package tasks
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -19,6 +21,11 @@ import (
 	"github.com/starkandwayne/rdpgd/utils/rdpgs3"
 )
 
+func init() {
+	Register(`FindFilesToCopyToS3`, Handler{Run: (*Task).FindFilesToCopyToS3})
+	Register(`CopyFileToS3`, Handler{Run: (*Task).CopyFileToS3, Decode: decodeS3FileMetadata, Concurrency: 4})
+}
+
 type s3Credentials struct {
 	awsSecretKey      string
 	awsAccessKey      string
@@ -37,6 +44,8 @@ type S3FileMetadata struct {
 	DBName    string `json:"dbname"`
 	Node      string `json:"node"`
 	ClusterID string `json:"cluster_id"`
+	// Checksum is the file's SHA-256, set by VerifyBackup.
+	Checksum string `json:"checksum,omitempty"`
 }
 
 //S3FileDownload - Meta data needed for copying files from an s3 bucket
@@ -48,6 +57,18 @@ type S3FileDownload struct {
 	DBName string `json:"dbname"`
 }
 
+// decodeS3FileMetadata decodes the S3FileMetadata passed to file tasks.
+func decodeS3FileMetadata(data string) (interface{}, error) {
+	fm := S3FileMetadata{}
+	if err := json.Unmarshal([]byte(data), &fm); err != nil {
+		return nil, err
+	}
+	if fm.Location == `` {
+		return nil, fmt.Errorf(`location is required`)
+	}
+	return fm, nil
+}
+
 //FindFilesToCopyToS3 - Responsible for copying files, such as database backups
 //to S3 storage
 func (t *Task) FindFilesToCopyToS3() (err error) {
@@ -94,8 +115,12 @@ func (t *Task) FindFilesToCopyToS3() (err error) {
 			log.Trace(fmt.Sprintf("tasks.FindFilesToCopyToS3() > Attempting to add %s", fileToCopyParams))
 			//Insert the task
 			newTask := Task{ClusterID: t.ClusterID, Node: t.Node, Role: t.Role, Action: "CopyFileToS3", Data: string(fileToCopyParams), TTL: t.TTL, NodeType: t.NodeType}
+			// A copy of the file still pending from an earlier run is not queued again.
+			newTask.DedupKey = DedupKey(`CopyFileToS3`, fm.DBName, fm.Location)
 			err = newTask.Enqueue()
-			if err != nil {
+			if err == ErrDuplicate {
+				err = nil
+			} else if err != nil {
 				log.Error(fmt.Sprintf(`tasks.FindFilesToCopyToS3() service task schedules ! %s`, err))
 			}
 		}
@@ -157,7 +182,18 @@ func (t *Task) CopyFileToS3() (err error) {
 	f.FileName = fileInfo.Name()
 	buffer := make([]byte, f.Size)
 	file.Read(buffer)
-	fileBytes := bytes.NewReader(buffer) // convert to io.ReadSeeker type
+	if fm.Checksum != `` {
+		sum := sha256.Sum256(buffer)
+		if hex.EncodeToString(sum[:]) != fm.Checksum {
+			err = fmt.Errorf(`checksum of %s does not match %s`, fm.Location, fm.Checksum)
+			log.Error(fmt.Sprintf("tasks.CopyFileToS3() ! %s", err))
+			return err
+		}
+	}
+	// convert to io.ReadSeeker type, reporting the upload's progress
+	fileBytes := backup.NewProgressReader(bytes.NewReader(buffer), f.Size, func(done, total int64) {
+		t.ReportBytes(`upload `+f.FileName, done, total)
+	})
 	fileType := http.DetectContentType(buffer)
 
 	s3params := &s3.PutObjectInput{
@@ -190,7 +226,9 @@ func (t *Task) CopyFileToS3() (err error) {
 			// error which satisfies the awserr.Error interface.
 			log.Error(fmt.Sprintf("tasks.CopyFileToS3() General AWS Error %s ! ", err.Error()))
 		}
+		return
 	}
-
+	// Steps after the upload in a workflow run on the node holding the file.
+	t.SetOutput(t.Data)
 	return
 }
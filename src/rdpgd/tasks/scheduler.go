@@ -6,7 +6,6 @@ import (
 	"syscall"
 	"time"
 
-	consulapi "github.com/hashicorp/consul/api"
 	"github.com/jmoiron/sqlx"
 
 	"github.com/starkandwayne/rdpgd/globals"
@@ -15,9 +14,7 @@ import (
 )
 
 var (
-	scheduleLock   *consulapi.Lock
-	scheduleLockCh <-chan struct{}
-	scheduleDB     *sqlx.DB
+	scheduleDB *sqlx.DB
 )
 
 //Schedule - holds one row object from tasks.schedules
@@ -32,6 +29,23 @@ type Schedule struct {
 	NodeType       string `db:"node_type" json:"node_type"`
 	Frequency      string `db:"frequency" json:"frequency"`
 	Enabled        bool   `db:"enabled" json:"enabled"`
+	// Priority of the tasks the schedule enqueues, nil for the action's
+	// default.
+	Priority *int `db:"priority" json:"priority"`
+	// Cron, when set, is used instead of Frequency, see cronSpec.
+	Cron     string `db:"cron" json:"cron"`
+	TimeZone string `db:"time_zone" json:"time_zone"`
+	// MaintenanceWindow names the window outside which the schedule does not
+	// start tasks, empty for none.
+	MaintenanceWindow string `db:"maintenance_window" json:"maintenance_window"`
+	// MisfirePolicy is what is done about runs missed while the scheduler was
+	// not running, one of MisfireSkip, MisfireRunOnce or MisfireRunAll.
+	MisfirePolicy string `db:"misfire_policy" json:"misfire_policy"`
+	// Jitter is the longest random delay, as a PostgreSQL interval, added to
+	// each run so schedules with the same timing do not all start together.
+	Jitter          string `db:"jitter" json:"jitter"`
+	NextRunAt       string `db:"next_run_at" json:"next_run_at"`
+	LastScheduledAt string `db:"last_scheduled_at" json:"last_scheduled_at"`
 }
 
 //Add - Insert a new schedule into tasks.schedules
@@ -46,24 +60,35 @@ func (s *Schedule) Add() (err error) {
 
 	defer scheduleDB.Close()
 
-	sq := fmt.Sprintf(`INSERT INTO tasks.schedules (cluster_id,role,action,data,frequency,enabled,node_type,cluster_service) SELECT '%s','%s','%s','%s','%s'::interval, %t, '%s', '%s' WHERE NOT EXISTS (SELECT id FROM tasks.schedules WHERE action = '%s' AND node_type = '%s' AND data = '%s') `, s.ClusterID, s.Role, s.Action, s.Data, s.Frequency, s.Enabled, s.NodeType, s.ClusterService, s.Action, s.NodeType, s.Data)
+	frequency := s.Frequency
+	if frequency == `` {
+		frequency = `1 hour`
+	}
+	timeZone := s.TimeZone
+	if timeZone == `` {
+		timeZone = `UTC`
+	}
+	misfirePolicy := s.MisfirePolicy
+	if misfirePolicy == `` {
+		misfirePolicy = MisfireRunOnce
+	}
+	jitter := s.Jitter
+	if jitter == `` {
+		jitter = `0`
+	}
+	sq := fmt.Sprintf(`INSERT INTO tasks.schedules (cluster_id,role,action,data,frequency,enabled,node_type,cluster_service,cron,time_zone,maintenance_window,priority,misfire_policy,jitter) SELECT '%s','%s','%s','%s','%s'::interval, %t, '%s', '%s', '%s', '%s', '%s', $1::integer, '%s', '%s'::interval WHERE NOT EXISTS (SELECT id FROM tasks.schedules WHERE action = '%s' AND node_type = '%s' AND data = '%s') `, s.ClusterID, s.Role, s.Action, s.Data, frequency, s.Enabled, s.NodeType, s.ClusterService, s.Cron, timeZone, s.MaintenanceWindow, misfirePolicy, jitter, s.Action, s.NodeType, s.Data)
 	log.Trace(fmt.Sprintf(`tasks.Schedule.Add(): %s`, sq))
-	_, err = scheduleDB.Exec(sq)
+	_, err = scheduleDB.Exec(sq, s.Priority)
 	if err != nil {
 		log.Error(fmt.Sprintf(`tasks.Schedule.Add():  %s`, err))
 	}
 	return
 }
 
-/*
-Task Scheduler TODO's
-- Task TTL: "Task type X should take no more than this long"
-- accounting history stored in database.
-- TTL based cleanup of task Queue for workers that may have imploded.
-*/
-
-//Scheduler - Entry point for executing the long running tasks scheduler
+//Scheduler - Entry point for executing the long running tasks scheduler, runs
+// until Shutdown() is called.
 func Scheduler() {
+	defer close(schedulerStopped)
 	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
 	p.Set(`database`, `rdpg`)
 
@@ -80,83 +105,186 @@ func Scheduler() {
 	}
 	defer scheduleDB.Close()
 
-	for {
+	for !stopped() {
 		err = SchedulerLock()
 		if err != nil {
-			time.Sleep(10 * time.Second)
+			sleep(10 * time.Second)
 			continue
 		}
+		err = initNextRuns(scheduleDB)
+		if err != nil {
+			log.Error(fmt.Sprintf(`tasks.Scheduler() initNextRuns() ! %s`, err))
+		}
 		schedules := []Schedule{}
-		sq := fmt.Sprintf(`SELECT id,cluster_id, role, action, data, ttl, node_type, cluster_service FROM tasks.schedules WHERE enabled = true AND CURRENT_TIMESTAMP >= (last_scheduled_at + frequency::interval) AND role IN ('all','%s')`, globals.ServiceRole)
+		sq := fmt.Sprintf(`SELECT id,cluster_id, role, action, data, ttl, node_type, cluster_service, priority, cron, time_zone, maintenance_window, misfire_policy FROM tasks.schedules WHERE enabled = true AND next_run_at <= CURRENT_TIMESTAMP AND role IN ('all','%s')`, globals.ServiceRole)
 		log.Trace(fmt.Sprintf(`tasks#Scheduler() Selecting Schedules > %s`, sq))
 		err = scheduleDB.Select(&schedules, sq)
 		if err != nil {
 			log.Error(fmt.Sprintf(`tasks.Scheduler() Selecting Schedules ! %s`, err))
 			SchedulerUnlock()
-			time.Sleep(10 * time.Second)
+			sleep(10 * time.Second)
 			continue
 		}
+		now := time.Now()
 		for index := range schedules {
-			sq = fmt.Sprintf(`UPDATE tasks.schedules SET last_scheduled_at = CURRENT_TIMESTAMP WHERE id=%d`, schedules[index].ID)
-			log.Trace(fmt.Sprintf(`tasks#Scheduler() %+v > %s`, schedules[index], sq))
-			_, err = scheduleDB.Exec(sq)
+			s := schedules[index]
+			if s.MaintenanceWindow != `` {
+				open, opens, err := s.inMaintenanceWindow(now)
+				if err != nil {
+					log.Error(fmt.Sprintf(`tasks.Scheduler() Schedule: %+v maintenance window ! %s`, s, err))
+				} else if !open {
+					// Runs deferred to the window are not missed.
+					sq = fmt.Sprintf(`UPDATE tasks.schedules SET scheduled_at=$1, next_run_at=$1 WHERE id=%d`, s.ID)
+					log.Trace(fmt.Sprintf(`tasks#Scheduler() %+v outside maintenance window %s, deferring to %s > %s`, s, s.MaintenanceWindow, opens, sq))
+					_, err = scheduleDB.Exec(sq, opens)
+					if err != nil {
+						log.Error(fmt.Sprintf(`tasks.Scheduler() Schedule: %+v ! %s`, s, err))
+					}
+					continue
+				}
+			}
+
+			runs, next, misfired, err := s.dueRuns(scheduleDB, now)
 			if err != nil {
-				log.Error(fmt.Sprintf(`tasks.Scheduler() Schedule: %+v ! %s`, schedules[index], err))
+				log.Error(fmt.Sprintf(`tasks.Scheduler() Schedule: %+v ! %s`, s, err))
 				continue
 			}
-			task := NewTask()
-			task.ClusterID = schedules[index].ClusterID
-			task.ClusterService = schedules[index].ClusterService
-			task.Role = schedules[index].Role
-			task.Action = schedules[index].Action
-			task.Data = schedules[index].Data
-			task.TTL = schedules[index].TTL
-			task.NodeType = schedules[index].NodeType
-			err = task.Enqueue()
+			enqueue := 1
+			if misfired {
+				enqueue = s.catchUp(runs)
+				s.recordMisfire(runs, enqueue)
+			}
+			sq = fmt.Sprintf(`UPDATE tasks.schedules SET last_scheduled_at = CURRENT_TIMESTAMP, scheduled_at = $1, next_run_at = $1::timestamptz + random() * jitter WHERE id=%d`, s.ID)
+			log.Trace(fmt.Sprintf(`tasks#Scheduler() %+v > %s`, s, sq))
+			_, err = scheduleDB.Exec(sq, next)
 			if err != nil {
-				log.Error(fmt.Sprintf(`tasks.Scheduler() Task.Enqueue() %+v ! %s`, task, err))
+				log.Error(fmt.Sprintf(`tasks.Scheduler() Schedule: %+v ! %s`, s, err))
+				continue
+			}
+			for i := 0; i < enqueue; i++ {
+				task := s.task()
+				err = task.Enqueue()
+				if err != nil {
+					log.Error(fmt.Sprintf(`tasks.Scheduler() Task.Enqueue() %+v ! %s`, task, err))
+				}
 			}
 		}
 		SchedulerUnlock()
-		time.Sleep(10 * time.Second)
+		sleep(10 * time.Second)
 	}
+	log.Info(`tasks.Scheduler() Stopped scheduling tasks`)
 }
 
-//NewSchedule - default empty constructor
-func NewSchedule() (s *Schedule) {
-	return &Schedule{}
-}
-
-// SchedulerLock - Acquire consul schedulerLock for cluster to aquire right to schedule tasks.
-func SchedulerLock() (err error) {
-
-	key := fmt.Sprintf("rdpg/%s/tasks/scheduler/lock", ClusterID)
-	client, _ := consulapi.NewClient(consulapi.DefaultConfig())
-	scheduleLock, err = client.LockKey(key)
+// initNextRuns fills in next_run_at for new schedules and those whose timing
+// changed, interval schedules are due frequency after they last ran, or now if
+// that has passed, and cron schedules at the expression's next fire time. Each
+// is then delayed by up to the schedule's jitter.
+func initNextRuns(db *sqlx.DB) (err error) {
+	// Schedules from before scheduled_at are due when they were to run.
+	sq := `UPDATE tasks.schedules SET scheduled_at = next_run_at WHERE scheduled_at IS NULL AND next_run_at IS NOT NULL`
+	log.Trace(fmt.Sprintf(`tasks.initNextRuns() > %s`, sq))
+	_, err = db.Exec(sq)
+	if err != nil {
+		return
+	}
+	sq = `UPDATE tasks.schedules SET scheduled_at = GREATEST(last_scheduled_at + frequency, CURRENT_TIMESTAMP) WHERE next_run_at IS NULL AND cron = ''`
+	log.Trace(fmt.Sprintf(`tasks.initNextRuns() > %s`, sq))
+	_, err = db.Exec(sq)
 	if err != nil {
-		log.Error(fmt.Sprintf("tasks.SchedulerLock() Error Locking Scheduler Key %s ! %s", key, err))
 		return
 	}
-	scheduleLockCh, err = scheduleLock.Lock(nil)
+	sq = `UPDATE tasks.schedules SET next_run_at = scheduled_at + random() * jitter WHERE next_run_at IS NULL AND cron = ''`
+	log.Trace(fmt.Sprintf(`tasks.initNextRuns() > %s`, sq))
+	_, err = db.Exec(sq)
 	if err != nil {
-		log.Error(fmt.Sprintf("tasks.SchedulerLock() Error Aquiring Scheduler Key lock %s ! %s", key, err))
 		return
 	}
+	schedules := []Schedule{}
+	sq = `SELECT id, action, cron, time_zone FROM tasks.schedules WHERE next_run_at IS NULL AND cron <> ''`
+	log.Trace(fmt.Sprintf(`tasks.initNextRuns() > %s`, sq))
+	err = db.Select(&schedules, sq)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for _, s := range schedules {
+		next, err := nextCronTime(s.Cron, s.TimeZone, now)
+		if err != nil {
+			log.Error(fmt.Sprintf(`tasks.initNextRuns() Schedule<%d> %s ! %s`, s.ID, s.Action, err))
+			continue
+		}
+		sq = fmt.Sprintf(`UPDATE tasks.schedules SET scheduled_at = $1, next_run_at = $1::timestamptz + random() * jitter WHERE id=%d`, s.ID)
+		log.Trace(fmt.Sprintf(`tasks.initNextRuns() > %s`, sq))
+		_, err = db.Exec(sq, next)
+		if err != nil {
+			log.Error(fmt.Sprintf(`tasks.initNextRuns() Schedule<%d> %s ! %s`, s.ID, s.Action, err))
+		}
+	}
+	return nil
+}
 
-	if scheduleLockCh == nil {
-		err = fmt.Errorf(`tasks.SchedulerLock() Scheduler Lock not aquired`)
+// inMaintenanceWindow reports whether the schedule's maintenance window is open
+// at t and if not when it next opens. A window which does not exist does not
+// restrict the schedule.
+func (s *Schedule) inMaintenanceWindow(t time.Time) (open bool, opens time.Time, err error) {
+	w, err := FindMaintenanceWindow(s.MaintenanceWindow)
+	if err != nil {
+		return
+	}
+	if w == nil {
+		log.Warn(fmt.Sprintf(`tasks.Schedule<%d>#inMaintenanceWindow() Unknown maintenance window %s, not restricting %s`, s.ID, s.MaintenanceWindow, s.Action))
+		return true, opens, nil
+	}
+	open, err = w.Contains(t)
+	if err != nil || open {
+		return
 	}
+	opens, err = w.NextStart(t)
+	return
+}
 
+//UpcomingSchedules - Return the enabled schedules in the order they will next run
+func UpcomingSchedules(limit int) (schedules []Schedule, err error) {
+	schedules = []Schedule{}
+	sq := fmt.Sprintf(`SELECT id,cluster_id,cluster_service,role,action,data,ttl,node_type,frequency::text AS frequency,enabled,priority,cron,time_zone,maintenance_window,misfire_policy,jitter::text AS jitter,COALESCE(next_run_at::text,'') AS next_run_at FROM tasks.schedules WHERE enabled = true ORDER BY next_run_at ASC NULLS LAST, id LIMIT %d`, limit)
+	log.Trace(fmt.Sprintf(`tasks.UpcomingSchedules() > %s`, sq))
+	OpenWorkDB()
+	err = workDB.Select(&schedules, sq)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.UpcomingSchedules() ! %s`, err))
+	}
 	return
 }
 
-// SchedulerUnlock - Release consul schedulerLock for the current cluster
-func SchedulerUnlock() (err error) {
-	if scheduleLock != nil {
-		err = scheduleLock.Unlock()
-		if err != nil {
-			log.Error(fmt.Sprintf("tasks.SchedulerUnlock() Error Unlocking Scheduler ! %s", err))
-		}
+//SetSchedulePriority - Change the priority of the tasks a schedule enqueues,
+// nil for its action's default.
+func SetSchedulePriority(id int64, priority *int) (err error) {
+	sq := `UPDATE tasks.schedules SET priority=$2 WHERE id=$1`
+	log.Trace(fmt.Sprintf(`tasks.SetSchedulePriority(%d) > %s`, id, sq))
+	OpenWorkDB()
+	result, err := workDB.Exec(sq, id, priority)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.SetSchedulePriority(%d) ! %s`, id, err))
+		return
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		err = fmt.Errorf(`schedule %d not found`, id)
 	}
 	return
 }
+
+//NewSchedule - default empty constructor
+func NewSchedule() (s *Schedule) {
+	return &Schedule{}
+}
+
+// SchedulerLock - Acquire the cluster's scheduler lock from the configured
+// coordinator, giving up on shutdown.
+func SchedulerLock() (err error) {
+	return coordination().Lock(lockName(`scheduler`), stopping)
+}
+
+// SchedulerUnlock - Release the scheduler lock for the current cluster
+func SchedulerUnlock() (err error) {
+	return coordination().Unlock(lockName(`scheduler`))
+}
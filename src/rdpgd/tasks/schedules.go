@@ -0,0 +1,228 @@
+package tasks
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/starkandwayne/rdpgd/globals"
+	"github.com/starkandwayne/rdpgd/log"
+)
+
+var (
+	// ErrScheduleExists is returned by Schedule#Create() when a schedule with
+	// the same action, node type and data exists.
+	ErrScheduleExists = errors.New(`a schedule with this action, node type and data already exists`)
+	// ErrScheduleNotFound is returned when changing a schedule which does not
+	// exist.
+	ErrScheduleNotFound = errors.New(`schedule not found`)
+)
+
+const scheduleColumns = `id,cluster_id,cluster_service,role,action,data,ttl,node_type,frequency::text AS frequency,enabled,priority,cron,time_zone,maintenance_window,misfire_policy,jitter::text AS jitter,COALESCE(next_run_at::text,'') AS next_run_at,last_scheduled_at::text AS last_scheduled_at`
+
+// task returns a task running the schedule's action.
+func (s *Schedule) task() *Task {
+	t := NewTask()
+	t.ClusterID = s.ClusterID
+	t.ClusterService = s.ClusterService
+	t.Role = s.Role
+	t.Action = s.Action
+	t.Data = s.Data
+	t.TTL = s.TTL
+	t.NodeType = s.NodeType
+	t.Priority = s.Priority
+	return t
+}
+
+//Validate - Check the schedule's action, data, role, node type and timing,
+// filling in defaults for those not given.
+func (s *Schedule) Validate() (err error) {
+	h, ok := Lookup(s.Action)
+	if !ok {
+		return fmt.Errorf(`unknown task action '%s'`, s.Action)
+	}
+	if h.Decode != nil {
+		if _, err = h.Decode(s.Data); err != nil {
+			return fmt.Errorf(`invalid data for task action %s: %s`, s.Action, err)
+		}
+	}
+	if s.Role == `` {
+		s.Role = h.Role
+	}
+	switch s.Role {
+	case `all`, `manager`, `service`:
+	default:
+		return fmt.Errorf(`invalid role '%s', expected all, manager or service`, s.Role)
+	}
+	if s.NodeType == `` {
+		s.NodeType = h.NodeType
+	}
+	switch s.NodeType {
+	case `any`, `read`, `write`:
+	default:
+		return fmt.Errorf(`invalid node type '%s', expected any, read or write`, s.NodeType)
+	}
+	if s.TTL < 0 {
+		return fmt.Errorf(`invalid ttl %d`, s.TTL)
+	}
+	if s.TTL == 0 {
+		s.TTL = int64(defaultTTL.Seconds())
+	}
+	if s.Frequency == `` {
+		s.Frequency = `1 hour`
+	}
+	if s.TimeZone == `` {
+		s.TimeZone = `UTC`
+	}
+	if s.Cron != `` {
+		if _, err = nextCronTime(s.Cron, s.TimeZone, time.Now()); err != nil {
+			return
+		}
+	} else if _, err = loadLocation(s.TimeZone); err != nil {
+		return
+	}
+	if err = validateFrequency(s.Frequency); err != nil {
+		return
+	}
+	return s.validateMisfire()
+}
+
+// validateFrequency checks the frequency is a positive PostgreSQL interval.
+func validateFrequency(frequency string) (err error) {
+	var positive bool
+	OpenWorkDB()
+	err = workDB.QueryRow(`SELECT $1::interval > '0'::interval`, frequency).Scan(&positive)
+	if err != nil {
+		return fmt.Errorf(`invalid frequency '%s'`, frequency)
+	}
+	if !positive {
+		return fmt.Errorf(`frequency '%s' must be positive`, frequency)
+	}
+	return nil
+}
+
+//Schedules - Return the schedules, optionally only those of the given action
+func Schedules(action string) (schedules []Schedule, err error) {
+	schedules = []Schedule{}
+	args := []interface{}{}
+	sq := `SELECT ` + scheduleColumns + ` FROM tasks.schedules`
+	if action != `` {
+		args = append(args, action)
+		sq += ` WHERE action=$1`
+	}
+	sq += ` ORDER BY id`
+	log.Trace(fmt.Sprintf(`tasks.Schedules() > %s`, sq))
+	OpenWorkDB()
+	err = workDB.Select(&schedules, sq, args...)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.Schedules() ! %s`, err))
+	}
+	return
+}
+
+//FindSchedule - Return the schedule with the given id, nil if there is none
+func FindSchedule(id int64) (s *Schedule, err error) {
+	schedules := []Schedule{}
+	sq := fmt.Sprintf(`SELECT %s FROM tasks.schedules WHERE id=%d`, scheduleColumns, id)
+	log.Trace(fmt.Sprintf(`tasks.FindSchedule(%d) > %s`, id, sq))
+	OpenWorkDB()
+	err = workDB.Select(&schedules, sq)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.FindSchedule(%d) ! %s`, id, err))
+		return
+	}
+	if len(schedules) > 0 {
+		s = &schedules[0]
+	}
+	return
+}
+
+//Create - Validate and insert the schedule, unlike Add() it reports a
+// duplicate schedule as ErrScheduleExists.
+func (s *Schedule) Create() (err error) {
+	if err = s.Validate(); err != nil {
+		return
+	}
+	if s.ClusterID == `` {
+		s.ClusterID = ClusterID
+	}
+	if s.ClusterService == `` {
+		s.ClusterService = globals.ClusterService
+	}
+	sq := `INSERT INTO tasks.schedules (cluster_id,cluster_service,role,action,data,ttl,node_type,frequency,enabled,priority,cron,time_zone,maintenance_window,misfire_policy,jitter) SELECT $1,$2,$3,$4,$5,$6,$7,$8::interval,$9,$10,$11,$12,$13,$14,$15::interval WHERE NOT EXISTS (SELECT id FROM tasks.schedules WHERE action=$4 AND node_type=$7 AND data=$5) RETURNING id`
+	log.Trace(fmt.Sprintf(`tasks.Schedule#Create() > %s`, sq))
+	OpenWorkDB()
+	rows, err := workDB.Query(sq, s.ClusterID, s.ClusterService, s.Role, s.Action, s.Data, s.TTL, s.NodeType, s.Frequency, s.Enabled, s.Priority, s.Cron, s.TimeZone, s.MaintenanceWindow, s.MisfirePolicy, s.Jitter)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.Schedule#Create() %+v ! %s`, s, err))
+		return
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return ErrScheduleExists
+	}
+	err = rows.Scan(&s.ID)
+	return
+}
+
+//Update - Validate and save the schedule, it is next due by its new timing.
+func (s *Schedule) Update() (err error) {
+	if err = s.Validate(); err != nil {
+		return
+	}
+	sq := `UPDATE tasks.schedules SET role=$2,action=$3,data=$4,ttl=$5,node_type=$6,frequency=$7::interval,enabled=$8,priority=$9,cron=$10,time_zone=$11,maintenance_window=$12,misfire_policy=$13,jitter=$14::interval,next_run_at=NULL WHERE id=$1`
+	log.Trace(fmt.Sprintf(`tasks.Schedule<%d>#Update() > %s`, s.ID, sq))
+	OpenWorkDB()
+	result, err := workDB.Exec(sq, s.ID, s.Role, s.Action, s.Data, s.TTL, s.NodeType, s.Frequency, s.Enabled, s.Priority, s.Cron, s.TimeZone, s.MaintenanceWindow, s.MisfirePolicy, s.Jitter)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.Schedule<%d>#Update() ! %s`, s.ID, err))
+		return
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		err = ErrScheduleNotFound
+	}
+	return
+}
+
+//SetScheduleEnabled - Enable or disable a schedule, an enabled schedule is next
+// due by its timing from when it last ran.
+func SetScheduleEnabled(id int64, enabled bool) (err error) {
+	sq := fmt.Sprintf(`UPDATE tasks.schedules SET enabled=%t, next_run_at=NULL WHERE id=%d`, enabled, id)
+	log.Trace(fmt.Sprintf(`tasks.SetScheduleEnabled(%d) > %s`, id, sq))
+	OpenWorkDB()
+	result, err := workDB.Exec(sq)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.SetScheduleEnabled(%d) ! %s`, id, err))
+		return
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		err = ErrScheduleNotFound
+	}
+	return
+}
+
+//DeleteSchedule - Remove a schedule, tasks it already enqueued are left queued
+func DeleteSchedule(id int64) (err error) {
+	sq := fmt.Sprintf(`DELETE FROM tasks.schedules WHERE id=%d`, id)
+	log.Trace(fmt.Sprintf(`tasks.DeleteSchedule(%d) > %s`, id, sq))
+	OpenWorkDB()
+	result, err := workDB.Exec(sq)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.DeleteSchedule(%d) ! %s`, id, err))
+		return
+	}
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		err = ErrScheduleNotFound
+	}
+	return
+}
+
+//RunNow - Enqueue the schedule's task straight away, leaving its timing as is
+func (s *Schedule) RunNow() (t *Task, err error) {
+	t = s.task()
+	err = t.Enqueue()
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.Schedule<%d>#RunNow() ! %s`, s.ID, err))
+	}
+	return
+}
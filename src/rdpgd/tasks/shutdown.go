@@ -0,0 +1,84 @@
+package tasks
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/starkandwayne/rdpgd/log"
+)
+
+// releaseTimeout is how long Shutdown() waits for the tasks it abandons to be
+// released.
+const releaseTimeout = 10 * time.Second
+
+var (
+	// stopping is closed by Shutdown() to stop claiming and scheduling tasks.
+	stopping = make(chan struct{})
+	// abandon is closed once the grace period is over, workers then cancel the
+	// tasks still running and release them to be retried.
+	abandon          = make(chan struct{})
+	workerStopped    = make(chan struct{})
+	schedulerStopped = make(chan struct{})
+	shutdownOnce     sync.Once
+)
+
+// shutdownError is the outcome recorded for a task abandoned by Shutdown().
+type shutdownError struct{}
+
+func (e shutdownError) Error() string {
+	return `rdpgd shut down before the task finished`
+}
+
+// stopped reports whether Shutdown() has been called.
+func stopped() bool {
+	select {
+	case <-stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// sleep waits for d, returning early if Shutdown() is called.
+func sleep(d time.Duration) {
+	select {
+	case <-stopping:
+	case <-time.After(d):
+	}
+}
+
+//Shutdown - Stop claiming and scheduling tasks and wait up to grace for the
+// tasks being worked to finish. Tasks still running after it are cancelled and
+// released so that they are retried, by another node or this one once it is
+// back.
+func Shutdown(grace time.Duration) {
+	shutdownOnce.Do(func() { close(stopping) })
+	log.Info(fmt.Sprintf(`tasks.Shutdown() Waiting up to %s for %d running task(s)`, grace, pool.stats().Active))
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	// The worker and scheduler release their locks as they stop.
+	waitUntil(ctx, workerStopped)
+	waitUntil(ctx, schedulerStopped)
+	if !pool.drain(ctx) {
+		log.Warn(fmt.Sprintf(`tasks.Shutdown() %d task(s) still running after %s, releasing them for retry`, pool.stats().Active, grace))
+		close(abandon)
+		releaseCtx, releaseCancel := context.WithTimeout(context.Background(), releaseTimeout)
+		defer releaseCancel()
+		if !pool.drain(releaseCtx) {
+			log.Error(fmt.Sprintf(`tasks.Shutdown() %d task(s) not released, ClearStuckTasks will release them`, pool.stats().Active))
+		}
+	}
+	CloseWorkDB()
+	log.Info(`tasks.Shutdown() Stopped`)
+}
+
+// waitUntil returns once ch is closed or ctx is done.
+func waitUntil(ctx context.Context, ch <-chan struct{}) {
+	select {
+	case <-ch:
+	case <-ctx.Done():
+	}
+}
@@ -1,11 +1,15 @@
 package tasks
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/starkandwayne/rdpgd/globals"
 	"github.com/starkandwayne/rdpgd/log"
@@ -41,9 +45,28 @@ type Task struct {
 	Data           string `db:"data" json:"data"`
 	TTL            int64  `db:"ttl" json:"ttl"`
 	NodeType       string `db:"node_type" json:"node_type"`
+	Attempts       int64  `db:"attempts" json:"attempts"`
+	// Priority nil enqueues the task with its handler's priority.
+	Priority *int `db:"priority" json:"priority"`
+	// WorkflowStepID is the tasks.workflow_steps row the task runs, 0 if it is
+	// not part of a workflow.
+	WorkflowStepID int64 `db:"workflow_step_id" json:"workflow_step_id"`
+	// DedupKey, when set, keeps the task from being enqueued while another task
+	// with the same key is queued and not yet running, see DedupKey().
+	DedupKey string `db:"dedup_key" json:"dedup_key"`
+	// ctx is done once the task has run past its TTL.
+	ctx     context.Context
+	payload interface{}
+	output  string
+	// progress is the last progress written, at progressAt.
+	progress   Progress
+	progressAt time.Time
 }
 
 func init() {
+	Register(`ClearStuckTasks`, Handler{Run: (*Task).ClearStuckTasks})
+
+	myIP = globals.MyIP
 	MatrixName = os.Getenv(`RDPGD_MATRIX`)
 	MatrixNameSplit = strings.SplitAfterN(MatrixName, `-`, -1)
 	MatrixColumn = os.Getenv(`RDPGD_MATRIX_COLUMN`)
@@ -74,8 +97,19 @@ func init() {
 			poolSize = p
 		}
 	}
+	configurePool()
 }
 
+// ErrDuplicate is returned by Task#Enqueue() when a task with the same dedup
+// key is already queued and not yet running, the task is not enqueued again.
+var ErrDuplicate = errors.New(`a task with the same dedup key is already queued`)
+
+// releaseDedupKey drops the dedup key of a task unlocked to be worked again
+// when another task with the key is pending, or is locked and has a lower id
+// as both may be unlocked at once, so that the two do not clash in
+// tasks_pending_dedup_key_idx. Both are then worked.
+const releaseDedupKey = `dedup_key=CASE WHEN EXISTS (SELECT 1 FROM tasks.tasks p WHERE p.dedup_key=tasks.tasks.dedup_key AND p.id<>tasks.tasks.id AND (p.locked_by IS NULL OR p.id<tasks.tasks.id)) THEN NULL ELSE dedup_key END`
+
 /*
 NewTask returns a new Task struct object.
 */
@@ -84,35 +118,93 @@ func NewTask() *Task {
 }
 
 /*
-Enqueue enqueue's a given task to the database's rdpg.tasks table.
+Enqueue enqueue's a given task to the database's rdpg.tasks table. A task with
+a dedup key is not enqueued, and ErrDuplicate returned, while another task
+with the same key is queued and not yet running; one which is running may not
+see the change which led to the new task, so it does not hold it back.
 */
 func (t *Task) Enqueue() (err error) {
-	sq := fmt.Sprintf(`INSERT INTO tasks.tasks (cluster_id,node,role,action,data,ttl,node_type,cluster_service) VALUES ('%s','%s','%s','%s','%s',%d,'%s','%s')`, t.ClusterID, t.Node, t.Role, t.Action, t.Data, t.TTL, t.NodeType, t.ClusterService)
+	if err = t.prepare(true); err != nil {
+		return
+	}
+	sq := `INSERT INTO tasks.tasks (cluster_id,node,role,action,data,ttl,node_type,cluster_service,priority,workflow_step_id,dedup_key) SELECT $2::text,$3::text,$4::text,$5::text,$6::text,$7::integer,$8::text,$9::text,$10::integer,NULLIF($11::bigint,0),NULLIF($1::text,'') WHERE $1::text='' OR NOT EXISTS (SELECT 1 FROM tasks.tasks WHERE dedup_key=$1::text AND locked_by IS NULL)`
 	log.Trace(fmt.Sprintf(`tasks.Task#Enqueue() > %s`, sq))
 	for {
 		OpenWorkDB()
-		_, err = workDB.Exec(sq)
+		var result sql.Result
+		result, err = workDB.Exec(sq, t.DedupKey, t.ClusterID, t.Node, t.Role, t.Action, t.Data, t.TTL, t.NodeType, t.ClusterService, *t.Priority, t.WorkflowStepID)
 		if err != nil {
-			re := regexp.MustCompile(`tasks_pkey`)
-			if re.MatchString(err.Error()) {
+			if regexp.MustCompile(`tasks_pkey`).MatchString(err.Error()) {
 				continue
+			}
+			if regexp.MustCompile(`tasks_pending_dedup_key_idx`).MatchString(err.Error()) {
+				// Enqueued by someone else since the NOT EXISTS check.
+				err = ErrDuplicate
 			} else {
 				log.Error(fmt.Sprintf(`tasks.Task#Enqueue() Insert Task %+v ! %s`, t, err))
 				return
 			}
+		} else if inserted, _ := result.RowsAffected(); inserted == 0 {
+			err = ErrDuplicate
 		}
 		break
 	}
+	if err == ErrDuplicate {
+		log.Trace(fmt.Sprintf(`tasks.Task#Enqueue() %s task with dedup key %s already queued, skipping`, t.Action, t.DedupKey))
+		return
+	}
+	notifyWorkers(workDB, t.Action)
 	log.Trace(fmt.Sprintf(`tasks.Task#Enqueue() Task Enqueued > %+v`, t))
 	return
 }
 
+// DedupKey returns a dedup key for a task of the action on the given things,
+// eg. DedupKey(`CopyFileToS3`, dbname, location).
+func DedupKey(action string, parts ...string) string {
+	return strings.Join(append([]string{action}, parts...), `:`)
+}
+
+// prepare checks the task's action is registered and, when decode is set, that
+// its data decodes, then fills in the handler's defaults.
+func (t *Task) prepare(decode bool) (err error) {
+	h, ok := Lookup(t.Action)
+	if !ok {
+		err = fmt.Errorf(`unknown task action '%s'`, t.Action)
+		log.Error(fmt.Sprintf(`tasks.Task#Enqueue() %+v ! %s`, t, err))
+		return
+	}
+	if decode && h.Decode != nil {
+		if _, err = h.Decode(t.Data); err != nil {
+			err = fmt.Errorf(`invalid data for task action %s: %s`, t.Action, err)
+			log.Error(fmt.Sprintf(`tasks.Task#Enqueue() %+v ! %s`, t, err))
+			return
+		}
+	}
+	if t.Node == `` {
+		t.Node = `*`
+	}
+	if t.Role == `` {
+		t.Role = h.Role
+	}
+	if t.NodeType == `` {
+		t.NodeType = h.NodeType
+	}
+	if t.TTL == 0 {
+		t.TTL = h.TTL
+	}
+	if t.Priority == nil {
+		priority := h.Priority
+		t.Priority = &priority
+	}
+	return
+}
+
 /*
 Dequeue dequeue's a given task from the database's rdpg.tasks table.
 */
 func (t *Task) Dequeue() (err error) {
 	tasks := []Task{}
-	sq := fmt.Sprintf(`SELECT id,node,cluster_id,role,action,data,ttl,node_type,cluster_service FROM tasks.tasks WHERE id=%d LIMIT 1`, t.ID)
+	sq := fmt.Sprintf(`SELECT id,node,cluster_id,role,action,data,ttl,node_type,cluster_service,attempts,priority,COALESCE(workflow_step_id,0) AS workflow_step_id FROM tasks.tasks WHERE id=%d LIMIT 1`, t.ID)
 	log.Trace(fmt.Sprintf(`tasks.Task<%d>#Dequeue() > %s`, t.ID, sq))
 	OpenWorkDB()
 	err = workDB.Select(&tasks, sq)
@@ -125,8 +217,7 @@ func (t *Task) Dequeue() (err error) {
 		return
 	}
 	t = &tasks[0]
-	// TODO: Add the information for who has this task locked using IP
-	sq = fmt.Sprintf(`UPDATE tasks.tasks SET locked_by='%s', processing_at=CURRENT_TIMESTAMP WHERE id=%d`, myIP, t.ID)
+	sq = fmt.Sprintf(`UPDATE tasks.tasks SET locked_by='%s', processing_at=CURRENT_TIMESTAMP, heartbeat_at=CURRENT_TIMESTAMP WHERE id=%d`, myIP, t.ID)
 	log.Trace(fmt.Sprintf(`tasks.Task<%d>#Dequeue() > %s`, t.ID, sq))
 	_, err = workDB.Exec(sq)
 	if err != nil {
@@ -137,16 +228,44 @@ func (t *Task) Dequeue() (err error) {
 	return
 }
 
-//ClearStuckTasks - Clear any stuck tasks
-func (t *Task) ClearStuckTasks() (err error) {
+//SetTaskPriority - Change the priority of a task which is still queued
+func SetTaskPriority(id int64, priority int) (err error) {
+	sq := fmt.Sprintf(`UPDATE tasks.tasks SET priority=%d WHERE id=%d AND locked_by IS NULL`, priority, id)
+	log.Trace(fmt.Sprintf(`tasks.SetTaskPriority(%d) > %s`, id, sq))
+	OpenWorkDB()
+	result, err := workDB.Exec(sq)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.SetTaskPriority(%d) ! %s`, id, err))
+		return
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		err = fmt.Errorf(`task %d not found or already being worked`, id)
+	}
+	return
+}
 
-	sq := fmt.Sprintf(`DELETE FROM tasks.tasks WHERE created_at < (CURRENT_TIMESTAMP - '%s'::interval)`, globals.StuckDuration)
+// context returns the context the task's handler runs under, tasks worked
+// outside of a worker (eg. from the admin API) have no deadline.
+func (t *Task) context() context.Context {
+	if t.ctx == nil {
+		return context.Background()
+	}
+	return t.ctx
+}
 
-	log.Trace(fmt.Sprintf(`tasks#Work() > %s`, sq))
+//ClearStuckTasks - Release tasks locked by a worker which stopped heartbeating,
+// eg. because rdpgd died mid-task, so that they are picked up again.
+func (t *Task) ClearStuckTasks() (err error) {
+	sq := fmt.Sprintf(`UPDATE tasks.tasks SET locked_by=NULL, processing_at=NULL, heartbeat_at=NULL, attempts=attempts+1, last_error='worker stopped heartbeating', %s, %s WHERE locked_by IS NOT NULL AND ((heartbeat_at IS NOT NULL AND heartbeat_at < (CURRENT_TIMESTAMP - '%d seconds'::interval)) OR (heartbeat_at IS NULL AND processing_at < (CURRENT_TIMESTAMP - '%s'::interval)))`, clearProgress, releaseDedupKey, int64(heartbeatTimeout.Seconds()), globals.StuckDuration)
+	log.Trace(fmt.Sprintf(`tasks.Task#ClearStuckTasks() > %s`, sq))
 	OpenWorkDB()
-	_, err = workDB.Exec(sq)
+	result, err := workDB.Exec(sq)
 	if err != nil {
-		log.Error(fmt.Sprintf(`tasks.Work() Error Deleting Stuck Task ! %s`, err))
+		log.Error(fmt.Sprintf(`tasks.Task#ClearStuckTasks() Error Releasing Stuck Tasks ! %s`, err))
+		return
+	}
+	if released, _ := result.RowsAffected(); released > 0 {
+		log.Warn(fmt.Sprintf(`tasks.Task#ClearStuckTasks() Released %d task(s) whose worker stopped heartbeating`, released))
 	}
 	return
 }
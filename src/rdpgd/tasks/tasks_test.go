@@ -1,7 +1,15 @@
 package tasks
 
 import (
+	"errors"
+	"os"
 	"testing"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/starkandwayne/rdpgd/globals"
+	"github.com/starkandwayne/rdpgd/instances"
 )
 
 // Question: How to test locking/unlocking,
@@ -15,3 +23,354 @@ func TestQueue(t *testing.T) {
 	// Enqueue
 	// Dequeue
 }
+
+func TestRetryBackoff(t *testing.T) {
+	cases := []struct {
+		attempts int64
+		want     time.Duration
+	}{
+		{0, 0},
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{8, time.Hour},
+		{50, time.Hour},
+	}
+	for _, c := range cases {
+		if got := retryBackoff(c.attempts); got != c.want {
+			t.Errorf("retryBackoff(%d) = %s, want %s", c.attempts, got, c.want)
+		}
+	}
+}
+
+func TestTaskDatabase(t *testing.T) {
+	cases := []struct {
+		task Task
+		want string
+	}{
+		{Task{Action: `BackupDatabase`, Data: `d123`}, `d123`},
+		{Task{Action: `CopyFileToS3`, Data: `{"location":"/tmp/x.sql","dbname":"d456"}`}, `d456`},
+		{Task{Action: `Reconfigure`, Data: `pgbouncer`}, ``},
+		{Task{Action: `DeleteFile`, Data: `{not json`}, ``},
+	}
+	for _, c := range cases {
+		if got := c.task.database(); got != c.want {
+			t.Errorf("Task{%s %s}.database() = %q, want %q", c.task.Action, c.task.Data, got, c.want)
+		}
+	}
+}
+
+func TestRegisteredActions(t *testing.T) {
+	for _, action := range []string{`Vacuum`, `PrecreateDatabases`, `ReconcileAvailableDatabases`, `ReconcileAllDatabases`, `DecommissionDatabase`, `DecommissionDatabases`, `Reconfigure`, `ScheduleNewDatabaseBackups`, `BackupDatabase`, `DeleteBackupHistory`, `DeleteTaskHistory`, `FindFilesToCopyToS3`, `EnforceFileRetention`, `EnforceRemoteFileRetention`, `CopyFileToS3`, `DeleteFile`, `RestoreDatabaseFromFile`, `CreateTestDB`, `BackupAllDatabases`, `ClearStuckTasks`} {
+		if _, ok := Lookup(action); !ok {
+			t.Errorf("action %s is not registered", action)
+		}
+	}
+	if _, ok := Lookup(`NoSuchAction`); ok {
+		t.Errorf("Lookup(NoSuchAction) found a handler")
+	}
+
+	h, _ := Lookup(`Vacuum`)
+	if _, err := h.Decode(`tasks.tasks`); err != nil {
+		t.Errorf("Vacuum rejected tasks.tasks: %s", err)
+	}
+	if _, err := h.Decode(`tasks.tasks; DROP TABLE cfsb.instances`); err == nil {
+		t.Errorf("Vacuum accepted an invalid table name")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("registering Vacuum twice did not panic")
+		}
+	}()
+	Register(`Vacuum`, Handler{Run: (*Task).Vacuum})
+}
+
+func TestNextCronTime(t *testing.T) {
+	ny, err := time.LoadLocation(`America/New_York`)
+	if err != nil {
+		t.Skip(`no time zone database`)
+	}
+	after := time.Date(2016, 3, 10, 14, 7, 30, 0, time.UTC) // a Thursday
+	cases := []struct {
+		expr, tz string
+		want     time.Time
+	}{
+		{`*/15 * * * *`, ``, time.Date(2016, 3, 10, 14, 15, 0, 0, time.UTC)},
+		{`0 2 * * *`, `UTC`, time.Date(2016, 3, 11, 2, 0, 0, 0, time.UTC)},
+		{`@hourly`, ``, time.Date(2016, 3, 10, 15, 0, 0, 0, time.UTC)},
+		{`30 1 * * sun`, ``, time.Date(2016, 3, 13, 1, 30, 0, 0, time.UTC)},
+		{`0 0 1 jan-mar *`, ``, time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{`0 3 * * *`, `America/New_York`, time.Date(2016, 3, 11, 3, 0, 0, 0, ny)},
+		{`0 0 13 * 5`, ``, time.Date(2016, 3, 11, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		got, err := nextCronTime(c.expr, c.tz, after)
+		if err != nil {
+			t.Errorf("nextCronTime(%s) ! %s", c.expr, err)
+			continue
+		}
+		if !got.Equal(c.want) {
+			t.Errorf("nextCronTime(%s, %s) = %s, want %s", c.expr, c.tz, got, c.want)
+		}
+	}
+	for _, expr := range []string{``, `* * * *`, `60 * * * *`, `* * * foo *`, `5-1 * * * *`, `0 0 30 2 *`} {
+		if _, err := nextCronTime(expr, ``, after); err == nil {
+			t.Errorf("nextCronTime(%s) did not fail", expr)
+		}
+	}
+}
+
+func TestMaintenanceWindowContains(t *testing.T) {
+	w := MaintenanceWindow{Name: `nightly`, Cron: `0 2 * * *`, DurationSeconds: 3 * 3600}
+	for _, c := range []struct {
+		at   time.Time
+		open bool
+	}{
+		{time.Date(2016, 3, 10, 1, 59, 0, 0, time.UTC), false},
+		{time.Date(2016, 3, 10, 2, 0, 0, 0, time.UTC), true},
+		{time.Date(2016, 3, 10, 4, 59, 0, 0, time.UTC), true},
+		{time.Date(2016, 3, 10, 5, 0, 0, 0, time.UTC), false},
+	} {
+		open, err := w.Contains(c.at)
+		if err != nil || open != c.open {
+			t.Errorf("Contains(%s) = %t, %v want %t", c.at, open, err, c.open)
+		}
+	}
+}
+
+func TestClaimMode(t *testing.T) {
+	defer os.Unsetenv(`RDPGD_TASK_CLAIM_MODE`)
+	service := globals.ClusterService
+	defer func() { globals.ClusterService = service }()
+	cases := []struct {
+		env, service, want string
+	}{
+		{``, `postgresql`, claimRowLock},
+		{`auto`, `pgbdr`, claimConsul},
+		{`bogus`, `postgresql`, claimRowLock},
+		{claimConsul, `postgresql`, claimConsul},
+		{claimRowLock, `pgbdr`, claimRowLock},
+	}
+	for _, c := range cases {
+		os.Setenv(`RDPGD_TASK_CLAIM_MODE`, c.env)
+		globals.ClusterService = c.service
+		if got := claimMode(); got != c.want {
+			t.Errorf("claimMode() with %q on %s = %s, want %s", c.env, c.service, got, c.want)
+		}
+	}
+	if !isLockNotAvailable(&pq.Error{Code: `55P03`}) {
+		t.Errorf("lock_not_available was not recognized")
+	}
+	if isLockNotAvailable(&pq.Error{Code: `40P01`}) || isLockNotAvailable(errors.New(`55P03`)) || isLockNotAvailable(nil) {
+		t.Errorf("another error was taken for lock_not_available")
+	}
+}
+
+func TestWorkerPool(t *testing.T) {
+	limits, err := parseConcurrency(`BackupDatabase=1, CopyFileToS3=3`)
+	if err != nil {
+		t.Fatalf("parseConcurrency ! %s", err)
+	}
+	if limits[`BackupDatabase`] != 1 || limits[`CopyFileToS3`] != 3 {
+		t.Errorf("parseConcurrency = %v", limits)
+	}
+	for _, s := range []string{`BackupDatabase`, `BackupDatabase=x`, `BackupDatabase=-1`} {
+		if _, err := parseConcurrency(s); err == nil {
+			t.Errorf("parseConcurrency(%s) did not fail", s)
+		}
+	}
+
+	p := newWorkerPool(3, limits)
+	if !p.acquire(`BackupDatabase`) {
+		t.Fatalf("no slot for the first BackupDatabase")
+	}
+	if p.acquire(`BackupDatabase`) {
+		t.Errorf("BackupDatabase exceeded its limit of 1")
+	}
+	// Both dump with pg_dump and share a limit.
+	if s := p.saturated(); len(s) != 2 || s[0] != `BackupAllDatabases` || s[1] != `BackupDatabase` {
+		t.Errorf("saturated() = %v, want [BackupAllDatabases BackupDatabase]", s)
+	}
+	if p.acquire(`BackupAllDatabases`) {
+		t.Errorf("BackupAllDatabases ran alongside BackupDatabase past the pg_dump limit")
+	}
+	if !p.acquire(`CopyFileToS3`) || !p.acquire(`CopyFileToS3`) {
+		t.Fatalf("no slot for CopyFileToS3")
+	}
+	if !p.full() || p.acquire(`Vacuum`) {
+		t.Errorf("pool of 3 workers accepted a fourth task")
+	}
+	p.release(`BackupDatabase`)
+	if p.full() || !p.acquire(`BackupDatabase`) {
+		t.Errorf("released slot was not reused")
+	}
+}
+
+func TestDecodeMigration(t *testing.T) {
+	h, ok := Lookup(`MigrateDatabase`)
+	if !ok {
+		t.Fatalf("action MigrateDatabase is not registered")
+	}
+	if _, err := h.Decode(`o1`); err != nil {
+		t.Errorf("MigrateDatabase rejected an operation id: %s", err)
+	}
+	if _, err := h.Decode(``); err == nil {
+		t.Errorf("MigrateDatabase accepted no operation id")
+	}
+	if _, err := decodeMigration(`{"operation_id":"o1","instance":{"dbname":"d1","uname":"u1"},"source_dsn":"host=10.0.0.1"}`); err != nil {
+		t.Errorf("rejected a migration: %s", err)
+	}
+	if _, err := decodeMigration(`{"operation_id":"o1","instance":{"dbname":"d1"},"source_dsn":"host=10.0.0.1"}`); err == nil {
+		t.Errorf("accepted a migration without an owner")
+	}
+	if _, err := decodeMigration(`not json`); err == nil {
+		t.Errorf("accepted invalid json")
+	}
+}
+
+func TestDatabaseParametersMerge(t *testing.T) {
+	current := instances.DatabaseParameters{Extensions: []string{`hstore`}, Settings: map[string]string{`timezone`: `UTC`, `work_mem`: `8MB`}, PoolMode: `session`}
+	merged := current.Merge(instances.DatabaseParameters{Extensions: []string{`hstore`, `citext`}, Settings: map[string]string{`work_mem`: ``, `statement_timeout`: `5s`}})
+	if len(merged.Extensions) != 2 || merged.Extensions[0] != `hstore` || merged.Extensions[1] != `citext` {
+		t.Errorf("merged extensions %v, expected [hstore citext]", merged.Extensions)
+	}
+	if _, ok := merged.Settings[`work_mem`]; ok {
+		t.Errorf("an empty setting did not remove work_mem")
+	}
+	if merged.Settings[`timezone`] != `UTC` || merged.Settings[`statement_timeout`] != `5s` {
+		t.Errorf("merged settings %v", merged.Settings)
+	}
+	if merged.PoolMode != `session` {
+		t.Errorf("merged pool mode %s, expected session", merged.PoolMode)
+	}
+	if len(current.Settings) != 2 {
+		t.Errorf("Merge modified the settings merged into")
+	}
+	if !(instances.DatabaseParameters{DBName: `d1`}).Empty() {
+		t.Errorf("parameters naming only their database are not empty")
+	}
+}
+
+func TestHandlerPriorities(t *testing.T) {
+	for _, action := range []string{`PrecreateDatabases`, `Reconfigure`, `DecommissionDatabase`, `DecommissionDatabases`} {
+		provisioning, _ := Lookup(action)
+		for _, housekeeping := range []string{`BackupDatabase`, `CopyFileToS3`, `EnforceFileRetention`, `DeleteTaskHistory`} {
+			h, _ := Lookup(housekeeping)
+			if provisioning.Priority <= h.Priority {
+				t.Errorf("%s priority %d is not above %s priority %d", action, provisioning.Priority, housekeeping, h.Priority)
+			}
+		}
+	}
+}
+
+func TestWorkflowValidate(t *testing.T) {
+	w := NewBackupWorkflow(`d0`, Task{ClusterID: `c0`})
+	if err := w.validate(); err != nil {
+		t.Fatalf("backup workflow is invalid ! %s", err)
+	}
+	for _, s := range w.Steps {
+		if s.Role == `` || s.NodeType == `` || s.Node != `*` {
+			t.Errorf("step %s defaults not filled in: %+v", s.Name, s)
+		}
+	}
+
+	cases := map[string]func(w *Workflow){
+		`cycle`: func(w *Workflow) {
+			w.Step(`a`, Task{Action: `Vacuum`, Data: `tasks.tasks`}, `b`)
+			w.Step(`b`, Task{Action: `Vacuum`, Data: `tasks.tasks`}, `a`)
+		},
+		`unknown parent`: func(w *Workflow) {
+			w.Step(`a`, Task{Action: `Vacuum`, Data: `tasks.tasks`}, `missing`)
+		},
+		`duplicate name`: func(w *Workflow) {
+			w.Step(`a`, Task{Action: `Vacuum`, Data: `tasks.tasks`})
+			w.Step(`a`, Task{Action: `Vacuum`, Data: `tasks.tasks`})
+		},
+		`unknown action`: func(w *Workflow) {
+			w.Step(`a`, Task{Action: `NoSuchAction`})
+		},
+		`invalid root data`: func(w *Workflow) {
+			w.Step(`a`, Task{Action: `VerifyBackup`})
+		},
+	}
+	for name, build := range cases {
+		w := NewWorkflow(name)
+		build(w)
+		if err := w.validate(); err == nil {
+			t.Errorf("workflow with %s validated", name)
+		}
+	}
+}
+
+func TestScheduleValidate(t *testing.T) {
+	cases := []Schedule{
+		{Action: `NoSuchAction`},
+		{Action: `Vacuum`, Data: `tasks.tasks; DROP TABLE cfsb.instances`},
+		{Action: `Vacuum`, Data: `tasks.tasks`, Role: `everyone`},
+		{Action: `Vacuum`, Data: `tasks.tasks`, NodeType: `primary`},
+		{Action: `Vacuum`, Data: `tasks.tasks`, TTL: -1},
+		{Action: `Vacuum`, Data: `tasks.tasks`, Cron: `* * *`},
+		{Action: `Vacuum`, Data: `tasks.tasks`, TimeZone: `Nowhere/Special`},
+	}
+	for _, s := range cases {
+		if err := s.Validate(); err == nil {
+			t.Errorf("schedule %+v validated", s)
+		}
+	}
+}
+
+func TestProgressString(t *testing.T) {
+	cases := map[string]Progress{
+		``:                                  {},
+		`restore d42: 63% (1.2 GB/1.9 GB)`:  {Phase: `restore d42`, Percent: 63.2, Bytes: 1288490188, TotalBytes: 2040109465},
+		`pg_dumpall: 512.0 KB`:              {Phase: `pg_dumpall`, Percent: -1, Bytes: 524288},
+		`pg_dumpall`:                        {Phase: `pg_dumpall`, Percent: -1},
+		`reconfigure: 50%`:                  {Phase: `reconfigure`, Percent: 50},
+		`upload d1.sql: 100% (900 B/900 B)`: {Phase: `upload d1.sql`, Percent: 100, Bytes: 900, TotalBytes: 900},
+	}
+	for want, p := range cases {
+		if got := p.String(); got != want {
+			t.Errorf("Progress%+v.String() = %q, want %q", p, got, want)
+		}
+	}
+}
+
+func TestCronRuns(t *testing.T) {
+	scheduledAt := time.Date(2016, 3, 1, 2, 0, 0, 0, time.UTC)
+	cases := []struct {
+		now  time.Time
+		runs int
+		next time.Time
+	}{
+		{scheduledAt, 1, time.Date(2016, 3, 2, 2, 0, 0, 0, time.UTC)},
+		{scheduledAt.Add(time.Hour), 1, time.Date(2016, 3, 2, 2, 0, 0, 0, time.UTC)},
+		{time.Date(2016, 3, 4, 3, 0, 0, 0, time.UTC), 4, time.Date(2016, 3, 5, 2, 0, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		runs, next, err := cronRuns(`0 2 * * *`, `UTC`, scheduledAt, c.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if runs != c.runs || !next.Equal(c.next) {
+			t.Errorf("cronRuns() at %s = %d, %s, expected %d, %s", c.now, runs, next, c.runs, c.next)
+		}
+	}
+}
+
+func TestScheduleCatchUp(t *testing.T) {
+	cases := map[string][]int{
+		MisfireSkip:    {0, 0},
+		MisfireRunOnce: {1, 1},
+		MisfireRunAll:  {3, maxCatchUpRuns},
+	}
+	for policy, expected := range cases {
+		s := Schedule{MisfirePolicy: policy}
+		if n := s.catchUp(3); n != expected[0] {
+			t.Errorf("%s catchUp(3) = %d, expected %d", policy, n, expected[0])
+		}
+		if n := s.catchUp(500); n != expected[1] {
+			t.Errorf("%s catchUp(500) = %d, expected %d", policy, n, expected[1])
+		}
+	}
+}
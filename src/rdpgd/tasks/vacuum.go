@@ -7,6 +7,10 @@ import (
 	"github.com/starkandwayne/rdpgd/pg"
 )
 
+func init() {
+	Register(`Vacuum`, Handler{Run: (*Task).Vacuum, Decode: decodeRelation})
+}
+
 func (t *Task) Vacuum() (err error) {
 	p := pg.NewPG(`127.0.0.1`, pbPort, `rdpg`, `rdpg`, pgPass)
 	db, err := p.Connect()
@@ -1,202 +1,253 @@
 package tasks
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
 	"syscall"
 	"time"
 
-	"github.com/starkandwayne/rdpgd/globals"
-
-	consulapi "github.com/hashicorp/consul/api"
 	"github.com/jmoiron/sqlx"
 
 	"github.com/starkandwayne/rdpgd/log"
 	"github.com/starkandwayne/rdpgd/pg"
-	"github.com/starkandwayne/rdpgd/utils/rdpgconsul"
+)
+
+const (
+	defaultTTL        = time.Hour
+	heartbeatInterval = 30 * time.Second
+	// heartbeatTimeout is how long a locked task may go without a heartbeat
+	// before ClearStuckTasks considers its worker dead.
+	heartbeatTimeout = 5 * time.Minute
+	// priorityAgingInterval is how long a queued task waits for its priority to
+	// rise by one.
+	priorityAgingInterval = 5 * time.Minute
 )
 
 var (
-	workLock   *consulapi.Lock
-	workLockCh <-chan struct{}
-	workDB     *sqlx.DB
+	workDB *sqlx.DB
 )
 
-//Work - Select a task from the queue for this server
+//Work - Claim tasks from the queue for this server and work them, waking up
+// as soon as a task is enqueued and polling every 5 seconds otherwise, until
+// Shutdown() is called.
 func Work() {
+	defer close(workerStopped)
 	err := OpenWorkDB()
 	if err != nil {
 		log.Error(fmt.Sprintf("tasks.Work() OpenWorkDB() %s", err))
 		proc, _ := os.FindProcess(os.Getpid())
 		proc.Signal(syscall.SIGTERM)
+		return
 	}
-	defer CloseWorkDB()
 
-	for {
-		tasks := []Task{}
-		err = WorkLock()
-		if err != nil {
-			time.Sleep(10 * time.Second)
-			continue
-		}
-
-		nodeType := `read`
-		if rdpgconsul.IsWriteNode(globals.MyIP) {
-			nodeType = `write`
-		}
-		sq := fmt.Sprintf(`SELECT id,cluster_id,node,role,action,data,ttl,node_type,cluster_service FROM tasks.tasks WHERE locked_by IS NULL AND role IN ('all','%s') AND node IN ('*','%s') AND node_type IN ('any','%s') ORDER BY created_at DESC LIMIT 1`, globals.ServiceRole, globals.MyIP, nodeType)
+	mode := claimMode()
+	claim := claimWithWorkLock
+	if mode == claimRowLock {
+		lockClause := rowLockClause()
+		claim = claimWithRowLock(lockClause)
+		mode = fmt.Sprintf(`%s (%s)`, mode, lockClause)
+	}
+	log.Info(fmt.Sprintf(`tasks.Work() Claiming tasks with %s`, mode))
+	listener := listenForTasks()
+	if listener != nil {
+		defer listener.Close()
+	}
 
-		log.Trace(fmt.Sprintf(`tasks.Work() > %s`, sq))
-		err = workDB.Select(&tasks, sq)
-		if err != nil {
-			WorkUnlock()
-			if err == sql.ErrNoRows {
-				log.Trace(`tasks.Work() No tasks found.`)
-			} else {
-				log.Error(fmt.Sprintf(`tasks.Work() Selecting Task ! %s`, err))
-			}
-			time.Sleep(5 * time.Second)
+	for !stopped() {
+		// Leave tasks queued for other nodes while every worker here is busy.
+		if pool.full() {
+			sleep(time.Second)
 			continue
 		}
-		if len(tasks) == 0 {
-			WorkUnlock()
-			time.Sleep(5 * time.Second)
+		task, err := claim()
+		if err != nil {
+			sleep(10 * time.Second)
 			continue
 		}
-		task := tasks[0]
-		err = task.Dequeue()
-		if err != nil {
-			log.Error(fmt.Sprintf(`tasks.Work() Task<%d>#Dequeue() ! %s`, task.ID, err))
+		if task == nil {
+			log.Trace(`tasks.Work() No tasks found.`)
+			waitForTasks(listener)
 			continue
 		}
-		WorkUnlock()
 
-		// TODO: Come back and have a cleanup routine for tasks that were locked
-		// but never finished past the TTL, perhaps a health check or such.
-		err = task.Work()
-		if err != nil {
-			log.Error(fmt.Sprintf(`tasks.Task<%d>#Work() ! %s`, task.ID, err))
+		go func() {
+			defer pool.release(task.Action)
+			task.run()
+		}()
+	}
+	log.Info(`tasks.Work() Stopped claiming tasks`)
+}
+
+// dequeueOrder ranks queued tasks by their priority aged by how long they have
+// been waiting, oldest first within the same rank.
+var dequeueOrder = fmt.Sprintf(`priority + FLOOR(EXTRACT(EPOCH FROM CURRENT_TIMESTAMP - created_at) / %d) DESC, created_at ASC, id ASC`, int64(priorityAgingInterval.Seconds()))
+
+// excludeActions returns a condition leaving out tasks of the given actions.
+func excludeActions(actions []string) string {
+	if len(actions) == 0 {
+		return ``
+	}
+	return fmt.Sprintf(` AND action NOT IN ('%s')`, strings.Join(actions, `','`))
+}
+
+// timeoutError is the outcome recorded for a task which ran past its TTL.
+type timeoutError struct {
+	ttl time.Duration
+}
+
+func (e timeoutError) Error() string {
+	return fmt.Sprintf(`timed out after %s`, e.ttl)
+}
+
+// cancelledError is the outcome recorded for a task cancelled from the admin
+// API while it ran.
+type cancelledError struct{}
+
+func (e cancelledError) Error() string {
+	return `cancelled`
+}
 
-			sq = fmt.Sprintf(`UPDATE tasks.tasks SET locked_by=NULL, processing_at=NULL WHERE id=%d`, task.ID)
-			log.Trace(fmt.Sprintf(`tasks#Work() > %s`, sq))
-			_, err = workDB.Exec(sq)
+// errLockLost is returned by Heartbeat when the task is no longer locked by
+// this worker, eg. because it was requeued from the admin API.
+var errLockLost = errors.New(`task is no longer locked by this worker`)
+
+// run works the task under a deadline derived from its TTL, keeping its
+// heartbeat fresh while the handler runs, and records the outcome. The handler
+// is cancelled when the heartbeat finds the task was cancelled or requeued and
+// when Shutdown() abandons it, the outcome is recorded once it has returned.
+func (t Task) run() {
+	ttl := time.Duration(t.TTL) * time.Second
+	if ttl <= 0 {
+		ttl = defaultTTL
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ttl)
+	defer cancel()
+	t.ctx = ctx
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- t.Work()
+	}()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case err := <-done:
+			t.recordHistory(start, err)
 			if err != nil {
-				log.Error(fmt.Sprintf(`tasks.Work() Updating Task %d processing_at ! %s`, task.ID, err))
+				log.Error(fmt.Sprintf(`tasks.Task<%d>#Work() ! %s`, t.ID, err))
+				t.Fail(err)
+				return
 			}
-			continue
-		} else {
-			// TODO: (t *Task) Delete()
-			sq = fmt.Sprintf(`DELETE FROM tasks.tasks WHERE id=%d`, task.ID)
-			log.Trace(fmt.Sprintf(`tasks#Work() > %s`, sq))
-			_, err = workDB.Exec(sq)
-			if err != nil {
-				log.Error(fmt.Sprintf(`tasks.Work() Deleting Task %d ! %s`, task.ID, err))
-				continue
+			t.Complete()
+			return
+		case <-ctx.Done():
+			// Cancelling the context kills any child pg_dump/psql processes, the
+			// handler's eventual result is discarded.
+			err := timeoutError{ttl: ttl}
+			log.Error(fmt.Sprintf(`tasks.Task<%d>#Work() %s ! %s`, t.ID, t.Action, err))
+			t.stop(cancel, done)
+			t.recordHistory(start, err)
+			t.Fail(err)
+			return
+		case <-abandon:
+			err := shutdownError{}
+			log.Warn(fmt.Sprintf(`tasks.Task<%d>#Work() %s ! %s, releasing for retry`, t.ID, t.Action, err))
+			t.stop(cancel, done)
+			t.recordHistory(start, err)
+			t.release(err)
+			return
+		case <-heartbeat.C:
+			cancelRequested, err := t.Heartbeat()
+			if err == errLockLost {
+				// Someone else owns the task now, its outcome is theirs to record.
+				log.Warn(fmt.Sprintf(`tasks.Task<%d>#Work() %s ! %s, stopping`, t.ID, t.Action, err))
+				t.stop(cancel, done)
+				return
+			}
+			if cancelRequested {
+				err := cancelledError{}
+				log.Warn(fmt.Sprintf(`tasks.Task<%d>#Work() %s ! %s`, t.ID, t.Action, err))
+				t.stop(cancel, done)
+				t.recordHistory(start, err)
+				t.remove(err, myIP)
+				return
 			}
-			log.Trace(fmt.Sprintf(`tasks.Work() Task Completed! > %+v`, task))
 		}
 	}
 }
 
-// WorkLock - Acquire consul for cluster to aquire right to schedule tasks.
-func WorkLock() (err error) {
-	clusterID := os.Getenv("RDPGD_CLUSTER")
-	if clusterID == "" {
-		matrixName := os.Getenv(`RDPGD_MATRIX`)
-		matrixNameSplit := strings.SplitAfterN(matrixName, `-`, -1)
-		matrixColumn := os.Getenv(`RDPGD_MATRIX_COLUMN`)
-		for i := 0; i < len(matrixNameSplit)-1; i++ {
-			clusterID = clusterID + matrixNameSplit[i]
+// stop cancels the handler and waits for it to return, keeping the task's
+// heartbeat fresh meanwhile. Handlers ignoring their context would otherwise
+// keep running while the task is retried, here or by another node, and past
+// the limits of their action: the task stays locked, and its slot in the pool
+// held, until the handler has returned.
+func (t *Task) stop(cancel context.CancelFunc, done <-chan error) {
+	cancel()
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-heartbeat.C:
+			log.Warn(fmt.Sprintf(`tasks.Task<%d>#stop() %s Waiting for the cancelled handler to return`, t.ID, t.Action))
+			t.Heartbeat()
 		}
-		clusterID = clusterID + "c" + matrixColumn
 	}
+}
 
-	key := fmt.Sprintf("rdpg/%s/tasks/work/lock", clusterID)
-	client, _ := consulapi.NewClient(consulapi.DefaultConfig())
-	workLock, err = client.LockKey(key)
-	if err != nil {
-		log.Error(fmt.Sprintf("tasks.WorkLock() Error Locking Work Key %s ! %s", key, err))
-		return
+//Heartbeat - Record that the worker holding the task is still alive, reporting
+// whether the task's cancellation was requested.
+func (t *Task) Heartbeat() (cancelRequested bool, err error) {
+	sq := fmt.Sprintf(`UPDATE tasks.tasks SET heartbeat_at=CURRENT_TIMESTAMP WHERE id=%d AND locked_by='%s' RETURNING cancel_requested_at IS NOT NULL`, t.ID, myIP)
+	log.Trace(fmt.Sprintf(`tasks.Task<%d>#Heartbeat() > %s`, t.ID, sq))
+	OpenWorkDB()
+	err = workDB.QueryRow(sq).Scan(&cancelRequested)
+	if err == sql.ErrNoRows {
+		return false, errLockLost
 	}
-
-	workLockCh, err = workLock.Lock(nil) // Acquire Consul K/V Lock
 	if err != nil {
-		log.Error(fmt.Sprintf("tasks.WorkLock() Error Acquiring Work Key lock %s ! %s", key, err))
-		return
+		log.Error(fmt.Sprintf(`tasks.Task<%d>#Heartbeat() ! %s`, t.ID, err))
 	}
-
-	if workLockCh == nil {
-		err = fmt.Errorf(`tasks.WorkLock() Work Lock not acquired`)
-	}
-
 	return
 }
 
+// WorkLock - Acquire the cluster's work lock from the configured coordinator,
+// giving up on shutdown.
+func WorkLock() (err error) {
+	return coordination().Lock(lockName(`work`), stopping)
+}
+
 //WorkUnlock - Release the work lock
 func WorkUnlock() (err error) {
-	if workLock != nil {
-		err = workLock.Unlock()
-		if err != nil {
-			log.Error(fmt.Sprintf("tasks.WorkUnlock() Error Unlocking Work ! %s", err))
-		}
-	}
-	return
+	return coordination().Unlock(lockName(`work`))
 }
 
-//Work - Entry point for the type of action for a particular task
+//Work - Entry point for the type of action for a particular task, runs the
+// handler registered for the task's action and returns its outcome.
 func (t *Task) Work() (err error) {
-	// TODO: Add in TTL Logic with error logging.
-	switch t.Action {
-	case "Vacuum":
-		go t.Vacuum()
-	case "PrecreateDatabases":
-		go t.PrecreateDatabases()
-	case "ReconcileAvailableDatabases":
-		go t.ReconcileAvailableDatabases()
-	case "ReconcileAllDatabases":
-		go t.ReconcileAllDatabases()
-	case "DecommissionDatabase":
-		go t.DecommissionDatabase()
-	case "DecommissionDatabases":
-		go t.DecommissionDatabases()
-	case "Reconfigure":
-		go t.Reconfigure()
-	case "ScheduleNewDatabaseBackups":
-		go t.ScheduleNewDatabaseBackups()
-	case "BackupDatabase": // Role: read
-		go t.BackupDatabase()
-	case "DeleteBackupHistory":
-		go t.DeleteBackupHistory()
-	case "FindFilesToCopyToS3":
-		go t.FindFilesToCopyToS3()
-	case "EnforceFileRetention":
-		go t.EnforceFileRetention()
-	case "EnforceRemoteFileRetention":
-		go t.EnforceRemoteFileRetention()
-	case "CopyFileToS3":
-		go t.CopyFileToS3()
-	case "DeleteFile":
-		go t.DeleteFile()
-	case "RestoreDatabaseFromFile":
-		go t.RestoreDatabaseFromFile()
-	case "CreateTestDB":
-		go t.CreateTestDB()
-	case "BackupAllDatabases":
-		go t.BackupAllDatabases()
-	case "ClearStuckTasks":
-		go t.ClearStuckTasks()
-	default:
-		err = fmt.Errorf(`tasks.Work() BUG!!! Unknown Task Action %s`, t.Action)
+	h, ok := Lookup(t.Action)
+	if !ok {
+		err = permanentError{fmt.Errorf(`tasks.Work() BUG!!! Unknown Task Action %s`, t.Action)}
 		log.Error(fmt.Sprintf(`tasks.Work() Task %+v ! %s`, t, err))
+		return
 	}
-	sq := fmt.Sprintf(`DELETE FROM tasks.tasks WHERE id=%d`, t.ID)
-	_, err = workDB.Exec(sq)
-	if err != nil {
-		log.Error(fmt.Sprintf(`tasks.Work() Error deleting completed task %d ! %s`, t.ID, err))
+	if h.Decode != nil {
+		t.payload, err = h.Decode(t.Data)
+		if err != nil {
+			err = permanentError{fmt.Errorf(`tasks.Work() Invalid data for Task Action %s ! %s`, t.Action, err)}
+			log.Error(fmt.Sprintf(`tasks.Work() Task %+v ! %s`, t, err))
+			return
+		}
 	}
-	return
+	return h.Run(t)
 }
 
 //OpenWorkDB - Connect to the rdpg system database and connect to the tasks.tasks table
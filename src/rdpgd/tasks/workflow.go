@@ -0,0 +1,395 @@
+package tasks
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/starkandwayne/rdpgd/log"
+)
+
+// Workflow and workflow step statuses.
+const (
+	WorkflowRunning   = `running`
+	WorkflowSucceeded = `succeeded`
+	WorkflowFailed    = `failed`
+
+	StepPending   = `pending`
+	StepQueued    = `queued`
+	StepSucceeded = `succeeded`
+	StepFailed    = `failed`
+	StepSkipped   = `skipped`
+)
+
+/*
+Workflow struct is used to represent a small DAG of tasks, from
+tasks.workflows. Each step's task is enqueued once every step it depends on
+has succeeded, when a step fails for good the steps depending on it are skipped
+and the workflow fails.
+*/
+type Workflow struct {
+	ID         int64          `db:"id" json:"id"`
+	Name       string         `db:"name" json:"name"`
+	Status     string         `db:"status" json:"status"`
+	CreatedAt  string         `db:"created_at" json:"created_at"`
+	FinishedAt string         `db:"finished_at" json:"finished_at"`
+	Steps      []WorkflowStep `db:"-" json:"steps,omitempty"`
+}
+
+/*
+WorkflowStep struct is used to represent one step of a workflow, from
+tasks.workflow_steps. A step without data whose parent recorded an output with
+Task#SetOutput() gets that output as data and runs on the parent's node, eg.
+the file a backup wrote.
+*/
+type WorkflowStep struct {
+	ID             int64    `db:"id" json:"id"`
+	WorkflowID     int64    `db:"workflow_id" json:"workflow_id"`
+	Name           string   `db:"name" json:"name"`
+	ClusterID      string   `db:"cluster_id" json:"cluster_id"`
+	ClusterService string   `db:"cluster_service" json:"cluster_service"`
+	Node           string   `db:"node" json:"node"`
+	Role           string   `db:"role" json:"role"`
+	Action         string   `db:"action" json:"action"`
+	Data           string   `db:"data" json:"data"`
+	TTL            int64    `db:"ttl" json:"ttl"`
+	NodeType       string   `db:"node_type" json:"node_type"`
+	Priority       *int     `db:"priority" json:"priority"`
+	DependsOn      []string `db:"-" json:"depends_on"`
+	Status         string   `db:"status" json:"status"`
+	TaskID         int64    `db:"task_id" json:"task_id"`
+	WorkedBy       string   `db:"worked_by" json:"worked_by"`
+	Output         string   `db:"output" json:"output"`
+	Error          string   `db:"error" json:"error"`
+	FinishedAt     string   `db:"finished_at" json:"finished_at"`
+}
+
+type workflowDependency struct {
+	Step      string `db:"step"`
+	DependsOn string `db:"depends_on"`
+}
+
+//NewWorkflow - default constructor
+func NewWorkflow(name string) *Workflow {
+	return &Workflow{Name: name}
+}
+
+// Step adds a step running the task once the named steps have succeeded.
+func (w *Workflow) Step(name string, t Task, dependsOn ...string) {
+	w.Steps = append(w.Steps, WorkflowStep{
+		Name:           name,
+		ClusterID:      t.ClusterID,
+		ClusterService: t.ClusterService,
+		Node:           t.Node,
+		Role:           t.Role,
+		Action:         t.Action,
+		Data:           t.Data,
+		TTL:            t.TTL,
+		NodeType:       t.NodeType,
+		Priority:       t.Priority,
+		DependsOn:      dependsOn,
+	})
+}
+
+// task returns the task which runs the step.
+func (s *WorkflowStep) task() Task {
+	return Task{ClusterID: s.ClusterID, ClusterService: s.ClusterService, Node: s.Node, Role: s.Role, Action: s.Action, Data: s.Data, TTL: s.TTL, NodeType: s.NodeType, Priority: s.Priority, WorkflowStepID: s.ID}
+}
+
+// validate checks the steps form a DAG of registered actions and fills in the
+// defaults of their handlers.
+func (w *Workflow) validate() (err error) {
+	if w.Name == `` {
+		return fmt.Errorf(`workflow name is required`)
+	}
+	if len(w.Steps) == 0 {
+		return fmt.Errorf(`workflow %s has no steps`, w.Name)
+	}
+	names := map[string]bool{}
+	for _, s := range w.Steps {
+		if s.Name == `` {
+			return fmt.Errorf(`workflow %s has a step without a name`, w.Name)
+		}
+		if names[s.Name] {
+			return fmt.Errorf(`workflow %s has two steps named %s`, w.Name, s.Name)
+		}
+		names[s.Name] = true
+	}
+	waiting := map[string]int{}
+	children := map[string][]string{}
+	for i := range w.Steps {
+		s := &w.Steps[i]
+		seen := map[string]bool{}
+		for _, parent := range s.DependsOn {
+			if !names[parent] || parent == s.Name {
+				return fmt.Errorf(`workflow %s step %s depends on unknown step %s`, w.Name, s.Name, parent)
+			}
+			if seen[parent] {
+				return fmt.Errorf(`workflow %s step %s depends on %s twice`, w.Name, s.Name, parent)
+			}
+			seen[parent] = true
+			children[parent] = append(children[parent], s.Name)
+		}
+		waiting[s.Name] = len(s.DependsOn)
+
+		// Data may come from a parent's output, so it is only checked when given.
+		t := s.task()
+		if err = t.prepare(len(s.DependsOn) == 0 || s.Data != ``); err != nil {
+			return fmt.Errorf(`workflow %s step %s: %s`, w.Name, s.Name, err)
+		}
+		s.Node, s.Role, s.NodeType, s.TTL, s.Priority = t.Node, t.Role, t.NodeType, t.TTL, t.Priority
+	}
+
+	// Kahn's algorithm, steps left waiting are on a cycle.
+	ready := []string{}
+	for name, n := range waiting {
+		if n == 0 {
+			ready = append(ready, name)
+		}
+	}
+	for len(ready) > 0 {
+		name := ready[0]
+		ready = ready[1:]
+		delete(waiting, name)
+		for _, child := range children[name] {
+			waiting[child]--
+			if waiting[child] == 0 {
+				ready = append(ready, child)
+			}
+		}
+	}
+	if len(waiting) > 0 {
+		return fmt.Errorf(`workflow %s has a dependency cycle`, w.Name)
+	}
+	return nil
+}
+
+//Start - Insert the workflow and enqueue the tasks of its steps which depend on
+// no other step.
+func (w *Workflow) Start() (err error) {
+	if err = w.validate(); err != nil {
+		log.Error(fmt.Sprintf(`tasks.Workflow<%s>#Start() ! %s`, w.Name, err))
+		return
+	}
+	OpenWorkDB()
+	tx, err := workDB.Beginx()
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.Workflow<%s>#Start() Begin ! %s`, w.Name, err))
+		return
+	}
+	sq := `INSERT INTO tasks.workflows (name) VALUES ($1) RETURNING id,status,created_at::text`
+	log.Trace(fmt.Sprintf(`tasks.Workflow<%s>#Start() > %s`, w.Name, sq))
+	err = tx.QueryRow(sq, w.Name).Scan(&w.ID, &w.Status, &w.CreatedAt)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.Workflow<%s>#Start() Inserting workflow ! %s`, w.Name, err))
+		tx.Rollback()
+		return
+	}
+	for i := range w.Steps {
+		s := &w.Steps[i]
+		s.WorkflowID = w.ID
+		s.Status = StepPending
+		sq = `INSERT INTO tasks.workflow_steps (workflow_id,name,cluster_id,cluster_service,node,role,action,data,ttl,node_type,priority) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11) RETURNING id`
+		log.Trace(fmt.Sprintf(`tasks.Workflow<%d>#Start() > %s`, w.ID, sq))
+		err = tx.QueryRow(sq, w.ID, s.Name, s.ClusterID, s.ClusterService, s.Node, s.Role, s.Action, s.Data, s.TTL, s.NodeType, s.Priority).Scan(&s.ID)
+		if err != nil {
+			log.Error(fmt.Sprintf(`tasks.Workflow<%d>#Start() Inserting step %s ! %s`, w.ID, s.Name, err))
+			tx.Rollback()
+			return
+		}
+		for _, parent := range s.DependsOn {
+			sq = `INSERT INTO tasks.workflow_dependencies (workflow_id,step,depends_on) VALUES ($1,$2,$3)`
+			_, err = tx.Exec(sq, w.ID, s.Name, parent)
+			if err != nil {
+				log.Error(fmt.Sprintf(`tasks.Workflow<%d>#Start() Inserting dependency %s on %s ! %s`, w.ID, s.Name, parent, err))
+				tx.Rollback()
+				return
+			}
+		}
+	}
+	err = enqueueReadySteps(tx, w.ID)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.Workflow<%d>#Start() Commit ! %s`, w.ID, err))
+		return
+	}
+	log.Trace(fmt.Sprintf(`tasks.Workflow<%d>#Start() Workflow Started > %+v`, w.ID, w))
+	return
+}
+
+// enqueueReadySteps enqueues the tasks of the workflow's pending steps whose
+// parents have all succeeded. Marking them queued in the same statement as
+// selecting them keeps two parents finishing at once from both enqueueing a
+// child.
+func enqueueReadySteps(tx *sqlx.Tx, workflowID int64) (err error) {
+	steps := []WorkflowStep{}
+	sq := fmt.Sprintf(`UPDATE tasks.workflow_steps s SET status='queued' WHERE s.workflow_id=%d AND s.status='pending' AND NOT EXISTS (SELECT 1 FROM tasks.workflow_dependencies d JOIN tasks.workflow_steps p ON p.workflow_id=d.workflow_id AND p.name=d.depends_on WHERE d.workflow_id=s.workflow_id AND d.step=s.name AND p.status<>'succeeded') RETURNING s.id,s.workflow_id,s.name,s.cluster_id,s.cluster_service,s.node,s.role,s.action,s.data,s.ttl,s.node_type,s.priority`, workflowID)
+	log.Trace(fmt.Sprintf(`tasks.enqueueReadySteps(%d) > %s`, workflowID, sq))
+	err = tx.Select(&steps, sq)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.enqueueReadySteps(%d) ! %s`, workflowID, err))
+		return
+	}
+	for _, s := range steps {
+		t := s.task()
+		if t.Data == `` {
+			parents := []WorkflowStep{}
+			sq = `SELECT p.output,p.worked_by FROM tasks.workflow_dependencies d JOIN tasks.workflow_steps p ON p.workflow_id=d.workflow_id AND p.name=d.depends_on WHERE d.workflow_id=$1 AND d.step=$2 AND p.output<>'' ORDER BY p.name LIMIT 1`
+			err = tx.Select(&parents, sq, workflowID, s.Name)
+			if err != nil {
+				log.Error(fmt.Sprintf(`tasks.enqueueReadySteps(%d) Selecting output for %s ! %s`, workflowID, s.Name, err))
+				return
+			}
+			if len(parents) > 0 {
+				t.Data = parents[0].Output
+				if t.Node == `*` {
+					t.Node = parents[0].WorkedBy
+				}
+			}
+		}
+		sq = `INSERT INTO tasks.tasks (cluster_id,node,role,action,data,ttl,node_type,cluster_service,priority,workflow_step_id) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10) RETURNING id`
+		log.Trace(fmt.Sprintf(`tasks.enqueueReadySteps(%d) > %s`, workflowID, sq))
+		var taskID int64
+		err = tx.QueryRow(sq, t.ClusterID, t.Node, t.Role, t.Action, t.Data, t.TTL, t.NodeType, t.ClusterService, t.Priority, s.ID).Scan(&taskID)
+		if err != nil {
+			log.Error(fmt.Sprintf(`tasks.enqueueReadySteps(%d) Enqueue %s ! %s`, workflowID, s.Name, err))
+			return
+		}
+		_, err = tx.Exec(`UPDATE tasks.workflow_steps SET task_id=$1 WHERE id=$2`, taskID, s.ID)
+		if err != nil {
+			log.Error(fmt.Sprintf(`tasks.enqueueReadySteps(%d) Updating task_id of %s ! %s`, workflowID, s.Name, err))
+			return
+		}
+		notifyWorkers(tx, t.Action)
+	}
+	return
+}
+
+// finishWorkflow records the workflow's outcome once none of its steps is left
+// to run.
+func finishWorkflow(tx *sqlx.Tx, workflowID int64) (err error) {
+	sq := `UPDATE tasks.workflows w SET status = CASE WHEN EXISTS (SELECT 1 FROM tasks.workflow_steps WHERE workflow_id=w.id AND status IN ('failed','skipped')) THEN 'failed' ELSE 'succeeded' END, finished_at=CURRENT_TIMESTAMP WHERE w.id=$1 AND w.finished_at IS NULL AND NOT EXISTS (SELECT 1 FROM tasks.workflow_steps WHERE workflow_id=w.id AND status IN ('pending','queued'))`
+	log.Trace(fmt.Sprintf(`tasks.finishWorkflow(%d) > %s`, workflowID, sq))
+	_, err = tx.Exec(sq, workflowID)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.finishWorkflow(%d) ! %s`, workflowID, err))
+	}
+	return
+}
+
+// SetOutput records a result of the task, eg. the file it wrote, for the
+// workflow steps depending on it.
+func (t *Task) SetOutput(output string) {
+	t.output = output
+}
+
+// stepSucceeded marks the task's workflow step succeeded and enqueues the
+// steps which were waiting on it.
+func (t *Task) stepSucceeded(tx *sqlx.Tx) (err error) {
+	var workflowID int64
+	sq := `UPDATE tasks.workflow_steps SET status='succeeded', output=$1, worked_by=$2, finished_at=CURRENT_TIMESTAMP WHERE id=$3 RETURNING workflow_id`
+	log.Trace(fmt.Sprintf(`tasks.Task<%d>#stepSucceeded() > %s`, t.ID, sq))
+	err = tx.QueryRow(sq, t.output, myIP, t.WorkflowStepID).Scan(&workflowID)
+	if err == sql.ErrNoRows {
+		// The workflow was deleted while the task ran.
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	if err = enqueueReadySteps(tx, workflowID); err != nil {
+		return
+	}
+	return finishWorkflow(tx, workflowID)
+}
+
+// stepFailed marks the task's workflow step and the workflow failed and skips
+// every step depending on it, directly or not.
+func (t *Task) stepFailed(tx *sqlx.Tx, cause error) (err error) {
+	var workflowID int64
+	var name string
+	sq := `UPDATE tasks.workflow_steps SET status='failed', error=$1, worked_by=$2, finished_at=CURRENT_TIMESTAMP WHERE id=$3 RETURNING workflow_id,name`
+	log.Trace(fmt.Sprintf(`tasks.Task<%d>#stepFailed() > %s`, t.ID, sq))
+	err = tx.QueryRow(sq, cause.Error(), myIP, t.WorkflowStepID).Scan(&workflowID, &name)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	sq = `WITH RECURSIVE descendants(name) AS (SELECT step FROM tasks.workflow_dependencies WHERE workflow_id=$1 AND depends_on=$2 UNION SELECT d.step FROM tasks.workflow_dependencies d JOIN descendants ON d.depends_on=descendants.name WHERE d.workflow_id=$1) UPDATE tasks.workflow_steps SET status='skipped', finished_at=CURRENT_TIMESTAMP WHERE workflow_id=$1 AND status='pending' AND name IN (SELECT name FROM descendants)`
+	log.Trace(fmt.Sprintf(`tasks.Task<%d>#stepFailed() > %s`, t.ID, sq))
+	if _, err = tx.Exec(sq, workflowID, name); err != nil {
+		return
+	}
+	if _, err = tx.Exec(`UPDATE tasks.workflows SET status='failed' WHERE id=$1`, workflowID); err != nil {
+		return
+	}
+	return finishWorkflow(tx, workflowID)
+}
+
+//Workflows - Return workflows newest first, optionally only those with the
+// given status, without their steps.
+func Workflows(status string, limit int) (workflows []Workflow, err error) {
+	workflows = []Workflow{}
+	args := []interface{}{}
+	sq := `SELECT id,name,status,created_at::text AS created_at,COALESCE(finished_at::text,'') AS finished_at FROM tasks.workflows`
+	if status != `` {
+		args = append(args, status)
+		sq += ` WHERE status=$1`
+	}
+	sq += fmt.Sprintf(` ORDER BY id DESC LIMIT %d`, limit)
+	log.Trace(fmt.Sprintf(`tasks.Workflows() > %s`, sq))
+	OpenWorkDB()
+	err = workDB.Select(&workflows, sq, args...)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.Workflows() ! %s`, err))
+	}
+	return
+}
+
+//FindWorkflow - Return the workflow with its steps, nil if there is none
+func FindWorkflow(id int64) (w *Workflow, err error) {
+	workflows := []Workflow{}
+	sq := `SELECT id,name,status,created_at::text AS created_at,COALESCE(finished_at::text,'') AS finished_at FROM tasks.workflows WHERE id=$1`
+	log.Trace(fmt.Sprintf(`tasks.FindWorkflow(%d) > %s`, id, sq))
+	OpenWorkDB()
+	err = workDB.Select(&workflows, sq, id)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.FindWorkflow(%d) ! %s`, id, err))
+		return
+	}
+	if len(workflows) == 0 {
+		return
+	}
+	w = &workflows[0]
+
+	sq = `SELECT id,workflow_id,name,cluster_id,cluster_service,node,role,action,data,ttl,node_type,priority,status,COALESCE(task_id,0) AS task_id,worked_by,output,error,COALESCE(finished_at::text,'') AS finished_at FROM tasks.workflow_steps WHERE workflow_id=$1 ORDER BY id`
+	log.Trace(fmt.Sprintf(`tasks.FindWorkflow(%d) > %s`, id, sq))
+	err = workDB.Select(&w.Steps, sq, id)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.FindWorkflow(%d) Selecting steps ! %s`, id, err))
+		return
+	}
+	dependencies := []workflowDependency{}
+	sq = `SELECT step,depends_on FROM tasks.workflow_dependencies WHERE workflow_id=$1 ORDER BY depends_on`
+	err = workDB.Select(&dependencies, sq, id)
+	if err != nil {
+		log.Error(fmt.Sprintf(`tasks.FindWorkflow(%d) Selecting dependencies ! %s`, id, err))
+		return
+	}
+	for i := range w.Steps {
+		w.Steps[i].DependsOn = []string{}
+		for _, d := range dependencies {
+			if d.Step == w.Steps[i].Name {
+				w.Steps[i].DependsOn = append(w.Steps[i].DependsOn, d.DependsOn)
+			}
+		}
+	}
+	return
+}
@@ -50,6 +50,10 @@ type RetentionPolicy struct {
 const backupFileSuffix string = ".sql"
 const globalsFileSuffix string = ".globals"
 
+// DumpFileSuffix is the suffix of backups taken in pg_dump's custom format,
+// which are restored with pg_restore rather than psql.
+const DumpFileSuffix string = ".dump"
+
 //For sortDBList
 //--ByDBName
 type ByDBName []DatabaseBackupList
@@ -369,9 +373,9 @@ func Combine(first, second []DatabaseBackupList) []DatabaseBackupList {
 
 func GenerateFiletypeMatcher(showGlobals bool) (matchingString string) {
 	if showGlobals {
-		matchingString = fmt.Sprintf(".+(%s|%s)\\z", regexp.QuoteMeta(backupFileSuffix), regexp.QuoteMeta(globalsFileSuffix))
+		matchingString = fmt.Sprintf(".+(%s|%s|%s)\\z", regexp.QuoteMeta(backupFileSuffix), regexp.QuoteMeta(DumpFileSuffix), regexp.QuoteMeta(globalsFileSuffix))
 	} else {
-		matchingString = fmt.Sprintf(".+%s\\z", regexp.QuoteMeta(backupFileSuffix))
+		matchingString = fmt.Sprintf(".+(%s|%s)\\z", regexp.QuoteMeta(backupFileSuffix), regexp.QuoteMeta(DumpFileSuffix))
 	}
 	return
 }
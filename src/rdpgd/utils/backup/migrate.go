@@ -0,0 +1,79 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/starkandwayne/rdpgd/config"
+	"github.com/starkandwayne/rdpgd/globals"
+	"github.com/starkandwayne/rdpgd/log"
+)
+
+// CopyDatabase copies a database from another service cluster into the local
+// database dbname, which must exist with the same extensions. The source is
+// dumped through sourceDSN in pg_dump's custom format into the restore stage
+// and restored as owner in a single transaction, leaving dbname untouched if
+// the restore fails. Extensions are left out of the restore, only superusers
+// may create them.
+func CopyDatabase(ctx context.Context, dbname, owner, sourceDSN string) (err error) {
+	pgDumpPath, err := config.GetValue(`pgDumpBinaryLocation`)
+	if err != nil {
+		log.Error(fmt.Sprintf("utils/backup.CopyDatabase(%s) config.GetValue(`pgDumpBinaryLocation`) ! %s", dbname, err))
+		return
+	}
+	pgPort, err := config.GetValue(`BackupPort`)
+	if err != nil {
+		log.Error(fmt.Sprintf("utils/backup.CopyDatabase(%s) config.GetValue(`BackupPort`) ! %s", dbname, err))
+		return
+	}
+	err = os.MkdirAll(globals.RestoreStagePath+"/"+dbname, 0700)
+	if err != nil {
+		log.Error(fmt.Sprintf("utils/backup.CopyDatabase(%s) os.MkdirAll() ! %s", dbname, err))
+		return
+	}
+	dumpFile := RestoreLocation(dbname, "migrate"+DumpFileSuffix)
+	listFile := dumpFile + ".list"
+	defer os.Remove(dumpFile)
+	defer os.Remove(listFile)
+
+	// The DSN carries the source's password, it is kept out of the logs.
+	log.Trace(fmt.Sprintf("utils/backup.CopyDatabase(%s) Dumping source database to %s", dbname, dumpFile))
+	out, err := exec.CommandContext(ctx, pgDumpPath, "-Fc", "-O", "-x", "-N", "bdr", "-f", dumpFile, "-d", sourceDSN).CombinedOutput()
+	if err != nil {
+		log.Error(fmt.Sprintf("utils/backup.CopyDatabase(%s) pg_dump out: %s ! %s", dbname, out, err))
+		return fmt.Errorf(`dumping the source database failed: %s`, err)
+	}
+
+	out, err = exec.CommandContext(ctx, globals.PG_RESTORE_PATH, "-l", dumpFile).Output()
+	if err != nil {
+		log.Error(fmt.Sprintf("utils/backup.CopyDatabase(%s) pg_restore -l ! %s", dbname, err))
+		return
+	}
+	list := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		if strings.Contains(scanner.Text(), " EXTENSION ") {
+			continue
+		}
+		list = append(list, scanner.Text())
+	}
+	err = ioutil.WriteFile(listFile, []byte(strings.Join(list, "\n")+"\n"), 0600)
+	if err != nil {
+		log.Error(fmt.Sprintf("utils/backup.CopyDatabase(%s) ioutil.WriteFile(%s) ! %s", dbname, listFile, err))
+		return
+	}
+
+	log.Trace(fmt.Sprintf("utils/backup.CopyDatabase(%s) Restoring %s as %s", dbname, dumpFile, owner))
+	out, err = exec.CommandContext(ctx, globals.PG_RESTORE_PATH, "-p", pgPort, "-U", "vcap", "-d", dbname, "-O", "-x", "--role="+owner, "--single-transaction", "--exit-on-error", "-L", listFile, dumpFile).CombinedOutput()
+	if err != nil {
+		log.Error(fmt.Sprintf("utils/backup.CopyDatabase(%s) pg_restore out: %s ! %s", dbname, out, err))
+		return fmt.Errorf(`restoring the database failed: %s`, err)
+	}
+	return
+}
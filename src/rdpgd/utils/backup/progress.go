@@ -0,0 +1,47 @@
+package backup
+
+import (
+	"errors"
+	"io"
+)
+
+// ProgressFunc is called with the number of bytes of a file processed so far
+// and the file's size, 0 if unknown.
+type ProgressFunc func(done, total int64)
+
+// ProgressReader counts the bytes read through it, eg. by psql restoring a
+// file or an S3 upload, and reports them to a ProgressFunc.
+type ProgressReader struct {
+	r        io.Reader
+	done     int64
+	total    int64
+	progress ProgressFunc
+}
+
+// NewProgressReader returns a ProgressReader reading r, total bytes long.
+func NewProgressReader(r io.Reader, total int64, progress ProgressFunc) *ProgressReader {
+	return &ProgressReader{r: r, total: total, progress: progress}
+}
+
+func (p *ProgressReader) Read(b []byte) (n int, err error) {
+	n, err = p.r.Read(b)
+	p.done += int64(n)
+	if p.progress != nil {
+		p.progress(p.done, p.total)
+	}
+	return
+}
+
+// Seek seeks the underlying reader, which must be an io.Seeker, so that the
+// reader can be rewound, eg. by the AWS SDK when signing a request.
+func (p *ProgressReader) Seek(offset int64, whence int) (int64, error) {
+	s, ok := p.r.(io.Seeker)
+	if !ok {
+		return 0, errors.New(`utils/backup.ProgressReader#Seek() reader is not seekable`)
+	}
+	pos, err := s.Seek(offset, whence)
+	if err == nil {
+		p.done = pos
+	}
+	return pos, err
+}
@@ -1,6 +1,7 @@
 package backup
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -93,6 +94,18 @@ func RestoreInPlace(dbname, basefile string) (err error) {
 // Restores a database given the name of the database, and the absolute path to
 // the backup file.
 func ImportSqlFile(dbname, filepath string) (err error) {
+	return ImportSqlFileContext(context.Background(), dbname, filepath)
+}
+
+// Same as ImportSqlFile, but psql is killed if the context is done before the
+// restore completes.
+func ImportSqlFileContext(ctx context.Context, dbname, filepath string) (err error) {
+	return ImportSqlFileProgress(ctx, dbname, filepath, nil)
+}
+
+// Same as ImportSqlFileContext, but the file is fed to psql through a
+// ProgressReader calling progress, if given, with the bytes restored so far.
+func ImportSqlFileProgress(ctx context.Context, dbname, filepath string, progress ProgressFunc) (err error) {
 	log.Trace(fmt.Sprintf("utils/backup.ImportSqlFile ! Beginning restore of database %s", dbname))
 	start := time.Now()
 	f := history.BackupFileHistory{}
@@ -126,9 +139,35 @@ func ImportSqlFile(dbname, filepath string) (err error) {
 		return err
 	}
 
+	// Backups taken in pg_dump's custom format are restored by pg_restore,
+	// which reads from stdin when given no file.
+	restorePath, fileArgs := globals.PSQL_PATH, []string{"-f", filepath}
+	if strings.HasSuffix(filepath, DumpFileSuffix) {
+		restorePath, fileArgs = globals.PG_RESTORE_PATH, []string{filepath}
+	}
+	cmd := exec.CommandContext(ctx, restorePath, append([]string{"-p", pgPort, "-U", "vcap", "-d", dbname}, fileArgs...)...)
+	if progress != nil {
+		file, err := os.Open(filepath)
+		if err != nil {
+			log.Error(fmt.Sprintf("utils/backup.ImportSqlFile ! os.Open(%s) erred : %s", filepath, err.Error()))
+			return err
+		}
+		defer file.Close()
+		var size int64
+		if info, err := file.Stat(); err == nil {
+			size = info.Size()
+		}
+		stdinArgs := []string{"-f", "-"}
+		if restorePath == globals.PG_RESTORE_PATH {
+			stdinArgs = nil
+		}
+		cmd = exec.CommandContext(ctx, restorePath, append([]string{"-p", pgPort, "-U", "vcap", "-d", dbname}, stdinArgs...)...)
+		cmd.Stdin = NewProgressReader(file, size, progress)
+	}
+
 	lockRestore()
-	log.Trace(fmt.Sprintf("utils/backup.RestoreInPlace ! Executing %s -p %s -U vcap -d %s -f %s", globals.PSQL_PATH, pgPort, dbname, filepath))
-	out, err := exec.Command(globals.PSQL_PATH, "-p", pgPort, "-U", "vcap", "-d", dbname, "-f", filepath).CombinedOutput()
+	log.Trace(fmt.Sprintf("utils/backup.RestoreInPlace ! Executing %s -p %s -U vcap -d %s %s", restorePath, pgPort, dbname, filepath))
+	out, err := cmd.CombinedOutput()
 	unlockRestore()
 	if err != nil {
 		log.Error(fmt.Sprintf(`utils/backup.ImportSqlFile ! Error running pg_dump command for: %s out: %s ! %s`, dbname, out, err))